@@ -14,12 +14,21 @@ kubectl delete -f k8s/03-api-gateway.yaml --ignore-not-found=true
 
 echo "Removing upload service..."
 kubectl delete -f k8s/02-upload-service.yaml --ignore-not-found=true
+kubectl delete secret upload-signing-key --ignore-not-found=true
 
 echo "Removing auth service..."
 kubectl delete -f k8s/01-auth-service.yaml --ignore-not-found=true
+kubectl delete secret admin-bootstrap-token --ignore-not-found=true
+
+echo "Removing MinIO..."
+kubectl delete -f k8s/minio.yaml --ignore-not-found=true
+
+echo "Removing PostgreSQL..."
+kubectl delete -f k8s/postgres.yaml --ignore-not-found=true
 
 echo "Removing common resources..."
 kubectl delete -f k8s/00-common.yaml --ignore-not-found=true
+kubectl delete secret service-token --ignore-not-found=true
 
 echo ""
 echo "Cleanup complete!"
@@ -6,14 +6,41 @@ echo "Deploying microservices to Kubernetes..."
 echo "Applying common resources..."
 kubectl apply -f k8s/00-common.yaml
 
-# Wait for PVC to be bound
-echo "Waiting for PVC to be ready..."
-kubectl wait --for=condition=Bound pvc/uploads-pvc --timeout=60s
+# Deploy the user database used by auth-service
+echo "Deploying PostgreSQL..."
+kubectl apply -f k8s/postgres.yaml
+kubectl wait --for=condition=available --timeout=120s deployment/postgres
+
+# Deploy the object store holding uploaded files
+echo "Deploying MinIO..."
+kubectl apply -f k8s/minio.yaml
+kubectl wait --for=condition=available --timeout=120s deployment/minio
+
+# The token the services present on auth-service's internal routes is
+# generated once and shared by all of them
+if ! kubectl get secret service-token >/dev/null 2>&1; then
+  kubectl create secret generic service-token \
+    --from-literal=token="$(head -c 32 /dev/urandom | base64)"
+fi
+
+# The first account to present this token becomes admin; it is refused once
+# an admin exists
+if ! kubectl get secret admin-bootstrap-token >/dev/null 2>&1; then
+  kubectl create secret generic admin-bootstrap-token \
+    --from-literal=token="$(head -c 32 /dev/urandom | base64)"
+fi
 
 # Apply services
 echo "Deploying auth service..."
 kubectl apply -f k8s/01-auth-service.yaml
 
+# The key signing file URLs is generated once; replacing it invalidates every
+# URL and share link handed out
+if ! kubectl get secret upload-signing-key >/dev/null 2>&1; then
+  kubectl create secret generic upload-signing-key \
+    --from-literal=key="$(head -c 32 /dev/urandom | base64)"
+fi
+
 echo "Deploying upload service..."
 kubectl apply -f k8s/02-upload-service.yaml
 
@@ -2,39 +2,70 @@ package main
 
 import (
 	"bytes"
-	"fmt"
+	"encoding/json"
+	"errors"
 	"io"
+	"log"
+	"mime"
 	"net/http"
-	"os"
+	"net/url"
 	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
+	"shared"
+	"shared/config"
 )
 
-func getAuthServiceURL() string {
-	if url := os.Getenv("AUTH_SERVICE_URL"); url != "" {
-		return url
+// cfg holds the service URLs requests are proxied to
+var cfg *config.Config
+
+// rejectRevokedTokens stops requests whose access token belongs to a signed
+// out session before they reach a service. Other token problems are left for
+// the services to report.
+func rejectRevokedTokens(c *gin.Context) {
+	auth := c.GetHeader("Authorization")
+	token := strings.TrimPrefix(auth, "Bearer ")
+	if token == auth || token == "" || shared.IsAPIKey(token) {
+		c.Next()
+		return
 	}
-	return "http://localhost:8082" // fallback for local development
-}
-
-func getUploadServiceURL() string {
-	if url := os.Getenv("UPLOAD_SERVICE_URL"); url != "" {
-		return url
+	if _, err := shared.ValidateJWT(token); errors.Is(err, shared.ErrTokenRevoked) {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
+		return
 	}
-	return "http://localhost:8083" // fallback for local development
+	c.Next()
 }
 
 func main() {
+	// Browsers reach the gateway from the page it serves, which is the
+	// only origin allowed by default
+	defaults := config.Default(":8081")
+	defaults.CORS.AllowOrigins = []string{"http://localhost:8081"}
+	defaults.CORS.AllowCredentials = true
+	cfg = config.MustLoad("api-gateway", defaults)
+
+	// Revoked sessions are looked up in auth-service and cached for
+	// services.revocationCacheTTL
+	shared.SetDenyList(shared.NewRemoteDenyList(shared.TokenStatusURL(), cfg.Services.RevocationCacheTTL))
+
 	r := gin.Default()
 
+	// The client IP is forwarded to the services for login throttling, so it
+	// must not be taken from headers set by untrusted clients. By default
+	// no proxy is trusted.
+	if err := r.SetTrustedProxies(cfg.HTTP.TrustedProxies); err != nil {
+		panic(err)
+	}
+
 	// Load HTML templates (check multiple possible paths)
 	templatePaths := []string{
-		"../../frontend/templates/*",     // Local dev (from services/api-gateway - used by start script)
-		"frontend/templates/*",           // Local development (from project root)
-		"./templates/*",                  // Docker container
-		"templates/*",                    // Alternative Docker path
+		"../../frontend/templates/*", // Local dev (from services/api-gateway - used by start script)
+		"frontend/templates/*",       // Local development (from project root)
+		"./templates/*",              // Docker container
+		"templates/*",                // Alternative Docker path
 	}
 
 	var templatesLoaded bool
@@ -51,45 +82,149 @@ func main() {
 	}
 
 	// Configure CORS to allow the same origin
-	config := cors.DefaultConfig()
-	config.AllowOrigins = []string{"http://localhost:8081"}
-	config.AllowHeaders = []string{"Origin", "Content-Length", "Content-Type", "Authorization"}
-	config.AllowCredentials = true
-	r.Use(cors.New(config))
+	corsConfig := cors.DefaultConfig()
+	corsConfig.AllowOrigins = cfg.CORS.AllowOrigins
+	corsConfig.AllowHeaders = []string{"Origin", "Content-Length", "Content-Type", "Authorization",
+		"Tus-Resumable", "Upload-Length", "Upload-Offset", "Upload-Metadata", "X-HTTP-Method-Override"}
+	corsConfig.ExposeHeaders = []string{"Location", "Tus-Resumable", "Tus-Version", "Tus-Extension",
+		"Tus-Max-Size", "Upload-Length", "Upload-Offset", "Upload-Expires"}
+	corsConfig.AllowCredentials = cfg.CORS.AllowCredentials
+	r.Use(cors.New(corsConfig))
+	r.Use(rejectRevokedTokens)
+
+	// Probes; the gateway is ready when both services it proxies to are up
+	health := shared.NewHealth(2 * time.Second)
+	health.AddCheck("auth-service", shared.HTTPCheck(cfg.Services.AuthURL+"/healthz"))
+	health.AddCheck("upload-service", shared.HTTPCheck(cfg.Services.UploadURL+"/healthz"))
+	r.GET("/healthz", health.Live)
+	r.GET("/readyz", health.Ready)
 
 	// Serve the main HTML page
 	r.GET("/", func(c *gin.Context) {
 		c.HTML(http.StatusOK, "index.html", nil)
 	})
 
-	// Proxy routes to auth service
-	r.POST("/auth/login", proxyToAuth("/login-form"))
-	r.POST("/auth/register", proxyToAuth("/register-form"))
+	// Proxy routes to auth service. The /auth routes used by the page's
+	// forms reach the same handlers as /api; auth-service answers htmx
+	// requests with HTML fragments and everything else with JSON.
+	r.POST("/auth/login", proxyToAuth("/login"))
+	r.POST("/auth/register", proxyToAuth("/register"))
+	r.POST("/auth/login/mfa", proxyToAuth("/login/mfa"))
 	r.POST("/api/register", proxyToAuth("/register"))
 	r.POST("/api/login", proxyToAuth("/login"))
+	r.POST("/api/refresh", proxyToAuth("/refresh"))
+	r.POST("/api/logout", proxyToAuth("/logout"))
+	r.POST("/api/verify-email", proxyToAuth("/verify-email"))
+	r.POST("/api/resend-verification", proxyToAuth("/resend-verification"))
+	r.POST("/api/forgot-password", proxyToAuth("/forgot-password"))
+	r.POST("/api/reset-password", proxyToAuth("/reset-password"))
+	r.POST("/api/login/mfa", proxyToAuth("/login/mfa"))
+	r.GET("/api/sessions", proxyToAuth("/sessions"))
+	r.DELETE("/api/sessions", proxyToAuth("/sessions"))
+	r.DELETE("/api/sessions/:id", proxyToAuth("/sessions/:id"))
+	r.GET("/api/account", proxyToAuth("/account"))
+	r.PATCH("/api/account", proxyToAuth("/account"))
+	r.DELETE("/api/account", proxyToAuth("/account"))
+	r.POST("/api/account/password", proxyToAuth("/account/password"))
+	r.GET("/api/orgs", proxyToAuth("/orgs"))
+	r.POST("/api/orgs/switch", proxyToAuth("/orgs/switch"))
+	r.GET("/api/orgs/:id/members", proxyToAuth("/orgs/:id/members"))
+	r.PUT("/api/orgs/:id/members/:username", proxyToAuth("/orgs/:id/members/:username"))
+	r.DELETE("/api/orgs/:id/members/:username", proxyToAuth("/orgs/:id/members/:username"))
+	r.GET("/api/api-keys", proxyToAuth("/api-keys"))
+	r.POST("/api/api-keys", proxyToAuth("/api-keys"))
+	r.DELETE("/api/api-keys/:id", proxyToAuth("/api-keys/:id"))
+	r.POST("/api/mfa/enroll", proxyToAuth("/mfa/enroll"))
+	r.POST("/api/mfa/confirm", proxyToAuth("/mfa/confirm"))
+	r.POST("/api/mfa/recovery-codes", proxyToAuth("/mfa/recovery-codes"))
+	r.POST("/api/mfa/disable", proxyToAuth("/mfa/disable"))
+
+	// OpenID Connect provider; the gateway is the public issuer URL
+	r.GET("/.well-known/openid-configuration", proxyToAuth("/.well-known/openid-configuration"))
+	r.GET("/.well-known/jwks.json", proxyToAuth("/.well-known/jwks.json"))
+	r.GET("/oauth/authorize", consentPage)
+	r.POST("/api/oauth/authorize", proxyToAuth("/oauth/authorize"))
+	r.POST("/oauth/token", proxyToAuth("/oauth/token"))
+	r.GET("/oauth/userinfo", proxyToAuth("/oauth/userinfo"))
+	r.POST("/oauth/userinfo", proxyToAuth("/oauth/userinfo"))
+	r.POST("/introspect", proxyToAuth("/introspect"))
+
+	// Admin routes (permissions are enforced by the services)
+	r.POST("/api/admin/bootstrap", proxyToAuth("/admin/bootstrap"))
+	r.GET("/api/admin/users", proxyToAuth("/admin/users"))
+	r.POST("/api/admin/users/:username/roles", proxyToAuth("/admin/users/:username/roles"))
+	r.DELETE("/api/admin/users/:username/roles/:role", proxyToAuth("/admin/users/:username/roles/:role"))
+	r.POST("/api/admin/users/:username/disable", proxyToAuth("/admin/users/:username/disable"))
+	r.POST("/api/admin/users/:username/enable", proxyToAuth("/admin/users/:username/enable"))
+	r.POST("/api/admin/users/:username/unlock", proxyToAuth("/admin/users/:username/unlock"))
+	r.GET("/api/admin/clients", proxyToAuth("/admin/clients"))
+	r.POST("/api/admin/clients", proxyToAuth("/admin/clients"))
+	r.DELETE("/api/admin/clients/:clientId", proxyToAuth("/admin/clients/:clientId"))
+	r.GET("/api/admin/audit", proxyToAuth("/admin/audit"))
+	r.GET("/api/admin/audit/export", proxyToAuth("/admin/audit/export"))
+	r.GET("/api/admin/orgs", proxyToAuth("/admin/orgs"))
+	r.POST("/api/admin/orgs", proxyToAuth("/admin/orgs"))
+	r.GET("/api/admin/uploads", proxyToUpload("/admin/uploads"))
+	r.DELETE("/api/admin/uploads/:filename", proxyToUpload("/admin/uploads/:filename"))
 
 	// Proxy routes to upload service with file handling
 	r.POST("/api/upload", proxyFileToUpload("/upload"))
 	r.GET("/api/profile", proxyToUpload("/profile"))
 
-	// Serve static files from upload service
+	// Resumable uploads (tus 1.0). POST covers X-HTTP-Method-Override,
+	// which upload-service applies.
+	for _, method := range []string{http.MethodOptions, http.MethodPost} {
+		r.Handle(method, "/api/tus", proxyTusToUpload("/tus"))
+	}
+	for _, method := range []string{http.MethodOptions, http.MethodPost, http.MethodHead, http.MethodPatch, http.MethodGet} {
+		r.Handle(method, "/api/tus/:id", proxyTusToUpload("/tus/:id"))
+	}
+
+	// The caller's upload library (ownership is enforced by upload-service)
+	r.GET("/api/uploads", proxyToUpload("/uploads"))
+	r.GET("/api/uploads/:id", proxyToUpload("/uploads/:id"))
+	r.PATCH("/api/uploads/:id", proxyToUpload("/uploads/:id"))
+	r.DELETE("/api/uploads/:id", proxyToUpload("/uploads/:id"))
+	r.POST("/api/uploads/:id/share", proxyToUpload("/uploads/:id/share"))
+
+	// Serve files from upload service for signed URLs
 	r.GET("/uploads/*filepath", func(c *gin.Context) {
 		// Proxy to upload service for static files
 		proxyStaticToUpload(c)
 	})
 
-	r.Run(":8081") // API Gateway on port 8081 (original port)
+	// API Gateway on port 8081 by default
+	if err := shared.Serve(cfg.HTTP.Addr, r, health, cfg.HTTP.ShutdownDelay, cfg.HTTP.DrainTimeout); err != nil {
+		log.Fatal("Server failed:", err)
+	}
+}
+
+// targetURL joins base and endpoint, filling ":name" segments from the route
+// parameters and forwarding the query string
+func targetURL(c *gin.Context, base, endpoint string) string {
+	segments := strings.Split(endpoint, "/")
+	for i, segment := range segments {
+		if strings.HasPrefix(segment, ":") {
+			segments[i] = url.PathEscape(c.Param(segment[1:]))
+		}
+	}
+
+	target := base + strings.Join(segments, "/")
+	if c.Request.URL.RawQuery != "" {
+		target += "?" + c.Request.URL.RawQuery
+	}
+	return target
 }
 
 func proxyToAuth(endpoint string) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		url := getAuthServiceURL() + endpoint
+		url := targetURL(c, cfg.Services.AuthURL, endpoint)
 
 		// Handle form data or JSON
 		var body io.Reader
 		contentType := c.GetHeader("Content-Type")
 
-		if contentType == "application/json" {
+		if mediaType, _, _ := mime.ParseMediaType(contentType); mediaType == "application/json" {
 			// Forward JSON body
 			jsonData, err := io.ReadAll(c.Request.Body)
 			if err != nil {
@@ -115,6 +250,13 @@ func proxyToAuth(endpoint string) gin.HandlerFunc {
 		}
 
 		req.Header.Set("Content-Type", contentType)
+		for _, header := range []string{"Authorization", "HX-Request"} {
+			if value := c.GetHeader(header); value != "" {
+				req.Header.Set(header, value)
+			}
+		}
+		req.Header.Set("X-Forwarded-For", c.ClientIP())
+		req.Header.Set("User-Agent", c.Request.UserAgent())
 
 		// Forward the request
 		client := &http.Client{}
@@ -125,25 +267,35 @@ func proxyToAuth(endpoint string) gin.HandlerFunc {
 		}
 		defer resp.Body.Close()
 
-		// Forward response
-		respBody, err := io.ReadAll(resp.Body)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read response"})
-			return
+		// Forward response; it is streamed so that large exports are not buffered
+		for _, header := range []string{"Retry-After", "Cache-Control", "Pragma", "WWW-Authenticate", "Content-Disposition", "HX-Trigger", "Vary"} {
+			if value := resp.Header.Get(header); value != "" {
+				c.Header(header, value)
+			}
 		}
-
-		c.Data(resp.StatusCode, "application/json", respBody)
+		respType := resp.Header.Get("Content-Type")
+		if respType == "" {
+			respType = "application/json"
+		}
+		c.DataFromReader(resp.StatusCode, resp.ContentLength, respType, resp.Body, nil)
 	}
 }
 
 func proxyToUpload(endpoint string) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		url := getUploadServiceURL() + endpoint
+		url := targetURL(c, cfg.Services.UploadURL, endpoint)
 
 		// Forward authorization header
 		auth := c.GetHeader("Authorization")
 
-		req, err := http.NewRequest(c.Request.Method, url, nil)
+		// JSON bodies, e.g. of PATCH /uploads/:id, are streamed through
+		var body io.Reader
+		contentType := c.GetHeader("Content-Type")
+		if mediaType, _, _ := mime.ParseMediaType(contentType); mediaType == "application/json" {
+			body = c.Request.Body
+		}
+
+		req, err := http.NewRequest(c.Request.Method, url, body)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create request"})
 			return
@@ -152,6 +304,9 @@ func proxyToUpload(endpoint string) gin.HandlerFunc {
 		if auth != "" {
 			req.Header.Set("Authorization", auth)
 		}
+		if body != nil {
+			req.Header.Set("Content-Type", contentType)
+		}
 
 		client := &http.Client{}
 		resp, err := client.Do(req)
@@ -171,85 +326,127 @@ func proxyToUpload(endpoint string) gin.HandlerFunc {
 	}
 }
 
+// proxyFileToUpload streams the multipart body to upload-service, which
+// parses and validates it, so that the gateway never holds a file in memory
 func proxyFileToUpload(endpoint string) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		url := getUploadServiceURL() + endpoint
+		url := cfg.Services.UploadURL + endpoint
 
-		// Get the multipart form
-		err := c.Request.ParseMultipartForm(32 << 20) // 32 MB
-		if err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to parse multipart form"})
+		contentType := c.GetHeader("Content-Type")
+		if mediaType, _, _ := mime.ParseMediaType(contentType); mediaType != "multipart/form-data" {
+			c.JSON(http.StatusBadRequest, shared.UploadResponse{Error: "No file uploaded", Code: shared.UploadErrNoFile})
 			return
 		}
 
-		// Create a new multipart form
-		body := &bytes.Buffer{}
-		writer := &bytes.Buffer{}
-
-		// Forward the file
-		file, header, err := c.Request.FormFile("image")
+		req, err := http.NewRequest(http.MethodPost, url, c.Request.Body)
 		if err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "No file uploaded"})
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create request"})
 			return
 		}
-		defer file.Close()
+		req.ContentLength = c.Request.ContentLength
+		req.Header.Set("Content-Type", contentType)
+		if auth := c.GetHeader("Authorization"); auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
 
-		// Read file content
-		fileContent, err := io.ReadAll(file)
+		resp, err := http.DefaultClient.Do(req)
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read file"})
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Upload service unavailable"})
 			return
 		}
+		defer resp.Body.Close()
 
-		// Create multipart form for forwarding
-		boundary := "----WebKitFormBoundary7MA4YWxkTrZu0gW"
-		contentType := fmt.Sprintf("multipart/form-data; boundary=%s", boundary)
+		respBody, err := io.ReadAll(resp.Body)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read response"})
+			return
+		}
 
-		writer.WriteString(fmt.Sprintf("--%s\r\n", boundary))
-		writer.WriteString(fmt.Sprintf("Content-Disposition: form-data; name=\"image\"; filename=\"%s\"\r\n", header.Filename))
-		writer.WriteString(fmt.Sprintf("Content-Type: %s\r\n\r\n", header.Header.Get("Content-Type")))
-		writer.Write(fileContent)
-		writer.WriteString(fmt.Sprintf("\r\n--%s--\r\n", boundary))
+		c.Data(resp.StatusCode, "application/json", respBody)
+	}
+}
 
-		body = writer
+// tusRequestHeaders and tusResponseHeaders are passed through for resumable
+// uploads
+var (
+	tusRequestHeaders = []string{"Authorization", "Content-Type", "Tus-Resumable",
+		"Upload-Length", "Upload-Offset", "Upload-Metadata", "X-HTTP-Method-Override"}
+	tusResponseHeaders = []string{"Tus-Resumable", "Tus-Version", "Tus-Extension", "Tus-Max-Size",
+		"Upload-Length", "Upload-Offset", "Upload-Expires", "Cache-Control"}
+)
 
-		// Forward authorization header
-		auth := c.GetHeader("Authorization")
+// proxyTusToUpload passes tus requests to upload-service with their method
+// and streams PATCH bodies through. Locations are rewritten to the gateway's
+// /api/tus.
+func proxyTusToUpload(endpoint string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		url := targetURL(c, cfg.Services.UploadURL, endpoint)
 
-		req, err := http.NewRequest("POST", url, body)
+		var body io.Reader
+		if c.Request.ContentLength != 0 {
+			body = c.Request.Body
+		}
+		req, err := http.NewRequest(c.Request.Method, url, body)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create request"})
 			return
 		}
-
-		req.Header.Set("Content-Type", contentType)
-		if auth != "" {
-			req.Header.Set("Authorization", auth)
+		req.ContentLength = c.Request.ContentLength
+		for _, header := range tusRequestHeaders {
+			if value := c.GetHeader(header); value != "" {
+				req.Header.Set(header, value)
+			}
 		}
 
-		client := &http.Client{}
-		resp, err := client.Do(req)
+		resp, err := http.DefaultClient.Do(req)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Upload service unavailable"})
 			return
 		}
 		defer resp.Body.Close()
 
-		respBody, err := io.ReadAll(resp.Body)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read response"})
+		for _, header := range tusResponseHeaders {
+			if value := resp.Header.Get(header); value != "" {
+				c.Header(header, value)
+			}
+		}
+		if location := resp.Header.Get("Location"); strings.HasPrefix(location, "/tus/") {
+			c.Header("Location", "/api"+location)
+		}
+		if resp.StatusCode == http.StatusNoContent || c.Request.Method == http.MethodHead {
+			c.Status(resp.StatusCode)
 			return
 		}
-
-		c.Data(resp.StatusCode, "application/json", respBody)
+		respType := resp.Header.Get("Content-Type")
+		if respType == "" {
+			respType = "application/json"
+		}
+		c.DataFromReader(resp.StatusCode, resp.ContentLength, respType, resp.Body, nil)
 	}
 }
 
 func proxyStaticToUpload(c *gin.Context) {
 	filepath := c.Param("filepath")
-	url := getUploadServiceURL() + "/uploads" + filepath
+	url := cfg.Services.UploadURL + "/files" + filepath
+	if c.Request.URL.RawQuery != "" {
+		// The signature, and e.g. ?size= for a resized variant
+		url += "?" + c.Request.URL.RawQuery
+	}
 
-	resp, err := http.Get(url)
+	// The signature in the query is the only credential, so the caller's
+	// token is not passed on. Range and conditional headers are.
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create request"})
+		return
+	}
+	for _, header := range []string{"Range", "If-Range", "If-None-Match", "If-Modified-Since"} {
+		if value := c.GetHeader(header); value != "" {
+			req.Header.Set(header, value)
+		}
+	}
+
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
 		return
@@ -265,4 +462,48 @@ func proxyStaticToUpload(c *gin.Context) {
 
 	c.Status(resp.StatusCode)
 	io.Copy(c.Writer, resp.Body)
-}
\ No newline at end of file
+}
+
+// consentInfo is auth-service's description of a valid authorization request
+type consentInfo struct {
+	ClientID    string   `json:"clientId"`
+	ClientName  string   `json:"clientName"`
+	Scopes      []string `json:"scopes"`
+	Error       string   `json:"error"`
+	Description string   `json:"error_description"`
+	Redirect    string   `json:"redirect"`
+}
+
+// consentPage is the OpenID Connect authorization endpoint. It asks
+// auth-service to validate the request and renders the consent template; the
+// page posts the user's decision to /api/oauth/authorize with their token.
+func consentPage(c *gin.Context) {
+	resp, err := http.Get(cfg.Services.AuthURL + "/oauth/authorize?" + c.Request.URL.RawQuery)
+	if err != nil {
+		c.HTML(http.StatusBadGateway, "consent.html", gin.H{"Error": "Auth service unavailable"})
+		return
+	}
+	defer resp.Body.Close()
+
+	var info consentInfo
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		c.HTML(http.StatusBadGateway, "consent.html", gin.H{"Error": "Invalid response from auth service"})
+		return
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		// Errors for a trusted redirect URI go back to the client
+		if info.Redirect != "" {
+			c.Redirect(http.StatusFound, info.Redirect)
+			return
+		}
+		c.HTML(http.StatusBadRequest, "consent.html", gin.H{"Error": info.Description})
+		return
+	}
+
+	c.HTML(http.StatusOK, "consent.html", gin.H{
+		"ClientName": info.ClientName,
+		"Scopes":     info.Scopes,
+		"Query":      c.Request.URL.RawQuery,
+	})
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"shared"
+)
+
+const maxDisplayNameLength = 64
+
+// uploadClient calls upload-service when an account is deleted
+var uploadClient = &http.Client{Timeout: 30 * time.Second}
+
+// toProfile converts a stored account into its self-service representation
+func toProfile(user *UserRecord) shared.ProfileResponse {
+	createdAt := user.CreatedAt
+	return shared.ProfileResponse{
+		Username:         user.Username,
+		DisplayName:      user.DisplayName,
+		Email:            user.Email,
+		EmailVerified:    user.EmailVerified,
+		Roles:            user.Roles,
+		TwoFactorEnabled: user.TOTPEnabled,
+		CreatedAt:        &createdAt,
+	}
+}
+
+// validateDisplayName returns a message describing why name is not acceptable, or ""
+func validateDisplayName(name string) string {
+	if utf8.RuneCountInString(name) > maxDisplayNameLength {
+		return fmt.Sprintf("Display name must be at most %d characters", maxDisplayNameLength)
+	}
+	for _, r := range name {
+		if unicode.IsControl(r) {
+			return "Display name contains invalid characters"
+		}
+	}
+	return ""
+}
+
+// getAccount returns the signed-in user's profile
+func getAccount(c *gin.Context) {
+	user, ok := currentAccount(c)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, toProfile(user))
+}
+
+// profileForService returns a user's profile to other services. It is not
+// exposed through the gateway.
+func profileForService(c *gin.Context) {
+	user, err := users.GetUser(c.Request.Context(), c.Param("username"))
+	if errors.Is(err, ErrUserNotFound) {
+		c.JSON(http.StatusNotFound, shared.ProfileResponse{Error: "User not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, shared.ProfileResponse{Error: "Could not look up user"})
+		return
+	}
+	c.JSON(http.StatusOK, toProfile(user))
+}
+
+type updateAccountRequest struct {
+	DisplayName *string `json:"displayName"`
+	Email       *string `json:"email"`
+	// Password is required to change the email address, since the address
+	// is where password reset links are sent
+	Password string `json:"password"`
+}
+
+// updateAccount changes the display name and email address. A new address
+// must be verified again.
+func updateAccount(c *gin.Context) {
+	var req updateAccountRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, shared.AuthResponse{Error: "Invalid request"})
+		return
+	}
+	user, ok := currentAccount(c)
+	if !ok {
+		return
+	}
+
+	fieldErrors := map[string]string{}
+	if req.DisplayName != nil {
+		name := strings.TrimSpace(*req.DisplayName)
+		if msg := validateDisplayName(name); msg != "" {
+			fieldErrors["displayName"] = msg
+		}
+		user.DisplayName = name
+	}
+
+	previousEmail := user.Email
+	emailChanged := req.Email != nil && !strings.EqualFold(*req.Email, user.Email)
+	if emailChanged {
+		if msg := validateEmail(*req.Email); msg != "" {
+			fieldErrors["email"] = msg
+		} else if match, _, err := shared.VerifyPassword(user.PasswordHash, req.Password); err != nil || !match {
+			fieldErrors["password"] = "Current password is required to change your email"
+		}
+		user.Email = *req.Email
+		user.EmailVerified = false
+	}
+	if len(fieldErrors) > 0 {
+		c.JSON(http.StatusBadRequest, shared.AuthResponse{Error: "Validation failed", FieldErrors: fieldErrors})
+		return
+	}
+
+	ctx := c.Request.Context()
+	err := users.UpdateUser(ctx, user)
+	if errors.Is(err, ErrEmailExists) {
+		c.JSON(http.StatusConflict, shared.AuthResponse{
+			Error:       "Email already in use",
+			FieldErrors: map[string]string{"email": "An account with this email already exists"},
+		})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, shared.AuthResponse{Error: "Could not update profile"})
+		return
+	}
+
+	resp := toProfile(user)
+	resp.Message = "Profile updated"
+	if emailChanged {
+		if err := sendVerificationEmail(ctx, user); err != nil {
+			log.Printf("Failed to send verification email to %q: %v", user.Username, err)
+		}
+		// Let the previous owner of the address know in case this was not them
+		if previousEmail != "" {
+			err := notifier.Send(ctx, Message{
+				To:      previousEmail,
+				Subject: "Your email address was changed",
+				Body: fmt.Sprintf("Hello %s,\n\nThe email address on your account was changed to %s.\n\n"+
+					"If you did not make this change, reset your password and contact an administrator.\n",
+					user.Username, user.Email),
+			})
+			if err != nil {
+				log.Printf("Failed to notify %q of email change: %v", user.Username, err)
+			}
+		}
+		resp.Message = "Profile updated. Check your email to verify your new address."
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+type changePasswordRequest struct {
+	CurrentPassword string `json:"currentPassword" form:"current_password" binding:"required"`
+	NewPassword     string `json:"newPassword" form:"new_password" binding:"required"`
+}
+
+// changePassword replaces the password after checking the current one and
+// signs out every other session. Wrong guesses count as failed logins.
+func changePassword(c *gin.Context) {
+	var req changePasswordRequest
+	if err := c.ShouldBind(&req); err != nil {
+		c.JSON(http.StatusBadRequest, shared.AuthResponse{Error: "Invalid request", FieldErrors: bindingFieldErrors(err)})
+		return
+	}
+	user, ok := currentAccount(c)
+	if !ok {
+		return
+	}
+	if !checkLoginThrottle(c, user.Username) {
+		return
+	}
+
+	match, _, err := shared.VerifyPassword(user.PasswordHash, req.CurrentPassword)
+	if err != nil || !match {
+		recordAudit(c, auditPasswordChange, user.Username, outcomeFailure, "invalid current password")
+		recordLoginFailure(c, user.Username)
+		c.JSON(http.StatusUnauthorized, shared.AuthResponse{
+			Error:       "Current password is incorrect",
+			FieldErrors: map[string]string{"currentPassword": "Current password is incorrect"},
+		})
+		return
+	}
+	if msg := registrationPolicy.validatePassword(user.Username, req.NewPassword); msg != "" {
+		c.JSON(http.StatusBadRequest, shared.AuthResponse{
+			Error:       "Validation failed",
+			FieldErrors: map[string]string{"newPassword": msg},
+		})
+		return
+	}
+
+	hashedPassword, err := shared.HashPassword(req.NewPassword)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, shared.AuthResponse{Error: "Could not hash password"})
+		return
+	}
+	user.PasswordHash = hashedPassword
+
+	ctx := c.Request.Context()
+	if err := users.UpdateUser(ctx, user); err != nil {
+		c.JSON(http.StatusInternalServerError, shared.AuthResponse{Error: "Could not change password"})
+		return
+	}
+	recordLoginSuccess(c, user.Username)
+	recordAudit(c, auditPasswordChange, user.Username, outcomeSuccess, "")
+
+	// Keep the session making the change; everything else must sign in again
+	var currentFamily string
+	if claims := shared.ClaimsFromContext(c); claims != nil {
+		currentFamily, _ = tokens.FamilyForAccessToken(ctx, claims.ID)
+	}
+	if err := tokens.RevokeUserTokens(ctx, user.Username, currentFamily); err != nil {
+		log.Printf("Failed to revoke other sessions for %q after password change: %v", user.Username, err)
+		c.JSON(http.StatusInternalServerError, shared.AuthResponse{Error: "Password changed, but other sessions could not be signed out"})
+		return
+	}
+	if err := tokens.DeleteActionTokens(ctx, user.Username, purposeResetPassword); err != nil {
+		log.Printf("Failed to invalidate reset links for %q: %v", user.Username, err)
+	}
+
+	c.JSON(http.StatusOK, shared.AuthResponse{Username: user.Username, Message: "Password changed. Other sessions have been signed out."})
+}
+
+type deleteAccountRequest struct {
+	Password string `json:"password" form:"password" binding:"required"`
+	Code     string `json:"code" form:"code"` // required with two-factor authentication
+}
+
+// deleteAccount removes the signed-in account after re-checking the password
+// (and second factor). The user's uploads are deleted first so that a failure
+// there leaves the account in place to retry.
+func deleteAccount(c *gin.Context) {
+	var req deleteAccountRequest
+	if err := c.ShouldBind(&req); err != nil {
+		c.JSON(http.StatusBadRequest, shared.AuthResponse{Error: "Password is required"})
+		return
+	}
+	user, ok := currentAccount(c)
+	if !ok {
+		return
+	}
+	if !checkLoginThrottle(c, user.Username) {
+		return
+	}
+
+	ctx := c.Request.Context()
+	match, _, err := shared.VerifyPassword(user.PasswordHash, req.Password)
+	if err == nil && match && user.TOTPEnabled {
+		match, err = checkSecondFactor(ctx, user, req.Code)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, shared.AuthResponse{Error: "Could not delete account"})
+			return
+		}
+	}
+	if err != nil || !match {
+		recordAudit(c, auditAccountDelete, user.Username, outcomeFailure, "invalid password or code")
+		recordLoginFailure(c, user.Username)
+		c.JSON(http.StatusUnauthorized, shared.AuthResponse{Error: "Invalid password or code", MFARequired: user.TOTPEnabled})
+		return
+	}
+
+	if err := deleteUserUploads(ctx, c.GetHeader("Authorization")); err != nil {
+		log.Printf("Failed to delete uploads for %q: %v", user.Username, err)
+		c.JSON(http.StatusBadGateway, shared.AuthResponse{Error: "Could not delete your files, please try again"})
+		return
+	}
+
+	// Revoke before deleting so that outstanding access tokens land on the
+	// deny-list; DeleteUser drops the action tokens, authorization codes, API
+	// keys and memberships with the account
+	if err := tokens.RevokeUserTokens(ctx, user.Username, ""); err != nil {
+		c.JSON(http.StatusInternalServerError, shared.AuthResponse{Error: "Could not delete account"})
+		return
+	}
+	if err := attempts.ResetAttempts(ctx, userAttemptKey(user.Username)); err != nil {
+		log.Printf("Failed to reset login failures for %q: %v", user.Username, err)
+	}
+
+	if err := users.DeleteUser(ctx, user.Username); err != nil && !errors.Is(err, ErrUserNotFound) {
+		c.JSON(http.StatusInternalServerError, shared.AuthResponse{Error: "Could not delete account"})
+		return
+	}
+
+	log.Printf("Deleted account %q", user.Username)
+	recordAudit(c, auditAccountDelete, user.Username, outcomeSuccess, "")
+	c.JSON(http.StatusOK, shared.AuthResponse{Username: user.Username, Message: "Account deleted"})
+}
+
+// deleteUserUploads asks upload-service to remove every file owned by the
+// caller, passing on the caller's own access token
+func deleteUserUploads(ctx context.Context, authorization string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, cfg.Services.UploadURL+"/account/uploads", nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", authorization)
+
+	resp, err := uploadClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("upload-service returned %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"shared"
+)
+
+// bootstrapMu keeps two bootstrap requests from both finding no admin
+var bootstrapMu sync.Mutex
+
+type bootstrapRequest struct {
+	Token string `json:"token" form:"token" binding:"required"`
+}
+
+// bootstrapAdmin grants the admin role to the caller if they present the
+// bootstrap token and no account holds the role yet. Without a configured
+// token the route is disabled.
+func bootstrapAdmin(c *gin.Context) {
+	adminBootstrapToken := cfg.Auth.AdminBootstrapToken
+	if adminBootstrapToken == "" {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Admin bootstrap is not enabled"})
+		return
+	}
+	var req bootstrapRequest
+	if err := c.ShouldBind(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Token is required"})
+		return
+	}
+	username := c.GetString(shared.ContextUsername)
+	if subtle.ConstantTimeCompare([]byte(req.Token), []byte(adminBootstrapToken)) != 1 {
+		recordAudit(c, auditAdminBootstrap, username, outcomeFailure, "invalid token")
+		c.JSON(http.StatusForbidden, gin.H{"error": "Invalid bootstrap token"})
+		return
+	}
+
+	bootstrapMu.Lock()
+	defer bootstrapMu.Unlock()
+	ctx := c.Request.Context()
+	exists, err := adminExists(ctx)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not look up users"})
+		return
+	}
+	if exists {
+		recordAudit(c, auditAdminBootstrap, username, outcomeFailure, "an admin already exists")
+		c.JSON(http.StatusConflict, gin.H{"error": "An admin already exists"})
+		return
+	}
+
+	user, err := users.GetUser(ctx, username)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not look up user"})
+		return
+	}
+	user.Roles = append(user.Roles, shared.RoleAdmin)
+	if err := users.UpdateUser(ctx, user); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not update user"})
+		return
+	}
+	log.Printf("Granted the admin role to %q with the bootstrap token", username)
+	recordAudit(c, auditAdminBootstrap, username, outcomeSuccess, "")
+	// tokens pick up the new role on their next refresh
+	c.JSON(http.StatusOK, toUserSummary(user))
+}
+
+// adminExists reports whether any account holds the admin role
+func adminExists(ctx context.Context) (bool, error) {
+	const pageSize = 100
+	for offset := 0; ; offset += pageSize {
+		page, err := users.ListUsers(ctx, offset, pageSize)
+		if err != nil {
+			return false, err
+		}
+		for _, user := range page {
+			if hasRole(user, shared.RoleAdmin) {
+				return true, nil
+			}
+		}
+		if len(page) < pageSize {
+			return false, nil
+		}
+	}
+}
+
+func hasRole(user *UserRecord, role string) bool {
+	for _, r := range user.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+func toUserSummary(user *UserRecord) shared.UserSummary {
+	return shared.UserSummary{
+		Username:  user.Username,
+		Roles:     user.Roles,
+		Disabled:  user.Disabled,
+		CreatedAt: user.CreatedAt,
+	}
+}
+
+// pagination reads offset and limit query parameters, capping limit at 100
+func pagination(c *gin.Context) (offset, limit int) {
+	offset, _ = strconv.Atoi(c.DefaultQuery("offset", "0"))
+	limit, _ = strconv.Atoi(c.DefaultQuery("limit", "50"))
+	if offset < 0 {
+		offset = 0
+	}
+	if limit <= 0 || limit > 100 {
+		limit = 50
+	}
+	return offset, limit
+}
+
+func listUsers(c *gin.Context) {
+	offset, limit := pagination(c)
+
+	page, err := users.ListUsers(c.Request.Context(), offset, limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, shared.UserListResponse{Error: "Could not list users"})
+		return
+	}
+
+	resp := shared.UserListResponse{Users: []shared.UserSummary{}, Offset: offset, Limit: limit}
+	for _, user := range page {
+		resp.Users = append(resp.Users, toUserSummary(user))
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+type roleRequest struct {
+	Role string `json:"role" form:"role" binding:"required"`
+}
+
+func grantRole(c *gin.Context) {
+	var req roleRequest
+	if err := c.ShouldBind(&req); err != nil || !shared.IsKnownRole(req.Role) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "A known role is required"})
+		return
+	}
+
+	updateUser(c, func(user *UserRecord) bool {
+		if !hasRole(user, req.Role) {
+			user.Roles = append(user.Roles, req.Role)
+		}
+		return false // tokens pick up the new role on their next refresh
+	})
+}
+
+func revokeRole(c *gin.Context) {
+	role := c.Param("role")
+	if role == shared.RoleAdmin && c.Param("username") == c.GetString(shared.ContextUsername) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Admins cannot revoke their own admin role"})
+		return
+	}
+
+	updateUser(c, func(user *UserRecord) bool {
+		kept := user.Roles[:0]
+		for _, r := range user.Roles {
+			if r != role {
+				kept = append(kept, r)
+			}
+		}
+		user.Roles = kept
+		return true // outstanding tokens still carry the role
+	})
+}
+
+func disableUser(c *gin.Context) {
+	if c.Param("username") == c.GetString(shared.ContextUsername) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Admins cannot disable their own account"})
+		return
+	}
+
+	updateUser(c, func(user *UserRecord) bool {
+		user.Disabled = true
+		return true
+	})
+}
+
+func enableUser(c *gin.Context) {
+	updateUser(c, func(user *UserRecord) bool {
+		user.Disabled = false
+		return false
+	})
+}
+
+// updateUser applies change to the account named in the path and responds
+// with the updated summary. When change returns true the user's outstanding
+// tokens are revoked so the new state takes effect immediately.
+func updateUser(c *gin.Context, change func(user *UserRecord) (revokeTokens bool)) {
+	ctx := c.Request.Context()
+
+	user, err := users.GetUser(ctx, c.Param("username"))
+	if errors.Is(err, ErrUserNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not look up user"})
+		return
+	}
+
+	revoke := change(user)
+	if err := users.UpdateUser(ctx, user); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not update user"})
+		return
+	}
+
+	if revoke {
+		if err := tokens.RevokeUserTokens(ctx, user.Username, ""); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not revoke user tokens"})
+			return
+		}
+	}
+
+	c.JSON(http.StatusOK, toUserSummary(user))
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"shared"
+)
+
+var (
+	// ErrAPIKeyNotFound is returned for unknown API key IDs or hashes
+	ErrAPIKeyNotFound = errors.New("API key not found")
+	// ErrAPIKeyExpired is returned when a key is used after its expiry
+	ErrAPIKeyExpired = errors.New("API key expired")
+)
+
+// APIKey is a named, scoped credential for scripts. Only the SHA-256 hash of
+// the key is stored; Prefix keeps its first characters so users can tell
+// keys apart.
+type APIKey struct {
+	ID         string
+	Username   string
+	Name       string
+	KeyHash    string
+	Prefix     string
+	Scopes     []string
+	Tenant     string // organization the key acts for, empty for the default tenant
+	CreatedAt  time.Time
+	ExpiresAt  *time.Time // nil for keys that do not expire
+	LastUsedAt *time.Time
+}
+
+// APIKeyStore persists API keys next to the accounts that own them
+type APIKeyStore interface {
+	CreateAPIKey(ctx context.Context, key *APIKey) error
+	// ListAPIKeys returns the user's keys, newest first
+	ListAPIKeys(ctx context.Context, username string) ([]*APIKey, error)
+	DeleteAPIKey(ctx context.Context, username, id string) error
+	GetAPIKeyByHash(ctx context.Context, keyHash string) (*APIKey, error)
+	TouchAPIKey(ctx context.Context, id string, usedAt time.Time) error
+}
+
+// apiKeyTouchInterval limits how often last-used timestamps are written
+const apiKeyTouchInterval = time.Minute
+
+func toAPIKeyInfo(key *APIKey) shared.APIKeyInfo {
+	return shared.APIKeyInfo{
+		ID:         key.ID,
+		Name:       key.Name,
+		Prefix:     key.Prefix,
+		Scopes:     key.Scopes,
+		CreatedAt:  key.CreatedAt,
+		ExpiresAt:  key.ExpiresAt,
+		LastUsedAt: key.LastUsedAt,
+	}
+}
+
+type apiKeyRequest struct {
+	Name      string     `json:"name" binding:"required"`
+	Scopes    []string   `json:"scopes" binding:"required,min=1"`
+	ExpiresAt *time.Time `json:"expiresAt"`
+}
+
+// createAPIKey issues a key limited to scopes the user currently holds in the
+// tenant of the token creating it. The key itself is only returned in this
+// response.
+func createAPIKey(c *gin.Context) {
+	var req apiKeyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Name and at least one scope are required"})
+		return
+	}
+	if req.ExpiresAt != nil && !req.ExpiresAt.After(time.Now()) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Expiry must be in the future"})
+		return
+	}
+
+	ctx := c.Request.Context()
+	username := c.GetString(shared.ContextUsername)
+	user, err := users.GetUser(ctx, username)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+
+	tenant, orgRoles, err := tenantAccess(ctx, user)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not create API key"})
+		return
+	}
+	if claims := shared.ClaimsFromContext(c); claims != nil && claims.Tenant != tenant {
+		c.JSON(http.StatusConflict, gin.H{"error": "Your organization changed; refresh your token first"})
+		return
+	}
+
+	granted := shared.Claims{Permissions: shared.PermissionsForMember(user.Roles, orgRoles)}
+	for _, scope := range req.Scopes {
+		if !granted.HasPermission(scope) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Scope not available to your account: " + scope})
+			return
+		}
+	}
+
+	id, err := shared.NewTokenID()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not create API key"})
+		return
+	}
+	secret, err := newOpaqueToken()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not create API key"})
+		return
+	}
+	plain := shared.APIKeyPrefix + secret
+
+	key := &APIKey{
+		ID:        id,
+		Username:  username,
+		Name:      strings.TrimSpace(req.Name),
+		KeyHash:   shared.HashAPIKey(plain),
+		Prefix:    plain[:len(shared.APIKeyPrefix)+8],
+		Scopes:    req.Scopes,
+		Tenant:    tenant,
+		CreatedAt: time.Now(),
+		ExpiresAt: req.ExpiresAt,
+	}
+	if err := apiKeys.CreateAPIKey(ctx, key); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not create API key"})
+		return
+	}
+
+	info := toAPIKeyInfo(key)
+	info.Key = plain
+	c.JSON(http.StatusCreated, info)
+}
+
+func listAPIKeys(c *gin.Context) {
+	keys, err := apiKeys.ListAPIKeys(c.Request.Context(), c.GetString(shared.ContextUsername))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, shared.APIKeyListResponse{Error: "Could not list API keys"})
+		return
+	}
+
+	resp := shared.APIKeyListResponse{Keys: make([]shared.APIKeyInfo, 0, len(keys))}
+	for _, key := range keys {
+		resp.Keys = append(resp.Keys, toAPIKeyInfo(key))
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+func revokeAPIKey(c *gin.Context) {
+	err := apiKeys.DeleteAPIKey(c.Request.Context(), c.GetString(shared.ContextUsername), c.Param("id"))
+	if errors.Is(err, ErrAPIKeyNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "API key not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not revoke API key"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "API key revoked"})
+}
+
+type verifyAPIKeyRequest struct {
+	Key string `json:"key" binding:"required"`
+}
+
+// resolveAPIKey looks up a raw key and returns it with the scopes its owner
+// still holds, e.g. dropping scopes of a revoked role. It returns
+// ErrAPIKeyNotFound for unknown keys, keys of disabled accounts and keys of
+// organizations the owner has left, and ErrAPIKeyExpired once the key has
+// expired.
+func resolveAPIKey(ctx context.Context, raw string) (*APIKey, []string, error) {
+	key, err := apiKeys.GetAPIKeyByHash(ctx, shared.HashAPIKey(raw))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	now := time.Now()
+	if key.ExpiresAt != nil && !now.Before(*key.ExpiresAt) {
+		return nil, nil, ErrAPIKeyExpired
+	}
+
+	user, err := users.GetUser(ctx, key.Username)
+	if errors.Is(err, ErrUserNotFound) || (err == nil && user.Disabled) {
+		return nil, nil, ErrAPIKeyNotFound
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var orgRoles []string
+	if key.Tenant != "" {
+		member, err := orgs.GetMember(ctx, key.Tenant, key.Username)
+		if errors.Is(err, ErrMemberNotFound) {
+			return nil, nil, ErrAPIKeyNotFound
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		orgRoles = member.Roles
+	}
+
+	granted := shared.Claims{Permissions: shared.PermissionsForMember(user.Roles, orgRoles)}
+	var scopes []string
+	for _, scope := range key.Scopes {
+		if granted.HasPermission(scope) {
+			scopes = append(scopes, scope)
+		}
+	}
+
+	if key.LastUsedAt == nil || now.Sub(*key.LastUsedAt) >= apiKeyTouchInterval {
+		if err := apiKeys.TouchAPIKey(ctx, key.ID, now); err != nil {
+			log.Printf("Failed to record use of API key %s: %v", key.ID, err)
+		}
+	}
+	return key, scopes, nil
+}
+
+// verifyAPIKey is called by other services to resolve a key
+func verifyAPIKey(c *gin.Context) {
+	var req verifyAPIKeyRequest
+	if err := c.ShouldBindJSON(&req); err != nil || !shared.IsAPIKey(req.Key) {
+		c.JSON(http.StatusUnauthorized, shared.APIKeyVerifyResponse{Error: "Invalid API key"})
+		return
+	}
+
+	key, scopes, err := resolveAPIKey(c.Request.Context(), req.Key)
+	if errors.Is(err, ErrAPIKeyNotFound) {
+		c.JSON(http.StatusUnauthorized, shared.APIKeyVerifyResponse{Error: "Invalid API key"})
+		return
+	}
+	if errors.Is(err, ErrAPIKeyExpired) {
+		c.JSON(http.StatusUnauthorized, shared.APIKeyVerifyResponse{Error: "API key expired"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, shared.APIKeyVerifyResponse{Error: "Could not verify API key"})
+		return
+	}
+
+	c.JSON(http.StatusOK, shared.APIKeyVerifyResponse{
+		KeyID:     key.ID,
+		Username:  key.Username,
+		Scopes:    scopes,
+		ExpiresAt: key.ExpiresAt,
+		Tenant:    key.Tenant,
+	})
+}
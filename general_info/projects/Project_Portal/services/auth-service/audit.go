@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"shared"
+)
+
+// Audit event types
+const (
+	auditRegister       = "register"
+	auditLogin          = "login"
+	auditRefresh        = "refresh"
+	auditPasswordChange = "password_change"
+	auditPasswordReset  = "password_reset"
+	auditLockout        = "lockout"
+	auditUnlock         = "unlock"
+	auditAccountDelete  = "account_delete"
+	auditSessionRevoke  = "session_revoke"
+	auditAdminBootstrap = "admin_bootstrap"
+)
+
+// Audit event outcomes
+const (
+	outcomeSuccess = "success"
+	outcomeFailure = "failure"
+)
+
+// AuditFilter selects audit events; zero fields match everything
+type AuditFilter struct {
+	Type     string
+	Username string
+	ClientIP string
+	Outcome  string
+	Since    time.Time
+	Until    time.Time
+}
+
+// matches reports whether event passes the filter
+func (f AuditFilter) matches(event *shared.AuditEvent) bool {
+	return (f.Type == "" || event.Type == f.Type) &&
+		(f.Username == "" || event.Username == f.Username) &&
+		(f.ClientIP == "" || event.ClientIP == f.ClientIP) &&
+		(f.Outcome == "" || event.Outcome == f.Outcome) &&
+		(f.Since.IsZero() || !event.Time.Before(f.Since)) &&
+		(f.Until.IsZero() || event.Time.Before(f.Until))
+}
+
+// AuditStore is an append-only log of security-relevant events. There is
+// deliberately no way to change or remove an event once written.
+type AuditStore interface {
+	AppendAuditEvent(ctx context.Context, event *shared.AuditEvent) error
+	// ListAuditEvents returns matching events newest first
+	ListAuditEvents(ctx context.Context, filter AuditFilter, offset, limit int) ([]*shared.AuditEvent, error)
+	// ExportAuditEvents calls fn for every matching event, oldest first,
+	// stopping at the first error
+	ExportAuditEvents(ctx context.Context, filter AuditFilter, fn func(*shared.AuditEvent) error) error
+}
+
+// recordAudit appends an event for the request. The audit log must not make
+// logins fail, so write errors are only logged.
+func recordAudit(c *gin.Context, eventType, username, outcome, detail string) {
+	event := &shared.AuditEvent{
+		Time:      time.Now().UTC(),
+		Type:      eventType,
+		Username:  username,
+		ClientIP:  c.ClientIP(),
+		UserAgent: c.Request.UserAgent(),
+		Outcome:   outcome,
+		Detail:    detail,
+	}
+	if err := auditLog.AppendAuditEvent(c.Request.Context(), event); err != nil {
+		log.Printf("Failed to write audit event %s/%s for %q: %v", eventType, outcome, username, err)
+	}
+}
+
+// auditFilter reads the type, username, ip, outcome, since and until query
+// parameters. since and until are RFC 3339 timestamps.
+func auditFilter(c *gin.Context) (AuditFilter, bool) {
+	filter := AuditFilter{
+		Type:     c.Query("type"),
+		Username: c.Query("username"),
+		ClientIP: c.Query("ip"),
+		Outcome:  c.Query("outcome"),
+	}
+	for param, dst := range map[string]*time.Time{"since": &filter.Since, "until": &filter.Until} {
+		value := c.Query(param)
+		if value == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, shared.AuditListResponse{Error: param + " must be an RFC 3339 timestamp"})
+			return filter, false
+		}
+		*dst = t
+	}
+	return filter, true
+}
+
+// listAuditEvents returns a page of matching audit events, newest first
+func listAuditEvents(c *gin.Context) {
+	filter, ok := auditFilter(c)
+	if !ok {
+		return
+	}
+	offset, limit := pagination(c)
+
+	page, err := auditLog.ListAuditEvents(c.Request.Context(), filter, offset, limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, shared.AuditListResponse{Error: "Could not list audit events"})
+		return
+	}
+
+	resp := shared.AuditListResponse{Events: []shared.AuditEvent{}, Offset: offset, Limit: limit}
+	for _, event := range page {
+		resp.Events = append(resp.Events, *event)
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// exportAuditEvents streams every matching event as newline-delimited JSON,
+// oldest first, for ingestion into a SIEM
+func exportAuditEvents(c *gin.Context) {
+	filter, ok := auditFilter(c)
+	if !ok {
+		return
+	}
+
+	c.Header("Content-Type", "application/x-ndjson")
+	c.Header("Content-Disposition",
+		`attachment; filename="audit-`+time.Now().UTC().Format("20060102T150405Z")+`.ndjson"`)
+	c.Status(http.StatusOK)
+
+	enc := json.NewEncoder(c.Writer)
+	err := auditLog.ExportAuditEvents(c.Request.Context(), filter, func(event *shared.AuditEvent) error {
+		return enc.Encode(event)
+	})
+	if err != nil {
+		// Headers are already sent, so the client sees a truncated stream
+		log.Printf("Audit export interrupted: %v", err)
+	}
+}
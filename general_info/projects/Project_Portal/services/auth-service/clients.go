@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"shared"
+)
+
+var (
+	// ErrClientNotFound is returned for unknown OpenID Connect client IDs
+	ErrClientNotFound = errors.New("client not found")
+	// ErrAuthorizationCodeInvalid is returned for unknown, expired or already used codes
+	ErrAuthorizationCodeInvalid = errors.New("authorization code is invalid or expired")
+)
+
+// OAuthClient is an application allowed to sign users in through the OpenID
+// Connect endpoints. Public clients (e.g. single-page apps) have no secret
+// and rely on PKCE alone.
+type OAuthClient struct {
+	ClientID     string
+	SecretHash   string // SHA-256 of the client secret, empty for public clients
+	Name         string
+	RedirectURIs []string
+	CreatedAt    time.Time
+}
+
+// Public reports whether the client authenticates without a secret
+func (c *OAuthClient) Public() bool {
+	return c.SecretHash == ""
+}
+
+// AllowsRedirect reports whether uri exactly matches a registered redirect URI
+func (c *OAuthClient) AllowsRedirect(uri string) bool {
+	for _, registered := range c.RedirectURIs {
+		if registered == uri {
+			return true
+		}
+	}
+	return false
+}
+
+// AuthorizationCode is the server-side record of an issued authorization
+// code. Only the SHA-256 hash of the code is stored.
+type AuthorizationCode struct {
+	CodeHash      string
+	ClientID      string
+	Username      string
+	RedirectURI   string
+	Scope         string
+	Nonce         string
+	CodeChallenge string // S256 PKCE challenge
+	AuthTime      time.Time
+	ExpiresAt     time.Time
+}
+
+// ClientStore persists OpenID Connect clients and their authorization codes
+// in the same backend as the user accounts
+type ClientStore interface {
+	CreateClient(ctx context.Context, client *OAuthClient) error
+	GetClient(ctx context.Context, clientID string) (*OAuthClient, error)
+	// ListClients returns clients ordered by name
+	ListClients(ctx context.Context) ([]*OAuthClient, error)
+	DeleteClient(ctx context.Context, clientID string) error
+	SaveAuthorizationCode(ctx context.Context, code *AuthorizationCode) error
+	// ConsumeAuthorizationCode deletes the code and returns it, or returns
+	// ErrAuthorizationCodeInvalid if it is unknown or expired
+	ConsumeAuthorizationCode(ctx context.Context, codeHash string) (*AuthorizationCode, error)
+}
+
+// authenticateClient checks the secret of a confidential client in constant time
+func authenticateClient(client *OAuthClient, secret string) bool {
+	if client.Public() {
+		return secret == ""
+	}
+	return subtle.ConstantTimeCompare([]byte(client.SecretHash), []byte(hashToken(secret))) == 1
+}
+
+func toClientInfo(client *OAuthClient) shared.OAuthClientInfo {
+	return shared.OAuthClientInfo{
+		ClientID:     client.ClientID,
+		Name:         client.Name,
+		RedirectURIs: client.RedirectURIs,
+		Public:       client.Public(),
+		CreatedAt:    client.CreatedAt,
+	}
+}
+
+type clientRequest struct {
+	Name         string   `json:"name" binding:"required"`
+	RedirectURIs []string `json:"redirectUris" binding:"required,min=1"`
+	Public       bool     `json:"public"`
+}
+
+// validRedirectURI accepts absolute https URIs, and http only for loopback
+// hosts used during development. Fragments are not allowed.
+func validRedirectURI(raw string) bool {
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" || u.Fragment != "" {
+		return false
+	}
+	switch u.Scheme {
+	case "https":
+		return true
+	case "http":
+		host := u.Hostname()
+		return host == "localhost" || host == "127.0.0.1" || host == "::1"
+	}
+	return false
+}
+
+// registerClient creates a client and returns its secret once
+func registerClient(c *gin.Context) {
+	var req clientRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Name and at least one redirect URI are required"})
+		return
+	}
+	for _, uri := range req.RedirectURIs {
+		if !validRedirectURI(uri) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid redirect URI: " + uri})
+			return
+		}
+	}
+
+	clientID, err := shared.NewTokenID()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not create client"})
+		return
+	}
+	client := &OAuthClient{
+		ClientID:     clientID,
+		Name:         strings.TrimSpace(req.Name),
+		RedirectURIs: req.RedirectURIs,
+		CreatedAt:    time.Now(),
+	}
+
+	var secret string
+	if !req.Public {
+		if secret, err = newOpaqueToken(); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not create client"})
+			return
+		}
+		client.SecretHash = hashToken(secret)
+	}
+
+	if err := clients.CreateClient(c.Request.Context(), client); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not create client"})
+		return
+	}
+
+	info := toClientInfo(client)
+	info.ClientSecret = secret
+	c.JSON(http.StatusCreated, info)
+}
+
+func listClients(c *gin.Context) {
+	records, err := clients.ListClients(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, shared.OAuthClientListResponse{Error: "Could not list clients"})
+		return
+	}
+
+	resp := shared.OAuthClientListResponse{Clients: make([]shared.OAuthClientInfo, 0, len(records))}
+	for _, client := range records {
+		resp.Clients = append(resp.Clients, toClientInfo(client))
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+func deleteClient(c *gin.Context) {
+	err := clients.DeleteClient(c.Request.Context(), c.Param("clientId"))
+	if errors.Is(err, ErrClientNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Client not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not delete client"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Client deleted"})
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"shared"
+)
+
+// Purposes of single-use action tokens
+const (
+	purposeVerifyEmail   = "verify_email"
+	purposeResetPassword = "reset_password"
+)
+
+// ErrActionTokenInvalid is returned for unknown, expired or already used action tokens
+var ErrActionTokenInvalid = errors.New("token is invalid or expired")
+
+// ActionToken is a single-use, expiring token mailed to a user. Only its
+// SHA-256 hash is stored.
+type ActionToken struct {
+	TokenHash string
+	Purpose   string
+	Username  string
+	Email     string // address the token was sent to
+	CreatedAt time.Time
+	ExpiresAt time.Time
+}
+
+// validateEmail returns a message describing why email is not acceptable, or ""
+func validateEmail(email string) string {
+	if strings.TrimSpace(email) == "" {
+		return "Email is required"
+	}
+	addr, err := mail.ParseAddress(email)
+	if err != nil || addr.Address != email || len(email) > 254 {
+		return "Email address is invalid"
+	}
+	return ""
+}
+
+// publicURL builds a link into the frontend served by the gateway
+func publicURL(path string, query url.Values) string {
+	return cfg.Auth.PublicBaseURL + path + "?" + query.Encode()
+}
+
+// issueActionToken invalidates earlier tokens of the same purpose and stores a new one
+func issueActionToken(ctx context.Context, user *UserRecord, purpose string, ttl time.Duration) (string, error) {
+	if err := tokens.DeleteActionTokens(ctx, user.Username, purpose); err != nil {
+		return "", err
+	}
+
+	token, err := newOpaqueToken()
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	err = tokens.SaveActionToken(ctx, &ActionToken{
+		TokenHash: hashToken(token),
+		Purpose:   purpose,
+		Username:  user.Username,
+		Email:     user.Email,
+		CreatedAt: now,
+		ExpiresAt: now.Add(ttl),
+	})
+	return token, err
+}
+
+// sendVerificationEmail mails a link that confirms the user's address
+func sendVerificationEmail(ctx context.Context, user *UserRecord) error {
+	ttl := cfg.Auth.Tokens.EmailVerificationTTL
+	token, err := issueActionToken(ctx, user, purposeVerifyEmail, ttl)
+	if err != nil {
+		return err
+	}
+
+	link := publicURL("/", url.Values{"verify_token": {token}})
+	return notifier.Send(ctx, Message{
+		To:      user.Email,
+		Subject: "Confirm your email address",
+		Body: fmt.Sprintf("Hello %s,\n\nPlease confirm your email address by opening this link:\n\n%s\n\n"+
+			"The link expires in %s. If you did not create an account, you can ignore this message.\n",
+			user.Username, link, ttl),
+	})
+}
+
+type tokenRequest struct {
+	Token string `json:"token" form:"token" binding:"required"`
+}
+
+// verifyEmail confirms the address a verification token was sent to. It
+// accepts the token in the query string so the mailed link works directly.
+func verifyEmail(c *gin.Context) {
+	var req tokenRequest
+	if err := c.ShouldBind(&req); err != nil {
+		c.JSON(http.StatusBadRequest, shared.AuthResponse{Error: "Token is required"})
+		return
+	}
+
+	ctx := c.Request.Context()
+	action, err := tokens.ConsumeActionToken(ctx, hashToken(req.Token), purposeVerifyEmail)
+	if errors.Is(err, ErrActionTokenInvalid) {
+		c.JSON(http.StatusBadRequest, shared.AuthResponse{Error: "Verification link is invalid or expired"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, shared.AuthResponse{Error: "Could not verify email"})
+		return
+	}
+
+	user, err := users.GetUser(ctx, action.Username)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, shared.AuthResponse{Error: "Verification link is invalid or expired"})
+		return
+	}
+	// The address may have changed after the link was sent
+	if !strings.EqualFold(user.Email, action.Email) {
+		c.JSON(http.StatusBadRequest, shared.AuthResponse{Error: "Verification link is invalid or expired"})
+		return
+	}
+
+	user.EmailVerified = true
+	if err := users.UpdateUser(ctx, user); err != nil {
+		c.JSON(http.StatusInternalServerError, shared.AuthResponse{Error: "Could not verify email"})
+		return
+	}
+
+	c.JSON(http.StatusOK, shared.AuthResponse{Username: user.Username, Message: "Email verified"})
+}
+
+// resendVerification mails a fresh verification link to the signed-in user
+func resendVerification(c *gin.Context) {
+	ctx := c.Request.Context()
+	user, err := users.GetUser(ctx, c.GetString(shared.ContextUsername))
+	if err != nil {
+		c.JSON(http.StatusNotFound, shared.AuthResponse{Error: "User not found"})
+		return
+	}
+	if user.EmailVerified {
+		c.JSON(http.StatusOK, shared.AuthResponse{Message: "Email already verified"})
+		return
+	}
+
+	if err := sendVerificationEmail(ctx, user); err != nil {
+		log.Printf("Failed to send verification email to %q: %v", user.Username, err)
+		c.JSON(http.StatusInternalServerError, shared.AuthResponse{Error: "Could not send verification email"})
+		return
+	}
+	c.JSON(http.StatusOK, shared.AuthResponse{Message: "Verification email sent"})
+}
+
+type forgotPasswordRequest struct {
+	Email    string `json:"email" form:"email"`
+	Username string `json:"username" form:"username"`
+}
+
+// forgotPassword mails a reset link. It responds the same way whether or not
+// the account exists so it cannot be used to discover registered addresses.
+func forgotPassword(c *gin.Context) {
+	var req forgotPasswordRequest
+	if err := c.ShouldBind(&req); err != nil || (req.Email == "" && req.Username == "") {
+		c.JSON(http.StatusBadRequest, shared.AuthResponse{Error: "Email or username is required"})
+		return
+	}
+
+	ctx := c.Request.Context()
+	var user *UserRecord
+	var err error
+	if req.Email != "" {
+		user, err = users.GetUserByEmail(ctx, req.Email)
+	} else {
+		user, err = users.GetUser(ctx, req.Username)
+	}
+
+	if err == nil && user.Email != "" && !user.Disabled {
+		if err := sendPasswordResetEmail(ctx, user); err != nil {
+			log.Printf("Failed to send password reset email to %q: %v", user.Username, err)
+		}
+	} else if err != nil && !errors.Is(err, ErrUserNotFound) {
+		log.Printf("Failed to look up account for password reset: %v", err)
+	}
+
+	c.JSON(http.StatusOK, shared.AuthResponse{
+		Message: "If the account exists, a password reset link has been sent to its email address",
+	})
+}
+
+func sendPasswordResetEmail(ctx context.Context, user *UserRecord) error {
+	ttl := cfg.Auth.Tokens.PasswordResetTTL
+	token, err := issueActionToken(ctx, user, purposeResetPassword, ttl)
+	if err != nil {
+		return err
+	}
+
+	link := publicURL("/", url.Values{"reset_token": {token}})
+	return notifier.Send(ctx, Message{
+		To:      user.Email,
+		Subject: "Reset your password",
+		Body: fmt.Sprintf("Hello %s,\n\nUse this link to choose a new password:\n\n%s\n\n"+
+			"The link can be used once and expires in %s. If you did not ask for a reset, you can ignore this message.\n",
+			user.Username, link, ttl),
+	})
+}
+
+type resetPasswordRequest struct {
+	Token    string `json:"token" form:"token" binding:"required"`
+	Password string `json:"password" form:"password" binding:"required"`
+}
+
+// resetPassword sets a new password with a single-use reset token and signs
+// the user out everywhere
+func resetPassword(c *gin.Context) {
+	var req resetPasswordRequest
+	if err := c.ShouldBind(&req); err != nil {
+		c.JSON(http.StatusBadRequest, shared.AuthResponse{Error: "Invalid request", FieldErrors: bindingFieldErrors(err)})
+		return
+	}
+
+	ctx := c.Request.Context()
+	action, err := tokens.ConsumeActionToken(ctx, hashToken(req.Token), purposeResetPassword)
+	if errors.Is(err, ErrActionTokenInvalid) {
+		c.JSON(http.StatusBadRequest, shared.AuthResponse{Error: "Reset link is invalid or expired"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, shared.AuthResponse{Error: "Could not reset password"})
+		return
+	}
+
+	user, err := users.GetUser(ctx, action.Username)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, shared.AuthResponse{Error: "Reset link is invalid or expired"})
+		return
+	}
+
+	if msg := registrationPolicy.validatePassword(user.Username, req.Password); msg != "" {
+		// Give the user another chance with a fresh link rather than burning it
+		if err := sendPasswordResetEmail(ctx, user); err != nil {
+			log.Printf("Failed to resend password reset email to %q: %v", user.Username, err)
+		}
+		c.JSON(http.StatusBadRequest, shared.AuthResponse{
+			Error:       "Validation failed; a new reset link has been sent",
+			FieldErrors: map[string]string{"password": msg},
+		})
+		return
+	}
+
+	hashedPassword, err := shared.HashPassword(req.Password)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, shared.AuthResponse{Error: "Could not hash password"})
+		return
+	}
+	user.PasswordHash = hashedPassword
+	// Receiving the link proves control of the address
+	if strings.EqualFold(user.Email, action.Email) {
+		user.EmailVerified = true
+	}
+	if err := users.UpdateUser(ctx, user); err != nil {
+		c.JSON(http.StatusInternalServerError, shared.AuthResponse{Error: "Could not reset password"})
+		return
+	}
+
+	recordAudit(c, auditPasswordReset, user.Username, outcomeSuccess, "")
+	if err := tokens.RevokeUserTokens(ctx, user.Username, ""); err != nil {
+		log.Printf("Failed to revoke tokens for %q after password reset: %v", user.Username, err)
+	}
+	if err := attempts.ResetAttempts(ctx, userAttemptKey(user.Username)); err != nil {
+		log.Printf("Failed to reset login failures for %q: %v", user.Username, err)
+	}
+
+	c.JSON(http.StatusOK, shared.AuthResponse{Username: user.Username, Message: "Password has been reset"})
+}
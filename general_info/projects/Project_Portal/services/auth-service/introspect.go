@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"shared"
+)
+
+var inactiveToken = &shared.IntrospectionResponse{Active: false}
+
+// introspect implements RFC 7662 token introspection for confidential
+// clients. Access tokens, API keys and refresh tokens are told apart by their
+// form, so token_type_hint is accepted but not needed.
+func introspect(c *gin.Context) {
+	c.Header("Cache-Control", "no-store")
+	c.Header("Pragma", "no-cache")
+
+	client, ok := requireClient(c)
+	if !ok {
+		return
+	}
+	if client.Public() {
+		tokenError(c, http.StatusUnauthorized, "invalid_client", "Public clients cannot introspect tokens")
+		return
+	}
+
+	token := c.PostForm("token")
+	if token == "" {
+		tokenError(c, http.StatusBadRequest, "invalid_request", "token is required")
+		return
+	}
+
+	var resp *shared.IntrospectionResponse
+	var err error
+	switch {
+	case shared.IsAPIKey(token):
+		resp, err = introspectAPIKey(c.Request.Context(), token)
+	case strings.Count(token, ".") == 2:
+		resp, err = introspectJWT(c.Request.Context(), token)
+	default:
+		resp, err = introspectRefreshToken(c.Request.Context(), token)
+	}
+	if err != nil {
+		tokenError(c, http.StatusInternalServerError, "server_error", "Could not introspect token")
+		return
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// activeAccount returns the token owner, or nil if the account was deleted or disabled
+func activeAccount(ctx context.Context, username string) (*UserRecord, error) {
+	user, err := users.GetUser(ctx, username)
+	if errors.Is(err, ErrUserNotFound) || (err == nil && user.Disabled) {
+		return nil, nil
+	}
+	return user, err
+}
+
+func introspectJWT(ctx context.Context, token string) (*shared.IntrospectionResponse, error) {
+	claims, err := shared.ValidateJWT(token)
+	if errors.Is(err, shared.ErrRevocationCheck) {
+		return nil, err
+	}
+	if err != nil {
+		return inactiveToken, nil
+	}
+	user, err := activeAccount(ctx, claims.Username)
+	if err != nil {
+		return nil, err
+	}
+	if user == nil {
+		return inactiveToken, nil
+	}
+
+	// Tokens issued to OpenID Connect clients carry OAuth scopes; Portal
+	// access tokens are scoped to their permissions
+	scope := claims.Scope
+	if scope == "" {
+		scope = strings.Join(claims.Permissions, " ")
+	}
+	resp := &shared.IntrospectionResponse{
+		Active:    true,
+		Scope:     scope,
+		ClientID:  claims.AuthorizedParty,
+		Username:  claims.Username,
+		TokenType: shared.TokenTypeBearer,
+		Sub:       claims.Username,
+		Aud:       claims.Audience,
+		Iss:       claims.Issuer,
+		Jti:       claims.ID,
+		Roles:     claims.Roles,
+		Tenant:    claims.Tenant,
+	}
+	if claims.ExpiresAt != nil {
+		resp.Exp = claims.ExpiresAt.Unix()
+	}
+	if claims.IssuedAt != nil {
+		resp.Iat = claims.IssuedAt.Unix()
+	}
+	return resp, nil
+}
+
+func introspectAPIKey(ctx context.Context, raw string) (*shared.IntrospectionResponse, error) {
+	key, scopes, err := resolveAPIKey(ctx, raw)
+	if errors.Is(err, ErrAPIKeyNotFound) || errors.Is(err, ErrAPIKeyExpired) {
+		return inactiveToken, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &shared.IntrospectionResponse{
+		Active:    true,
+		Scope:     strings.Join(scopes, " "),
+		Username:  key.Username,
+		TokenType: shared.TokenTypeBearer,
+		Iat:       key.CreatedAt.Unix(),
+		Sub:       key.Username,
+		Jti:       "key:" + key.ID,
+		Tenant:    key.Tenant,
+	}
+	if key.ExpiresAt != nil {
+		resp.Exp = key.ExpiresAt.Unix()
+	}
+	return resp, nil
+}
+
+func introspectRefreshToken(ctx context.Context, token string) (*shared.IntrospectionResponse, error) {
+	refresh, err := tokens.GetRefreshToken(ctx, hashToken(token))
+	if errors.Is(err, ErrRefreshTokenInvalid) {
+		return inactiveToken, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	user, err := activeAccount(ctx, refresh.Username)
+	if err != nil {
+		return nil, err
+	}
+	if user == nil {
+		return inactiveToken, nil
+	}
+	// A refresh issues tokens for the account's current organization
+	tenant, orgRoles, err := tenantAccess(ctx, user)
+	if err != nil {
+		return nil, err
+	}
+
+	return &shared.IntrospectionResponse{
+		Active:    true,
+		Scope:     strings.Join(shared.PermissionsForMember(user.Roles, orgRoles), " "),
+		Username:  user.Username,
+		TokenType: shared.TokenTypeRefresh,
+		Exp:       refresh.ExpiresAt.Unix(),
+		Iat:       refresh.CreatedAt.Unix(),
+		Sub:       user.Username,
+		Roles:     user.Roles,
+		Tenant:    tenant,
+	}, nil
+}
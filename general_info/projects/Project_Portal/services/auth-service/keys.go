@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"shared"
+)
+
+// SigningKeyRecord is a stored JWT signing key. PrivateKey holds the PKCS #8
+// DER encoding, so access to the backing store must be restricted.
+type SigningKeyRecord struct {
+	ID         string
+	Algorithm  string
+	PrivateKey []byte
+	CreatedAt  time.Time
+}
+
+// KeyStore persists signing keys so that all replicas sign with, and publish,
+// the same key set
+type KeyStore interface {
+	SaveSigningKey(ctx context.Context, key *SigningKeyRecord) error
+	// ListSigningKeys returns all keys, newest first
+	ListSigningKeys(ctx context.Context) ([]*SigningKeyRecord, error)
+	DeleteSigningKeysBefore(ctx context.Context, cutoff time.Time) error
+}
+
+type loadedKey struct {
+	id        string
+	alg       string
+	signer    crypto.Signer
+	createdAt time.Time
+}
+
+// keyring signs tokens with the newest key and rotates it on a schedule.
+// Retired keys stay published until every token they signed has expired.
+type keyring struct {
+	store     KeyStore
+	alg       string
+	rotation  time.Duration
+	retention time.Duration
+
+	mu   sync.RWMutex
+	keys []loadedKey // newest first
+}
+
+func newKeyring(store KeyStore) *keyring {
+	rotation := cfg.Auth.Tokens.KeyRotation
+	return &keyring{
+		store:    store,
+		alg:      shared.SigningAlgorithm(),
+		rotation: rotation,
+		// a key signs for one rotation period and its tokens live for one TTL
+		retention: rotation + shared.AccessTokenTTL() + 5*time.Minute,
+	}
+}
+
+// run rotates and reloads keys until ctx is cancelled. Reloading picks up
+// keys created by other replicas.
+func (k *keyring) run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := k.rotate(ctx); err != nil {
+				log.Printf("Signing key rotation failed: %v", err)
+			}
+		}
+	}
+}
+
+// rotate creates a new signing key when the newest one is older than the
+// rotation period (or uses another algorithm) and drops retired keys
+func (k *keyring) rotate(ctx context.Context) error {
+	if err := k.reload(ctx); err != nil {
+		return err
+	}
+
+	k.mu.RLock()
+	needsKey := true
+	if len(k.keys) > 0 {
+		newest := k.keys[0]
+		needsKey = newest.alg != k.alg || time.Since(newest.createdAt) >= k.rotation
+	}
+	k.mu.RUnlock()
+
+	if needsKey {
+		record, err := generateSigningKey(k.alg)
+		if err != nil {
+			return err
+		}
+		if err := k.store.SaveSigningKey(ctx, record); err != nil {
+			return err
+		}
+		log.Printf("Created %s signing key %s", record.Algorithm, record.ID)
+	}
+
+	if err := k.store.DeleteSigningKeysBefore(ctx, time.Now().Add(-k.retention)); err != nil {
+		return err
+	}
+	return k.reload(ctx)
+}
+
+// reload replaces the cached keys with the contents of the store
+func (k *keyring) reload(ctx context.Context) error {
+	records, err := k.store.ListSigningKeys(ctx)
+	if err != nil {
+		return err
+	}
+
+	keys := make([]loadedKey, 0, len(records))
+	for _, record := range records {
+		parsed, err := x509.ParsePKCS8PrivateKey(record.PrivateKey)
+		if err != nil {
+			log.Printf("Skipping unreadable signing key %s: %v", record.ID, err)
+			continue
+		}
+		signer, ok := parsed.(crypto.Signer)
+		if !ok {
+			continue
+		}
+		keys = append(keys, loadedKey{id: record.ID, alg: record.Algorithm, signer: signer, createdAt: record.CreatedAt})
+	}
+
+	k.mu.Lock()
+	k.keys = keys
+	k.mu.Unlock()
+	return nil
+}
+
+// SigningKey implements shared.Signer with the newest key of the configured algorithm
+func (k *keyring) SigningKey(ctx context.Context) (*shared.SigningKey, error) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	for _, key := range k.keys {
+		if key.alg == k.alg {
+			return &shared.SigningKey{ID: key.id, Algorithm: key.alg, Key: key.signer}, nil
+		}
+	}
+	return nil, fmt.Errorf("no %s signing key available", k.alg)
+}
+
+// PublicKey implements shared.KeySet so the auth service validates tokens
+// without fetching its own JWKS over HTTP
+func (k *keyring) PublicKey(ctx context.Context, kid string) (string, crypto.PublicKey, error) {
+	if alg, pub, ok := k.lookup(kid); ok {
+		return alg, pub, nil
+	}
+
+	// The key may have been created by another replica since the last reload
+	if err := k.reload(ctx); err != nil {
+		return "", nil, err
+	}
+	if alg, pub, ok := k.lookup(kid); ok {
+		return alg, pub, nil
+	}
+	return "", nil, shared.ErrUnknownKeyID
+}
+
+func (k *keyring) lookup(kid string) (string, crypto.PublicKey, bool) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	for _, key := range k.keys {
+		if key.id == kid {
+			return key.alg, key.signer.Public(), true
+		}
+	}
+	return "", nil, false
+}
+
+// jwks returns the public keys of all unretired signing keys
+func (k *keyring) jwks() shared.JSONWebKeySet {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	set := shared.JSONWebKeySet{Keys: []shared.JSONWebKey{}}
+	for _, key := range k.keys {
+		jwk, err := shared.NewJSONWebKey(key.id, key.alg, key.signer.Public())
+		if err != nil {
+			continue
+		}
+		set.Keys = append(set.Keys, jwk)
+	}
+	return set
+}
+
+// generateSigningKey creates a new RS256 or EdDSA key with a random kid
+func generateSigningKey(alg string) (*SigningKeyRecord, error) {
+	var private crypto.Signer
+	var err error
+	switch alg {
+	case "RS256":
+		private, err = rsa.GenerateKey(rand.Reader, 2048)
+	case "EdDSA":
+		_, private, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		return nil, fmt.Errorf("cannot generate key for algorithm %q", alg)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		return nil, err
+	}
+
+	kid, err := shared.NewTokenID()
+	if err != nil {
+		return nil, err
+	}
+
+	return &SigningKeyRecord{ID: kid, Algorithm: alg, PrivateKey: der, CreatedAt: time.Now()}, nil
+}
+
+// jwks publishes the verification keys at /.well-known/jwks.json
+func jwks(c *gin.Context) {
+	set := shared.JSONWebKeySet{Keys: []shared.JSONWebKey{}}
+	if signingKeys != nil {
+		set = signingKeys.jwks()
+	}
+
+	c.Header("Cache-Control", "public, max-age=300")
+	c.JSON(http.StatusOK, set)
+}
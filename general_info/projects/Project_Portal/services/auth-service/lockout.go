@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"shared"
+	"shared/config"
+)
+
+// AttemptStore records failed logins per key ("user:<name>" or "ip:<addr>").
+// It is shared by all replicas so an attacker cannot spread guesses across pods.
+type AttemptStore interface {
+	// RecordFailure adds a failed attempt and forgets attempts older than retainSince
+	RecordFailure(ctx context.Context, key string, at, retainSince time.Time) error
+	// Failures counts attempts since the given time and returns the latest one
+	Failures(ctx context.Context, key string, since time.Time) (count int, last time.Time, err error)
+	LockUntil(ctx context.Context, key string, until time.Time) error
+	// LockedUntil returns the end of the key's lockout, or the zero time
+	LockedUntil(ctx context.Context, key string) (time.Time, error)
+	// ResetAttempts clears failures and any lockout for key
+	ResetAttempts(ctx context.Context, key string) error
+}
+
+// loginPolicy controls throttling: after delayAfter failures within window
+// each further attempt must wait an exponentially growing delay, and after
+// lockoutAfter failures the key is locked for lockout
+type loginPolicy struct {
+	window         time.Duration
+	delayAfter     int
+	lockoutAfter   int
+	ipLockoutAfter int
+	baseDelay      time.Duration
+	maxDelay       time.Duration
+	lockout        time.Duration
+}
+
+func loadLoginPolicy(c config.LoginConfig) loginPolicy {
+	return loginPolicy{
+		window:         c.FailureWindow,
+		delayAfter:     c.DelayAfter,
+		lockoutAfter:   c.LockoutAfter,
+		ipLockoutAfter: c.IPLockoutAfter,
+		baseDelay:      time.Second,
+		maxDelay:       30 * time.Second,
+		lockout:        c.LockoutDuration,
+	}
+}
+
+func userAttemptKey(username string) string { return "user:" + username }
+func ipAttemptKey(ip string) string         { return "ip:" + ip }
+
+// retryAfter returns how long key must wait before its next attempt
+func (p loginPolicy) retryAfter(ctx context.Context, key string) (time.Duration, error) {
+	now := time.Now()
+
+	lockedUntil, err := attempts.LockedUntil(ctx, key)
+	if err != nil {
+		return 0, err
+	}
+	if lockedUntil.After(now) {
+		return lockedUntil.Sub(now), nil
+	}
+
+	count, last, err := attempts.Failures(ctx, key, now.Add(-p.window))
+	if err != nil || count < p.delayAfter {
+		return 0, err
+	}
+
+	delay := p.baseDelay * time.Duration(math.Pow(2, float64(count-p.delayAfter)))
+	if delay > p.maxDelay || delay <= 0 {
+		delay = p.maxDelay
+	}
+	if wait := last.Add(delay).Sub(now); wait > 0 {
+		return wait, nil
+	}
+	return 0, nil
+}
+
+// recordFailure counts a failed attempt and locks the key once it crosses
+// limit. It reports whether the key was locked.
+func (p loginPolicy) recordFailure(ctx context.Context, key string, limit int) (bool, error) {
+	now := time.Now()
+	if err := attempts.RecordFailure(ctx, key, now, now.Add(-p.window)); err != nil {
+		return false, err
+	}
+
+	count, _, err := attempts.Failures(ctx, key, now.Add(-p.window))
+	if err != nil {
+		return false, err
+	}
+	if count >= limit {
+		log.Printf("Locking %s after %d failed logins", key, count)
+		return true, attempts.LockUntil(ctx, key, now.Add(p.lockout))
+	}
+	return false, nil
+}
+
+// checkLoginThrottle rejects the request with 429 and Retry-After when the
+// username or client IP must wait. It returns false if a response was written.
+func checkLoginThrottle(c *gin.Context, username string) bool {
+	ctx := c.Request.Context()
+
+	var wait time.Duration
+	for _, key := range []string{userAttemptKey(username), ipAttemptKey(c.ClientIP())} {
+		w, err := loginLimits.retryAfter(ctx, key)
+		if err != nil {
+			respondAuth(c, http.StatusInternalServerError, shared.AuthResponse{Error: "Could not check login attempts"})
+			return false
+		}
+		if w > wait {
+			wait = w
+		}
+	}
+
+	if wait > 0 {
+		c.Header("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		respondAuth(c, http.StatusTooManyRequests, shared.AuthResponse{
+			Error: fmt.Sprintf("Too many failed attempts, try again in %s", wait.Round(time.Second)),
+		})
+		return false
+	}
+	return true
+}
+
+// recordLoginFailure counts a failed attempt against the username and client IP
+func recordLoginFailure(c *gin.Context, username string) {
+	ctx := c.Request.Context()
+	locked, err := loginLimits.recordFailure(ctx, userAttemptKey(username), loginLimits.lockoutAfter)
+	if err != nil {
+		log.Printf("Failed to record login failure for %q: %v", username, err)
+	}
+	if locked {
+		recordAudit(c, auditLockout, username, outcomeSuccess, "account locked for "+loginLimits.lockout.String())
+	}
+
+	locked, err = loginLimits.recordFailure(ctx, ipAttemptKey(c.ClientIP()), loginLimits.ipLockoutAfter)
+	if err != nil {
+		log.Printf("Failed to record login failure for %s: %v", c.ClientIP(), err)
+	}
+	if locked {
+		recordAudit(c, auditLockout, username, outcomeSuccess, "client IP locked for "+loginLimits.lockout.String())
+	}
+}
+
+// recordLoginSuccess clears the username's failures. The IP counter is kept
+// so that logging into one's own account cannot reset a guessing campaign.
+func recordLoginSuccess(c *gin.Context, username string) {
+	if err := attempts.ResetAttempts(c.Request.Context(), userAttemptKey(username)); err != nil {
+		log.Printf("Failed to reset login failures for %q: %v", username, err)
+	}
+}
+
+// unlockUser clears the lockout and failure count of an account
+func unlockUser(c *gin.Context) {
+	username := c.Param("username")
+	if err := attempts.ResetAttempts(c.Request.Context(), userAttemptKey(username)); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not unlock user"})
+		return
+	}
+	recordAudit(c, auditUnlock, username, outcomeSuccess, "by "+c.GetString(shared.ContextUsername))
+	c.JSON(http.StatusOK, gin.H{"message": "User unlocked", "username": username})
+}
@@ -1,130 +1,376 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
 	"net/http"
+	"time"
 
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
 	"shared"
+	"shared/config"
 )
 
-var users = make(map[string]string) // username -> hashed password
+var (
+	cfg *config.Config
+
+	users    UserStore
+	tokens   TokenStore
+	keyStore KeyStore
+	attempts AttemptStore
+	clients  ClientStore
+	apiKeys  APIKeyStore
+	auditLog AuditStore
+	orgs     OrgStore
+
+	notifier Notifier
+
+	loginLimits        loginPolicy
+	registrationPolicy passwordPolicy
+
+	signingKeys *keyring // nil when signing with the HS256 development secret
+)
 
 func main() {
+	defaults := config.Default(":8082")
+	defaults.HTTP.TrustedProxies = []string{"127.0.0.1", "::1"}
+	cfg = config.MustLoad("auth-service", defaults, &defaults.Auth)
+
+	if err := openStores(cfg.Auth.Store); err != nil {
+		log.Fatal("Failed to initialize stores:", err)
+	}
+	shared.SetDenyList(tokens)
+	if !shared.HasServiceToken() {
+		log.Println("SERVICE_TOKEN is not set; internal routes answer any caller")
+	}
+
+	if shared.SigningAlgorithm() != "HS256" {
+		signingKeys = newKeyring(keyStore)
+		if err := signingKeys.rotate(context.Background()); err != nil {
+			log.Fatal("Failed to initialize signing keys:", err)
+		}
+		shared.SetSigner(signingKeys)
+		shared.SetKeySet(signingKeys)
+		go signingKeys.run(context.Background(), time.Minute)
+	}
+
+	var err error
+	if notifier, err = newNotifier(cfg.Auth.Notifier); err != nil {
+		log.Fatal("Failed to initialize notifier:", err)
+	}
+
+	loginLimits = loadLoginPolicy(cfg.Auth.Login)
+	registrationPolicy = loadPasswordPolicy(cfg.Auth.Passwords)
+	shared.SetArgon2Params(argon2Params(cfg.Auth.Passwords))
+	dummyPasswordHash, _ = shared.HashPassword("dummy-password")
+	if len(cfg.Auth.AdminUsers) > 0 {
+		log.Println("ADMIN_USERS is no longer supported; grant the first admin with ADMIN_BOOTSTRAP_TOKEN")
+	}
+
 	r := gin.Default()
 
+	// Login throttling is keyed by client IP, so only trust forwarded
+	// addresses from the gateway
+	if err := r.SetTrustedProxies(cfg.HTTP.TrustedProxies); err != nil {
+		log.Fatal("Invalid TRUSTED_PROXIES:", err)
+	}
+
 	// Configure CORS
-	config := cors.DefaultConfig()
-	config.AllowOrigins = []string{"*"}
-	config.AllowHeaders = []string{"Origin", "Content-Length", "Content-Type", "Authorization"}
-	config.AllowCredentials = true
-	r.Use(cors.New(config))
+	corsConfig := cors.DefaultConfig()
+	corsConfig.AllowOrigins = cfg.CORS.AllowOrigins
+	corsConfig.AllowHeaders = []string{"Origin", "Content-Length", "Content-Type", "Authorization"}
+	corsConfig.AllowCredentials = cfg.CORS.AllowCredentials
+	r.Use(cors.New(corsConfig))
+
+	// Probes; the service is ready when the user store answers
+	health := shared.NewHealth(2 * time.Second)
+	health.AddCheck("users", users.Ping)
+	r.GET("/healthz", health.Live)
+	r.GET("/readyz", health.Ready)
+
+	// Verification keys for other services
+	r.GET("/.well-known/jwks.json", jwks)
+
+	// OpenID Connect provider
+	r.GET("/.well-known/openid-configuration", openIDConfiguration)
+	r.GET("/oauth/authorize", authorizeInfo)
+	r.POST("/oauth/authorize", shared.RequirePermission(shared.PermProfileRead), authorize)
+	r.POST("/oauth/token", oauthToken)
+	r.GET("/oauth/userinfo", userinfo)
+	r.POST("/oauth/userinfo", userinfo)
+	r.POST("/introspect", introspect)
 
 	// Auth routes
 	r.POST("/register", register)
 	r.POST("/login", login)
-	r.POST("/register-form", registerForm)
-	r.POST("/login-form", loginForm)
+	r.POST("/refresh", refresh)
+	r.POST("/logout", logout)
 
-	r.Run(":8082") // Auth service on port 8082
-}
+	// Email verification and password reset
+	r.GET("/verify-email", verifyEmail)
+	r.POST("/verify-email", verifyEmail)
+	r.POST("/resend-verification", shared.AuthMiddleware(), resendVerification)
+	r.POST("/forgot-password", forgotPassword)
+	r.POST("/reset-password", resetPassword)
 
-func register(c *gin.Context) {
-	var user shared.User
-	if err := c.ShouldBindJSON(&user); err != nil {
-		c.JSON(http.StatusBadRequest, shared.AuthResponse{Error: err.Error()})
-		return
+	// Sessions; /tokens/status is for other services, which present the
+	// service token, and is not exposed through the gateway
+	sessions := r.Group("/sessions", shared.AuthMiddleware())
+	{
+		sessions.GET("", listSessions)
+		sessions.DELETE("", revokeAllSessions)
+		sessions.DELETE("/:id", revokeSession)
 	}
+	r.POST("/tokens/status", shared.RequireServiceToken(), tokenStatus)
 
-	// Check if user already exists
-	if _, exists := users[user.Username]; exists {
-		c.JSON(http.StatusConflict, shared.AuthResponse{Error: "User already exists"})
-		return
+	// Account self-service; /profiles/:username is for other services, which
+	// present the service token, and is not exposed through the gateway
+	account := r.Group("/account", shared.AuthMiddleware())
+	{
+		account.GET("", getAccount)
+		account.PATCH("", updateAccount)
+		account.DELETE("", deleteAccount)
+		account.POST("/password", changePassword)
+	}
+	r.GET("/profiles/:username", shared.RequireServiceToken(), profileForService)
+
+	// API keys for scripts; /api-keys/verify is for other services, which
+	// present the service token, and is not exposed through the gateway
+	keys := r.Group("/api-keys")
+	{
+		keys.GET("", shared.AuthMiddleware(), listAPIKeys)
+		keys.POST("", shared.AuthMiddleware(), createAPIKey)
+		keys.DELETE("/:id", shared.AuthMiddleware(), revokeAPIKey)
+		keys.POST("/verify", shared.RequireServiceToken(), verifyAPIKey)
+	}
+
+	// Organizations the user belongs to
+	orgRoutes := r.Group("/orgs", shared.AuthMiddleware())
+	{
+		orgRoutes.GET("", listMyOrgs)
+		orgRoutes.POST("/switch", switchOrg)
+		orgRoutes.GET("/:id/members", listOrgMembers)
+		orgRoutes.PUT("/:id/members/:username", saveOrgMember)
+		orgRoutes.DELETE("/:id/members/:username", removeOrgMember)
 	}
 
-	// Hash password
-	hashedPassword := shared.HashPassword(user.Password)
-	users[user.Username] = hashedPassword
+	// Two-factor authentication
+	r.POST("/login/mfa", loginMFA)
+	mfa := r.Group("/mfa", shared.AuthMiddleware())
+	{
+		mfa.POST("/enroll", enrollMFA)
+		mfa.POST("/confirm", confirmMFA)
+		mfa.POST("/recovery-codes", regenerateRecoveryCodes)
+		mfa.POST("/disable", disableMFA)
+	}
 
-	c.JSON(http.StatusCreated, shared.AuthResponse{Message: "User registered successfully"})
+	// Admin routes
+	admin := r.Group("/admin")
+	{
+		admin.POST("/bootstrap", shared.AuthMiddleware(), bootstrapAdmin)
+		admin.GET("/users", shared.RequirePermission(shared.PermUsersRead), listUsers)
+		admin.POST("/users/:username/roles", shared.RequirePermission(shared.PermRolesWrite), grantRole)
+		admin.DELETE("/users/:username/roles/:role", shared.RequirePermission(shared.PermRolesWrite), revokeRole)
+		admin.POST("/users/:username/disable", shared.RequirePermission(shared.PermUsersWrite), disableUser)
+		admin.POST("/users/:username/enable", shared.RequirePermission(shared.PermUsersWrite), enableUser)
+		admin.POST("/users/:username/unlock", shared.RequirePermission(shared.PermUsersWrite), unlockUser)
+		admin.GET("/clients", shared.RequirePermission(shared.PermClientsWrite), listClients)
+		admin.POST("/clients", shared.RequirePermission(shared.PermClientsWrite), registerClient)
+		admin.DELETE("/clients/:clientId", shared.RequirePermission(shared.PermClientsWrite), deleteClient)
+		admin.GET("/audit", shared.RequirePermission(shared.PermAuditRead), listAuditEvents)
+		admin.GET("/audit/export", shared.RequirePermission(shared.PermAuditRead), exportAuditEvents)
+		admin.GET("/orgs", shared.RequirePermission(shared.PermOrgsWrite), listOrgs)
+		admin.POST("/orgs", shared.RequirePermission(shared.PermOrgsWrite), createOrg)
+	}
+
+	// Auth service on port 8082 by default
+	if err := shared.Serve(cfg.HTTP.Addr, r, health, cfg.HTTP.ShutdownDelay, cfg.HTTP.DrainTimeout); err != nil {
+		log.Fatal("Server failed:", err)
+	}
 }
 
-func registerForm(c *gin.Context) {
-	username := c.PostForm("username")
-	password := c.PostForm("password")
+// dummyPasswordHash is verified for unknown usernames so that login takes the
+// same time whether or not the account exists. It is made with the
+// configured cost at startup.
+var dummyPasswordHash string
+
+// authenticate checks the password for username and returns the account, or
+// nil if the credentials are wrong. A legacy or outdated hash is transparently
+// replaced with one using the current algorithm and cost.
+func authenticate(ctx context.Context, username, password string) (*UserRecord, error) {
+	stored, err := users.GetUser(ctx, username)
+	if errors.Is(err, ErrUserNotFound) {
+		shared.VerifyPassword(dummyPasswordHash, password)
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
 
-	if username == "" || password == "" {
-		c.JSON(http.StatusBadRequest, shared.AuthResponse{Error: "Username and password are required"})
+	match, needsRehash, err := shared.VerifyPassword(stored.PasswordHash, password)
+	if err != nil {
+		log.Printf("Unreadable password hash for %q: %v", username, err)
+		return nil, nil
+	}
+	if !match {
+		return nil, nil
+	}
+
+	// Only the hash is written, and only if it is unchanged, so the upgrade
+	// cannot undo a concurrent password change or other account update
+	if needsRehash {
+		if upgraded, err := shared.HashPassword(password); err == nil {
+			updated, err := users.UpdatePasswordHash(ctx, username, stored.PasswordHash, upgraded)
+			if err != nil {
+				log.Printf("Failed to upgrade password hash for %q: %v", username, err)
+			} else if updated {
+				stored.PasswordHash = upgraded
+			}
+		}
+	}
+	return stored, nil
+}
+
+// register creates an account from a JSON or form body
+func register(c *gin.Context) {
+	var user shared.User
+	if err := c.ShouldBind(&user); err != nil {
+		respondAuth(c, http.StatusBadRequest, shared.AuthResponse{Error: "Invalid request", FieldErrors: bindingFieldErrors(err)})
 		return
 	}
 
-	// Check if user already exists
-	if _, exists := users[username]; exists {
-		c.JSON(http.StatusConflict, shared.AuthResponse{Error: "User already exists"})
+	if fieldErrors := registrationPolicy.validateRegistration(user.Username, user.Email, user.Password); fieldErrors != nil {
+		recordAudit(c, auditRegister, user.Username, outcomeFailure, "validation failed")
+		respondAuth(c, http.StatusBadRequest, shared.AuthResponse{Error: "Validation failed", FieldErrors: fieldErrors})
+		return
+	}
+
+	// Hash password and create the user; the store rejects duplicate usernames
+	hashedPassword, err := shared.HashPassword(user.Password)
+	if err != nil {
+		respondAuth(c, http.StatusInternalServerError, shared.AuthResponse{Error: "Could not hash password"})
+		return
+	}
+	account := &UserRecord{
+		Username:     user.Username,
+		PasswordHash: hashedPassword,
+		Email:        user.Email,
+		Roles:        []string{shared.RoleUser},
+		CreatedAt:    time.Now(),
+	}
+	err = users.CreateUser(c.Request.Context(), account)
+	if errors.Is(err, ErrUserExists) {
+		recordAudit(c, auditRegister, user.Username, outcomeFailure, "username taken")
+		respondAuth(c, http.StatusConflict, shared.AuthResponse{Error: "User already exists"})
+		return
+	}
+	if errors.Is(err, ErrEmailExists) {
+		recordAudit(c, auditRegister, user.Username, outcomeFailure, "email in use")
+		respondAuth(c, http.StatusConflict, shared.AuthResponse{
+			Error:       "Email already in use",
+			FieldErrors: map[string]string{"email": "An account with this email already exists"},
+		})
+		return
+	}
+	if err != nil {
+		respondAuth(c, http.StatusInternalServerError, shared.AuthResponse{Error: "Could not create user"})
 		return
 	}
 
-	// Hash password
-	hashedPassword := shared.HashPassword(password)
-	users[username] = hashedPassword
+	recordAudit(c, auditRegister, account.Username, outcomeSuccess, "")
+
+	// The account is usable without verification unless REQUIRE_VERIFIED_EMAIL
+	// is set, so a delivery failure only needs logging
+	if err := sendVerificationEmail(c.Request.Context(), account); err != nil {
+		log.Printf("Failed to send verification email to %q: %v", account.Username, err)
+	}
 
-	c.JSON(http.StatusCreated, shared.AuthResponse{Message: "User registered successfully"})
+	respondAuth(c, http.StatusCreated, shared.AuthResponse{Message: "User registered successfully. Check your email to verify your address."})
 }
 
+// login checks a username and password from a JSON or form body
 func login(c *gin.Context) {
 	var user shared.User
-	if err := c.ShouldBindJSON(&user); err != nil {
-		c.JSON(http.StatusBadRequest, shared.AuthResponse{Error: err.Error()})
+	if err := c.ShouldBind(&user); err != nil {
+		respondAuth(c, http.StatusBadRequest, shared.AuthResponse{Error: "Username and password are required"})
 		return
 	}
 
-	// Check if user exists and password is correct
-	hashedPassword, exists := users[user.Username]
-	if !exists || hashedPassword != shared.HashPassword(user.Password) {
-		c.JSON(http.StatusUnauthorized, shared.AuthResponse{Error: "Invalid credentials"})
+	if !checkLoginThrottle(c, user.Username) {
 		return
 	}
 
-	// Generate JWT token
-	token, err := shared.GenerateJWT(user.Username)
+	// Check if user exists and password is correct
+	account, err := authenticate(c.Request.Context(), user.Username, user.Password)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, shared.AuthResponse{Error: "Could not generate token"})
+		respondAuth(c, http.StatusInternalServerError, shared.AuthResponse{Error: "Could not look up user"})
+		return
+	}
+	if account == nil {
+		recordAudit(c, auditLogin, user.Username, outcomeFailure, "invalid credentials")
+		recordLoginFailure(c, user.Username)
+		respondAuth(c, http.StatusUnauthorized, shared.AuthResponse{Error: "Invalid credentials"})
 		return
 	}
 
-	c.JSON(http.StatusOK, shared.AuthResponse{
-		Token:    token,
-		Username: user.Username,
-		Message:  "Login successful",
-	})
+	// With a second factor the password alone neither clears failed attempts
+	// nor starts a session
+	if account.TOTPEnabled {
+		beginMFAChallenge(c, account)
+		return
+	}
+	recordLoginSuccess(c, user.Username)
+	completeLogin(c, account, "password")
 }
 
-func loginForm(c *gin.Context) {
-	username := c.PostForm("username")
-	password := c.PostForm("password")
-
-	if username == "" || password == "" {
-		c.JSON(http.StatusBadRequest, shared.AuthResponse{Error: "Username and password are required"})
+// completeLogin starts a new session for an authenticated account. method
+// names the factors that were checked, for the audit log.
+func completeLogin(c *gin.Context, account *UserRecord, method string) {
+	if account.Disabled {
+		recordAudit(c, auditLogin, account.Username, outcomeFailure, "account disabled")
+		respondAuth(c, http.StatusForbidden, shared.AuthResponse{Error: "Account disabled"})
 		return
 	}
-
-	// Check if user exists and password is correct
-	hashedPassword, exists := users[username]
-	if !exists || hashedPassword != shared.HashPassword(password) {
-		c.JSON(http.StatusUnauthorized, shared.AuthResponse{Error: "Invalid credentials"})
+	if cfg.Auth.RequireVerifiedEmail && !account.EmailVerified {
+		recordAudit(c, auditLogin, account.Username, outcomeFailure, "email not verified")
+		respondAuth(c, http.StatusForbidden, shared.AuthResponse{Error: "Email address not verified"})
 		return
 	}
 
-	// Generate JWT token
-	token, err := shared.GenerateJWT(username)
+	// Generate access and refresh tokens for a new token family
+	resp, err := issueTokens(c, account, "")
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, shared.AuthResponse{Error: "Could not generate token"})
+		respondAuth(c, http.StatusInternalServerError, shared.AuthResponse{Error: "Could not generate token"})
 		return
 	}
 
-	c.JSON(http.StatusOK, shared.AuthResponse{
-		Token:    token,
-		Username: username,
-		Message:  "Login successful",
-	})
-}
\ No newline at end of file
+	recordAudit(c, auditLogin, account.Username, outcomeSuccess, method)
+	resp.Message = "Login successful"
+	respondAuth(c, http.StatusOK, resp)
+}
+
+// respondAuth answers the login and registration endpoints with JSON, or
+// with the auth-response fragment for htmx. The page also needs the tokens
+// and MFA challenge, which htmx receives as HX-Trigger events.
+func respondAuth(c *gin.Context, status int, resp shared.AuthResponse) {
+	if shared.IsHTMX(c) {
+		var event string
+		switch {
+		case resp.Token != "":
+			event = "loggedIn"
+		case resp.MFARequired:
+			event = "mfaRequired"
+		case status == http.StatusCreated:
+			event = "registered"
+		}
+		if event != "" {
+			if trigger, err := json.Marshal(map[string]shared.AuthResponse{event: resp}); err == nil {
+				c.Header("HX-Trigger", string(trigger))
+			}
+		}
+	}
+	shared.Negotiate(c, status, "auth-response", resp)
+}
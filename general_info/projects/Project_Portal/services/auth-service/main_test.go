@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"shared"
+	"shared/config"
+)
+
+// setupTest gives each test fresh memory stores, HS256 tokens and a cheap
+// password hash
+func setupTest(t *testing.T) {
+	t.Helper()
+	defaults := config.Default(":8082")
+	defaults.Mode = gin.TestMode
+	defaults.JWT.SigningAlg = "HS256"
+	defaults.JWT.Secret = "test-secret-0123456789abcdef0123456789"
+	cfg = defaults
+	cfg.Apply()
+	if err := openStores(cfg.Auth.Store); err != nil {
+		t.Fatal(err)
+	}
+	shared.SetDenyList(tokens)
+	params := shared.DefaultArgon2Params
+	params.Memory, params.Iterations, params.Parallelism = 64, 1, 1
+	shared.SetArgon2Params(params)
+	t.Cleanup(func() {
+		shared.SetDenyList(nil)
+		shared.SetArgon2Params(shared.DefaultArgon2Params)
+	})
+}
+
+// createTestUser stores an account with the given password
+func createTestUser(t *testing.T, username, password string) *UserRecord {
+	t.Helper()
+	hash, err := shared.HashPassword(password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := &UserRecord{
+		Username:     username,
+		PasswordHash: hash,
+		Email:        username + "@example.com",
+		Roles:        []string{"user"},
+		CreatedAt:    time.Now(),
+	}
+	if err := users.CreateUser(context.Background(), user); err != nil {
+		t.Fatal(err)
+	}
+	return user
+}
+
+// testContext returns a gin context for calling helpers that need a request
+func testContext() *gin.Context {
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest(http.MethodPost, "/", nil)
+	return c
+}
+
+// serve runs handler for one request with a JSON or form body and decodes
+// the JSON answer into out
+func serve(t *testing.T, handler gin.HandlerFunc, method, target string, body any, out any) int {
+	t.Helper()
+	r := gin.New()
+	r.Handle(method, strings.SplitN(target, "?", 2)[0], handler)
+
+	var req *http.Request
+	switch body := body.(type) {
+	case nil:
+		req = httptest.NewRequest(method, target, nil)
+	case url.Values:
+		req = httptest.NewRequest(method, target, strings.NewReader(body.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	default:
+		data, err := json.Marshal(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req = httptest.NewRequest(method, target, strings.NewReader(string(data)))
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set("Accept", "application/json")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if out != nil {
+		if err := json.Unmarshal(w.Body.Bytes(), out); err != nil {
+			t.Fatalf("%s %s: decode %q: %v", method, target, w.Body.String(), err)
+		}
+	}
+	return w.Code
+}
@@ -0,0 +1,397 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/skip2/go-qrcode"
+	"shared"
+)
+
+// RFC 6238 parameters understood by common authenticator apps
+const (
+	totpPeriod = 30
+	totpDigits = 6
+	totpSkew   = 1 // steps accepted either side of now to allow for clock drift
+
+	purposeMFAChallenge = "mfa_challenge"
+	recoveryCodeCount   = 10
+)
+
+var base32NoPadding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// newTOTPSecret returns a random 160-bit secret in base32
+func newTOTPSecret() (string, error) {
+	secret := make([]byte, 20)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return base32NoPadding.EncodeToString(secret), nil
+}
+
+// totpCode computes the HOTP value (RFC 4226) for a time step
+func totpCode(key []byte, step int64) string {
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], uint64(step))
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(counter[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%1000000)
+}
+
+// verifyTOTP checks code against the steps around now and returns the
+// matching step. Steps at or before lastStep are refused so that a code
+// cannot be used twice.
+func verifyTOTP(secret, code string, lastStep int64, now time.Time) (int64, bool) {
+	key, err := base32NoPadding.DecodeString(strings.ToUpper(secret))
+	if err != nil || len(code) != totpDigits {
+		return 0, false
+	}
+
+	current := now.Unix() / totpPeriod
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if step <= lastStep {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(totpCode(key, step)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// otpauthURI builds the key URI that authenticator apps import from a QR code
+func otpauthURI(username, secret string) string {
+	issuer := cfg.Auth.TOTPIssuer
+	query := url.Values{
+		"secret":    {secret},
+		"issuer":    {issuer},
+		"algorithm": {"SHA1"},
+		"digits":    {fmt.Sprint(totpDigits)},
+		"period":    {fmt.Sprint(totpPeriod)},
+	}
+	label := url.PathEscape(issuer + ":" + username)
+	return "otpauth://totp/" + label + "?" + query.Encode()
+}
+
+// newRecoveryCodes returns codes to show the user and the hashes to store
+func newRecoveryCodes() ([]string, []string, error) {
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		raw := make([]byte, 5)
+		if _, err := rand.Read(raw); err != nil {
+			return nil, nil, err
+		}
+		code := strings.ToLower(base32NoPadding.EncodeToString(raw))
+		codes[i] = code[:4] + "-" + code[4:]
+		hashes[i] = hashToken(normalizeRecoveryCode(codes[i]))
+	}
+	return codes, hashes, nil
+}
+
+func normalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+}
+
+// checkSecondFactor accepts a current TOTP code or an unused recovery code.
+// The code is used up in the store in the same step it is accepted, so
+// concurrent requests with one code cannot both succeed; user is updated to
+// match.
+func checkSecondFactor(ctx context.Context, user *UserRecord, code string) (bool, error) {
+	code = strings.TrimSpace(code)
+	if step, ok := verifyTOTP(user.TOTPSecret, code, user.TOTPLastStep, time.Now()); ok {
+		used, err := users.UseTOTPStep(ctx, user.Username, step)
+		if used {
+			user.TOTPLastStep = step
+		}
+		return used, err
+	}
+
+	hash := hashToken(normalizeRecoveryCode(code))
+	for i, stored := range user.RecoveryCodes {
+		if subtle.ConstantTimeCompare([]byte(stored), []byte(hash)) == 1 {
+			used, err := users.UseRecoveryCode(ctx, user.Username, hash)
+			if used {
+				user.RecoveryCodes = append(user.RecoveryCodes[:i:i], user.RecoveryCodes[i+1:]...)
+			}
+			return used, err
+		}
+	}
+	return false, nil
+}
+
+// beginMFAChallenge answers a correct password for an account with a second
+// factor by handing out a short-lived challenge token instead of a session
+func beginMFAChallenge(c *gin.Context, user *UserRecord) {
+	ttl := cfg.Auth.Tokens.MFAChallengeTTL
+	token, err := issueActionToken(c.Request.Context(), user, purposeMFAChallenge, ttl)
+	if err != nil {
+		respondAuth(c, http.StatusInternalServerError, shared.AuthResponse{Error: "Could not start two-factor login"})
+		return
+	}
+
+	respondAuth(c, http.StatusOK, shared.AuthResponse{
+		Username:    user.Username,
+		Message:     "Enter the code from your authenticator app",
+		MFARequired: true,
+		MFAToken:    token,
+	})
+}
+
+type mfaLoginRequest struct {
+	MFAToken string `json:"mfaToken" form:"mfa_token" binding:"required"`
+	Code     string `json:"code" form:"code" binding:"required"`
+}
+
+// loginMFA completes a login started by /login with a TOTP or recovery code.
+// It accepts JSON or form bodies.
+func loginMFA(c *gin.Context) {
+	var req mfaLoginRequest
+	if err := c.ShouldBind(&req); err != nil {
+		respondAuth(c, http.StatusBadRequest, shared.AuthResponse{Error: "Challenge token and code are required"})
+		return
+	}
+
+	ctx := c.Request.Context()
+	challenge, err := tokens.ConsumeActionToken(ctx, hashToken(req.MFAToken), purposeMFAChallenge)
+	if errors.Is(err, ErrActionTokenInvalid) {
+		respondAuth(c, http.StatusUnauthorized, shared.AuthResponse{Error: "Login expired, please sign in again"})
+		return
+	}
+	if err != nil {
+		respondAuth(c, http.StatusInternalServerError, shared.AuthResponse{Error: "Could not check code"})
+		return
+	}
+
+	if !checkLoginThrottle(c, challenge.Username) {
+		return
+	}
+
+	account, err := users.GetUser(ctx, challenge.Username)
+	if err != nil {
+		respondAuth(c, http.StatusUnauthorized, shared.AuthResponse{Error: "Login expired, please sign in again"})
+		return
+	}
+
+	valid := false
+	if account.TOTPEnabled {
+		valid, err = checkSecondFactor(ctx, account, req.Code)
+		if err != nil {
+			respondAuth(c, http.StatusInternalServerError, shared.AuthResponse{Error: "Could not check code"})
+			return
+		}
+	}
+	if !valid {
+		recordAudit(c, auditLogin, account.Username, outcomeFailure, "invalid second factor")
+		recordLoginFailure(c, account.Username)
+
+		// Let the user retry within the original challenge lifetime
+		retry, err := newOpaqueToken()
+		if err == nil {
+			challenge.TokenHash = hashToken(retry)
+			err = tokens.SaveActionToken(ctx, challenge)
+		}
+		if err != nil {
+			log.Printf("Failed to renew MFA challenge for %q: %v", account.Username, err)
+			retry = ""
+		}
+		respondAuth(c, http.StatusUnauthorized, shared.AuthResponse{
+			Error:       "Invalid code",
+			MFARequired: retry != "",
+			MFAToken:    retry,
+		})
+		return
+	}
+
+	recordLoginSuccess(c, account.Username)
+	completeLogin(c, account, "password+totp")
+}
+
+// currentAccount loads the signed-in user for the /mfa and /account endpoints
+func currentAccount(c *gin.Context) (*UserRecord, bool) {
+	user, err := users.GetUser(c.Request.Context(), c.GetString(shared.ContextUsername))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return nil, false
+	}
+	return user, true
+}
+
+// enrollMFA creates a new TOTP secret for the signed-in user. It does not
+// take effect until confirmed with a code from the authenticator.
+func enrollMFA(c *gin.Context) {
+	user, ok := currentAccount(c)
+	if !ok {
+		return
+	}
+	if user.TOTPEnabled {
+		c.JSON(http.StatusConflict, shared.MFAEnrollResponse{Error: "Two-factor authentication is already enabled"})
+		return
+	}
+
+	secret, err := newTOTPSecret()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, shared.MFAEnrollResponse{Error: "Could not create secret"})
+		return
+	}
+	uri := otpauthURI(user.Username, secret)
+	png, err := qrcode.Encode(uri, qrcode.Medium, 256)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, shared.MFAEnrollResponse{Error: "Could not create QR code"})
+		return
+	}
+
+	user.TOTPSecret = secret
+	user.TOTPLastStep = 0
+	if err := users.UpdateUser(c.Request.Context(), user); err != nil {
+		c.JSON(http.StatusInternalServerError, shared.MFAEnrollResponse{Error: "Could not save secret"})
+		return
+	}
+
+	c.JSON(http.StatusOK, shared.MFAEnrollResponse{
+		Secret:     secret,
+		OTPAuthURI: uri,
+		QRCode:     "data:image/png;base64," + base64.StdEncoding.EncodeToString(png),
+	})
+}
+
+type mfaCodeRequest struct {
+	Code     string `json:"code" form:"code" binding:"required"`
+	Password string `json:"password" form:"password"`
+}
+
+// confirmMFA enables the enrolled secret once the user proves they can
+// generate codes, and returns the initial recovery codes
+func confirmMFA(c *gin.Context) {
+	var req mfaCodeRequest
+	if err := c.ShouldBind(&req); err != nil {
+		c.JSON(http.StatusBadRequest, shared.RecoveryCodesResponse{Error: "Code is required"})
+		return
+	}
+	user, ok := currentAccount(c)
+	if !ok {
+		return
+	}
+	if user.TOTPEnabled {
+		c.JSON(http.StatusConflict, shared.RecoveryCodesResponse{Error: "Two-factor authentication is already enabled"})
+		return
+	}
+	if user.TOTPSecret == "" {
+		c.JSON(http.StatusBadRequest, shared.RecoveryCodesResponse{Error: "Start enrollment first"})
+		return
+	}
+
+	step, valid := verifyTOTP(user.TOTPSecret, strings.TrimSpace(req.Code), user.TOTPLastStep, time.Now())
+	if !valid {
+		c.JSON(http.StatusBadRequest, shared.RecoveryCodesResponse{Error: "Invalid code"})
+		return
+	}
+	user.TOTPLastStep = step
+	user.TOTPEnabled = true
+
+	saveRecoveryCodes(c, user, "Two-factor authentication enabled")
+}
+
+// regenerateRecoveryCodes replaces all recovery codes after checking a current code
+func regenerateRecoveryCodes(c *gin.Context) {
+	var req mfaCodeRequest
+	if err := c.ShouldBind(&req); err != nil {
+		c.JSON(http.StatusBadRequest, shared.RecoveryCodesResponse{Error: "Code is required"})
+		return
+	}
+	user, ok := currentAccount(c)
+	if !ok {
+		return
+	}
+	if !user.TOTPEnabled {
+		c.JSON(http.StatusBadRequest, shared.RecoveryCodesResponse{Error: "Two-factor authentication is not enabled"})
+		return
+	}
+	valid, err := checkSecondFactor(c.Request.Context(), user, req.Code)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, shared.RecoveryCodesResponse{Error: "Could not check code"})
+		return
+	}
+	if !valid {
+		c.JSON(http.StatusBadRequest, shared.RecoveryCodesResponse{Error: "Invalid code"})
+		return
+	}
+
+	saveRecoveryCodes(c, user, "Recovery codes replaced")
+}
+
+func saveRecoveryCodes(c *gin.Context, user *UserRecord, message string) {
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, shared.RecoveryCodesResponse{Error: "Could not create recovery codes"})
+		return
+	}
+	user.RecoveryCodes = hashes
+	if err := users.UpdateUser(c.Request.Context(), user); err != nil {
+		c.JSON(http.StatusInternalServerError, shared.RecoveryCodesResponse{Error: "Could not save recovery codes"})
+		return
+	}
+	c.JSON(http.StatusOK, shared.RecoveryCodesResponse{RecoveryCodes: codes, Message: message})
+}
+
+// disableMFA removes the second factor. It needs both the password and a
+// current or recovery code so a stolen session alone cannot turn it off.
+func disableMFA(c *gin.Context) {
+	var req mfaCodeRequest
+	if err := c.ShouldBind(&req); err != nil || req.Password == "" {
+		c.JSON(http.StatusBadRequest, shared.AuthResponse{Error: "Password and code are required"})
+		return
+	}
+	user, ok := currentAccount(c)
+	if !ok {
+		return
+	}
+	if !user.TOTPEnabled {
+		c.JSON(http.StatusBadRequest, shared.AuthResponse{Error: "Two-factor authentication is not enabled"})
+		return
+	}
+
+	match, _, err := shared.VerifyPassword(user.PasswordHash, req.Password)
+	if err != nil || !match {
+		c.JSON(http.StatusUnauthorized, shared.AuthResponse{Error: "Invalid password or code"})
+		return
+	}
+	valid, err := checkSecondFactor(c.Request.Context(), user, req.Code)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, shared.AuthResponse{Error: "Could not check code"})
+		return
+	}
+	if !valid {
+		c.JSON(http.StatusUnauthorized, shared.AuthResponse{Error: "Invalid password or code"})
+		return
+	}
+
+	user.TOTPEnabled = false
+	user.TOTPSecret = ""
+	user.TOTPLastStep = 0
+	user.RecoveryCodes = nil
+	if err := users.UpdateUser(c.Request.Context(), user); err != nil {
+		c.JSON(http.StatusInternalServerError, shared.AuthResponse{Error: "Could not disable two-factor authentication"})
+		return
+	}
+	c.JSON(http.StatusOK, shared.AuthResponse{Message: "Two-factor authentication disabled"})
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// rfc6238Secret is the SHA-1 seed of RFC 6238 Appendix B, "12345678901234567890"
+const rfc6238Secret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestVerifyTOTPVectors(t *testing.T) {
+	// The RFC lists 8-digit codes; 6-digit codes are their last six digits
+	vectors := []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	for _, v := range vectors {
+		now := time.Unix(v.unix, 0)
+		step, ok := verifyTOTP(rfc6238Secret, v.code, 0, now)
+		if !ok || step != v.unix/totpPeriod {
+			t.Errorf("verifyTOTP(%s at %d) = %d, %v; want %d, true", v.code, v.unix, step, ok, v.unix/totpPeriod)
+		}
+	}
+}
+
+func TestVerifyTOTP(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	step := now.Unix() / totpPeriod
+
+	tests := []struct {
+		name     string
+		code     string
+		lastStep int64
+		now      time.Time
+		ok       bool
+	}{
+		{"current step", "050471", 0, now, true},
+		{"one step of clock drift", "050471", 0, now.Add(totpPeriod * time.Second), true},
+		{"too much clock drift", "050471", 0, now.Add(2 * totpPeriod * time.Second), false},
+		{"step already used", "050471", step, now, false},
+		{"later step already used", "050471", step + 1, now, false},
+		{"wrong code", "050472", 0, now, false},
+		{"wrong length", "50471", 0, now, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, ok := verifyTOTP(rfc6238Secret, tt.code, tt.lastStep, tt.now); ok != tt.ok {
+				t.Errorf("verifyTOTP = %v, want %v", ok, tt.ok)
+			}
+		})
+	}
+}
+
+func TestSecondFactorUsedOnce(t *testing.T) {
+	setupTest(t)
+	ctx := context.Background()
+	user := createTestUser(t, "alice", "Correct-Horse-9!")
+
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, _ := base32NoPadding.DecodeString(rfc6238Secret)
+	code := totpCode(key, time.Now().Unix()/totpPeriod)
+	user.TOTPSecret = rfc6238Secret
+	user.TOTPEnabled = true
+	user.RecoveryCodes = hashes
+	if err := users.UpdateUser(ctx, user); err != nil {
+		t.Fatal(err)
+	}
+
+	// Two requests that loaded the account before either used the code
+	for name, code := range map[string]string{"TOTP code": code, "recovery code": codes[0]} {
+		first, _ := users.GetUser(ctx, "alice")
+		second, _ := users.GetUser(ctx, "alice")
+		if ok, err := checkSecondFactor(ctx, first, code); !ok || err != nil {
+			t.Fatalf("%s: first use = %v, %v; want true", name, ok, err)
+		}
+		if ok, err := checkSecondFactor(ctx, second, code); ok || err != nil {
+			t.Errorf("%s: second use = %v, %v; want false", name, ok, err)
+		}
+	}
+
+	stored, _ := users.GetUser(ctx, "alice")
+	if len(stored.RecoveryCodes) != len(codes)-1 {
+		t.Errorf("%d recovery codes left, want %d", len(stored.RecoveryCodes), len(codes)-1)
+	}
+	if ok, _ := checkSecondFactor(ctx, stored, codes[1]); !ok {
+		t.Error("another recovery code was refused")
+	}
+}
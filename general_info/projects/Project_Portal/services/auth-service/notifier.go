@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"shared/config"
+)
+
+// Message is an email sent to a user
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Notifier delivers account emails such as verification and reset links
+type Notifier interface {
+	Send(ctx context.Context, msg Message) error
+}
+
+// newNotifier selects the configured implementation ("log", "file" or "smtp")
+func newNotifier(c config.NotifierConfig) (Notifier, error) {
+	switch c.Kind {
+	case "log":
+		return logNotifier{}, nil
+	case "file":
+		if err := os.MkdirAll(c.Dir, 0700); err != nil {
+			return nil, err
+		}
+		return fileNotifier{dir: c.Dir}, nil
+	case "smtp":
+		if c.SMTP.Host == "" {
+			return nil, fmt.Errorf("SMTP_HOST is required when NOTIFIER=smtp")
+		}
+		return smtpNotifier{
+			addr:     net.JoinHostPort(c.SMTP.Host, strconv.Itoa(c.SMTP.Port)),
+			host:     c.SMTP.Host,
+			username: c.SMTP.Username,
+			password: c.SMTP.Password,
+			from:     c.SMTP.From,
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown NOTIFIER %q (expected \"log\", \"file\" or \"smtp\")", c.Kind)
+	}
+}
+
+// logNotifier writes messages to the service log for local development
+type logNotifier struct{}
+
+func (logNotifier) Send(ctx context.Context, msg Message) error {
+	log.Printf("Mail to %s: %s\n%s", msg.To, msg.Subject, msg.Body)
+	return nil
+}
+
+// fileNotifier writes each message to its own .eml file so flows can be
+// exercised locally without a mail server
+type fileNotifier struct {
+	dir string
+}
+
+func (n fileNotifier) Send(ctx context.Context, msg Message) error {
+	name := fmt.Sprintf("%d-%s.eml", time.Now().UnixNano(), sanitizeForFilename(msg.To))
+	return os.WriteFile(filepath.Join(n.dir, name), formatMessage("no-reply@localhost", msg), 0600)
+}
+
+// smtpNotifier sends mail through an SMTP relay, using STARTTLS when offered
+type smtpNotifier struct {
+	addr     string
+	host     string
+	username string
+	password string
+	from     string
+}
+
+func (n smtpNotifier) Send(ctx context.Context, msg Message) error {
+	var auth smtp.Auth
+	if n.username != "" {
+		auth = smtp.PlainAuth("", n.username, n.password, n.host)
+	}
+	return smtp.SendMail(n.addr, auth, n.from, []string{msg.To}, formatMessage(n.from, msg))
+}
+
+// formatMessage renders a plain-text RFC 5322 message
+func formatMessage(from string, msg Message) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", msg.To)
+	fmt.Fprintf(&b, "Subject: %s\r\n", msg.Subject)
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=UTF-8\r\n\r\n")
+	b.WriteString(strings.ReplaceAll(msg.Body, "\n", "\r\n"))
+	return []byte(b.String())
+}
+
+func sanitizeForFilename(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '.' || r == '-' {
+			return r
+		}
+		return '_'
+	}, s)
+}
@@ -0,0 +1,387 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"shared"
+)
+
+// Scopes understood by the OpenID Connect endpoints; others are ignored
+var supportedScopes = []string{"openid", "profile", "email"}
+
+// oidcIssuer is the public base URL clients discover the provider at. The
+// gateway serves the discovery document, consent page and token endpoints
+// under it.
+func oidcIssuer() string {
+	if cfg.Auth.OIDCIssuer != "" {
+		return cfg.Auth.OIDCIssuer
+	}
+	return cfg.Auth.PublicBaseURL
+}
+
+// openIDConfiguration serves the OpenID Connect discovery document
+func openIDConfiguration(c *gin.Context) {
+	issuer := oidcIssuer()
+	c.Header("Cache-Control", "public, max-age=3600")
+	c.JSON(http.StatusOK, gin.H{
+		"issuer":                                        issuer,
+		"authorization_endpoint":                        issuer + "/oauth/authorize",
+		"token_endpoint":                                issuer + "/oauth/token",
+		"userinfo_endpoint":                             issuer + "/oauth/userinfo",
+		"introspection_endpoint":                        issuer + "/introspect",
+		"jwks_uri":                                      issuer + "/.well-known/jwks.json",
+		"response_types_supported":                      []string{"code"},
+		"grant_types_supported":                         []string{"authorization_code"},
+		"subject_types_supported":                       []string{"public"},
+		"id_token_signing_alg_values_supported":         []string{shared.SigningAlgorithm()},
+		"scopes_supported":                              supportedScopes,
+		"token_endpoint_auth_methods_supported":         []string{"client_secret_basic", "client_secret_post", "none"},
+		"introspection_endpoint_auth_methods_supported": []string{"client_secret_basic", "client_secret_post"},
+		"code_challenge_methods_supported":              []string{"S256"},
+		"claims_supported": []string{
+			"sub", "iss", "aud", "exp", "iat", "auth_time", "nonce", "azp",
+			"preferred_username", "name", "email", "email_verified",
+		},
+	})
+}
+
+// authorizeRequest holds the authorization request parameters. GET requests
+// carry them in the query string; the consent form posts them back.
+type authorizeRequest struct {
+	ResponseType        string `form:"response_type"`
+	ClientID            string `form:"client_id"`
+	RedirectURI         string `form:"redirect_uri"`
+	Scope               string `form:"scope"`
+	State               string `form:"state"`
+	Nonce               string `form:"nonce"`
+	CodeChallenge       string `form:"code_challenge"`
+	CodeChallengeMethod string `form:"code_challenge_method"`
+	Decision            string `form:"decision"` // "allow" or "deny" on the consent form
+}
+
+// authorizeError is an RFC 6749 error. Redirect is empty when the client or
+// redirect URI could not be trusted, in which case the user is not sent back.
+type authorizeError struct {
+	Code        string `json:"error"`
+	Description string `json:"error_description"`
+	Redirect    string `json:"redirect,omitempty"`
+}
+
+// redirectWith appends params to a registered redirect URI
+func redirectWith(redirectURI string, params url.Values) string {
+	u, err := url.Parse(redirectURI)
+	if err != nil {
+		return redirectURI
+	}
+	query := u.Query()
+	for key, values := range params {
+		query[key] = values
+	}
+	u.RawQuery = query.Encode()
+	return u.String()
+}
+
+// checkAuthorizeRequest validates an authorization request and returns the
+// client together with the scopes that will be granted
+func checkAuthorizeRequest(ctx context.Context, req *authorizeRequest) (*OAuthClient, []string, *authorizeError) {
+	if req.ClientID == "" || req.RedirectURI == "" {
+		return nil, nil, &authorizeError{Code: "invalid_request", Description: "client_id and redirect_uri are required"}
+	}
+	client, err := clients.GetClient(ctx, req.ClientID)
+	if errors.Is(err, ErrClientNotFound) {
+		return nil, nil, &authorizeError{Code: "invalid_client", Description: "Unknown client"}
+	}
+	if err != nil {
+		return nil, nil, &authorizeError{Code: "server_error", Description: "Could not look up client"}
+	}
+	if !client.AllowsRedirect(req.RedirectURI) {
+		return nil, nil, &authorizeError{Code: "invalid_request", Description: "redirect_uri is not registered for this client"}
+	}
+
+	// From here on errors are reported back to the client
+	fail := func(code, description string) (*OAuthClient, []string, *authorizeError) {
+		params := url.Values{"error": {code}, "error_description": {description}}
+		if req.State != "" {
+			params.Set("state", req.State)
+		}
+		return nil, nil, &authorizeError{Code: code, Description: description, Redirect: redirectWith(req.RedirectURI, params)}
+	}
+
+	if req.ResponseType != "code" {
+		return fail("unsupported_response_type", "Only the authorization code flow is supported")
+	}
+	if req.CodeChallenge == "" || req.CodeChallengeMethod != "S256" {
+		return fail("invalid_request", "PKCE with code_challenge_method=S256 is required")
+	}
+
+	var scopes []string
+	requested := strings.Fields(req.Scope)
+	for _, scope := range supportedScopes {
+		for _, r := range requested {
+			if r == scope {
+				scopes = append(scopes, scope)
+				break
+			}
+		}
+	}
+	if len(scopes) == 0 || scopes[0] != "openid" {
+		return fail("invalid_scope", "The openid scope is required")
+	}
+	return client, scopes, nil
+}
+
+// authorizeInfo validates an authorization request for the gateway's consent
+// page and describes what the user is asked to approve
+func authorizeInfo(c *gin.Context) {
+	var req authorizeRequest
+	if err := c.ShouldBindQuery(&req); err != nil {
+		c.JSON(http.StatusBadRequest, authorizeError{Code: "invalid_request", Description: "Malformed request"})
+		return
+	}
+
+	client, scopes, authErr := checkAuthorizeRequest(c.Request.Context(), &req)
+	if authErr != nil {
+		c.JSON(http.StatusBadRequest, authErr)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"clientId": client.ClientID, "clientName": client.Name, "scopes": scopes})
+}
+
+// authorize records the signed-in user's consent decision and returns where
+// to send the browser: back to the client with a code, or with access_denied
+func authorize(c *gin.Context) {
+	var req authorizeRequest
+	if err := c.ShouldBind(&req); err != nil {
+		c.JSON(http.StatusBadRequest, authorizeError{Code: "invalid_request", Description: "Malformed request"})
+		return
+	}
+
+	ctx := c.Request.Context()
+	_, scopes, authErr := checkAuthorizeRequest(ctx, &req)
+	if authErr != nil {
+		c.JSON(http.StatusBadRequest, authErr)
+		return
+	}
+
+	params := url.Values{}
+	if req.State != "" {
+		params.Set("state", req.State)
+	}
+	if req.Decision != "allow" {
+		params.Set("error", "access_denied")
+		params.Set("error_description", "The user denied the request")
+		c.JSON(http.StatusOK, gin.H{"redirect": redirectWith(req.RedirectURI, params)})
+		return
+	}
+
+	code, err := newOpaqueToken()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, authorizeError{Code: "server_error", Description: "Could not create code"})
+		return
+	}
+
+	// The session token's issue time stands in for the time the user signed in
+	authTime := time.Now()
+	if claims := shared.ClaimsFromContext(c); claims != nil && claims.IssuedAt != nil {
+		authTime = claims.IssuedAt.Time
+	}
+
+	err = clients.SaveAuthorizationCode(ctx, &AuthorizationCode{
+		CodeHash:      hashToken(code),
+		ClientID:      req.ClientID,
+		Username:      c.GetString(shared.ContextUsername),
+		RedirectURI:   req.RedirectURI,
+		Scope:         strings.Join(scopes, " "),
+		Nonce:         req.Nonce,
+		CodeChallenge: req.CodeChallenge,
+		AuthTime:      authTime,
+		ExpiresAt:     time.Now().Add(cfg.Auth.Tokens.OAuthCodeTTL),
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, authorizeError{Code: "server_error", Description: "Could not create code"})
+		return
+	}
+
+	params.Set("code", code)
+	c.JSON(http.StatusOK, gin.H{"redirect": redirectWith(req.RedirectURI, params)})
+}
+
+// verifyPKCE checks an RFC 7636 S256 code verifier against the stored challenge
+func verifyPKCE(challenge, verifier string) bool {
+	if len(verifier) < 43 || len(verifier) > 128 {
+		return false
+	}
+	sum := sha256.Sum256([]byte(verifier))
+	computed := base64.RawURLEncoding.EncodeToString(sum[:])
+	return subtle.ConstantTimeCompare([]byte(computed), []byte(challenge)) == 1
+}
+
+func tokenError(c *gin.Context, status int, code, description string) {
+	c.JSON(status, gin.H{"error": code, "error_description": description})
+}
+
+// requireClient authenticates the calling client with HTTP Basic or the
+// client_id and client_secret form parameters, answering invalid_client and
+// returning false on failure
+func requireClient(c *gin.Context) (*OAuthClient, bool) {
+	clientID, secret, basic := c.Request.BasicAuth()
+	if basic {
+		clientID, _ = url.QueryUnescape(clientID)
+		secret, _ = url.QueryUnescape(secret)
+	} else {
+		clientID, secret = c.PostForm("client_id"), c.PostForm("client_secret")
+	}
+
+	client, err := clients.GetClient(c.Request.Context(), clientID)
+	if err != nil || !authenticateClient(client, secret) {
+		if basic {
+			c.Header("WWW-Authenticate", `Basic realm="portal"`)
+		}
+		tokenError(c, http.StatusUnauthorized, "invalid_client", "Client authentication failed")
+		return nil, false
+	}
+	return client, true
+}
+
+// oauthToken exchanges an authorization code for an access token and ID token
+func oauthToken(c *gin.Context) {
+	c.Header("Cache-Control", "no-store")
+	c.Header("Pragma", "no-cache")
+
+	if c.PostForm("grant_type") != "authorization_code" {
+		tokenError(c, http.StatusBadRequest, "unsupported_grant_type", "Only authorization_code is supported")
+		return
+	}
+
+	ctx := c.Request.Context()
+	client, ok := requireClient(c)
+	if !ok {
+		return
+	}
+
+	code, err := clients.ConsumeAuthorizationCode(ctx, hashToken(c.PostForm("code")))
+	if errors.Is(err, ErrAuthorizationCodeInvalid) {
+		tokenError(c, http.StatusBadRequest, "invalid_grant", "Authorization code is invalid or expired")
+		return
+	}
+	if err != nil {
+		tokenError(c, http.StatusInternalServerError, "server_error", "Could not check code")
+		return
+	}
+	if code.ClientID != client.ClientID || code.RedirectURI != c.PostForm("redirect_uri") {
+		tokenError(c, http.StatusBadRequest, "invalid_grant", "Authorization code was issued to another client or redirect URI")
+		return
+	}
+	if !verifyPKCE(code.CodeChallenge, c.PostForm("code_verifier")) {
+		tokenError(c, http.StatusBadRequest, "invalid_grant", "PKCE verification failed")
+		return
+	}
+
+	user, err := users.GetUser(ctx, code.Username)
+	if err != nil || user.Disabled {
+		tokenError(c, http.StatusBadRequest, "invalid_grant", "Account is not available")
+		return
+	}
+
+	// The access token carries no roles, so it only works at /userinfo
+	accessClaims, err := shared.NewAccessClaims(user.Username, nil)
+	if err != nil {
+		tokenError(c, http.StatusInternalServerError, "server_error", "Could not generate token")
+		return
+	}
+	accessClaims.Scope = code.Scope
+	accessToken, err := shared.SignClaims(accessClaims)
+	if err != nil {
+		tokenError(c, http.StatusInternalServerError, "server_error", "Could not generate token")
+		return
+	}
+
+	idToken, err := shared.SignClaims(idTokenClaims(user, client, code, accessClaims))
+	if err != nil {
+		tokenError(c, http.StatusInternalServerError, "server_error", "Could not generate token")
+		return
+	}
+
+	c.JSON(http.StatusOK, shared.OAuthTokenResponse{
+		AccessToken: accessToken,
+		TokenType:   "Bearer",
+		ExpiresIn:   int64(time.Until(accessClaims.ExpiresAt.Time).Seconds()),
+		IDToken:     idToken,
+		Scope:       code.Scope,
+	})
+}
+
+// idTokenClaims builds the ID token for the client on top of shared.Claims
+func idTokenClaims(user *UserRecord, client *OAuthClient, code *AuthorizationCode, access *shared.Claims) *shared.Claims {
+	claims := &shared.Claims{
+		Username:        user.Username,
+		Nonce:           code.Nonce,
+		AuthTime:        jwt.NewNumericDate(code.AuthTime),
+		AuthorizedParty: client.ClientID,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        access.ID,
+			Issuer:    oidcIssuer(),
+			Subject:   user.Username,
+			Audience:  jwt.ClaimStrings{client.ClientID},
+			ExpiresAt: access.ExpiresAt,
+			IssuedAt:  access.IssuedAt,
+		},
+	}
+	if hasScope(code.Scope, "email") {
+		verified := user.EmailVerified
+		claims.Email = user.Email
+		claims.EmailVerified = &verified
+	}
+	return claims
+}
+
+func hasScope(scope, want string) bool {
+	for _, s := range strings.Fields(scope) {
+		if s == want {
+			return true
+		}
+	}
+	return false
+}
+
+// userinfo returns the claims released by the scopes of an OIDC access token
+func userinfo(c *gin.Context) {
+	claims, err := shared.ValidateJWT(bearerToken(c))
+	if err != nil {
+		c.Header("WWW-Authenticate", `Bearer error="invalid_token"`)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid_token"})
+		return
+	}
+	if !hasScope(claims.Scope, "openid") {
+		c.Header("WWW-Authenticate", `Bearer error="insufficient_scope", scope="openid"`)
+		c.JSON(http.StatusForbidden, gin.H{"error": "insufficient_scope"})
+		return
+	}
+
+	user, err := users.GetUser(c.Request.Context(), claims.Username)
+	if err != nil || user.Disabled {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid_token"})
+		return
+	}
+
+	info := gin.H{"sub": user.Username}
+	if hasScope(claims.Scope, "profile") {
+		info["preferred_username"] = user.Username
+		info["name"] = user.Username
+	}
+	if hasScope(claims.Scope, "email") {
+		info["email"] = user.Email
+		info["email_verified"] = user.EmailVerified
+	}
+	c.JSON(http.StatusOK, info)
+}
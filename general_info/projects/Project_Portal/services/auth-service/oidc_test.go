@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"shared"
+)
+
+// The example of RFC 7636 Appendix B
+const (
+	pkceVerifier  = "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+	pkceChallenge = "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM"
+)
+
+func TestVerifyPKCE(t *testing.T) {
+	if !verifyPKCE(pkceChallenge, pkceVerifier) {
+		t.Error("the RFC 7636 verifier was refused")
+	}
+	if verifyPKCE(pkceChallenge, pkceVerifier[1:]+"x") {
+		t.Error("a different verifier was accepted")
+	}
+	if verifyPKCE(pkceChallenge, "") {
+		t.Error("an empty verifier was accepted")
+	}
+}
+
+func TestAuthorizationCodeExchange(t *testing.T) {
+	setupTest(t)
+	ctx := context.Background()
+	createTestUser(t, "alice", "Correct-Horse-9!")
+	const redirect = "https://app.example.com/callback"
+	client := &OAuthClient{ClientID: "app", Name: "App", RedirectURIs: []string{redirect}, CreatedAt: time.Now()}
+	if err := clients.CreateClient(ctx, client); err != nil {
+		t.Fatal(err)
+	}
+
+	newCode := func() string {
+		code, err := newOpaqueToken()
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = clients.SaveAuthorizationCode(ctx, &AuthorizationCode{
+			CodeHash:      hashToken(code),
+			ClientID:      "app",
+			Username:      "alice",
+			RedirectURI:   redirect,
+			Scope:         "openid profile",
+			CodeChallenge: pkceChallenge,
+			AuthTime:      time.Now(),
+			ExpiresAt:     time.Now().Add(time.Minute),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return code
+	}
+	exchange := func(code, verifier string) (int, map[string]any) {
+		var resp map[string]any
+		status := serve(t, oauthToken, http.MethodPost, "/oauth/token", url.Values{
+			"grant_type":    {"authorization_code"},
+			"code":          {code},
+			"redirect_uri":  {redirect},
+			"client_id":     {"app"},
+			"code_verifier": {verifier},
+		}, &resp)
+		return status, resp
+	}
+
+	t.Run("PKCE mismatch", func(t *testing.T) {
+		code := newCode()
+		wrong := "x" + pkceVerifier[1:]
+		if status, resp := exchange(code, wrong); status != http.StatusBadRequest || resp["error"] != "invalid_grant" {
+			t.Errorf("exchange with a wrong verifier = %d %v, want 400 invalid_grant", status, resp)
+		}
+		// The code is spent by the failed attempt
+		if status, _ := exchange(code, pkceVerifier); status != http.StatusBadRequest {
+			t.Errorf("exchange after a failed attempt = %d, want 400", status)
+		}
+	})
+
+	t.Run("code used once", func(t *testing.T) {
+		code := newCode()
+		status, resp := exchange(code, pkceVerifier)
+		if status != http.StatusOK || resp["id_token"] == nil {
+			t.Fatalf("exchange = %d %v, want 200 with an ID token", status, resp)
+		}
+		claims, err := shared.ValidateJWT(resp["access_token"].(string))
+		if err != nil || claims.Username != "alice" {
+			t.Errorf("access token claims = %+v, %v; want alice", claims, err)
+		}
+		if status, resp := exchange(code, pkceVerifier); status != http.StatusBadRequest || resp["error"] != "invalid_grant" {
+			t.Errorf("second exchange = %d %v, want 400 invalid_grant", status, resp)
+		}
+	})
+}
@@ -0,0 +1,368 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"shared"
+)
+
+var (
+	// ErrOrgNotFound is returned for unknown organization IDs
+	ErrOrgNotFound = errors.New("organization not found")
+	// ErrOrgExists is returned when creating an organization whose ID is taken
+	ErrOrgExists = errors.New("organization already exists")
+	// ErrMemberNotFound is returned when the user is not a member of the organization
+	ErrMemberNotFound = errors.New("membership not found")
+)
+
+// Organization is a tenant: a customer team whose members share uploads that
+// no other tenant can read. The ID names the tenant in access tokens.
+type Organization struct {
+	ID        string
+	Name      string
+	CreatedAt time.Time
+}
+
+// Membership grants a user roles within an organization
+type Membership struct {
+	OrgID    string
+	Username string
+	Roles    []string
+	JoinedAt time.Time
+}
+
+// OrgStore persists organizations and their members
+type OrgStore interface {
+	CreateOrg(ctx context.Context, org *Organization) error
+	GetOrg(ctx context.Context, id string) (*Organization, error)
+	// ListOrgs returns organizations ordered by ID
+	ListOrgs(ctx context.Context, offset, limit int) ([]*Organization, error)
+	// SaveMember adds the user to the organization or replaces their roles
+	SaveMember(ctx context.Context, member *Membership) error
+	GetMember(ctx context.Context, orgID, username string) (*Membership, error)
+	RemoveMember(ctx context.Context, orgID, username string) error
+	// ListMembers returns the organization's members ordered by username
+	ListMembers(ctx context.Context, orgID string) ([]*Membership, error)
+	// ListMemberships returns the user's memberships ordered by organization ID
+	ListMemberships(ctx context.Context, username string) ([]*Membership, error)
+}
+
+// tenantAccess returns the tenant tokens for user act in, with the roles the
+// user holds there. An active organization the user has since left falls back
+// to the default tenant.
+func tenantAccess(ctx context.Context, user *UserRecord) (string, []string, error) {
+	if user.ActiveOrg == "" {
+		return "", nil, nil
+	}
+	member, err := orgs.GetMember(ctx, user.ActiveOrg, user.Username)
+	if errors.Is(err, ErrMemberNotFound) {
+		return "", nil, nil
+	}
+	if err != nil {
+		return "", nil, err
+	}
+	return member.OrgID, member.Roles, nil
+}
+
+// validOrgRoles reports whether roles is a non-empty list of known organization roles
+func validOrgRoles(roles []string) bool {
+	for _, role := range roles {
+		if !shared.IsKnownOrgRole(role) {
+			return false
+		}
+	}
+	return len(roles) > 0
+}
+
+func hasOrgRole(member *Membership, role string) bool {
+	for _, r := range member.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+func toOrgMemberInfo(member *Membership) shared.OrgMemberInfo {
+	return shared.OrgMemberInfo{Username: member.Username, Roles: member.Roles, JoinedAt: member.JoinedAt}
+}
+
+// listMyOrgs returns the organizations the signed-in user belongs to and
+// marks the one their token acts for
+func listMyOrgs(c *gin.Context) {
+	ctx := c.Request.Context()
+	memberships, err := orgs.ListMemberships(ctx, c.GetString(shared.ContextUsername))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, shared.OrgListResponse{Error: "Could not list organizations"})
+		return
+	}
+
+	var current string
+	if claims := shared.ClaimsFromContext(c); claims != nil {
+		current = claims.Tenant
+	}
+	resp := shared.OrgListResponse{Orgs: []shared.OrgInfo{}}
+	for _, member := range memberships {
+		org, err := orgs.GetOrg(ctx, member.OrgID)
+		if err != nil {
+			continue
+		}
+		resp.Orgs = append(resp.Orgs, shared.OrgInfo{
+			ID:        org.ID,
+			Name:      org.Name,
+			Roles:     member.Roles,
+			Current:   org.ID == current,
+			CreatedAt: org.CreatedAt,
+		})
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+type switchOrgRequest struct {
+	// Org is the organization to act for, or empty for the default tenant
+	Org string `json:"org"`
+}
+
+// switchOrg selects the organization the user's tokens act for. It takes
+// effect for access tokens issued from now on, so clients refresh afterwards.
+func switchOrg(c *gin.Context) {
+	var req switchOrgRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+	user, ok := currentAccount(c)
+	if !ok {
+		return
+	}
+
+	ctx := c.Request.Context()
+	if req.Org != "" {
+		_, err := orgs.GetMember(ctx, req.Org, user.Username)
+		if errors.Is(err, ErrMemberNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Organization not found"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not switch organization"})
+			return
+		}
+	}
+
+	user.ActiveOrg = req.Org
+	if err := users.UpdateUser(ctx, user); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not switch organization"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Organization switched; refresh your token to use it", "org": req.Org})
+}
+
+// orgMember loads the caller's membership of the :id organization, answering
+// 404 when they are not a member so that organizations cannot be probed
+func orgMember(c *gin.Context) (*Membership, bool) {
+	member, err := orgs.GetMember(c.Request.Context(), c.Param("id"), c.GetString(shared.ContextUsername))
+	if errors.Is(err, ErrMemberNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Organization not found"})
+		return nil, false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not load organization"})
+		return nil, false
+	}
+	return member, true
+}
+
+// listOrgMembers returns the members of an organization the caller belongs to
+func listOrgMembers(c *gin.Context) {
+	if _, ok := orgMember(c); !ok {
+		return
+	}
+	members, err := orgs.ListMembers(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, shared.OrgMemberListResponse{Error: "Could not list members"})
+		return
+	}
+
+	resp := shared.OrgMemberListResponse{Members: make([]shared.OrgMemberInfo, 0, len(members))}
+	for _, member := range members {
+		resp.Members = append(resp.Members, toOrgMemberInfo(member))
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// isLastOwner reports whether username is the only owner of the organization
+func isLastOwner(ctx context.Context, orgID, username string) (bool, error) {
+	members, err := orgs.ListMembers(ctx, orgID)
+	if err != nil {
+		return false, err
+	}
+	for _, member := range members {
+		if member.Username != username && hasOrgRole(member, shared.OrgRoleOwner) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+type orgMemberRequest struct {
+	Roles []string `json:"roles" binding:"required"`
+}
+
+// saveOrgMember adds an account to the organization or changes its roles.
+// Only owners may do this, and the last owner cannot step down.
+func saveOrgMember(c *gin.Context) {
+	caller, ok := orgMember(c)
+	if !ok {
+		return
+	}
+	if !hasOrgRole(caller, shared.OrgRoleOwner) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only organization owners can manage members"})
+		return
+	}
+	var req orgMemberRequest
+	if err := c.ShouldBindJSON(&req); err != nil || !validOrgRoles(req.Roles) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Roles must be one or more of member, owner"})
+		return
+	}
+
+	ctx := c.Request.Context()
+	username := c.Param("username")
+	if _, err := users.GetUser(ctx, username); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+
+	member := &Membership{OrgID: caller.OrgID, Username: username, Roles: req.Roles, JoinedAt: time.Now()}
+	existing, err := orgs.GetMember(ctx, caller.OrgID, username)
+	if err == nil {
+		member.JoinedAt = existing.JoinedAt
+		if hasOrgRole(existing, shared.OrgRoleOwner) && !hasOrgRole(member, shared.OrgRoleOwner) {
+			if last, err := isLastOwner(ctx, caller.OrgID, username); err != nil || last {
+				c.JSON(http.StatusConflict, gin.H{"error": "An organization needs at least one owner"})
+				return
+			}
+		}
+	} else if !errors.Is(err, ErrMemberNotFound) {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not save member"})
+		return
+	}
+
+	if err := orgs.SaveMember(ctx, member); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not save member"})
+		return
+	}
+	// Tokens carry the organization roles, so changed roles must not outlive them
+	if existing != nil {
+		if err := tokens.RevokeUserTokens(ctx, username, ""); err != nil {
+			log.Printf("Failed to revoke tokens for %q after role change in %s: %v", username, caller.OrgID, err)
+		}
+	}
+	c.JSON(http.StatusOK, toOrgMemberInfo(member))
+}
+
+// removeOrgMember removes a member. Owners may remove anyone; members may
+// leave. The last owner cannot leave.
+func removeOrgMember(c *gin.Context) {
+	caller, ok := orgMember(c)
+	if !ok {
+		return
+	}
+	username := c.Param("username")
+	if username != caller.Username && !hasOrgRole(caller, shared.OrgRoleOwner) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only organization owners can manage members"})
+		return
+	}
+
+	ctx := c.Request.Context()
+	member, err := orgs.GetMember(ctx, caller.OrgID, username)
+	if errors.Is(err, ErrMemberNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Member not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not remove member"})
+		return
+	}
+	if hasOrgRole(member, shared.OrgRoleOwner) {
+		if last, err := isLastOwner(ctx, caller.OrgID, username); err != nil || last {
+			c.JSON(http.StatusConflict, gin.H{"error": "An organization needs at least one owner"})
+			return
+		}
+	}
+
+	if err := orgs.RemoveMember(ctx, caller.OrgID, username); err != nil && !errors.Is(err, ErrMemberNotFound) {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not remove member"})
+		return
+	}
+	if err := tokens.RevokeUserTokens(ctx, username, ""); err != nil {
+		log.Printf("Failed to revoke tokens for %q after leaving %s: %v", username, caller.OrgID, err)
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Member removed", "username": username})
+}
+
+type orgRequest struct {
+	ID    string `json:"id" binding:"required"`
+	Name  string `json:"name" binding:"required"`
+	Owner string `json:"owner" binding:"required"`
+}
+
+// createOrg creates an organization with its first owner
+func createOrg(c *gin.Context) {
+	var req orgRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "ID, name and owner are required"})
+		return
+	}
+	if !shared.ValidTenantID(req.ID) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "ID must be 3-40 lowercase letters, digits or dashes"})
+		return
+	}
+
+	ctx := c.Request.Context()
+	if _, err := users.GetUser(ctx, req.Owner); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+
+	now := time.Now()
+	org := &Organization{ID: req.ID, Name: strings.TrimSpace(req.Name), CreatedAt: now}
+	err := orgs.CreateOrg(ctx, org)
+	if errors.Is(err, ErrOrgExists) {
+		c.JSON(http.StatusConflict, gin.H{"error": "Organization already exists"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not create organization"})
+		return
+	}
+	owner := &Membership{OrgID: org.ID, Username: req.Owner, Roles: []string{shared.OrgRoleOwner}, JoinedAt: now}
+	if err := orgs.SaveMember(ctx, owner); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not add owner"})
+		return
+	}
+
+	log.Printf("Created organization %q owned by %q", org.ID, req.Owner)
+	c.JSON(http.StatusCreated, shared.OrgInfo{ID: org.ID, Name: org.Name, CreatedAt: org.CreatedAt})
+}
+
+// listOrgs returns every organization for administrators
+func listOrgs(c *gin.Context) {
+	offset, limit := pagination(c)
+	page, err := orgs.ListOrgs(c.Request.Context(), offset, limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, shared.OrgListResponse{Error: "Could not list organizations"})
+		return
+	}
+
+	resp := shared.OrgListResponse{Orgs: make([]shared.OrgInfo, 0, len(page))}
+	for _, org := range page {
+		resp.Orgs = append(resp.Orgs, shared.OrgInfo{ID: org.ID, Name: org.Name, CreatedAt: org.CreatedAt})
+	}
+	c.JSON(http.StatusOK, resp)
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"shared"
+)
+
+// ErrSessionNotFound is returned for unknown, expired or revoked sessions
+var ErrSessionNotFound = errors.New("session not found")
+
+// Session describes the device behind a refresh token family. It is created
+// on login, updated on every refresh and removed when the family is revoked.
+type Session struct {
+	ID           string // the refresh token family ID
+	Username     string
+	UserAgent    string
+	ClientIP     string
+	CreatedAt    time.Time
+	LastActiveAt time.Time
+	ExpiresAt    time.Time // expiry of the newest refresh token
+}
+
+func toSessionInfo(session *Session, currentID string) shared.SessionInfo {
+	return shared.SessionInfo{
+		ID:           session.ID,
+		UserAgent:    session.UserAgent,
+		ClientIP:     session.ClientIP,
+		CreatedAt:    session.CreatedAt,
+		LastActiveAt: session.LastActiveAt,
+		Current:      session.ID == currentID,
+	}
+}
+
+// currentSessionID returns the session the request's access token belongs to, or ""
+func currentSessionID(c *gin.Context) string {
+	claims := shared.ClaimsFromContext(c)
+	if claims == nil {
+		return ""
+	}
+	familyID, err := tokens.FamilyForAccessToken(c.Request.Context(), claims.ID)
+	if err != nil {
+		return ""
+	}
+	return familyID
+}
+
+// listSessions returns the signed-in user's active sessions, most recently used first
+func listSessions(c *gin.Context) {
+	username := c.GetString(shared.ContextUsername)
+	sessions, err := tokens.ListSessions(c.Request.Context(), username)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, shared.SessionListResponse{Error: "Could not list sessions"})
+		return
+	}
+
+	currentID := currentSessionID(c)
+	resp := shared.SessionListResponse{Sessions: []shared.SessionInfo{}}
+	for _, session := range sessions {
+		resp.Sessions = append(resp.Sessions, toSessionInfo(session, currentID))
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// revokeSession signs one of the user's devices out
+func revokeSession(c *gin.Context) {
+	username := c.GetString(shared.ContextUsername)
+	ctx := c.Request.Context()
+
+	session, err := tokens.GetSession(ctx, c.Param("id"))
+	if errors.Is(err, ErrSessionNotFound) || (err == nil && session.Username != username) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Session not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not revoke session"})
+		return
+	}
+
+	if err := tokens.RevokeTokenFamily(ctx, session.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not revoke session"})
+		return
+	}
+	recordAudit(c, auditSessionRevoke, username, outcomeSuccess, "session "+session.ID)
+	c.JSON(http.StatusOK, gin.H{"message": "Session revoked", "id": session.ID})
+}
+
+// revokeAllSessions signs the user out everywhere, including this device
+func revokeAllSessions(c *gin.Context) {
+	username := c.GetString(shared.ContextUsername)
+	if err := tokens.RevokeUserTokens(c.Request.Context(), username, ""); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not revoke sessions"})
+		return
+	}
+	recordAudit(c, auditSessionRevoke, username, outcomeSuccess, "all sessions")
+	c.JSON(http.StatusOK, gin.H{"message": "Signed out everywhere"})
+}
+
+type tokenStatusRequest struct {
+	JTI string `json:"jti" binding:"required"`
+}
+
+// tokenStatus tells other services whether an access token was revoked. It
+// is not exposed through the gateway.
+func tokenStatus(c *gin.Context) {
+	var req tokenStatusRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "jti is required"})
+		return
+	}
+
+	revoked, err := tokens.IsRevoked(c.Request.Context(), req.JTI)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not check token"})
+		return
+	}
+	c.JSON(http.StatusOK, shared.TokenStatusResponse{Revoked: revoked})
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"shared/config"
+)
+
+var (
+	// ErrUserExists is returned when registering a username that is already taken
+	ErrUserExists = errors.New("user already exists")
+	// ErrUserNotFound is returned when no account matches the requested username
+	ErrUserNotFound = errors.New("user not found")
+	// ErrEmailExists is returned when an email address belongs to another account
+	ErrEmailExists = errors.New("email already in use")
+)
+
+// UserRecord represents a stored user account
+type UserRecord struct {
+	Username      string
+	PasswordHash  string
+	DisplayName   string
+	Email         string
+	EmailVerified bool
+	Roles         []string
+	Disabled      bool
+	CreatedAt     time.Time
+	ActiveOrg     string // organization new tokens act for, empty for the default tenant
+
+	// TOTPSecret is the base32 shared secret; it is set at enrollment and
+	// only takes effect once TOTPEnabled is set by a confirmed code
+	TOTPSecret    string
+	TOTPEnabled   bool
+	TOTPLastStep  int64    // last accepted time step, so a code cannot be replayed
+	RecoveryCodes []string // SHA-256 hashes of unused recovery codes
+}
+
+// UserStore persists user accounts. Implementations must be safe for
+// concurrent use by multiple handlers.
+type UserStore interface {
+	CreateUser(ctx context.Context, user *UserRecord) error
+	GetUser(ctx context.Context, username string) (*UserRecord, error)
+	// GetUserByEmail looks an account up by email address, ignoring case
+	GetUserByEmail(ctx context.Context, email string) (*UserRecord, error)
+	UpdateUser(ctx context.Context, user *UserRecord) error
+	// UpdatePasswordHash replaces the password hash only while it is still
+	// oldHash, leaving the rest of the account alone, and reports whether it did
+	UpdatePasswordHash(ctx context.Context, username, oldHash, newHash string) (bool, error)
+	// UseTOTPStep records step as the last accepted TOTP step unless the
+	// same or a later step was accepted already, and reports whether it was
+	UseTOTPStep(ctx context.Context, username string, step int64) (bool, error)
+	// UseRecoveryCode removes the recovery code with the given hash and
+	// reports whether it was still there
+	UseRecoveryCode(ctx context.Context, username, codeHash string) (bool, error)
+	// DeleteUser removes the account together with the tokens, API keys and
+	// authorization codes that belong to it
+	DeleteUser(ctx context.Context, username string) error
+	// ListUsers returns accounts ordered by username
+	ListUsers(ctx context.Context, offset, limit int) ([]*UserRecord, error)
+	// Ping reports whether the backend can be reached, for readiness checks
+	Ping(ctx context.Context) error
+}
+
+// openStores initializes the package-level stores of the configured kind
+// ("memory" or "postgres"). All stores share the same backend so that
+// replicas agree on users, tokens, signing keys, login attempts, OIDC
+// clients, API keys, organizations and the audit log.
+func openStores(c config.StoreConfig) error {
+	switch c.Kind {
+	case "memory":
+		memTokens := newMemoryTokenStore()
+		memClients := newMemoryClientStore()
+		memAPIKeys := newMemoryAPIKeyStore()
+		memOrgs := newMemoryOrgStore()
+		users = newMemoryUserStore(memTokens, memClients, memAPIKeys, memOrgs)
+		tokens = memTokens
+		keyStore = newMemoryKeyStore()
+		attempts = newMemoryAttemptStore()
+		clients = memClients
+		apiKeys = memAPIKeys
+		auditLog = newMemoryAuditStore()
+		orgs = memOrgs
+	case "postgres":
+		db, err := openPostgres(postgresConnString(c))
+		if err != nil {
+			return err
+		}
+		users = &postgresUserStore{db: db}
+		tokens = &postgresTokenStore{db: db}
+		keyStore = &postgresKeyStore{db: db}
+		attempts = &postgresAttemptStore{db: db}
+		clients = &postgresClientStore{db: db}
+		apiKeys = &postgresAPIKeyStore{db: db}
+		auditLog = &postgresAuditStore{db: db}
+		orgs = &postgresOrgStore{db: db}
+	default:
+		return fmt.Errorf("unknown USER_STORE %q (expected \"memory\" or \"postgres\")", c.Kind)
+	}
+	return nil
+}
+
+// postgresConnString builds the connection string from the database URL or
+// the separate settings
+func postgresConnString(c config.StoreConfig) string {
+	if c.DatabaseURL != "" {
+		return c.DatabaseURL
+	}
+	return fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s sslmode=%s",
+		c.Host, c.Port, c.User, c.Password, c.Name, c.SSLMode)
+}
@@ -0,0 +1,989 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"shared"
+)
+
+// memoryUserStore keeps accounts in process memory. It is intended for
+// single-node development; accounts are lost on restart.
+type memoryUserStore struct {
+	mu    sync.RWMutex
+	users map[string]UserRecord
+
+	// Stores holding records that belong to a user; DeleteUser clears them
+	// the way ON DELETE CASCADE does for the Postgres tables
+	tokens  *memoryTokenStore
+	clients *memoryClientStore
+	apiKeys *memoryAPIKeyStore
+	orgs    *memoryOrgStore
+}
+
+func newMemoryUserStore(tokens *memoryTokenStore, clients *memoryClientStore, apiKeys *memoryAPIKeyStore, orgs *memoryOrgStore) *memoryUserStore {
+	return &memoryUserStore{
+		users:   make(map[string]UserRecord),
+		tokens:  tokens,
+		clients: clients,
+		apiKeys: apiKeys,
+		orgs:    orgs,
+	}
+}
+
+func (s *memoryUserStore) CreateUser(ctx context.Context, user *UserRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.users[user.Username]; exists {
+		return ErrUserExists
+	}
+	if s.emailTakenLocked(user.Email, user.Username) {
+		return ErrEmailExists
+	}
+	s.users[user.Username] = cloneUser(user)
+	return nil
+}
+
+func (s *memoryUserStore) GetUser(ctx context.Context, username string) (*UserRecord, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	user, exists := s.users[username]
+	if !exists {
+		return nil, ErrUserNotFound
+	}
+	user = cloneUser(&user)
+	return &user, nil
+}
+
+func (s *memoryUserStore) UpdateUser(ctx context.Context, user *UserRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.users[user.Username]; !exists {
+		return ErrUserNotFound
+	}
+	if s.emailTakenLocked(user.Email, user.Username) {
+		return ErrEmailExists
+	}
+	s.users[user.Username] = cloneUser(user)
+	return nil
+}
+
+func (s *memoryUserStore) UpdatePasswordHash(ctx context.Context, username, oldHash, newHash string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, exists := s.users[username]
+	if !exists {
+		return false, ErrUserNotFound
+	}
+	if user.PasswordHash != oldHash {
+		return false, nil
+	}
+	user.PasswordHash = newHash
+	s.users[username] = user
+	return true, nil
+}
+
+func (s *memoryUserStore) UseTOTPStep(ctx context.Context, username string, step int64) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, exists := s.users[username]
+	if !exists {
+		return false, ErrUserNotFound
+	}
+	if user.TOTPLastStep >= step {
+		return false, nil
+	}
+	user.TOTPLastStep = step
+	s.users[username] = user
+	return true, nil
+}
+
+func (s *memoryUserStore) UseRecoveryCode(ctx context.Context, username, codeHash string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, exists := s.users[username]
+	if !exists {
+		return false, ErrUserNotFound
+	}
+	for i, stored := range user.RecoveryCodes {
+		if stored == codeHash {
+			user.RecoveryCodes = append(user.RecoveryCodes[:i:i], user.RecoveryCodes[i+1:]...)
+			s.users[username] = user
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// DeleteUser also removes refresh tokens, action tokens, sessions,
+// authorization codes, API keys and memberships, matching the Postgres store
+func (s *memoryUserStore) DeleteUser(ctx context.Context, username string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.users[username]; !exists {
+		return ErrUserNotFound
+	}
+	delete(s.users, username)
+	s.tokens.deleteUser(username)
+	s.clients.deleteUser(username)
+	s.apiKeys.deleteUser(username)
+	s.orgs.deleteUser(username)
+	return nil
+}
+
+func (s *memoryUserStore) GetUserByEmail(ctx context.Context, email string) (*UserRecord, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, user := range s.users {
+		if user.Email != "" && strings.EqualFold(user.Email, email) {
+			user = cloneUser(&user)
+			return &user, nil
+		}
+	}
+	return nil, ErrUserNotFound
+}
+
+// emailTakenLocked reports whether another account uses email; callers must hold s.mu
+func (s *memoryUserStore) emailTakenLocked(email, username string) bool {
+	if email == "" {
+		return false
+	}
+	for _, other := range s.users {
+		if other.Username != username && strings.EqualFold(other.Email, email) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *memoryUserStore) ListUsers(ctx context.Context, offset, limit int) ([]*UserRecord, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	names := make([]string, 0, len(s.users))
+	for name := range s.users {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var page []*UserRecord
+	for i := offset; i < len(names) && len(page) < limit; i++ {
+		user := s.users[names[i]]
+		user = cloneUser(&user)
+		page = append(page, &user)
+	}
+	return page, nil
+}
+
+func (s *memoryUserStore) Ping(ctx context.Context) error {
+	return nil
+}
+
+// cloneUser copies a record so callers never share slices with the map
+func cloneUser(user *UserRecord) UserRecord {
+	clone := *user
+	clone.Roles = append([]string(nil), user.Roles...)
+	clone.RecoveryCodes = append([]string(nil), user.RecoveryCodes...)
+	return clone
+}
+
+type memoryRefreshToken struct {
+	RefreshToken
+	used    bool
+	revoked bool
+}
+
+// memoryTokenStore keeps refresh tokens and revoked token IDs in process memory
+type memoryTokenStore struct {
+	mu       sync.Mutex
+	refresh  map[string]*memoryRefreshToken // token hash -> record
+	revoked  map[string]time.Time           // jti -> expiry
+	actions  map[string]ActionToken         // token hash -> record
+	sessions map[string]Session             // family ID -> session
+}
+
+func newMemoryTokenStore() *memoryTokenStore {
+	return &memoryTokenStore{
+		refresh:  make(map[string]*memoryRefreshToken),
+		revoked:  make(map[string]time.Time),
+		actions:  make(map[string]ActionToken),
+		sessions: make(map[string]Session),
+	}
+}
+
+// deleteUser drops the refresh tokens, action tokens and sessions of a user
+func (s *memoryTokenStore) deleteUser(username string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for hash, token := range s.refresh {
+		if token.Username == username {
+			delete(s.refresh, hash)
+		}
+	}
+	for hash, token := range s.actions {
+		if token.Username == username {
+			delete(s.actions, hash)
+		}
+	}
+	for id, session := range s.sessions {
+		if session.Username == username {
+			delete(s.sessions, id)
+		}
+	}
+}
+
+func (s *memoryTokenStore) IsRevoked(ctx context.Context, jti string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, revoked := s.revoked[jti]
+	return revoked, nil
+}
+
+func (s *memoryTokenStore) RevokeAccessToken(ctx context.Context, jti string, expiresAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.revoked[jti] = expiresAt
+	s.pruneLocked(time.Now())
+	return nil
+}
+
+func (s *memoryTokenStore) SaveRefreshToken(ctx context.Context, token *RefreshToken) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.refresh[token.TokenHash] = &memoryRefreshToken{RefreshToken: *token}
+	s.pruneLocked(time.Now())
+	return nil
+}
+
+func (s *memoryTokenStore) UseRefreshToken(ctx context.Context, tokenHash string) (*RefreshToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, exists := s.refresh[tokenHash]
+	if !exists || stored.revoked || time.Now().After(stored.ExpiresAt) {
+		return nil, ErrRefreshTokenInvalid
+	}
+
+	token := stored.RefreshToken
+	if stored.used {
+		return &token, ErrRefreshTokenReused
+	}
+	stored.used = true
+	return &token, nil
+}
+
+func (s *memoryTokenStore) GetRefreshToken(ctx context.Context, tokenHash string) (*RefreshToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, exists := s.refresh[tokenHash]
+	if !exists || stored.used || stored.revoked || time.Now().After(stored.ExpiresAt) {
+		return nil, ErrRefreshTokenInvalid
+	}
+	token := stored.RefreshToken
+	return &token, nil
+}
+
+func (s *memoryTokenStore) RevokeTokenFamily(ctx context.Context, familyID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for _, stored := range s.refresh {
+		if stored.FamilyID != familyID {
+			continue
+		}
+		stored.revoked = true
+		if stored.AccessExpiresAt.After(now) {
+			s.revoked[stored.AccessJTI] = stored.AccessExpiresAt
+		}
+	}
+	delete(s.sessions, familyID)
+	return nil
+}
+
+func (s *memoryTokenStore) FamilyForAccessToken(ctx context.Context, jti string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, stored := range s.refresh {
+		if stored.AccessJTI == jti {
+			return stored.FamilyID, nil
+		}
+	}
+	return "", ErrRefreshTokenInvalid
+}
+
+func (s *memoryTokenStore) RevokeUserTokens(ctx context.Context, username, exceptFamilyID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for _, stored := range s.refresh {
+		if stored.Username != username || (exceptFamilyID != "" && stored.FamilyID == exceptFamilyID) {
+			continue
+		}
+		stored.revoked = true
+		if stored.AccessExpiresAt.After(now) {
+			s.revoked[stored.AccessJTI] = stored.AccessExpiresAt
+		}
+		delete(s.sessions, stored.FamilyID)
+	}
+	return nil
+}
+
+func (s *memoryTokenStore) SaveActionToken(ctx context.Context, token *ActionToken) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.pruneLocked(time.Now())
+	s.actions[token.TokenHash] = *token
+	return nil
+}
+
+func (s *memoryTokenStore) ConsumeActionToken(ctx context.Context, tokenHash, purpose string) (*ActionToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	token, exists := s.actions[tokenHash]
+	if !exists || token.Purpose != purpose {
+		return nil, ErrActionTokenInvalid
+	}
+	delete(s.actions, tokenHash)
+	if time.Now().After(token.ExpiresAt) {
+		return nil, ErrActionTokenInvalid
+	}
+	return &token, nil
+}
+
+func (s *memoryTokenStore) DeleteActionTokens(ctx context.Context, username, purpose string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for hash, token := range s.actions {
+		if token.Username == username && token.Purpose == purpose {
+			delete(s.actions, hash)
+		}
+	}
+	return nil
+}
+
+// pruneLocked drops expired entries; callers must hold s.mu
+func (s *memoryTokenStore) pruneLocked(now time.Time) {
+	for jti, expiresAt := range s.revoked {
+		if now.After(expiresAt) {
+			delete(s.revoked, jti)
+		}
+	}
+	for hash, stored := range s.refresh {
+		if now.After(stored.ExpiresAt) {
+			delete(s.refresh, hash)
+		}
+	}
+	for hash, token := range s.actions {
+		if now.After(token.ExpiresAt) {
+			delete(s.actions, hash)
+		}
+	}
+	for id, session := range s.sessions {
+		if now.After(session.ExpiresAt) {
+			delete(s.sessions, id)
+		}
+	}
+}
+
+func (s *memoryTokenStore) CreateSession(ctx context.Context, session *Session) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.pruneLocked(time.Now())
+	s.sessions[session.ID] = *session
+	return nil
+}
+
+func (s *memoryTokenStore) TouchSession(ctx context.Context, id, clientIP, userAgent string, at, expiresAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// A session revoked since the refresh token was checked stays revoked
+	session, exists := s.sessions[id]
+	if !exists {
+		return nil
+	}
+	session.ClientIP = clientIP
+	session.UserAgent = userAgent
+	session.LastActiveAt = at
+	session.ExpiresAt = expiresAt
+	s.sessions[id] = session
+	return nil
+}
+
+func (s *memoryTokenStore) GetSession(ctx context.Context, id string) (*Session, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	session, exists := s.sessions[id]
+	if !exists || time.Now().After(session.ExpiresAt) {
+		return nil, ErrSessionNotFound
+	}
+	return &session, nil
+}
+
+func (s *memoryTokenStore) ListSessions(ctx context.Context, username string) ([]*Session, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	var list []*Session
+	for _, session := range s.sessions {
+		if session.Username == username && now.Before(session.ExpiresAt) {
+			session := session
+			list = append(list, &session)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].LastActiveAt.After(list[j].LastActiveAt) })
+	return list, nil
+}
+
+// memoryKeyStore keeps signing keys in process memory; a restart invalidates
+// every outstanding token
+type memoryKeyStore struct {
+	mu   sync.Mutex
+	keys []SigningKeyRecord
+}
+
+func newMemoryKeyStore() *memoryKeyStore {
+	return &memoryKeyStore{}
+}
+
+func (s *memoryKeyStore) SaveSigningKey(ctx context.Context, key *SigningKeyRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.keys = append(s.keys, *key)
+	return nil
+}
+
+func (s *memoryKeyStore) ListSigningKeys(ctx context.Context) ([]*SigningKeyRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	keys := make([]*SigningKeyRecord, 0, len(s.keys))
+	for i := len(s.keys) - 1; i >= 0; i-- {
+		key := s.keys[i]
+		keys = append(keys, &key)
+	}
+	return keys, nil
+}
+
+func (s *memoryKeyStore) DeleteSigningKeysBefore(ctx context.Context, cutoff time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	kept := s.keys[:0]
+	for _, key := range s.keys {
+		if !key.CreatedAt.Before(cutoff) {
+			kept = append(kept, key)
+		}
+	}
+	s.keys = kept
+	return nil
+}
+
+// memoryAttemptStore tracks failed logins in process memory for single-node development
+type memoryAttemptStore struct {
+	mu       sync.Mutex
+	failures map[string][]time.Time
+	locks    map[string]time.Time
+}
+
+func newMemoryAttemptStore() *memoryAttemptStore {
+	return &memoryAttemptStore{
+		failures: make(map[string][]time.Time),
+		locks:    make(map[string]time.Time),
+	}
+}
+
+func (s *memoryAttemptStore) RecordFailure(ctx context.Context, key string, at, retainSince time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	kept := s.failures[key][:0]
+	for _, t := range s.failures[key] {
+		if !t.Before(retainSince) {
+			kept = append(kept, t)
+		}
+	}
+	s.failures[key] = append(kept, at)
+	return nil
+}
+
+func (s *memoryAttemptStore) Failures(ctx context.Context, key string, since time.Time) (int, time.Time, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var count int
+	var last time.Time
+	for _, t := range s.failures[key] {
+		if t.Before(since) {
+			continue
+		}
+		count++
+		if t.After(last) {
+			last = t
+		}
+	}
+	return count, last, nil
+}
+
+func (s *memoryAttemptStore) LockUntil(ctx context.Context, key string, until time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.locks[key] = until
+	return nil
+}
+
+func (s *memoryAttemptStore) LockedUntil(ctx context.Context, key string) (time.Time, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	until, locked := s.locks[key]
+	if locked && time.Now().After(until) {
+		delete(s.locks, key)
+		return time.Time{}, nil
+	}
+	return until, nil
+}
+
+func (s *memoryAttemptStore) ResetAttempts(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.failures, key)
+	delete(s.locks, key)
+	return nil
+}
+
+// memoryClientStore keeps OpenID Connect clients and authorization codes in
+// process memory
+type memoryClientStore struct {
+	mu      sync.Mutex
+	clients map[string]OAuthClient
+	codes   map[string]AuthorizationCode // code hash -> record
+}
+
+func newMemoryClientStore() *memoryClientStore {
+	return &memoryClientStore{
+		clients: make(map[string]OAuthClient),
+		codes:   make(map[string]AuthorizationCode),
+	}
+}
+
+func (s *memoryClientStore) CreateClient(ctx context.Context, client *OAuthClient) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored := *client
+	stored.RedirectURIs = append([]string(nil), client.RedirectURIs...)
+	s.clients[client.ClientID] = stored
+	return nil
+}
+
+func (s *memoryClientStore) GetClient(ctx context.Context, clientID string) (*OAuthClient, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	client, exists := s.clients[clientID]
+	if !exists {
+		return nil, ErrClientNotFound
+	}
+	client.RedirectURIs = append([]string(nil), client.RedirectURIs...)
+	return &client, nil
+}
+
+func (s *memoryClientStore) ListClients(ctx context.Context) ([]*OAuthClient, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	list := make([]*OAuthClient, 0, len(s.clients))
+	for _, stored := range s.clients {
+		client := stored
+		client.RedirectURIs = append([]string(nil), stored.RedirectURIs...)
+		list = append(list, &client)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list, nil
+}
+
+func (s *memoryClientStore) DeleteClient(ctx context.Context, clientID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.clients[clientID]; !exists {
+		return ErrClientNotFound
+	}
+	delete(s.clients, clientID)
+	for hash, code := range s.codes {
+		if code.ClientID == clientID {
+			delete(s.codes, hash)
+		}
+	}
+	return nil
+}
+
+// deleteUser drops the outstanding authorization codes of a user
+func (s *memoryClientStore) deleteUser(username string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for hash, code := range s.codes {
+		if code.Username == username {
+			delete(s.codes, hash)
+		}
+	}
+}
+
+func (s *memoryClientStore) SaveAuthorizationCode(ctx context.Context, code *AuthorizationCode) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for hash, stored := range s.codes {
+		if now.After(stored.ExpiresAt) {
+			delete(s.codes, hash)
+		}
+	}
+	s.codes[code.CodeHash] = *code
+	return nil
+}
+
+func (s *memoryClientStore) ConsumeAuthorizationCode(ctx context.Context, codeHash string) (*AuthorizationCode, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	code, exists := s.codes[codeHash]
+	if !exists {
+		return nil, ErrAuthorizationCodeInvalid
+	}
+	delete(s.codes, codeHash)
+	if time.Now().After(code.ExpiresAt) {
+		return nil, ErrAuthorizationCodeInvalid
+	}
+	return &code, nil
+}
+
+// memoryAPIKeyStore keeps API keys in process memory
+type memoryAPIKeyStore struct {
+	mu   sync.Mutex
+	keys map[string]APIKey // id -> record
+}
+
+func newMemoryAPIKeyStore() *memoryAPIKeyStore {
+	return &memoryAPIKeyStore{keys: make(map[string]APIKey)}
+}
+
+func (s *memoryAPIKeyStore) CreateAPIKey(ctx context.Context, key *APIKey) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.keys[key.ID] = cloneAPIKey(key)
+	return nil
+}
+
+func (s *memoryAPIKeyStore) ListAPIKeys(ctx context.Context, username string) ([]*APIKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var list []*APIKey
+	for _, stored := range s.keys {
+		if stored.Username == username {
+			key := cloneAPIKey(&stored)
+			list = append(list, &key)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.After(list[j].CreatedAt) })
+	return list, nil
+}
+
+func (s *memoryAPIKeyStore) DeleteAPIKey(ctx context.Context, username, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key, exists := s.keys[id]
+	if !exists || key.Username != username {
+		return ErrAPIKeyNotFound
+	}
+	delete(s.keys, id)
+	return nil
+}
+
+func (s *memoryAPIKeyStore) GetAPIKeyByHash(ctx context.Context, keyHash string) (*APIKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, stored := range s.keys {
+		if stored.KeyHash == keyHash {
+			key := cloneAPIKey(&stored)
+			return &key, nil
+		}
+	}
+	return nil, ErrAPIKeyNotFound
+}
+
+func (s *memoryAPIKeyStore) TouchAPIKey(ctx context.Context, id string, usedAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key, exists := s.keys[id]
+	if !exists {
+		return ErrAPIKeyNotFound
+	}
+	key.LastUsedAt = &usedAt
+	s.keys[id] = key
+	return nil
+}
+
+// deleteUser drops every API key of a user
+func (s *memoryAPIKeyStore) deleteUser(username string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for id, key := range s.keys {
+		if key.Username == username {
+			delete(s.keys, id)
+		}
+	}
+}
+
+// cloneAPIKey copies a record so callers never share slices or times with the map
+func cloneAPIKey(key *APIKey) APIKey {
+	clone := *key
+	clone.Scopes = append([]string(nil), key.Scopes...)
+	if key.ExpiresAt != nil {
+		expiresAt := *key.ExpiresAt
+		clone.ExpiresAt = &expiresAt
+	}
+	if key.LastUsedAt != nil {
+		lastUsedAt := *key.LastUsedAt
+		clone.LastUsedAt = &lastUsedAt
+	}
+	return clone
+}
+
+// memoryAuditLimit bounds the in-memory audit log; the oldest events are
+// dropped first
+const memoryAuditLimit = 10000
+
+// memoryAuditStore keeps audit events in process memory, oldest first
+type memoryAuditStore struct {
+	mu     sync.RWMutex
+	events []shared.AuditEvent
+	nextID int64
+}
+
+func newMemoryAuditStore() *memoryAuditStore {
+	return &memoryAuditStore{nextID: 1}
+}
+
+func (s *memoryAuditStore) AppendAuditEvent(ctx context.Context, event *shared.AuditEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	event.ID = s.nextID
+	s.nextID++
+	s.events = append(s.events, *event)
+	if len(s.events) > memoryAuditLimit {
+		s.events = append([]shared.AuditEvent(nil), s.events[len(s.events)-memoryAuditLimit:]...)
+	}
+	return nil
+}
+
+func (s *memoryAuditStore) ListAuditEvents(ctx context.Context, filter AuditFilter, offset, limit int) ([]*shared.AuditEvent, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var page []*shared.AuditEvent
+	skipped := 0
+	for i := len(s.events) - 1; i >= 0 && len(page) < limit; i-- {
+		event := s.events[i]
+		if !filter.matches(&event) {
+			continue
+		}
+		if skipped < offset {
+			skipped++
+			continue
+		}
+		page = append(page, &event)
+	}
+	return page, nil
+}
+
+func (s *memoryAuditStore) ExportAuditEvents(ctx context.Context, filter AuditFilter, fn func(*shared.AuditEvent) error) error {
+	// Copy first so that a slow reader does not hold up logins
+	s.mu.RLock()
+	var matched []shared.AuditEvent
+	for i := range s.events {
+		if filter.matches(&s.events[i]) {
+			matched = append(matched, s.events[i])
+		}
+	}
+	s.mu.RUnlock()
+
+	for i := range matched {
+		if err := fn(&matched[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// memoryOrgStore keeps organizations and memberships in process memory
+type memoryOrgStore struct {
+	mu      sync.RWMutex
+	orgs    map[string]Organization
+	members map[string]map[string]Membership // org ID -> username -> membership
+}
+
+func newMemoryOrgStore() *memoryOrgStore {
+	return &memoryOrgStore{
+		orgs:    make(map[string]Organization),
+		members: make(map[string]map[string]Membership),
+	}
+}
+
+func (s *memoryOrgStore) CreateOrg(ctx context.Context, org *Organization) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.orgs[org.ID]; exists {
+		return ErrOrgExists
+	}
+	s.orgs[org.ID] = *org
+	s.members[org.ID] = make(map[string]Membership)
+	return nil
+}
+
+func (s *memoryOrgStore) GetOrg(ctx context.Context, id string) (*Organization, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	org, exists := s.orgs[id]
+	if !exists {
+		return nil, ErrOrgNotFound
+	}
+	return &org, nil
+}
+
+func (s *memoryOrgStore) ListOrgs(ctx context.Context, offset, limit int) ([]*Organization, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	ids := make([]string, 0, len(s.orgs))
+	for id := range s.orgs {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	var page []*Organization
+	for i := offset; i < len(ids) && len(page) < limit; i++ {
+		org := s.orgs[ids[i]]
+		page = append(page, &org)
+	}
+	return page, nil
+}
+
+func (s *memoryOrgStore) SaveMember(ctx context.Context, member *Membership) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	members, exists := s.members[member.OrgID]
+	if !exists {
+		return ErrOrgNotFound
+	}
+	members[member.Username] = cloneMembership(member)
+	return nil
+}
+
+func (s *memoryOrgStore) GetMember(ctx context.Context, orgID, username string) (*Membership, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	stored, exists := s.members[orgID][username]
+	if !exists {
+		return nil, ErrMemberNotFound
+	}
+	member := cloneMembership(&stored)
+	return &member, nil
+}
+
+func (s *memoryOrgStore) RemoveMember(ctx context.Context, orgID, username string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.members[orgID][username]; !exists {
+		return ErrMemberNotFound
+	}
+	delete(s.members[orgID], username)
+	return nil
+}
+
+func (s *memoryOrgStore) ListMembers(ctx context.Context, orgID string) ([]*Membership, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var list []*Membership
+	for _, stored := range s.members[orgID] {
+		member := cloneMembership(&stored)
+		list = append(list, &member)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Username < list[j].Username })
+	return list, nil
+}
+
+func (s *memoryOrgStore) ListMemberships(ctx context.Context, username string) ([]*Membership, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var list []*Membership
+	for _, members := range s.members {
+		if stored, exists := members[username]; exists {
+			member := cloneMembership(&stored)
+			list = append(list, &member)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].OrgID < list[j].OrgID })
+	return list, nil
+}
+
+// deleteUser drops the memberships of a user in every organization
+func (s *memoryOrgStore) deleteUser(username string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, members := range s.members {
+		delete(members, username)
+	}
+}
+
+// cloneMembership copies a record so callers never share the roles slice with the map
+func cloneMembership(member *Membership) Membership {
+	clone := *member
+	clone.Roles = append([]string(nil), member.Roles...)
+	return clone
+}
@@ -0,0 +1,1131 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	"shared"
+)
+
+// postgresMigrations are applied in order on startup. Each statement must be
+// idempotent so that several replicas can start concurrently.
+var postgresMigrations = []string{
+	`CREATE TABLE IF NOT EXISTS users (
+		username      TEXT PRIMARY KEY,
+		password_hash TEXT NOT NULL,
+		created_at    TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`,
+	`CREATE TABLE IF NOT EXISTS refresh_tokens (
+		token_hash        TEXT PRIMARY KEY,
+		family_id         TEXT NOT NULL,
+		username          TEXT NOT NULL REFERENCES users (username) ON DELETE CASCADE,
+		access_jti        TEXT NOT NULL,
+		access_expires_at TIMESTAMPTZ NOT NULL,
+		created_at        TIMESTAMPTZ NOT NULL DEFAULT now(),
+		expires_at        TIMESTAMPTZ NOT NULL,
+		used_at           TIMESTAMPTZ,
+		revoked_at        TIMESTAMPTZ
+	)`,
+	`CREATE INDEX IF NOT EXISTS refresh_tokens_family_idx ON refresh_tokens (family_id)`,
+	`CREATE INDEX IF NOT EXISTS refresh_tokens_access_jti_idx ON refresh_tokens (access_jti)`,
+	`CREATE TABLE IF NOT EXISTS revoked_tokens (
+		jti        TEXT PRIMARY KEY,
+		expires_at TIMESTAMPTZ NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS signing_keys (
+		kid         TEXT PRIMARY KEY,
+		algorithm   TEXT NOT NULL,
+		private_key BYTEA NOT NULL,
+		created_at  TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`,
+	`CREATE TABLE IF NOT EXISTS login_failures (
+		key          TEXT NOT NULL,
+		attempted_at TIMESTAMPTZ NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS login_failures_key_idx ON login_failures (key, attempted_at)`,
+	`CREATE TABLE IF NOT EXISTS login_locks (
+		key          TEXT PRIMARY KEY,
+		locked_until TIMESTAMPTZ NOT NULL
+	)`,
+	`ALTER TABLE users ADD COLUMN IF NOT EXISTS roles TEXT[] NOT NULL DEFAULT '{user}'`,
+	`ALTER TABLE users ADD COLUMN IF NOT EXISTS disabled BOOLEAN NOT NULL DEFAULT false`,
+	`ALTER TABLE users ADD COLUMN IF NOT EXISTS email TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE users ADD COLUMN IF NOT EXISTS email_verified BOOLEAN NOT NULL DEFAULT false`,
+	`CREATE UNIQUE INDEX IF NOT EXISTS users_email_idx ON users (lower(email)) WHERE email <> ''`,
+	`CREATE TABLE IF NOT EXISTS action_tokens (
+		token_hash TEXT PRIMARY KEY,
+		purpose    TEXT NOT NULL,
+		username   TEXT NOT NULL REFERENCES users (username) ON DELETE CASCADE,
+		email      TEXT NOT NULL,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		expires_at TIMESTAMPTZ NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS action_tokens_username_idx ON action_tokens (username, purpose)`,
+	`ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_secret TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_enabled BOOLEAN NOT NULL DEFAULT false`,
+	`ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_last_step BIGINT NOT NULL DEFAULT 0`,
+	`ALTER TABLE users ADD COLUMN IF NOT EXISTS recovery_codes TEXT[] NOT NULL DEFAULT '{}'`,
+	`CREATE TABLE IF NOT EXISTS oauth_clients (
+		client_id     TEXT PRIMARY KEY,
+		secret_hash   TEXT NOT NULL DEFAULT '',
+		name          TEXT NOT NULL,
+		redirect_uris TEXT[] NOT NULL,
+		created_at    TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`,
+	`CREATE TABLE IF NOT EXISTS oauth_codes (
+		code_hash      TEXT PRIMARY KEY,
+		client_id      TEXT NOT NULL REFERENCES oauth_clients (client_id) ON DELETE CASCADE,
+		username       TEXT NOT NULL REFERENCES users (username) ON DELETE CASCADE,
+		redirect_uri   TEXT NOT NULL,
+		scope          TEXT NOT NULL,
+		nonce          TEXT NOT NULL DEFAULT '',
+		code_challenge TEXT NOT NULL,
+		auth_time      TIMESTAMPTZ NOT NULL,
+		expires_at     TIMESTAMPTZ NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS api_keys (
+		id           TEXT PRIMARY KEY,
+		username     TEXT NOT NULL REFERENCES users (username) ON DELETE CASCADE,
+		name         TEXT NOT NULL,
+		key_hash     TEXT NOT NULL UNIQUE,
+		prefix       TEXT NOT NULL,
+		scopes       TEXT[] NOT NULL,
+		created_at   TIMESTAMPTZ NOT NULL DEFAULT now(),
+		expires_at   TIMESTAMPTZ,
+		last_used_at TIMESTAMPTZ
+	)`,
+	`CREATE INDEX IF NOT EXISTS api_keys_username_idx ON api_keys (username)`,
+	`ALTER TABLE users ADD COLUMN IF NOT EXISTS display_name TEXT NOT NULL DEFAULT ''`,
+	// Audit events outlive the accounts they mention, so there is no foreign key
+	`CREATE TABLE IF NOT EXISTS audit_events (
+		id          BIGSERIAL PRIMARY KEY,
+		occurred_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		event_type  TEXT NOT NULL,
+		username    TEXT NOT NULL DEFAULT '',
+		client_ip   TEXT NOT NULL DEFAULT '',
+		user_agent  TEXT NOT NULL DEFAULT '',
+		outcome     TEXT NOT NULL,
+		detail      TEXT NOT NULL DEFAULT ''
+	)`,
+	`CREATE INDEX IF NOT EXISTS audit_events_username_idx ON audit_events (username, id)`,
+	`CREATE INDEX IF NOT EXISTS audit_events_occurred_at_idx ON audit_events (occurred_at)`,
+	`CREATE OR REPLACE FUNCTION audit_events_append_only() RETURNS trigger LANGUAGE plpgsql AS $$
+	BEGIN
+		RAISE EXCEPTION 'audit_events is append-only';
+	END $$`,
+	`CREATE OR REPLACE TRIGGER audit_events_append_only BEFORE UPDATE OR DELETE ON audit_events
+		FOR EACH ROW EXECUTE FUNCTION audit_events_append_only()`,
+	`CREATE TABLE IF NOT EXISTS sessions (
+		id             TEXT PRIMARY KEY,
+		username       TEXT NOT NULL REFERENCES users (username) ON DELETE CASCADE,
+		user_agent     TEXT NOT NULL DEFAULT '',
+		client_ip      TEXT NOT NULL DEFAULT '',
+		created_at     TIMESTAMPTZ NOT NULL DEFAULT now(),
+		last_active_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		expires_at     TIMESTAMPTZ NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS sessions_username_idx ON sessions (username)`,
+	`CREATE TABLE IF NOT EXISTS organizations (
+		id         TEXT PRIMARY KEY,
+		name       TEXT NOT NULL,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`,
+	`CREATE TABLE IF NOT EXISTS org_members (
+		org_id    TEXT NOT NULL REFERENCES organizations (id) ON DELETE CASCADE,
+		username  TEXT NOT NULL REFERENCES users (username) ON DELETE CASCADE,
+		roles     TEXT[] NOT NULL,
+		joined_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		PRIMARY KEY (org_id, username)
+	)`,
+	`CREATE INDEX IF NOT EXISTS org_members_username_idx ON org_members (username)`,
+	`ALTER TABLE users ADD COLUMN IF NOT EXISTS active_org TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE api_keys ADD COLUMN IF NOT EXISTS tenant TEXT NOT NULL DEFAULT ''`,
+}
+
+// postgresConnectTimeout bounds how long openPostgres waits for the database
+// to accept connections, e.g. while its container is still starting
+const postgresConnectTimeout = time.Minute
+
+// openPostgres connects to PostgreSQL and applies the schema migrations
+func openPostgres(connStr string) (*sql.DB, error) {
+	db, err := sql.Open("postgres", connStr)
+	if err != nil {
+		return nil, fmt.Errorf("open database: %w", err)
+	}
+	if err := pingWithBackoff(db, postgresConnectTimeout); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("ping database: %w", err)
+	}
+
+	for _, stmt := range postgresMigrations {
+		if _, err := db.Exec(stmt); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("migrate database: %w", err)
+		}
+	}
+
+	return db, nil
+}
+
+// pingWithBackoff retries Ping with exponential backoff until it succeeds or
+// timeout elapses, returning the last error
+func pingWithBackoff(db *sql.DB, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	delay := 250 * time.Millisecond
+	for {
+		err := db.Ping()
+		if err == nil {
+			return nil
+		}
+		if time.Now().Add(delay).After(deadline) {
+			return err
+		}
+		log.Printf("Database not ready, retrying in %s: %v", delay, err)
+		time.Sleep(delay)
+		delay = min(delay*2, 5*time.Second)
+	}
+}
+
+// postgresUserStore keeps accounts in PostgreSQL so that every auth-service
+// replica sees the same users.
+type postgresUserStore struct {
+	db *sql.DB
+}
+
+func (s *postgresUserStore) CreateUser(ctx context.Context, user *UserRecord) error {
+	_, err := s.db.ExecContext(ctx,
+		`INSERT INTO users (username, password_hash, email, email_verified, roles, disabled, created_at,
+		                    totp_secret, totp_enabled, totp_last_step, recovery_codes, display_name, active_org)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)`,
+		user.Username, user.PasswordHash, user.Email, user.EmailVerified, pq.Array(user.Roles),
+		user.Disabled, user.CreatedAt, user.TOTPSecret, user.TOTPEnabled, user.TOTPLastStep,
+		pq.Array(nonNil(user.RecoveryCodes)), user.DisplayName, user.ActiveOrg)
+	return uniqueViolation(err, ErrUserExists)
+}
+
+// uniqueViolation maps a unique_violation to ErrEmailExists when the email
+// index was hit, or to fallback otherwise
+func uniqueViolation(err error, fallback error) error {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+		if pqErr.Constraint == "users_email_idx" {
+			return ErrEmailExists
+		}
+		return fallback
+	}
+	return err
+}
+
+func (s *postgresUserStore) GetUserByEmail(ctx context.Context, email string) (*UserRecord, error) {
+	user, err := scanUser(s.db.QueryRowContext(ctx,
+		`SELECT `+userColumns+` FROM users WHERE email <> '' AND lower(email) = lower($1)`, email))
+
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrUserNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+func (s *postgresUserStore) GetUser(ctx context.Context, username string) (*UserRecord, error) {
+	user, err := scanUser(s.db.QueryRowContext(ctx,
+		`SELECT `+userColumns+` FROM users WHERE username = $1`, username))
+
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrUserNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+func (s *postgresUserStore) UpdateUser(ctx context.Context, user *UserRecord) error {
+	result, err := s.db.ExecContext(ctx,
+		`UPDATE users SET password_hash = $2, email = $3, email_verified = $4, roles = $5, disabled = $6,
+		        totp_secret = $7, totp_enabled = $8, totp_last_step = $9, recovery_codes = $10, display_name = $11,
+		        active_org = $12
+		 WHERE username = $1`,
+		user.Username, user.PasswordHash, user.Email, user.EmailVerified, pq.Array(user.Roles), user.Disabled,
+		user.TOTPSecret, user.TOTPEnabled, user.TOTPLastStep, pq.Array(nonNil(user.RecoveryCodes)), user.DisplayName,
+		user.ActiveOrg)
+	if err != nil {
+		return uniqueViolation(err, err)
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
+
+// UpdatePasswordHash leaves the row alone if the password was changed since
+// oldHash was read
+func (s *postgresUserStore) UpdatePasswordHash(ctx context.Context, username, oldHash, newHash string) (bool, error) {
+	result, err := s.db.ExecContext(ctx,
+		`UPDATE users SET password_hash = $3 WHERE username = $1 AND password_hash = $2`, username, oldHash, newHash)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n == 1, err
+}
+
+// UseTOTPStep only updates the row while its last step is older, so of two
+// logins with the same code exactly one changes it
+func (s *postgresUserStore) UseTOTPStep(ctx context.Context, username string, step int64) (bool, error) {
+	result, err := s.db.ExecContext(ctx,
+		`UPDATE users SET totp_last_step = $2 WHERE username = $1 AND totp_last_step < $2`, username, step)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n == 1, err
+}
+
+func (s *postgresUserStore) UseRecoveryCode(ctx context.Context, username, codeHash string) (bool, error) {
+	result, err := s.db.ExecContext(ctx,
+		`UPDATE users SET recovery_codes = array_remove(recovery_codes, $2)
+		 WHERE username = $1 AND $2 = ANY (recovery_codes)`, username, codeHash)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n == 1, err
+}
+
+// DeleteUser relies on ON DELETE CASCADE to remove refresh tokens, action
+// tokens, sessions, authorization codes, API keys and memberships
+func (s *postgresUserStore) DeleteUser(ctx context.Context, username string) error {
+	result, err := s.db.ExecContext(ctx, `DELETE FROM users WHERE username = $1`, username)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
+
+func (s *postgresUserStore) ListUsers(ctx context.Context, offset, limit int) ([]*UserRecord, error) {
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT `+userColumns+` FROM users ORDER BY username OFFSET $1 LIMIT $2`, offset, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var page []*UserRecord
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		page = append(page, user)
+	}
+	return page, rows.Err()
+}
+
+func (s *postgresUserStore) Ping(ctx context.Context) error {
+	return s.db.PingContext(ctx)
+}
+
+// userColumns lists the users columns in the order scanUser expects
+const userColumns = `username, password_hash, email, email_verified, roles, disabled, created_at,
+	totp_secret, totp_enabled, totp_last_step, recovery_codes, display_name, active_org`
+
+// rowScanner is implemented by *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanUser(row rowScanner) (*UserRecord, error) {
+	var user UserRecord
+	err := row.Scan(&user.Username, &user.PasswordHash, &user.Email, &user.EmailVerified,
+		pq.Array(&user.Roles), &user.Disabled, &user.CreatedAt,
+		&user.TOTPSecret, &user.TOTPEnabled, &user.TOTPLastStep, pq.Array(&user.RecoveryCodes), &user.DisplayName, &user.ActiveOrg)
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// nonNil avoids writing NULL into NOT NULL array columns
+func nonNil(values []string) []string {
+	if values == nil {
+		return []string{}
+	}
+	return values
+}
+
+// postgresTokenStore keeps refresh tokens and the access token deny-list in
+// PostgreSQL so that revocation is visible to every replica
+type postgresTokenStore struct {
+	db *sql.DB
+}
+
+func (s *postgresTokenStore) IsRevoked(ctx context.Context, jti string) (bool, error) {
+	var revoked bool
+	err := s.db.QueryRowContext(ctx,
+		`SELECT EXISTS (SELECT 1 FROM revoked_tokens WHERE jti = $1)`, jti).Scan(&revoked)
+	return revoked, err
+}
+
+func (s *postgresTokenStore) RevokeAccessToken(ctx context.Context, jti string, expiresAt time.Time) error {
+	_, err := s.db.ExecContext(ctx,
+		`INSERT INTO revoked_tokens (jti, expires_at) VALUES ($1, $2) ON CONFLICT (jti) DO NOTHING`,
+		jti, expiresAt)
+	if err != nil {
+		return err
+	}
+
+	// Expired entries can no longer be presented, so the deny-list can forget them
+	_, err = s.db.ExecContext(ctx, `DELETE FROM revoked_tokens WHERE expires_at < now()`)
+	return err
+}
+
+func (s *postgresTokenStore) SaveRefreshToken(ctx context.Context, token *RefreshToken) error {
+	_, err := s.db.ExecContext(ctx,
+		`INSERT INTO refresh_tokens (token_hash, family_id, username, access_jti, access_expires_at, created_at, expires_at)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+		token.TokenHash, token.FamilyID, token.Username, token.AccessJTI, token.AccessExpiresAt,
+		token.CreatedAt, token.ExpiresAt)
+	return err
+}
+
+func (s *postgresTokenStore) UseRefreshToken(ctx context.Context, tokenHash string) (*RefreshToken, error) {
+	var token RefreshToken
+	var used bool
+	err := s.db.QueryRowContext(ctx,
+		`WITH previous AS (
+			SELECT token_hash, used_at IS NOT NULL AS used FROM refresh_tokens
+			WHERE token_hash = $1 AND revoked_at IS NULL AND expires_at > now()
+			FOR UPDATE
+		)
+		UPDATE refresh_tokens r SET used_at = COALESCE(r.used_at, now())
+		FROM previous p WHERE r.token_hash = p.token_hash
+		RETURNING r.token_hash, r.family_id, r.username, r.access_jti, r.access_expires_at,
+		          r.created_at, r.expires_at, p.used`,
+		tokenHash).Scan(&token.TokenHash, &token.FamilyID, &token.Username, &token.AccessJTI,
+		&token.AccessExpiresAt, &token.CreatedAt, &token.ExpiresAt, &used)
+
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrRefreshTokenInvalid
+	}
+	if err != nil {
+		return nil, err
+	}
+	if used {
+		return &token, ErrRefreshTokenReused
+	}
+	return &token, nil
+}
+
+func (s *postgresTokenStore) GetRefreshToken(ctx context.Context, tokenHash string) (*RefreshToken, error) {
+	var token RefreshToken
+	err := s.db.QueryRowContext(ctx,
+		`SELECT token_hash, family_id, username, access_jti, access_expires_at, created_at, expires_at
+		 FROM refresh_tokens
+		 WHERE token_hash = $1 AND used_at IS NULL AND revoked_at IS NULL AND expires_at > now()`,
+		tokenHash).Scan(&token.TokenHash, &token.FamilyID, &token.Username, &token.AccessJTI,
+		&token.AccessExpiresAt, &token.CreatedAt, &token.ExpiresAt)
+
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrRefreshTokenInvalid
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &token, nil
+}
+
+func (s *postgresTokenStore) RevokeTokenFamily(ctx context.Context, familyID string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx,
+		`INSERT INTO revoked_tokens (jti, expires_at)
+		 SELECT access_jti, access_expires_at FROM refresh_tokens
+		 WHERE family_id = $1 AND access_expires_at > now()
+		 ON CONFLICT (jti) DO NOTHING`, familyID)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx,
+		`UPDATE refresh_tokens SET revoked_at = now() WHERE family_id = $1 AND revoked_at IS NULL`, familyID)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM sessions WHERE id = $1`, familyID)
+	if err != nil {
+		return err
+	}
+
+	// Drop families and sessions that can no longer be refreshed
+	_, err = tx.ExecContext(ctx, `DELETE FROM refresh_tokens WHERE expires_at < now()`)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `DELETE FROM sessions WHERE expires_at < now()`)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *postgresTokenStore) FamilyForAccessToken(ctx context.Context, jti string) (string, error) {
+	var familyID string
+	err := s.db.QueryRowContext(ctx,
+		`SELECT family_id FROM refresh_tokens WHERE access_jti = $1`, jti).Scan(&familyID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", ErrRefreshTokenInvalid
+	}
+	return familyID, err
+}
+
+func (s *postgresTokenStore) SaveActionToken(ctx context.Context, token *ActionToken) error {
+	_, err := s.db.ExecContext(ctx,
+		`INSERT INTO action_tokens (token_hash, purpose, username, email, created_at, expires_at)
+		 VALUES ($1, $2, $3, $4, $5, $6)`,
+		token.TokenHash, token.Purpose, token.Username, token.Email, token.CreatedAt, token.ExpiresAt)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.db.ExecContext(ctx, `DELETE FROM action_tokens WHERE expires_at < now()`)
+	return err
+}
+
+func (s *postgresTokenStore) ConsumeActionToken(ctx context.Context, tokenHash, purpose string) (*ActionToken, error) {
+	var token ActionToken
+	err := s.db.QueryRowContext(ctx,
+		`DELETE FROM action_tokens WHERE token_hash = $1 AND purpose = $2
+		 RETURNING token_hash, purpose, username, email, created_at, expires_at`,
+		tokenHash, purpose).Scan(&token.TokenHash, &token.Purpose, &token.Username, &token.Email,
+		&token.CreatedAt, &token.ExpiresAt)
+
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrActionTokenInvalid
+	}
+	if err != nil {
+		return nil, err
+	}
+	if time.Now().After(token.ExpiresAt) {
+		return nil, ErrActionTokenInvalid
+	}
+	return &token, nil
+}
+
+func (s *postgresTokenStore) DeleteActionTokens(ctx context.Context, username, purpose string) error {
+	_, err := s.db.ExecContext(ctx,
+		`DELETE FROM action_tokens WHERE username = $1 AND purpose = $2`, username, purpose)
+	return err
+}
+
+func (s *postgresTokenStore) CreateSession(ctx context.Context, session *Session) error {
+	_, err := s.db.ExecContext(ctx,
+		`INSERT INTO sessions (`+sessionColumns+`) VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+		session.ID, session.Username, session.UserAgent, session.ClientIP, session.CreatedAt,
+		session.LastActiveAt, session.ExpiresAt)
+	return err
+}
+
+// TouchSession only updates an existing row, so a session revoked since the
+// refresh token was checked stays revoked
+func (s *postgresTokenStore) TouchSession(ctx context.Context, id, clientIP, userAgent string, at, expiresAt time.Time) error {
+	_, err := s.db.ExecContext(ctx,
+		`UPDATE sessions SET client_ip = $2, user_agent = $3, last_active_at = $4, expires_at = $5 WHERE id = $1`,
+		id, clientIP, userAgent, at, expiresAt)
+	return err
+}
+
+func (s *postgresTokenStore) GetSession(ctx context.Context, id string) (*Session, error) {
+	session, err := scanSession(s.db.QueryRowContext(ctx,
+		`SELECT `+sessionColumns+` FROM sessions WHERE id = $1 AND expires_at > now()`, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrSessionNotFound
+	}
+	return session, err
+}
+
+func (s *postgresTokenStore) ListSessions(ctx context.Context, username string) ([]*Session, error) {
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT `+sessionColumns+` FROM sessions WHERE username = $1 AND expires_at > now()
+		 ORDER BY last_active_at DESC`, username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var list []*Session
+	for rows.Next() {
+		session, err := scanSession(rows)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, session)
+	}
+	return list, rows.Err()
+}
+
+// sessionColumns lists the sessions columns in the order scanSession expects
+const sessionColumns = `id, username, user_agent, client_ip, created_at, last_active_at, expires_at`
+
+func scanSession(row rowScanner) (*Session, error) {
+	var session Session
+	err := row.Scan(&session.ID, &session.Username, &session.UserAgent, &session.ClientIP,
+		&session.CreatedAt, &session.LastActiveAt, &session.ExpiresAt)
+	if err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+// postgresKeyStore keeps JWT signing keys in PostgreSQL so that all replicas
+// share one key set
+type postgresKeyStore struct {
+	db *sql.DB
+}
+
+func (s *postgresKeyStore) SaveSigningKey(ctx context.Context, key *SigningKeyRecord) error {
+	_, err := s.db.ExecContext(ctx,
+		`INSERT INTO signing_keys (kid, algorithm, private_key, created_at) VALUES ($1, $2, $3, $4)`,
+		key.ID, key.Algorithm, key.PrivateKey, key.CreatedAt)
+	return err
+}
+
+func (s *postgresKeyStore) ListSigningKeys(ctx context.Context) ([]*SigningKeyRecord, error) {
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT kid, algorithm, private_key, created_at FROM signing_keys ORDER BY created_at DESC`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []*SigningKeyRecord
+	for rows.Next() {
+		var key SigningKeyRecord
+		if err := rows.Scan(&key.ID, &key.Algorithm, &key.PrivateKey, &key.CreatedAt); err != nil {
+			return nil, err
+		}
+		keys = append(keys, &key)
+	}
+	return keys, rows.Err()
+}
+
+func (s *postgresKeyStore) DeleteSigningKeysBefore(ctx context.Context, cutoff time.Time) error {
+	_, err := s.db.ExecContext(ctx, `DELETE FROM signing_keys WHERE created_at < $1`, cutoff)
+	return err
+}
+
+func (s *postgresTokenStore) RevokeUserTokens(ctx context.Context, username, exceptFamilyID string) error {
+	var families []string
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT DISTINCT family_id FROM refresh_tokens
+		 WHERE username = $1 AND family_id <> $2 AND revoked_at IS NULL`, username, exceptFamilyID)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var familyID string
+		if err := rows.Scan(&familyID); err != nil {
+			rows.Close()
+			return err
+		}
+		families = append(families, familyID)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, familyID := range families {
+		if err := s.RevokeTokenFamily(ctx, familyID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// postgresAttemptStore tracks failed logins in PostgreSQL so limits apply
+// across all replicas
+type postgresAttemptStore struct {
+	db *sql.DB
+}
+
+func (s *postgresAttemptStore) RecordFailure(ctx context.Context, key string, at, retainSince time.Time) error {
+	_, err := s.db.ExecContext(ctx,
+		`INSERT INTO login_failures (key, attempted_at) VALUES ($1, $2)`, key, at)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.db.ExecContext(ctx,
+		`DELETE FROM login_failures WHERE key = $1 AND attempted_at < $2`, key, retainSince)
+	return err
+}
+
+func (s *postgresAttemptStore) Failures(ctx context.Context, key string, since time.Time) (int, time.Time, error) {
+	var count int
+	var last sql.NullTime
+	err := s.db.QueryRowContext(ctx,
+		`SELECT count(*), max(attempted_at) FROM login_failures WHERE key = $1 AND attempted_at >= $2`,
+		key, since).Scan(&count, &last)
+	return count, last.Time, err
+}
+
+func (s *postgresAttemptStore) LockUntil(ctx context.Context, key string, until time.Time) error {
+	_, err := s.db.ExecContext(ctx,
+		`INSERT INTO login_locks (key, locked_until) VALUES ($1, $2)
+		 ON CONFLICT (key) DO UPDATE SET locked_until = GREATEST(login_locks.locked_until, EXCLUDED.locked_until)`,
+		key, until)
+	return err
+}
+
+func (s *postgresAttemptStore) LockedUntil(ctx context.Context, key string) (time.Time, error) {
+	var until time.Time
+	err := s.db.QueryRowContext(ctx,
+		`SELECT locked_until FROM login_locks WHERE key = $1 AND locked_until > now()`, key).Scan(&until)
+	if errors.Is(err, sql.ErrNoRows) {
+		return time.Time{}, nil
+	}
+	return until, err
+}
+
+func (s *postgresAttemptStore) ResetAttempts(ctx context.Context, key string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM login_failures WHERE key = $1`, key); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM login_locks WHERE key = $1`, key); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// postgresClientStore keeps OpenID Connect clients and authorization codes in
+// PostgreSQL next to the accounts they sign in
+type postgresClientStore struct {
+	db *sql.DB
+}
+
+func (s *postgresClientStore) CreateClient(ctx context.Context, client *OAuthClient) error {
+	_, err := s.db.ExecContext(ctx,
+		`INSERT INTO oauth_clients (client_id, secret_hash, name, redirect_uris, created_at) VALUES ($1, $2, $3, $4, $5)`,
+		client.ClientID, client.SecretHash, client.Name, pq.Array(client.RedirectURIs), client.CreatedAt)
+	return err
+}
+
+func (s *postgresClientStore) GetClient(ctx context.Context, clientID string) (*OAuthClient, error) {
+	var client OAuthClient
+	err := s.db.QueryRowContext(ctx,
+		`SELECT client_id, secret_hash, name, redirect_uris, created_at FROM oauth_clients WHERE client_id = $1`,
+		clientID).Scan(&client.ClientID, &client.SecretHash, &client.Name, pq.Array(&client.RedirectURIs), &client.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrClientNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &client, nil
+}
+
+func (s *postgresClientStore) ListClients(ctx context.Context) ([]*OAuthClient, error) {
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT client_id, secret_hash, name, redirect_uris, created_at FROM oauth_clients ORDER BY name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var list []*OAuthClient
+	for rows.Next() {
+		var client OAuthClient
+		if err := rows.Scan(&client.ClientID, &client.SecretHash, &client.Name,
+			pq.Array(&client.RedirectURIs), &client.CreatedAt); err != nil {
+			return nil, err
+		}
+		list = append(list, &client)
+	}
+	return list, rows.Err()
+}
+
+func (s *postgresClientStore) DeleteClient(ctx context.Context, clientID string) error {
+	result, err := s.db.ExecContext(ctx, `DELETE FROM oauth_clients WHERE client_id = $1`, clientID)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return ErrClientNotFound
+	}
+	return nil
+}
+
+func (s *postgresClientStore) SaveAuthorizationCode(ctx context.Context, code *AuthorizationCode) error {
+	_, err := s.db.ExecContext(ctx,
+		`INSERT INTO oauth_codes (code_hash, client_id, username, redirect_uri, scope, nonce, code_challenge, auth_time, expires_at)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`,
+		code.CodeHash, code.ClientID, code.Username, code.RedirectURI, code.Scope, code.Nonce,
+		code.CodeChallenge, code.AuthTime, code.ExpiresAt)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.db.ExecContext(ctx, `DELETE FROM oauth_codes WHERE expires_at < now()`)
+	return err
+}
+
+func (s *postgresClientStore) ConsumeAuthorizationCode(ctx context.Context, codeHash string) (*AuthorizationCode, error) {
+	var code AuthorizationCode
+	err := s.db.QueryRowContext(ctx,
+		`DELETE FROM oauth_codes WHERE code_hash = $1
+		 RETURNING code_hash, client_id, username, redirect_uri, scope, nonce, code_challenge, auth_time, expires_at`,
+		codeHash).Scan(&code.CodeHash, &code.ClientID, &code.Username, &code.RedirectURI, &code.Scope,
+		&code.Nonce, &code.CodeChallenge, &code.AuthTime, &code.ExpiresAt)
+
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrAuthorizationCodeInvalid
+	}
+	if err != nil {
+		return nil, err
+	}
+	if time.Now().After(code.ExpiresAt) {
+		return nil, ErrAuthorizationCodeInvalid
+	}
+	return &code, nil
+}
+
+// postgresAPIKeyStore keeps API keys in PostgreSQL
+type postgresAPIKeyStore struct {
+	db *sql.DB
+}
+
+// apiKeyColumns lists the api_keys columns in the order scanAPIKey expects
+const apiKeyColumns = `id, username, name, key_hash, prefix, scopes, created_at, expires_at, last_used_at, tenant`
+
+func scanAPIKey(row rowScanner) (*APIKey, error) {
+	var key APIKey
+	var expiresAt, lastUsedAt sql.NullTime
+	err := row.Scan(&key.ID, &key.Username, &key.Name, &key.KeyHash, &key.Prefix, pq.Array(&key.Scopes),
+		&key.CreatedAt, &expiresAt, &lastUsedAt, &key.Tenant)
+	if err != nil {
+		return nil, err
+	}
+	if expiresAt.Valid {
+		key.ExpiresAt = &expiresAt.Time
+	}
+	if lastUsedAt.Valid {
+		key.LastUsedAt = &lastUsedAt.Time
+	}
+	return &key, nil
+}
+
+func (s *postgresAPIKeyStore) CreateAPIKey(ctx context.Context, key *APIKey) error {
+	_, err := s.db.ExecContext(ctx,
+		`INSERT INTO api_keys (`+apiKeyColumns+`) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)`,
+		key.ID, key.Username, key.Name, key.KeyHash, key.Prefix, pq.Array(key.Scopes),
+		key.CreatedAt, key.ExpiresAt, key.LastUsedAt, key.Tenant)
+	return err
+}
+
+func (s *postgresAPIKeyStore) ListAPIKeys(ctx context.Context, username string) ([]*APIKey, error) {
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT `+apiKeyColumns+` FROM api_keys WHERE username = $1 ORDER BY created_at DESC`, username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var list []*APIKey
+	for rows.Next() {
+		key, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, key)
+	}
+	return list, rows.Err()
+}
+
+func (s *postgresAPIKeyStore) DeleteAPIKey(ctx context.Context, username, id string) error {
+	result, err := s.db.ExecContext(ctx, `DELETE FROM api_keys WHERE id = $1 AND username = $2`, id, username)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return ErrAPIKeyNotFound
+	}
+	return nil
+}
+
+func (s *postgresAPIKeyStore) GetAPIKeyByHash(ctx context.Context, keyHash string) (*APIKey, error) {
+	key, err := scanAPIKey(s.db.QueryRowContext(ctx,
+		`SELECT `+apiKeyColumns+` FROM api_keys WHERE key_hash = $1`, keyHash))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrAPIKeyNotFound
+	}
+	return key, err
+}
+
+func (s *postgresAPIKeyStore) TouchAPIKey(ctx context.Context, id string, usedAt time.Time) error {
+	_, err := s.db.ExecContext(ctx, `UPDATE api_keys SET last_used_at = $2 WHERE id = $1`, id, usedAt)
+	return err
+}
+
+// postgresAuditStore keeps the audit log in PostgreSQL. A trigger rejects
+// updates and deletes so that rows cannot be rewritten through the service.
+type postgresAuditStore struct {
+	db *sql.DB
+}
+
+// auditExportBatch is the number of rows fetched per query when exporting
+const auditExportBatch = 500
+
+// auditColumns lists the audit_events columns in the order scanAuditEvent expects
+const auditColumns = `id, occurred_at, event_type, username, client_ip, user_agent, outcome, detail`
+
+func scanAuditEvent(row rowScanner) (*shared.AuditEvent, error) {
+	var event shared.AuditEvent
+	err := row.Scan(&event.ID, &event.Time, &event.Type, &event.Username, &event.ClientIP,
+		&event.UserAgent, &event.Outcome, &event.Detail)
+	if err != nil {
+		return nil, err
+	}
+	return &event, nil
+}
+
+// auditWhere builds the WHERE clause and arguments for filter
+func auditWhere(filter AuditFilter) (string, []any) {
+	conds := []string{"TRUE"}
+	var args []any
+	add := func(cond string, arg any) {
+		args = append(args, arg)
+		conds = append(conds, fmt.Sprintf(cond, len(args)))
+	}
+	if filter.Type != "" {
+		add("event_type = $%d", filter.Type)
+	}
+	if filter.Username != "" {
+		add("username = $%d", filter.Username)
+	}
+	if filter.ClientIP != "" {
+		add("client_ip = $%d", filter.ClientIP)
+	}
+	if filter.Outcome != "" {
+		add("outcome = $%d", filter.Outcome)
+	}
+	if !filter.Since.IsZero() {
+		add("occurred_at >= $%d", filter.Since)
+	}
+	if !filter.Until.IsZero() {
+		add("occurred_at < $%d", filter.Until)
+	}
+	return strings.Join(conds, " AND "), args
+}
+
+func (s *postgresAuditStore) AppendAuditEvent(ctx context.Context, event *shared.AuditEvent) error {
+	return s.db.QueryRowContext(ctx,
+		`INSERT INTO audit_events (occurred_at, event_type, username, client_ip, user_agent, outcome, detail)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING id`,
+		event.Time, event.Type, event.Username, event.ClientIP, event.UserAgent, event.Outcome,
+		event.Detail).Scan(&event.ID)
+}
+
+func (s *postgresAuditStore) ListAuditEvents(ctx context.Context, filter AuditFilter, offset, limit int) ([]*shared.AuditEvent, error) {
+	where, args := auditWhere(filter)
+	args = append(args, offset, limit)
+	rows, err := s.db.QueryContext(ctx,
+		fmt.Sprintf(`SELECT `+auditColumns+` FROM audit_events WHERE %s ORDER BY id DESC OFFSET $%d LIMIT $%d`,
+			where, len(args)-1, len(args)), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var page []*shared.AuditEvent
+	for rows.Next() {
+		event, err := scanAuditEvent(rows)
+		if err != nil {
+			return nil, err
+		}
+		page = append(page, event)
+	}
+	return page, rows.Err()
+}
+
+// ExportAuditEvents pages through the table by id so that no connection is
+// held while the client reads
+func (s *postgresAuditStore) ExportAuditEvents(ctx context.Context, filter AuditFilter, fn func(*shared.AuditEvent) error) error {
+	where, args := auditWhere(filter)
+	query := fmt.Sprintf(`SELECT `+auditColumns+` FROM audit_events WHERE %s AND id > $%d ORDER BY id LIMIT %d`,
+		where, len(args)+1, auditExportBatch)
+
+	var after int64
+	for {
+		batch, err := s.auditBatch(ctx, query, append(args, after))
+		if err != nil {
+			return err
+		}
+		for _, event := range batch {
+			if err := fn(event); err != nil {
+				return err
+			}
+			after = event.ID
+		}
+		if len(batch) < auditExportBatch {
+			return nil
+		}
+	}
+}
+
+func (s *postgresAuditStore) auditBatch(ctx context.Context, query string, args []any) ([]*shared.AuditEvent, error) {
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var batch []*shared.AuditEvent
+	for rows.Next() {
+		event, err := scanAuditEvent(rows)
+		if err != nil {
+			return nil, err
+		}
+		batch = append(batch, event)
+	}
+	return batch, rows.Err()
+}
+
+// postgresOrgStore keeps organizations and memberships in PostgreSQL
+type postgresOrgStore struct {
+	db *sql.DB
+}
+
+func (s *postgresOrgStore) CreateOrg(ctx context.Context, org *Organization) error {
+	_, err := s.db.ExecContext(ctx,
+		`INSERT INTO organizations (id, name, created_at) VALUES ($1, $2, $3)`,
+		org.ID, org.Name, org.CreatedAt)
+	return uniqueViolation(err, ErrOrgExists)
+}
+
+func (s *postgresOrgStore) GetOrg(ctx context.Context, id string) (*Organization, error) {
+	var org Organization
+	err := s.db.QueryRowContext(ctx,
+		`SELECT id, name, created_at FROM organizations WHERE id = $1`, id).Scan(&org.ID, &org.Name, &org.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrOrgNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &org, nil
+}
+
+func (s *postgresOrgStore) ListOrgs(ctx context.Context, offset, limit int) ([]*Organization, error) {
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT id, name, created_at FROM organizations ORDER BY id OFFSET $1 LIMIT $2`, offset, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var page []*Organization
+	for rows.Next() {
+		var org Organization
+		if err := rows.Scan(&org.ID, &org.Name, &org.CreatedAt); err != nil {
+			return nil, err
+		}
+		page = append(page, &org)
+	}
+	return page, rows.Err()
+}
+
+func (s *postgresOrgStore) SaveMember(ctx context.Context, member *Membership) error {
+	_, err := s.db.ExecContext(ctx,
+		`INSERT INTO org_members (org_id, username, roles, joined_at) VALUES ($1, $2, $3, $4)
+		 ON CONFLICT (org_id, username) DO UPDATE SET roles = EXCLUDED.roles`,
+		member.OrgID, member.Username, pq.Array(member.Roles), member.JoinedAt)
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == "23503" {
+		return ErrOrgNotFound
+	}
+	return err
+}
+
+// memberColumns lists the org_members columns in the order scanMember expects
+const memberColumns = `org_id, username, roles, joined_at`
+
+func scanMember(row rowScanner) (*Membership, error) {
+	var member Membership
+	if err := row.Scan(&member.OrgID, &member.Username, pq.Array(&member.Roles), &member.JoinedAt); err != nil {
+		return nil, err
+	}
+	return &member, nil
+}
+
+func (s *postgresOrgStore) GetMember(ctx context.Context, orgID, username string) (*Membership, error) {
+	member, err := scanMember(s.db.QueryRowContext(ctx,
+		`SELECT `+memberColumns+` FROM org_members WHERE org_id = $1 AND username = $2`, orgID, username))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrMemberNotFound
+	}
+	return member, err
+}
+
+func (s *postgresOrgStore) RemoveMember(ctx context.Context, orgID, username string) error {
+	result, err := s.db.ExecContext(ctx,
+		`DELETE FROM org_members WHERE org_id = $1 AND username = $2`, orgID, username)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return ErrMemberNotFound
+	}
+	return nil
+}
+
+func (s *postgresOrgStore) ListMembers(ctx context.Context, orgID string) ([]*Membership, error) {
+	return s.listMembers(ctx,
+		`SELECT `+memberColumns+` FROM org_members WHERE org_id = $1 ORDER BY username`, orgID)
+}
+
+func (s *postgresOrgStore) ListMemberships(ctx context.Context, username string) ([]*Membership, error) {
+	return s.listMembers(ctx,
+		`SELECT `+memberColumns+` FROM org_members WHERE username = $1 ORDER BY org_id`, username)
+}
+
+func (s *postgresOrgStore) listMembers(ctx context.Context, query string, arg string) ([]*Membership, error) {
+	rows, err := s.db.QueryContext(ctx, query, arg)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var list []*Membership
+	for rows.Next() {
+		member, err := scanMember(rows)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, member)
+	}
+	return list, rows.Err()
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"shared"
+)
+
+var (
+	// ErrRefreshTokenInvalid is returned for unknown, expired or revoked refresh tokens
+	ErrRefreshTokenInvalid = errors.New("refresh token is invalid")
+	// ErrRefreshTokenReused is returned when an already rotated refresh token is presented again
+	ErrRefreshTokenReused = errors.New("refresh token was already used")
+)
+
+// RefreshToken is the server-side record of an issued refresh token. Only the
+// SHA-256 hash of the token is stored. Tokens issued by rotating one another
+// share a FamilyID so that a stolen token can be invalidated with its family.
+type RefreshToken struct {
+	TokenHash       string
+	FamilyID        string
+	Username        string
+	AccessJTI       string // jti of the access token issued alongside
+	AccessExpiresAt time.Time
+	CreatedAt       time.Time
+	ExpiresAt       time.Time
+}
+
+// TokenStore persists refresh tokens and revoked access token IDs. It also
+// serves as the deny-list consulted by shared.ValidateJWT.
+type TokenStore interface {
+	shared.DenyList
+	RevokeAccessToken(ctx context.Context, jti string, expiresAt time.Time) error
+	SaveRefreshToken(ctx context.Context, token *RefreshToken) error
+	// UseRefreshToken atomically marks the token as used and returns it.
+	// If the token was already used it returns the record together with
+	// ErrRefreshTokenReused so the caller can revoke the family.
+	UseRefreshToken(ctx context.Context, tokenHash string) (*RefreshToken, error)
+	// GetRefreshToken returns an unused, unexpired and unrevoked refresh
+	// token without using it, or ErrRefreshTokenInvalid
+	GetRefreshToken(ctx context.Context, tokenHash string) (*RefreshToken, error)
+	// RevokeTokenFamily revokes every refresh token in the family together
+	// with the access tokens issued alongside them.
+	RevokeTokenFamily(ctx context.Context, familyID string) error
+	// FamilyForAccessToken returns the family the access token was issued in
+	FamilyForAccessToken(ctx context.Context, jti string) (string, error)
+	// RevokeUserTokens revokes every token family belonging to username
+	// except exceptFamilyID, which may be empty to sign out everywhere
+	RevokeUserTokens(ctx context.Context, username, exceptFamilyID string) error
+	SaveActionToken(ctx context.Context, token *ActionToken) error
+	// ConsumeActionToken deletes the token and returns it, or returns
+	// ErrActionTokenInvalid if it is unknown, expired or for another purpose
+	ConsumeActionToken(ctx context.Context, tokenHash, purpose string) (*ActionToken, error)
+	// DeleteActionTokens invalidates every outstanding token of purpose for username
+	DeleteActionTokens(ctx context.Context, username, purpose string) error
+	CreateSession(ctx context.Context, session *Session) error
+	// TouchSession records a refresh of the session from clientIP and userAgent
+	TouchSession(ctx context.Context, id, clientIP, userAgent string, at, expiresAt time.Time) error
+	GetSession(ctx context.Context, id string) (*Session, error)
+	// ListSessions returns username's unexpired sessions, most recently active first
+	ListSessions(ctx context.Context, username string) ([]*Session, error)
+}
+
+// getRefreshTokenTTL returns the configured refresh token lifetime
+func getRefreshTokenTTL() time.Duration {
+	return cfg.Auth.Tokens.RefreshTTL
+}
+
+// hashToken returns the hex SHA-256 of an opaque token for storage lookups
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// newOpaqueToken returns a random URL-safe token with 256 bits of entropy
+func newOpaqueToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// issueTokens creates an access token and a rotating refresh token for user.
+// An empty familyID starts a new token family and session, as on login;
+// otherwise the session's activity is updated.
+func issueTokens(c *gin.Context, user *UserRecord, familyID string) (shared.AuthResponse, error) {
+	ctx := c.Request.Context()
+	username := user.Username
+	tenant, orgRoles, err := tenantAccess(ctx, user)
+	if err != nil {
+		return shared.AuthResponse{}, err
+	}
+	claims, err := shared.NewAccessClaims(username, user.Roles)
+	if err != nil {
+		return shared.AuthResponse{}, err
+	}
+	claims.Tenant = tenant
+	claims.OrgRoles = orgRoles
+	claims.Permissions = shared.PermissionsForMember(user.Roles, orgRoles)
+	accessToken, err := shared.SignClaims(claims)
+	if err != nil {
+		return shared.AuthResponse{}, err
+	}
+
+	refreshToken, err := newOpaqueToken()
+	if err != nil {
+		return shared.AuthResponse{}, err
+	}
+
+	now := time.Now()
+	expiresAt := now.Add(getRefreshTokenTTL())
+	if familyID == "" {
+		if familyID, err = shared.NewTokenID(); err != nil {
+			return shared.AuthResponse{}, err
+		}
+		err = tokens.CreateSession(ctx, &Session{
+			ID:           familyID,
+			Username:     username,
+			UserAgent:    c.Request.UserAgent(),
+			ClientIP:     c.ClientIP(),
+			CreatedAt:    now,
+			LastActiveAt: now,
+			ExpiresAt:    expiresAt,
+		})
+	} else {
+		err = tokens.TouchSession(ctx, familyID, c.ClientIP(), c.Request.UserAgent(), now, expiresAt)
+	}
+	if err != nil {
+		return shared.AuthResponse{}, err
+	}
+
+	err = tokens.SaveRefreshToken(ctx, &RefreshToken{
+		TokenHash:       hashToken(refreshToken),
+		FamilyID:        familyID,
+		Username:        username,
+		AccessJTI:       claims.ID,
+		AccessExpiresAt: claims.ExpiresAt.Time,
+		CreatedAt:       now,
+		ExpiresAt:       expiresAt,
+	})
+	if err != nil {
+		return shared.AuthResponse{}, err
+	}
+
+	return shared.AuthResponse{
+		Token:        accessToken,
+		RefreshToken: refreshToken,
+		ExpiresIn:    int64(time.Until(claims.ExpiresAt.Time).Seconds()),
+		Username:     username,
+	}, nil
+}
+
+type refreshRequest struct {
+	RefreshToken string `json:"refreshToken" form:"refresh_token" binding:"required"`
+}
+
+// refresh exchanges a refresh token for a new access and refresh token pair.
+// Presenting a token that was already rotated revokes its whole family.
+func refresh(c *gin.Context) {
+	var req refreshRequest
+	if err := c.ShouldBind(&req); err != nil {
+		c.JSON(http.StatusBadRequest, shared.AuthResponse{Error: "Refresh token is required"})
+		return
+	}
+
+	ctx := c.Request.Context()
+	stored, err := tokens.UseRefreshToken(ctx, hashToken(req.RefreshToken))
+	if errors.Is(err, ErrRefreshTokenReused) {
+		log.Printf("Refresh token reuse detected for %q, revoking token family", stored.Username)
+		recordAudit(c, auditRefresh, stored.Username, outcomeFailure, "reused token, family revoked")
+		if err := tokens.RevokeTokenFamily(ctx, stored.FamilyID); err != nil {
+			log.Printf("Failed to revoke token family: %v", err)
+		}
+		c.JSON(http.StatusUnauthorized, shared.AuthResponse{Error: "Invalid refresh token"})
+		return
+	}
+	if errors.Is(err, ErrRefreshTokenInvalid) {
+		recordAudit(c, auditRefresh, "", outcomeFailure, "invalid token")
+		c.JSON(http.StatusUnauthorized, shared.AuthResponse{Error: "Invalid refresh token"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, shared.AuthResponse{Error: "Could not refresh token"})
+		return
+	}
+
+	// Pick up role changes and refuse accounts disabled since login
+	account, err := users.GetUser(ctx, stored.Username)
+	if errors.Is(err, ErrUserNotFound) || (err == nil && account.Disabled) {
+		recordAudit(c, auditRefresh, stored.Username, outcomeFailure, "account disabled or deleted")
+		c.JSON(http.StatusUnauthorized, shared.AuthResponse{Error: "Invalid refresh token"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, shared.AuthResponse{Error: "Could not refresh token"})
+		return
+	}
+
+	resp, err := issueTokens(c, account, stored.FamilyID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, shared.AuthResponse{Error: "Could not generate token"})
+		return
+	}
+
+	recordAudit(c, auditRefresh, account.Username, outcomeSuccess, "")
+	resp.Message = "Token refreshed"
+	c.JSON(http.StatusOK, resp)
+}
+
+// logout revokes the presented access token and its refresh token family
+func logout(c *gin.Context) {
+	claims, err := shared.ValidateJWT(bearerToken(c))
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, shared.AuthResponse{Error: "Invalid token"})
+		return
+	}
+
+	ctx := c.Request.Context()
+	if err := tokens.RevokeAccessToken(ctx, claims.ID, claims.ExpiresAt.Time); err != nil {
+		c.JSON(http.StatusInternalServerError, shared.AuthResponse{Error: "Could not revoke token"})
+		return
+	}
+
+	familyID, err := tokens.FamilyForAccessToken(ctx, claims.ID)
+	if err == nil && familyID != "" {
+		err = tokens.RevokeTokenFamily(ctx, familyID)
+	}
+	if err != nil && !errors.Is(err, ErrRefreshTokenInvalid) {
+		c.JSON(http.StatusInternalServerError, shared.AuthResponse{Error: "Could not revoke token"})
+		return
+	}
+
+	c.JSON(http.StatusOK, shared.AuthResponse{Message: "Logged out"})
+}
+
+// bearerToken extracts the token from the Authorization header
+func bearerToken(c *gin.Context) string {
+	return strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"shared"
+)
+
+func TestRefreshTokenReuseRevokesFamily(t *testing.T) {
+	setupTest(t)
+	user := createTestUser(t, "alice", "Correct-Horse-9!")
+
+	first, err := issueTokens(testContext(), user, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var second shared.AuthResponse
+	if code := serve(t, refresh, http.MethodPost, "/refresh", refreshRequest{first.RefreshToken}, &second); code != http.StatusOK {
+		t.Fatalf("first refresh: status %d, %+v", code, second)
+	}
+	if second.RefreshToken == "" || second.RefreshToken == first.RefreshToken {
+		t.Fatalf("refresh did not rotate the refresh token: %+v", second)
+	}
+
+	// The rotated token turning up again means it was stolen
+	var reused shared.AuthResponse
+	if code := serve(t, refresh, http.MethodPost, "/refresh", refreshRequest{first.RefreshToken}, &reused); code != http.StatusUnauthorized {
+		t.Fatalf("reused refresh token: status %d, want 401", code)
+	}
+
+	var revoked shared.AuthResponse
+	if code := serve(t, refresh, http.MethodPost, "/refresh", refreshRequest{second.RefreshToken}, &revoked); code != http.StatusUnauthorized {
+		t.Errorf("refresh with the family's current token after reuse: status %d, want 401", code)
+	}
+	if _, err := shared.ValidateJWT(second.Token); err == nil {
+		t.Error("the family's access token is still accepted after reuse")
+	}
+	if sessions, err := tokens.ListSessions(context.Background(), "alice"); err != nil || len(sessions) != 0 {
+		t.Errorf("sessions after reuse = %d, %v; want none", len(sessions), err)
+	}
+
+	// Other sessions of the user are not affected
+	other, err := issueTokens(testContext(), user, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code := serve(t, refresh, http.MethodPost, "/refresh", refreshRequest{other.RefreshToken}, nil); code != http.StatusOK {
+		t.Errorf("refresh of another session: status %d, want 200", code)
+	}
+}
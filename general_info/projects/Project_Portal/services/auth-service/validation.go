@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+	"unicode"
+
+	"github.com/go-playground/validator/v10"
+	"shared"
+	"shared/config"
+)
+
+// usernamePattern allows letters, digits, '.', '_' and '-', starting with a
+// letter or digit. Usernames end up in upload file names, so path separators
+// and other special characters must never get through.
+var usernamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// commonPasswords is a small built-in banned list; PASSWORD_BANNED_FILE adds more
+var commonPasswords = []string{
+	"password", "password1", "password123", "passw0rd", "123456", "12345678",
+	"123456789", "1234567890", "qwerty", "qwerty123", "qwertyuiop", "abc123",
+	"111111", "123123", "letmein", "welcome", "welcome1", "iloveyou", "admin",
+	"admin123", "monkey", "dragon", "football", "baseball", "sunshine",
+	"princess", "trustno1", "changeme", "secret", "p@ssw0rd", "p@ssword",
+}
+
+// passwordPolicy holds the configurable registration rules
+type passwordPolicy struct {
+	minLength         int
+	maxLength         int
+	minClasses        int // of lowercase, uppercase, digits and symbols
+	banned            map[string]bool
+	usernameMinLength int
+	usernameMaxLength int
+}
+
+func loadPasswordPolicy(c config.PasswordConfig) passwordPolicy {
+	policy := passwordPolicy{
+		minLength:         c.MinLength,
+		maxLength:         c.MaxLength,
+		minClasses:        c.MinClasses,
+		banned:            make(map[string]bool),
+		usernameMinLength: c.UsernameMinLength,
+		usernameMaxLength: c.UsernameMaxLength,
+	}
+
+	for _, p := range commonPasswords {
+		policy.banned[p] = true
+	}
+	if path := c.BannedFile; path != "" {
+		if err := policy.loadBannedFile(path); err != nil {
+			log.Printf("Failed to load banned passwords from %s: %v", path, err)
+		}
+	}
+	return policy
+}
+
+// argon2Params returns the configured cost of new password hashes
+func argon2Params(c config.PasswordConfig) shared.Argon2Params {
+	params := shared.DefaultArgon2Params
+	params.Memory = uint32(c.HashMemoryKiB)
+	params.Iterations = uint32(c.HashIterations)
+	params.Parallelism = uint8(c.HashParallelism)
+	return params
+}
+
+// loadBannedFile adds one password per line, ignoring blank lines and # comments
+func (p passwordPolicy) loadBannedFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" && !strings.HasPrefix(line, "#") {
+			p.banned[strings.ToLower(line)] = true
+		}
+	}
+	return scanner.Err()
+}
+
+// validateUsername returns a message describing why username is not acceptable, or ""
+func (p passwordPolicy) validateUsername(username string) string {
+	switch {
+	case strings.TrimSpace(username) == "":
+		return "Username is required"
+	case len(username) < p.usernameMinLength || len(username) > p.usernameMaxLength:
+		return fmt.Sprintf("Username must be %d-%d characters", p.usernameMinLength, p.usernameMaxLength)
+	case !usernamePattern.MatchString(username):
+		return "Username may only contain letters, digits, '.', '_' and '-', and must start with a letter or digit"
+	}
+	return ""
+}
+
+// validatePassword returns a message describing why password is not acceptable, or ""
+func (p passwordPolicy) validatePassword(username, password string) string {
+	if strings.TrimSpace(password) == "" {
+		return "Password is required"
+	}
+
+	length := len([]rune(password))
+	if length < p.minLength {
+		return fmt.Sprintf("Password must be at least %d characters", p.minLength)
+	}
+	if length > p.maxLength {
+		return fmt.Sprintf("Password must be at most %d characters", p.maxLength)
+	}
+
+	if classes := characterClasses(password); classes < p.minClasses {
+		return fmt.Sprintf("Password must contain at least %d of: lowercase letters, uppercase letters, digits, symbols", p.minClasses)
+	}
+
+	lower := strings.ToLower(password)
+	if p.banned[lower] {
+		return "Password is too common"
+	}
+	if username != "" && strings.Contains(lower, strings.ToLower(username)) {
+		return "Password must not contain the username"
+	}
+	return ""
+}
+
+func characterClasses(password string) int {
+	var lower, upper, digit, symbol int
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			lower = 1
+		case unicode.IsUpper(r):
+			upper = 1
+		case unicode.IsDigit(r):
+			digit = 1
+		default:
+			symbol = 1
+		}
+	}
+	return lower + upper + digit + symbol
+}
+
+// validateRegistration checks every field and returns per-field messages, or nil
+func (p passwordPolicy) validateRegistration(username, email, password string) map[string]string {
+	fieldErrors := make(map[string]string)
+	if msg := p.validateUsername(username); msg != "" {
+		fieldErrors["username"] = msg
+	}
+	if msg := validateEmail(email); msg != "" {
+		fieldErrors["email"] = msg
+	}
+	if msg := p.validatePassword(username, password); msg != "" {
+		fieldErrors["password"] = msg
+	}
+	if len(fieldErrors) == 0 {
+		return nil
+	}
+	return fieldErrors
+}
+
+// bindingFieldErrors converts gin binding errors into per-field messages
+func bindingFieldErrors(err error) map[string]string {
+	var validationErrors validator.ValidationErrors
+	if !errors.As(err, &validationErrors) {
+		return nil
+	}
+
+	fieldErrors := make(map[string]string)
+	for _, fe := range validationErrors {
+		field := strings.ToLower(fe.Field())
+		if fe.Tag() == "required" {
+			fieldErrors[field] = fe.Field() + " is required"
+		} else {
+			fieldErrors[field] = fe.Field() + " is invalid"
+		}
+	}
+	return fieldErrors
+}
@@ -0,0 +1,171 @@
+package shared
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// APIKeyPrefix starts every API key so it can be told apart from a JWT
+const APIKeyPrefix = "ptk_"
+
+// ErrInvalidAPIKey is returned for unknown, expired or revoked API keys
+var ErrInvalidAPIKey = errors.New("invalid API key")
+
+// APIKeyValidator resolves an API key to claims carrying the key's scopes as
+// permissions
+type APIKeyValidator interface {
+	ValidateAPIKey(ctx context.Context, key string) (*Claims, error)
+}
+
+var apiKeyValidator APIKeyValidator
+
+// SetAPIKeyValidator makes AuthMiddleware and RequirePermission accept API
+// keys. Services that do not call it only accept JWTs.
+func SetAPIKeyValidator(v APIKeyValidator) {
+	apiKeyValidator = v
+}
+
+// IsAPIKey reports whether a credential looks like an API key
+func IsAPIKey(credential string) bool {
+	return strings.HasPrefix(credential, APIKeyPrefix)
+}
+
+// HashAPIKey returns the digest under which a key is stored and cached
+func HashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// APIKeyClaims builds the claims a validated key stands for. The jti is the
+// key ID prefixed with "key:" so logs can tell keys and tokens apart.
+func APIKeyClaims(username, keyID string, scopes []string, expiresAt *time.Time) *Claims {
+	claims := &Claims{
+		Username:    username,
+		Permissions: scopes,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:      "key:" + keyID,
+			Subject: username,
+		},
+	}
+	if expiresAt != nil {
+		claims.ExpiresAt = jwt.NewNumericDate(*expiresAt)
+	}
+	return claims
+}
+
+// FromAPIKey reports whether the claims stand for an API key rather than a
+// token issued at login
+func (c *Claims) FromAPIKey() bool {
+	return strings.HasPrefix(c.ID, "key:")
+}
+
+// RemoteAPIKeyValidator checks keys against auth-service and caches valid
+// results for a short time, so a revoked key stops working within the TTL
+type RemoteAPIKeyValidator struct {
+	url    string
+	ttl    time.Duration
+	client *http.Client
+
+	mu    sync.Mutex
+	cache map[string]cachedAPIKey // key hash -> claims
+}
+
+type cachedAPIKey struct {
+	claims   *Claims
+	cachedAt time.Time
+}
+
+// NewRemoteAPIKeyValidator returns a validator that posts keys to url
+// (auth-service's /api-keys/verify endpoint)
+func NewRemoteAPIKeyValidator(url string, ttl time.Duration) *RemoteAPIKeyValidator {
+	return &RemoteAPIKeyValidator{
+		url:    url,
+		ttl:    ttl,
+		client: &http.Client{Timeout: 5 * time.Second},
+		cache:  make(map[string]cachedAPIKey),
+	}
+}
+
+// ValidateAPIKey returns the claims for key or ErrInvalidAPIKey
+func (v *RemoteAPIKeyValidator) ValidateAPIKey(ctx context.Context, key string) (*Claims, error) {
+	hash := HashAPIKey(key)
+	now := time.Now()
+
+	v.mu.Lock()
+	cached, ok := v.cache[hash]
+	v.mu.Unlock()
+	if ok && now.Sub(cached.cachedAt) < v.ttl &&
+		(cached.claims.ExpiresAt == nil || now.Before(cached.claims.ExpiresAt.Time)) {
+		return cached.claims, nil
+	}
+
+	claims, err := v.verify(ctx, key)
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	for h, entry := range v.cache {
+		if now.Sub(entry.cachedAt) >= v.ttl {
+			delete(v.cache, h)
+		}
+	}
+	if err != nil {
+		delete(v.cache, hash)
+		return nil, err
+	}
+	v.cache[hash] = cachedAPIKey{claims: claims, cachedAt: now}
+	return claims, nil
+}
+
+func (v *RemoteAPIKeyValidator) verify(ctx context.Context, key string) (*Claims, error) {
+	body, err := json.Marshal(map[string]string{"key": key})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, v.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	AddServiceToken(req)
+
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("verify API key: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusUnauthorized {
+		return nil, ErrInvalidAPIKey
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("verify API key: unexpected status %d", resp.StatusCode)
+	}
+
+	var result APIKeyVerifyResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("decode API key verification: %w", err)
+	}
+	claims := APIKeyClaims(result.Username, result.KeyID, result.Scopes, result.ExpiresAt)
+	claims.Tenant = result.Tenant
+	return claims, nil
+}
+
+// APIKeyVerifyURL returns the configured API key verification URL or the
+// verify endpoint of auth-service
+func APIKeyVerifyURL() string {
+	if endpoints.APIKeyVerify != "" {
+		return endpoints.APIKeyVerify
+	}
+	return AuthServiceURL() + "/api-keys/verify"
+}
@@ -0,0 +1,837 @@
+// Package config loads the settings every Portal service shares. Values come
+// from an optional YAML file, then environment variables, then command-line
+// flags, each overriding the one before, and are validated before the
+// service starts.
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gopkg.in/yaml.v3"
+	"shared"
+)
+
+// Config is the effective configuration of a service
+type Config struct {
+	// Mode is the gin mode: "debug", "release" or "test". Insecure
+	// settings are refused in release mode.
+	Mode     string         `yaml:"mode"`
+	HTTP     HTTPConfig     `yaml:"http"`
+	CORS     CORSConfig     `yaml:"cors"`
+	JWT      JWTConfig      `yaml:"jwt"`
+	Services ServicesConfig `yaml:"services"`
+	// Auth and Upload are only used, and validated, by auth-service and
+	// upload-service respectively
+	Auth   AuthConfig   `yaml:"auth"`
+	Upload UploadConfig `yaml:"upload"`
+}
+
+// HTTPConfig configures the listener
+type HTTPConfig struct {
+	Addr string `yaml:"addr"`
+	// TrustedProxies lists the IPs or CIDRs whose forwarded client
+	// addresses are believed
+	TrustedProxies []string `yaml:"trustedProxies"`
+	// ShutdownDelay is how long /readyz fails before the listener closes
+	// on SIGTERM, so load balancers stop routing to the instance first
+	ShutdownDelay time.Duration `yaml:"shutdownDelay"`
+	// DrainTimeout is how long in-flight requests may then take to finish.
+	// Together with ShutdownDelay it must be shorter than the orchestrator's
+	// grace period.
+	DrainTimeout time.Duration `yaml:"drainTimeout"`
+}
+
+// CORSConfig configures cross-origin requests from browsers
+type CORSConfig struct {
+	AllowOrigins     []string `yaml:"allowOrigins"`
+	AllowCredentials bool     `yaml:"allowCredentials"`
+}
+
+// JWTConfig configures how access tokens are signed and checked
+type JWTConfig struct {
+	// Secret is the HS256 key; it is never printed
+	Secret     string `yaml:"secret"`
+	SigningAlg string `yaml:"signingAlg"`
+	Issuer     string `yaml:"issuer"`
+	Audience   string `yaml:"audience"`
+	// AccessTokenTTL is how long access tokens issued by auth-service last
+	AccessTokenTTL time.Duration `yaml:"accessTokenTTL"`
+}
+
+// ServicesConfig holds the base URLs of the other services
+type ServicesConfig struct {
+	AuthURL   string `yaml:"authURL"`
+	UploadURL string `yaml:"uploadURL"`
+	// Token authenticates the services to each other on auth-service's
+	// internal routes; it is never printed
+	Token string `yaml:"token"`
+	// The auth-service endpoints below default to their paths under AuthURL
+	JWKSURL          string `yaml:"jwksURL"`
+	TokenStatusURL   string `yaml:"tokenStatusURL"`
+	APIKeyVerifyURL  string `yaml:"apiKeyVerifyURL"`
+	IntrospectionURL string `yaml:"introspectionURL"`
+	// RevocationCacheTTL is how long a token's revocation status is cached,
+	// and so how long a revoked token may still be accepted
+	RevocationCacheTTL time.Duration `yaml:"revocationCacheTTL"`
+}
+
+// AuthConfig configures auth-service
+type AuthConfig struct {
+	// PublicBaseURL is where users reach the portal, for links in emails
+	PublicBaseURL string `yaml:"publicBaseURL"`
+	// OIDCIssuer is the OpenID Connect issuer; it defaults to PublicBaseURL
+	OIDCIssuer string `yaml:"oidcIssuer"`
+	// TOTPIssuer names the portal in authenticator apps
+	TOTPIssuer           string `yaml:"totpIssuer"`
+	RequireVerifiedEmail bool   `yaml:"requireVerifiedEmail"`
+	// AdminBootstrapToken lets the first account present it become admin;
+	// it is never printed
+	AdminBootstrapToken string `yaml:"adminBootstrapToken"`
+	// AdminUsers is no longer supported; it is only read to warn about it
+	AdminUsers []string       `yaml:"adminUsers,omitempty"`
+	Store      StoreConfig    `yaml:"store"`
+	Notifier   NotifierConfig `yaml:"notifier"`
+	Tokens     TokenConfig    `yaml:"tokens"`
+	Login      LoginConfig    `yaml:"login"`
+	Passwords  PasswordConfig `yaml:"passwords"`
+}
+
+// StoreConfig selects where accounts, tokens and the audit log are kept
+type StoreConfig struct {
+	// Kind is "memory" or "postgres"
+	Kind string `yaml:"kind"`
+	// DatabaseURL overrides the DB_* settings; it is never printed
+	DatabaseURL string `yaml:"databaseURL"`
+	Host        string `yaml:"host"`
+	Port        int    `yaml:"port"`
+	User        string `yaml:"user"`
+	// Password is never printed
+	Password string `yaml:"password"`
+	Name     string `yaml:"name"`
+	SSLMode  string `yaml:"sslMode"`
+}
+
+// NotifierConfig selects how account emails are delivered
+type NotifierConfig struct {
+	// Kind is "log", "file" (one .eml per message under Dir) or "smtp"
+	Kind string     `yaml:"kind"`
+	Dir  string     `yaml:"dir"`
+	SMTP SMTPConfig `yaml:"smtp"`
+}
+
+// SMTPConfig locates the mail server of the "smtp" notifier
+type SMTPConfig struct {
+	Host     string `yaml:"host"`
+	Port     int    `yaml:"port"`
+	Username string `yaml:"username"`
+	// Password is never printed
+	Password string `yaml:"password"`
+	From     string `yaml:"from"`
+}
+
+// TokenConfig sets how long tokens and links stay valid
+type TokenConfig struct {
+	RefreshTTL           time.Duration `yaml:"refreshTTL"`
+	EmailVerificationTTL time.Duration `yaml:"emailVerificationTTL"`
+	PasswordResetTTL     time.Duration `yaml:"passwordResetTTL"`
+	MFAChallengeTTL      time.Duration `yaml:"mfaChallengeTTL"`
+	OAuthCodeTTL         time.Duration `yaml:"oauthCodeTTL"`
+	// KeyRotation is how often a new signing key is generated
+	KeyRotation time.Duration `yaml:"keyRotation"`
+}
+
+// LoginConfig throttles failed logins: after DelayAfter failures within
+// FailureWindow each attempt is delayed, and after LockoutAfter failures of
+// an account, or IPLockoutAfter from one address, it is locked for
+// LockoutDuration
+type LoginConfig struct {
+	FailureWindow   time.Duration `yaml:"failureWindow"`
+	DelayAfter      int           `yaml:"delayAfter"`
+	LockoutAfter    int           `yaml:"lockoutAfter"`
+	IPLockoutAfter  int           `yaml:"ipLockoutAfter"`
+	LockoutDuration time.Duration `yaml:"lockoutDuration"`
+}
+
+// PasswordConfig holds the registration rules and the argon2id cost
+type PasswordConfig struct {
+	MinLength int `yaml:"minLength"`
+	MaxLength int `yaml:"maxLength"`
+	// MinClasses counts lowercase, uppercase, digits and symbols
+	MinClasses int `yaml:"minClasses"`
+	// BannedFile adds one banned password per line to the built-in list
+	BannedFile        string `yaml:"bannedFile"`
+	UsernameMinLength int    `yaml:"usernameMinLength"`
+	UsernameMaxLength int    `yaml:"usernameMaxLength"`
+	// Passwords are rehashed on login when the cost changes
+	HashMemoryKiB   int `yaml:"hashMemoryKiB"`
+	HashIterations  int `yaml:"hashIterations"`
+	HashParallelism int `yaml:"hashParallelism"`
+}
+
+// UploadConfig configures upload-service's file storage
+type UploadConfig struct {
+	// Storage selects where files are kept: "local" stores them under Dir,
+	// "s3" in an S3-compatible bucket, which lets several replicas share them
+	Storage string   `yaml:"storage"`
+	Dir     string   `yaml:"dir"`
+	S3      S3Config `yaml:"s3"`
+	// TempDir holds files while they stream in and are validated, whatever
+	// the storage; it must exist
+	TempDir string `yaml:"tempDir"`
+	// MaxBytes is the largest file accepted, enforced while it streams in
+	MaxBytes int64 `yaml:"maxBytes"`
+	// AllowedTypes lists the content types accepted, as sniffed from the
+	// file's first bytes rather than taken from the client
+	AllowedTypes []string `yaml:"allowedTypes"`
+	// Variants lists the sizes, in pixels along the longer edge, that
+	// images are also stored in; none are made larger than the original
+	Variants []int `yaml:"variants"`
+	// VariantWorkers bounds how many images are decoded and resized at once
+	VariantWorkers int `yaml:"variantWorkers"`
+	// SigningKey is the HMAC key of file URLs, shared by all replicas; it is
+	// never printed
+	SigningKey string `yaml:"signingKey"`
+	// URLTTL is how long the file URLs in responses stay valid
+	URLTTL time.Duration `yaml:"urlTTL"`
+	// MaxShareTTL bounds the expiry of share links minted by owners
+	MaxShareTTL time.Duration `yaml:"maxShareTTL"`
+	// APIKeyCacheTTL is how long an API key verification is cached, and so
+	// how long a revoked key may still be accepted
+	APIKeyCacheTTL time.Duration `yaml:"apiKeyCacheTTL"`
+}
+
+// S3Config locates the bucket of the "s3" storage
+type S3Config struct {
+	// Endpoint is the base URL of the S3 API, e.g.
+	// https://s3.eu-central-1.amazonaws.com or http://minio:9000
+	Endpoint string `yaml:"endpoint"`
+	Region   string `yaml:"region"`
+	Bucket   string `yaml:"bucket"`
+	// PathStyle addresses the bucket as a path instead of a subdomain of
+	// Endpoint, as MinIO and most other S3-compatible stores expect
+	PathStyle   bool   `yaml:"pathStyle"`
+	AccessKeyID string `yaml:"accessKeyID"`
+	// SecretAccessKey is never printed
+	SecretAccessKey string `yaml:"secretAccessKey"`
+}
+
+// Default returns the development defaults for a service listening on addr
+func Default(addr string) *Config {
+	return &Config{
+		Mode: gin.DebugMode,
+		HTTP: HTTPConfig{Addr: addr, DrainTimeout: 20 * time.Second},
+		CORS: CORSConfig{AllowOrigins: []string{"*"}},
+		JWT: JWTConfig{
+			SigningAlg:     "EdDSA",
+			Issuer:         "portal-auth-service",
+			Audience:       "portal",
+			AccessTokenTTL: 15 * time.Minute,
+		},
+		Services: ServicesConfig{
+			AuthURL:            "http://localhost:8082",
+			UploadURL:          "http://localhost:8083",
+			RevocationCacheTTL: 5 * time.Second,
+		},
+		Auth: AuthConfig{
+			PublicBaseURL: "http://localhost:8081",
+			TOTPIssuer:    "Portal",
+			Store: StoreConfig{
+				Kind:     "memory",
+				Host:     "localhost",
+				Port:     5432,
+				User:     "postgres",
+				Password: "postgres",
+				Name:     "portal_auth",
+				SSLMode:  "disable",
+			},
+			Notifier: NotifierConfig{
+				Kind: "log",
+				Dir:  "./mail",
+				SMTP: SMTPConfig{Port: 587, From: "no-reply@localhost"},
+			},
+			Tokens: TokenConfig{
+				RefreshTTL:           7 * 24 * time.Hour,
+				EmailVerificationTTL: 24 * time.Hour,
+				PasswordResetTTL:     time.Hour,
+				MFAChallengeTTL:      5 * time.Minute,
+				OAuthCodeTTL:         time.Minute,
+				KeyRotation:          24 * time.Hour,
+			},
+			Login: LoginConfig{
+				FailureWindow:   15 * time.Minute,
+				DelayAfter:      3,
+				LockoutAfter:    10,
+				IPLockoutAfter:  50,
+				LockoutDuration: 15 * time.Minute,
+			},
+			Passwords: PasswordConfig{
+				MinLength:         10,
+				MaxLength:         128,
+				MinClasses:        3,
+				UsernameMinLength: 3,
+				UsernameMaxLength: 32,
+				HashMemoryKiB:     int(shared.DefaultArgon2Params.Memory),
+				HashIterations:    int(shared.DefaultArgon2Params.Iterations),
+				HashParallelism:   int(shared.DefaultArgon2Params.Parallelism),
+			},
+		},
+		Upload: UploadConfig{
+			Storage:        "local",
+			Dir:            "./uploads",
+			S3:             S3Config{Region: "us-east-1", PathStyle: true},
+			TempDir:        os.TempDir(),
+			MaxBytes:       10 << 20,
+			AllowedTypes:   []string{"image/jpeg", "image/png", "image/gif"},
+			Variants:       []int{128, 512, 1024},
+			VariantWorkers: 2,
+			URLTTL:         15 * time.Minute,
+			MaxShareTTL:    30 * 24 * time.Hour,
+			APIKeyCacheTTL: 30 * time.Second,
+		},
+	}
+}
+
+// setting ties a field to its environment variable and flag. Secrets have no
+// flag, since command lines are visible to every user of the host.
+type setting struct {
+	env   string
+	flag  string
+	usage string
+	value any // *string, *bool, *int, *int64, *time.Duration, *[]string or *[]int
+}
+
+func (cfg *Config) settings() []setting {
+	return []setting{
+		{"GIN_MODE", "mode", "gin mode: debug, release or test", &cfg.Mode},
+		{"LISTEN_ADDR", "addr", "address to listen on", &cfg.HTTP.Addr},
+		{"SHUTDOWN_DELAY", "shutdown-delay", "how long readiness fails before the listener closes on shutdown", &cfg.HTTP.ShutdownDelay},
+		{"DRAIN_TIMEOUT", "drain-timeout", "how long in-flight requests may take to finish on shutdown", &cfg.HTTP.DrainTimeout},
+		{"TRUSTED_PROXIES", "trusted-proxies", "comma-separated IPs or CIDRs of trusted proxies", &cfg.HTTP.TrustedProxies},
+		{"CORS_ALLOW_ORIGINS", "cors-origins", "comma-separated origins allowed to call the service", &cfg.CORS.AllowOrigins},
+		{"CORS_ALLOW_CREDENTIALS", "cors-credentials", "allow credentialed cross-origin requests", &cfg.CORS.AllowCredentials},
+		{"JWT_SECRET", "", "", &cfg.JWT.Secret},
+		{"JWT_SIGNING_ALG", "jwt-signing-alg", "access token algorithm: EdDSA, RS256 or HS256", &cfg.JWT.SigningAlg},
+		{"JWT_ISSUER", "jwt-issuer", "iss claim of access tokens", &cfg.JWT.Issuer},
+		{"JWT_AUDIENCE", "jwt-audience", "aud claim of access tokens", &cfg.JWT.Audience},
+		{"ACCESS_TOKEN_TTL", "access-token-ttl", "lifetime of access tokens", &cfg.JWT.AccessTokenTTL},
+		{"AUTH_SERVICE_URL", "auth-service-url", "base URL of auth-service", &cfg.Services.AuthURL},
+		{"UPLOAD_SERVICE_URL", "upload-service-url", "base URL of upload-service", &cfg.Services.UploadURL},
+		{"SERVICE_TOKEN", "", "", &cfg.Services.Token},
+		{"JWKS_URL", "jwks-url", "JWKS of auth-service (default: under the auth-service URL)", &cfg.Services.JWKSURL},
+		{"TOKEN_STATUS_URL", "token-status-url", "token status endpoint of auth-service (default: under the auth-service URL)", &cfg.Services.TokenStatusURL},
+		{"API_KEY_VERIFY_URL", "api-key-verify-url", "API key verification endpoint of auth-service (default: under the auth-service URL)", &cfg.Services.APIKeyVerifyURL},
+		{"INTROSPECTION_URL", "introspection-url", "introspection endpoint of auth-service (default: under the auth-service URL)", &cfg.Services.IntrospectionURL},
+		{"REVOCATION_CACHE_TTL", "revocation-cache-ttl", "how long revocation checks are cached", &cfg.Services.RevocationCacheTTL},
+		{"PUBLIC_BASE_URL", "public-base-url", "where users reach the portal, for links in emails", &cfg.Auth.PublicBaseURL},
+		{"OIDC_ISSUER", "oidc-issuer", "OpenID Connect issuer (default: the public base URL)", &cfg.Auth.OIDCIssuer},
+		{"TOTP_ISSUER", "totp-issuer", "name of the portal in authenticator apps", &cfg.Auth.TOTPIssuer},
+		{"REQUIRE_VERIFIED_EMAIL", "require-verified-email", "refuse logins until the email address is verified", &cfg.Auth.RequireVerifiedEmail},
+		{"ADMIN_BOOTSTRAP_TOKEN", "", "", &cfg.Auth.AdminBootstrapToken},
+		{"ADMIN_USERS", "", "", &cfg.Auth.AdminUsers},
+		{"USER_STORE", "user-store", "where accounts are kept: memory or postgres", &cfg.Auth.Store.Kind},
+		{"DATABASE_URL", "", "", &cfg.Auth.Store.DatabaseURL},
+		{"DB_HOST", "db-host", "PostgreSQL host", &cfg.Auth.Store.Host},
+		{"DB_PORT", "db-port", "PostgreSQL port", &cfg.Auth.Store.Port},
+		{"DB_USER", "db-user", "PostgreSQL user", &cfg.Auth.Store.User},
+		{"DB_PASSWORD", "", "", &cfg.Auth.Store.Password},
+		{"DB_NAME", "db-name", "PostgreSQL database", &cfg.Auth.Store.Name},
+		{"DB_SSLMODE", "db-sslmode", "PostgreSQL sslmode", &cfg.Auth.Store.SSLMode},
+		{"NOTIFIER", "notifier", "how account emails are delivered: log, file or smtp", &cfg.Auth.Notifier.Kind},
+		{"NOTIFIER_DIR", "notifier-dir", "directory the file notifier writes to", &cfg.Auth.Notifier.Dir},
+		{"SMTP_HOST", "smtp-host", "mail server of the smtp notifier", &cfg.Auth.Notifier.SMTP.Host},
+		{"SMTP_PORT", "smtp-port", "port of the mail server", &cfg.Auth.Notifier.SMTP.Port},
+		{"SMTP_USERNAME", "smtp-username", "user of the mail server", &cfg.Auth.Notifier.SMTP.Username},
+		{"SMTP_PASSWORD", "", "", &cfg.Auth.Notifier.SMTP.Password},
+		{"SMTP_FROM", "smtp-from", "sender of account emails", &cfg.Auth.Notifier.SMTP.From},
+		{"REFRESH_TOKEN_TTL", "refresh-token-ttl", "lifetime of refresh tokens", &cfg.Auth.Tokens.RefreshTTL},
+		{"EMAIL_VERIFICATION_TTL", "email-verification-ttl", "lifetime of email verification links", &cfg.Auth.Tokens.EmailVerificationTTL},
+		{"PASSWORD_RESET_TTL", "password-reset-ttl", "lifetime of password reset links", &cfg.Auth.Tokens.PasswordResetTTL},
+		{"MFA_CHALLENGE_TTL", "mfa-challenge-ttl", "time allowed for the second factor", &cfg.Auth.Tokens.MFAChallengeTTL},
+		{"OAUTH_CODE_TTL", "oauth-code-ttl", "lifetime of OpenID Connect authorization codes", &cfg.Auth.Tokens.OAuthCodeTTL},
+		{"JWT_KEY_ROTATION", "jwt-key-rotation", "how often a new signing key is generated", &cfg.Auth.Tokens.KeyRotation},
+		{"LOGIN_FAILURE_WINDOW", "login-failure-window", "how long failed logins are counted", &cfg.Auth.Login.FailureWindow},
+		{"LOGIN_DELAY_AFTER", "login-delay-after", "failed logins before attempts are delayed", &cfg.Auth.Login.DelayAfter},
+		{"LOGIN_LOCKOUT_AFTER", "login-lockout-after", "failed logins before an account is locked", &cfg.Auth.Login.LockoutAfter},
+		{"LOGIN_IP_LOCKOUT_AFTER", "login-ip-lockout-after", "failed logins before a client address is locked", &cfg.Auth.Login.IPLockoutAfter},
+		{"LOGIN_LOCKOUT_DURATION", "login-lockout-duration", "how long a lockout lasts", &cfg.Auth.Login.LockoutDuration},
+		{"PASSWORD_MIN_LENGTH", "password-min-length", "shortest password accepted", &cfg.Auth.Passwords.MinLength},
+		{"PASSWORD_MAX_LENGTH", "password-max-length", "longest password accepted", &cfg.Auth.Passwords.MaxLength},
+		{"PASSWORD_MIN_CLASSES", "password-min-classes", "character classes a password needs", &cfg.Auth.Passwords.MinClasses},
+		{"PASSWORD_BANNED_FILE", "password-banned-file", "file of additional banned passwords", &cfg.Auth.Passwords.BannedFile},
+		{"USERNAME_MIN_LENGTH", "username-min-length", "shortest username accepted", &cfg.Auth.Passwords.UsernameMinLength},
+		{"USERNAME_MAX_LENGTH", "username-max-length", "longest username accepted", &cfg.Auth.Passwords.UsernameMaxLength},
+		{"PASSWORD_HASH_MEMORY_KIB", "password-hash-memory-kib", "argon2id memory in KiB", &cfg.Auth.Passwords.HashMemoryKiB},
+		{"PASSWORD_HASH_ITERATIONS", "password-hash-iterations", "argon2id iterations", &cfg.Auth.Passwords.HashIterations},
+		{"PASSWORD_HASH_PARALLELISM", "password-hash-parallelism", "argon2id parallelism", &cfg.Auth.Passwords.HashParallelism},
+		{"UPLOAD_STORAGE", "upload-storage", "where uploaded files are stored: local or s3", &cfg.Upload.Storage},
+		{"UPLOAD_DIR", "upload-dir", "directory uploaded files are stored in by the local storage", &cfg.Upload.Dir},
+		{"S3_ENDPOINT", "s3-endpoint", "base URL of the S3 API", &cfg.Upload.S3.Endpoint},
+		{"S3_REGION", "s3-region", "region of the bucket", &cfg.Upload.S3.Region},
+		{"S3_BUCKET", "s3-bucket", "bucket uploaded files are stored in", &cfg.Upload.S3.Bucket},
+		{"S3_PATH_STYLE", "s3-path-style", "address the bucket as a path rather than a subdomain", &cfg.Upload.S3.PathStyle},
+		{"S3_ACCESS_KEY_ID", "s3-access-key-id", "access key of the bucket", &cfg.Upload.S3.AccessKeyID},
+		{"S3_SECRET_ACCESS_KEY", "", "", &cfg.Upload.S3.SecretAccessKey},
+		{"UPLOAD_TEMP_DIR", "upload-temp-dir", "directory uploads are spooled in before they are stored", &cfg.Upload.TempDir},
+		{"UPLOAD_MAX_BYTES", "upload-max-bytes", "largest file accepted, in bytes", &cfg.Upload.MaxBytes},
+		{"UPLOAD_ALLOWED_TYPES", "upload-allowed-types", "comma-separated content types accepted", &cfg.Upload.AllowedTypes},
+		{"UPLOAD_VARIANTS", "upload-variants", "comma-separated sizes in pixels images are resized to", &cfg.Upload.Variants},
+		{"UPLOAD_VARIANT_WORKERS", "upload-variant-workers", "how many images are decoded and resized at once", &cfg.Upload.VariantWorkers},
+		{"UPLOAD_SIGNING_KEY", "", "", &cfg.Upload.SigningKey},
+		{"UPLOAD_URL_TTL", "upload-url-ttl", "how long file URLs in responses stay valid", &cfg.Upload.URLTTL},
+		{"UPLOAD_MAX_SHARE_TTL", "upload-max-share-ttl", "longest expiry of share links", &cfg.Upload.MaxShareTTL},
+		{"API_KEY_CACHE_TTL", "api-key-cache-ttl", "how long API key verifications are cached", &cfg.Upload.APIKeyCacheTTL},
+	}
+}
+
+// set parses raw into the field behind value
+func set(value any, raw string) error {
+	switch v := value.(type) {
+	case *string:
+		*v = raw
+	case *bool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return err
+		}
+		*v = b
+	case *int:
+		n, err := strconv.Atoi(raw)
+		if err != nil {
+			return err
+		}
+		*v = n
+	case *int64:
+		n, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			return err
+		}
+		*v = n
+	case *time.Duration:
+		d, err := time.ParseDuration(raw)
+		if err != nil {
+			return err
+		}
+		*v = d
+	case *[]string:
+		*v = nil
+		for _, item := range strings.Split(raw, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				*v = append(*v, item)
+			}
+		}
+	case *[]int:
+		*v = nil
+		for _, item := range strings.Split(raw, ",") {
+			if item = strings.TrimSpace(item); item == "" {
+				continue
+			}
+			n, err := strconv.Atoi(item)
+			if err != nil {
+				return err
+			}
+			*v = append(*v, n)
+		}
+	}
+	return nil
+}
+
+// Options are the flags that control loading rather than the configuration
+type Options struct {
+	// File is the YAML file given by --config or CONFIG_FILE
+	File string
+	// PrintConfig is set by --print-config
+	PrintConfig bool
+}
+
+// Section is a part of Config that only some services use, such as
+// &cfg.Upload. Those services pass it to Load to have it validated too.
+type Section interface {
+	Validate() error
+}
+
+// Load applies the YAML file, the environment and args, in that order, on
+// top of cfg and validates the shared settings and sections
+func Load(name string, cfg *Config, args []string, sections ...Section) (Options, error) {
+	var opts Options
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.StringVar(&opts.File, "config", os.Getenv("CONFIG_FILE"), "YAML configuration file")
+	fs.BoolVar(&opts.PrintConfig, "print-config", false, "print the effective configuration with secrets redacted and exit")
+
+	// Flags are collected first, since --config names the file they override
+	type flagValue struct {
+		s   setting
+		raw string
+	}
+	var flagValues []flagValue
+	for _, s := range cfg.settings() {
+		if s.flag == "" {
+			continue
+		}
+		s := s
+		fs.Func(s.flag, s.usage+" ("+s.env+")", func(raw string) error {
+			flagValues = append(flagValues, flagValue{s, raw})
+			return nil
+		})
+	}
+	if err := fs.Parse(args); err != nil {
+		return opts, err
+	}
+
+	if opts.File != "" {
+		f, err := os.Open(opts.File)
+		if err != nil {
+			return opts, err
+		}
+		dec := yaml.NewDecoder(f)
+		dec.KnownFields(true)
+		err = dec.Decode(cfg)
+		f.Close()
+		if err != nil && !errors.Is(err, io.EOF) {
+			return opts, fmt.Errorf("%s: %w", opts.File, err)
+		}
+	}
+
+	for _, s := range cfg.settings() {
+		if raw, ok := os.LookupEnv(s.env); ok && raw != "" {
+			if err := set(s.value, raw); err != nil {
+				return opts, fmt.Errorf("%s: %w", s.env, err)
+			}
+		}
+	}
+
+	for _, fv := range flagValues {
+		if err := set(fv.s.value, fv.raw); err != nil {
+			return opts, fmt.Errorf("--%s: %w", fv.s.flag, err)
+		}
+	}
+
+	cfg.Services.AuthURL = strings.TrimSuffix(cfg.Services.AuthURL, "/")
+	cfg.Services.UploadURL = strings.TrimSuffix(cfg.Services.UploadURL, "/")
+	cfg.Services.JWKSURL = strings.TrimSuffix(cfg.Services.JWKSURL, "/")
+	cfg.Services.TokenStatusURL = strings.TrimSuffix(cfg.Services.TokenStatusURL, "/")
+	cfg.Services.APIKeyVerifyURL = strings.TrimSuffix(cfg.Services.APIKeyVerifyURL, "/")
+	cfg.Services.IntrospectionURL = strings.TrimSuffix(cfg.Services.IntrospectionURL, "/")
+	cfg.Auth.PublicBaseURL = strings.TrimSuffix(cfg.Auth.PublicBaseURL, "/")
+	cfg.Auth.OIDCIssuer = strings.TrimSuffix(cfg.Auth.OIDCIssuer, "/")
+	cfg.Upload.S3.Endpoint = strings.TrimSuffix(cfg.Upload.S3.Endpoint, "/")
+	if err := cfg.Validate(); err != nil {
+		return opts, err
+	}
+	for _, section := range sections {
+		if err := section.Validate(); err != nil {
+			return opts, err
+		}
+	}
+	return opts, nil
+}
+
+// Validate reports the first invalid or insecure setting shared by every
+// service. The Auth and Upload sections are validated by their services.
+func (cfg *Config) Validate() error {
+	switch cfg.Mode {
+	case gin.DebugMode, gin.ReleaseMode, gin.TestMode:
+	default:
+		return fmt.Errorf("mode must be debug, release or test, not %q", cfg.Mode)
+	}
+	if _, _, err := net.SplitHostPort(cfg.HTTP.Addr); err != nil {
+		return fmt.Errorf("http.addr: %w", err)
+	}
+	if cfg.HTTP.ShutdownDelay < 0 || cfg.HTTP.DrainTimeout <= 0 {
+		return errors.New("http.shutdownDelay must not be negative and http.drainTimeout must be positive")
+	}
+	for _, proxy := range cfg.HTTP.TrustedProxies {
+		if net.ParseIP(proxy) == nil {
+			if _, _, err := net.ParseCIDR(proxy); err != nil {
+				return fmt.Errorf("http.trustedProxies: %q is not an IP or CIDR", proxy)
+			}
+		}
+	}
+	if len(cfg.CORS.AllowOrigins) == 0 {
+		return errors.New("cors.allowOrigins must not be empty")
+	}
+	switch cfg.JWT.SigningAlg {
+	case "EdDSA", "RS256", "HS256":
+	default:
+		return fmt.Errorf("jwt.signingAlg must be EdDSA, RS256 or HS256, not %q", cfg.JWT.SigningAlg)
+	}
+	if cfg.JWT.Issuer == "" || cfg.JWT.Audience == "" {
+		return errors.New("jwt.issuer and jwt.audience must not be empty")
+	}
+	if cfg.JWT.AccessTokenTTL <= 0 {
+		return errors.New("jwt.accessTokenTTL must be positive")
+	}
+	if err := checkHTTPURL("services.authURL", cfg.Services.AuthURL); err != nil {
+		return err
+	}
+	if err := checkHTTPURL("services.uploadURL", cfg.Services.UploadURL); err != nil {
+		return err
+	}
+	for _, endpoint := range []struct{ name, value string }{
+		{"services.jwksURL", cfg.Services.JWKSURL},
+		{"services.tokenStatusURL", cfg.Services.TokenStatusURL},
+		{"services.apiKeyVerifyURL", cfg.Services.APIKeyVerifyURL},
+		{"services.introspectionURL", cfg.Services.IntrospectionURL},
+	} {
+		if endpoint.value == "" {
+			continue
+		}
+		if err := checkHTTPURL(endpoint.name, endpoint.value); err != nil {
+			return err
+		}
+	}
+	if cfg.Services.RevocationCacheTTL <= 0 {
+		return errors.New("services.revocationCacheTTL must be positive")
+	}
+	if cfg.Services.Token != "" && len(cfg.Services.Token) < 32 {
+		return errors.New("SERVICE_TOKEN must be at least 32 characters")
+	}
+	if cfg.Mode != gin.ReleaseMode {
+		return nil
+	}
+	// Anyone knowing the development secret could mint HS256 tokens
+	if cfg.JWT.Secret == shared.DevJWTSecret ||
+		(cfg.JWT.SigningAlg == "HS256" && cfg.JWT.Secret == "") {
+		return errors.New("jwt.secret is the development default; set JWT_SECRET or use EdDSA or RS256")
+	}
+	// auth-service's internal routes would answer anyone who can reach them
+	if cfg.Services.Token == "" {
+		return errors.New("SERVICE_TOKEN must be set in release mode")
+	}
+	// Any site could make requests with the user's cookies
+	if cfg.CORS.AllowCredentials {
+		for _, origin := range cfg.CORS.AllowOrigins {
+			if origin == "*" {
+				return errors.New("cors.allowOrigins must list origins when cors.allowCredentials is set")
+			}
+		}
+	}
+	return nil
+}
+
+// Validate reports the first invalid auth setting
+func (a *AuthConfig) Validate() error {
+	if err := checkHTTPURL("auth.publicBaseURL", a.PublicBaseURL); err != nil {
+		return err
+	}
+	if a.OIDCIssuer != "" {
+		if err := checkHTTPURL("auth.oidcIssuer", a.OIDCIssuer); err != nil {
+			return err
+		}
+	}
+	if a.TOTPIssuer == "" {
+		return errors.New("auth.totpIssuer must not be empty")
+	}
+	if a.AdminBootstrapToken != "" && len(a.AdminBootstrapToken) < 32 {
+		return errors.New("ADMIN_BOOTSTRAP_TOKEN must be at least 32 characters")
+	}
+	switch a.Store.Kind {
+	case "memory", "postgres":
+	default:
+		return fmt.Errorf("auth.store.kind must be memory or postgres, not %q", a.Store.Kind)
+	}
+	switch a.Notifier.Kind {
+	case "log":
+	case "file":
+		if a.Notifier.Dir == "" {
+			return errors.New("auth.notifier.dir must not be empty")
+		}
+	case "smtp":
+		if a.Notifier.SMTP.Host == "" || a.Notifier.SMTP.Port <= 0 {
+			return errors.New("auth.notifier.smtp.host and port must be set for the smtp notifier")
+		}
+	default:
+		return fmt.Errorf("auth.notifier.kind must be log, file or smtp, not %q", a.Notifier.Kind)
+	}
+	t := a.Tokens
+	for _, d := range []struct {
+		name  string
+		value time.Duration
+	}{
+		{"refreshTTL", t.RefreshTTL},
+		{"emailVerificationTTL", t.EmailVerificationTTL},
+		{"passwordResetTTL", t.PasswordResetTTL},
+		{"mfaChallengeTTL", t.MFAChallengeTTL},
+		{"oauthCodeTTL", t.OAuthCodeTTL},
+		{"keyRotation", t.KeyRotation},
+	} {
+		if d.value <= 0 {
+			return fmt.Errorf("auth.tokens.%s must be positive", d.name)
+		}
+	}
+	l := a.Login
+	if l.FailureWindow <= 0 || l.LockoutDuration <= 0 {
+		return errors.New("auth.login.failureWindow and auth.login.lockoutDuration must be positive")
+	}
+	if l.DelayAfter < 1 || l.LockoutAfter < 1 || l.IPLockoutAfter < 1 {
+		return errors.New("auth.login.delayAfter, lockoutAfter and ipLockoutAfter must be at least 1")
+	}
+	p := a.Passwords
+	if p.MinLength < 1 || p.MaxLength < p.MinLength {
+		return errors.New("auth.passwords.minLength must be at least 1 and maxLength at least as long")
+	}
+	if p.MinClasses < 1 || p.MinClasses > 4 {
+		return errors.New("auth.passwords.minClasses must be between 1 and 4")
+	}
+	if p.UsernameMinLength < 1 || p.UsernameMaxLength < p.UsernameMinLength {
+		return errors.New("auth.passwords.usernameMinLength must be at least 1 and usernameMaxLength at least as long")
+	}
+	// argon2id needs at least 8 KiB per lane
+	if p.HashIterations < 1 || p.HashParallelism < 1 || p.HashParallelism > 255 ||
+		p.HashMemoryKiB < 8*p.HashParallelism || p.HashMemoryKiB > 4<<20 {
+		return errors.New("auth.passwords.hashIterations must be at least 1, hashParallelism between 1 and 255 " +
+			"and hashMemoryKiB between 8 KiB per lane and 4 GiB")
+	}
+	return nil
+}
+
+// Validate reports the first invalid upload setting
+func (u *UploadConfig) Validate() error {
+	switch u.Storage {
+	case "local":
+		if u.Dir == "" {
+			return errors.New("upload.dir must not be empty")
+		}
+	case "s3":
+		s3 := u.S3
+		if err := checkHTTPURL("upload.s3.endpoint", s3.Endpoint); err != nil {
+			return err
+		}
+		if s3.Region == "" || s3.Bucket == "" {
+			return errors.New("upload.s3.region and upload.s3.bucket must not be empty")
+		}
+		if s3.AccessKeyID == "" || s3.SecretAccessKey == "" {
+			return errors.New("upload.s3.accessKeyID and S3_SECRET_ACCESS_KEY must be set")
+		}
+	default:
+		return fmt.Errorf("upload.storage must be local or s3, not %q", u.Storage)
+	}
+	if fi, err := os.Stat(u.TempDir); err != nil || !fi.IsDir() {
+		return fmt.Errorf("upload.tempDir %q must be an existing directory", u.TempDir)
+	}
+	if u.MaxBytes <= 0 {
+		return errors.New("upload.maxBytes must be positive")
+	}
+	if len(u.AllowedTypes) == 0 {
+		return errors.New("upload.allowedTypes must not be empty")
+	}
+	for _, size := range u.Variants {
+		if size < 16 || size > 4096 {
+			return fmt.Errorf("upload.variants: %d is not between 16 and 4096", size)
+		}
+	}
+	if u.VariantWorkers < 1 {
+		return errors.New("upload.variantWorkers must be at least 1")
+	}
+	if u.URLTTL <= 0 || u.MaxShareTTL < u.URLTTL {
+		return errors.New("upload.urlTTL must be positive and upload.maxShareTTL at least as long")
+	}
+	if u.APIKeyCacheTTL <= 0 {
+		return errors.New("upload.apiKeyCacheTTL must be positive")
+	}
+	return nil
+}
+
+// checkHTTPURL reports raw unless it is an absolute http or https URL
+func checkHTTPURL(name, raw string) error {
+	if u, err := url.Parse(raw); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("%s must be an http or https URL, not %q", name, raw)
+	}
+	return nil
+}
+
+// Redacted returns a copy of cfg that is safe to print
+func (cfg *Config) Redacted() *Config {
+	redacted := *cfg
+	if redacted.JWT.Secret != "" {
+		redacted.JWT.Secret = "REDACTED"
+	}
+	if redacted.Services.Token != "" {
+		redacted.Services.Token = "REDACTED"
+	}
+	if redacted.Auth.AdminBootstrapToken != "" {
+		redacted.Auth.AdminBootstrapToken = "REDACTED"
+	}
+	if redacted.Auth.Store.DatabaseURL != "" {
+		redacted.Auth.Store.DatabaseURL = "REDACTED"
+	}
+	if redacted.Auth.Store.Password != "" {
+		redacted.Auth.Store.Password = "REDACTED"
+	}
+	if redacted.Auth.Notifier.SMTP.Password != "" {
+		redacted.Auth.Notifier.SMTP.Password = "REDACTED"
+	}
+	if redacted.Upload.S3.SecretAccessKey != "" {
+		redacted.Upload.S3.SecretAccessKey = "REDACTED"
+	}
+	if redacted.Upload.SigningKey != "" {
+		redacted.Upload.SigningKey = "REDACTED"
+	}
+	return &redacted
+}
+
+// Print writes cfg as YAML with secrets redacted
+func (cfg *Config) Print(w io.Writer) error {
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	if err := enc.Encode(cfg.Redacted()); err != nil {
+		return err
+	}
+	return enc.Close()
+}
+
+// Apply sets the gin mode and installs the JWT settings, the auth-service URL
+// and endpoints and the service token in the shared package
+func (cfg *Config) Apply() {
+	gin.SetMode(cfg.Mode)
+	shared.SetJWTSettings(shared.JWTSettings{
+		Secret:         cfg.JWT.Secret,
+		SigningAlg:     cfg.JWT.SigningAlg,
+		Issuer:         cfg.JWT.Issuer,
+		Audience:       cfg.JWT.Audience,
+		AccessTokenTTL: cfg.JWT.AccessTokenTTL,
+	})
+	shared.SetAuthServiceURL(cfg.Services.AuthURL)
+	shared.SetEndpoints(shared.Endpoints{
+		JWKS:          cfg.Services.JWKSURL,
+		TokenStatus:   cfg.Services.TokenStatusURL,
+		APIKeyVerify:  cfg.Services.APIKeyVerifyURL,
+		Introspection: cfg.Services.IntrospectionURL,
+	})
+	shared.SetServiceToken(cfg.Services.Token)
+}
+
+// MustLoad loads the configuration of the named service from os.Args,
+// validating the sections it uses, and applies it. It exits after
+// --print-config, and on invalid settings.
+func MustLoad(name string, cfg *Config, sections ...Section) *Config {
+	opts, err := Load(name, cfg, os.Args[1:], sections...)
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(0)
+	}
+	if opts.PrintConfig {
+		if err := cfg.Print(os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "invalid configuration:", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	if err != nil {
+		log.Fatalf("Invalid %s configuration: %v", name, err)
+	}
+	cfg.Apply()
+	return cfg
+}
@@ -0,0 +1,94 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"shared"
+)
+
+func TestLoadPrecedence(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "portal.yaml")
+	yaml := "http:\n  addr: \":9000\"\njwt:\n  issuer: yaml-issuer\n  audience: yaml-audience\n"
+	if err := os.WriteFile(file, []byte(yaml), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("JWT_ISSUER", "env-issuer")
+	t.Setenv("JWT_AUDIENCE", "env-audience")
+
+	cfg := Default(":8081")
+	if _, err := Load("test", cfg, []string{"--config", file, "--jwt-issuer", "flag-issuer"}); err != nil {
+		t.Fatal(err)
+	}
+	// Each source overrides the one before, and unset keys keep the default
+	for name, got := range map[string][2]string{
+		"http.addr (YAML)":      {cfg.HTTP.Addr, ":9000"},
+		"jwt.audience (env)":    {cfg.JWT.Audience, "env-audience"},
+		"jwt.issuer (flag)":     {cfg.JWT.Issuer, "flag-issuer"},
+		"jwt.signingAlg (none)": {cfg.JWT.SigningAlg, "EdDSA"},
+	} {
+		if got[0] != got[1] {
+			t.Errorf("%s = %q, want %q", name, got[0], got[1])
+		}
+	}
+}
+
+func TestLoadRejectsUnknownKeys(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "portal.yaml")
+	if err := os.WriteFile(file, []byte("jwt:\n  issuer: portal\n  isuser: typo\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Load("test", Default(":8081"), []string{"--config", file}); err == nil {
+		t.Error("Load accepted an unknown key")
+	}
+}
+
+func TestValidateRelease(t *testing.T) {
+	release := func(edit func(*Config)) *Config {
+		cfg := Default(":8081")
+		cfg.Mode = gin.ReleaseMode
+		cfg.Services.Token = strings.Repeat("s", 32)
+		cfg.CORS.AllowOrigins = []string{"https://portal.example.com"}
+		cfg.CORS.AllowCredentials = true
+		if edit != nil {
+			edit(cfg)
+		}
+		return cfg
+	}
+
+	tests := []struct {
+		name string
+		cfg  *Config
+		ok   bool
+	}{
+		{"secure", release(nil), true},
+		{"development JWT secret", release(func(c *Config) { c.JWT.Secret = shared.DevJWTSecret }), false},
+		{"HS256 without a secret", release(func(c *Config) { c.JWT.SigningAlg = "HS256" }), false},
+		{"HS256 with a secret", release(func(c *Config) {
+			c.JWT.SigningAlg = "HS256"
+			c.JWT.Secret = strings.Repeat("k", 32)
+		}), true},
+		{"no service token", release(func(c *Config) { c.Services.Token = "" }), false},
+		{"any origin with credentials", release(func(c *Config) { c.CORS.AllowOrigins = []string{"*"} }), false},
+		{"any origin without credentials", release(func(c *Config) {
+			c.CORS.AllowOrigins = []string{"*"}
+			c.CORS.AllowCredentials = false
+		}), true},
+		{"debug mode allows development settings", release(func(c *Config) {
+			c.Mode = gin.DebugMode
+			c.JWT.Secret = shared.DevJWTSecret
+			c.Services.Token = ""
+			c.CORS.AllowOrigins = []string{"*"}
+		}), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.cfg.Validate(); (err == nil) != tt.ok {
+				t.Errorf("Validate() = %v, want ok %v", err, tt.ok)
+			}
+		})
+	}
+}
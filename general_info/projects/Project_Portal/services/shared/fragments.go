@@ -0,0 +1,33 @@
+package shared
+
+import (
+	"embed"
+	"html/template"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/render"
+)
+
+//go:embed templates/*.html
+var templateFS embed.FS
+
+// Fragments holds the HTML fragments that services answer htmx requests
+// with, so every service renders the same markup for the same response type
+var Fragments = template.Must(template.ParseFS(templateFS, "templates/*.html"))
+
+// IsHTMX reports whether the request was made by htmx, which swaps the
+// response into the page and so wants HTML rather than JSON
+func IsHTMX(c *gin.Context) bool {
+	return c.GetHeader("HX-Request") == "true"
+}
+
+// Negotiate writes obj as JSON, or for htmx requests as the named fragment
+// executed with obj
+func Negotiate(c *gin.Context, status int, fragment string, obj any) {
+	c.Header("Vary", "HX-Request")
+	if IsHTMX(c) {
+		c.Render(status, render.HTML{Template: Fragments, Name: fragment, Data: obj})
+		return
+	}
+	c.JSON(status, obj)
+}
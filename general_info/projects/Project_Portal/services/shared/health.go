@@ -0,0 +1,171 @@
+package shared
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Health states reported by /healthz and /readyz
+const (
+	HealthOK          = "ok"
+	HealthUnavailable = "unavailable"
+	HealthDraining    = "draining"
+)
+
+// HealthCheck reports whether a dependency of the service can be used
+type HealthCheck func(ctx context.Context) error
+
+// Health serves the liveness and readiness endpoints of a service. Liveness
+// only shows that the process answers requests; readiness also runs the
+// registered dependency checks and fails once the service starts draining.
+type Health struct {
+	timeout  time.Duration
+	draining atomic.Bool
+
+	mu     sync.Mutex
+	checks map[string]HealthCheck
+}
+
+// NewHealth returns a Health whose checks must each finish within timeout
+func NewHealth(timeout time.Duration) *Health {
+	return &Health{timeout: timeout, checks: make(map[string]HealthCheck)}
+}
+
+// AddCheck registers a dependency check reported under name by /readyz
+func (h *Health) AddCheck(name string, check HealthCheck) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.checks[name] = check
+}
+
+// SetDraining makes /readyz fail so that load balancers stop sending new
+// requests while in-flight ones finish
+func (h *Health) SetDraining() {
+	h.draining.Store(true)
+}
+
+// Live handles GET /healthz
+func (h *Health) Live(c *gin.Context) {
+	c.JSON(http.StatusOK, HealthResponse{Status: HealthOK})
+}
+
+// Ready handles GET /readyz. The checks run concurrently and a failing one is
+// reported by name with its error.
+func (h *Health) Ready(c *gin.Context) {
+	if h.draining.Load() {
+		c.JSON(http.StatusServiceUnavailable, HealthResponse{Status: HealthDraining})
+		return
+	}
+
+	h.mu.Lock()
+	checks := make(map[string]HealthCheck, len(h.checks))
+	for name, check := range h.checks {
+		checks[name] = check
+	}
+	h.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), h.timeout)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	resp := HealthResponse{Status: HealthOK, Checks: make(map[string]string, len(checks))}
+	for name, check := range checks {
+		wg.Add(1)
+		go func(name string, check HealthCheck) {
+			defer wg.Done()
+			result := HealthOK
+			if err := check(ctx); err != nil {
+				result = err.Error()
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			resp.Checks[name] = result
+			if result != HealthOK {
+				resp.Status = HealthUnavailable
+			}
+		}(name, check)
+	}
+	wg.Wait()
+
+	status := http.StatusOK
+	if resp.Status != HealthOK {
+		status = http.StatusServiceUnavailable
+	}
+	c.JSON(status, resp)
+}
+
+// HTTPCheck returns a check that GETs url and expects 200, e.g. the /healthz
+// endpoint of a service this one depends on
+func HTTPCheck(url string) HealthCheck {
+	client := &http.Client{}
+	return func(ctx context.Context) error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("unexpected status %d", resp.StatusCode)
+		}
+		return nil
+	}
+}
+
+// Serve runs handler on addr until SIGINT or SIGTERM. It then marks health as
+// draining and keeps accepting requests for shutdownDelay, so load balancers
+// notice before connections are refused. Finally it stops listening and waits
+// up to drainTimeout for in-flight requests, such as uploads, before closing
+// the rest.
+func Serve(addr string, handler http.Handler, health *Health, shutdownDelay, drainTimeout time.Duration) error {
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- srv.ListenAndServe()
+	}()
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(stop)
+
+	select {
+	case err := <-errc:
+		return err
+	case sig := <-stop:
+		log.Printf("Received %s, draining requests for up to %s", sig, shutdownDelay+drainTimeout)
+	}
+
+	health.SetDraining()
+	time.Sleep(shutdownDelay)
+	ctx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		srv.Close()
+		return fmt.Errorf("drain requests: %w", err)
+	}
+	if err := <-errc; !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	log.Printf("Shut down cleanly")
+	return nil
+}
@@ -0,0 +1,183 @@
+package shared
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// ErrTokenInactive is returned by IntrospectionValidator for tokens that are
+// unknown, expired or revoked
+var ErrTokenInactive = errors.New("token is not active")
+
+// Token types reported by introspection. Access tokens and API keys are both
+// sent as bearer credentials.
+const (
+	TokenTypeBearer  = "Bearer"
+	TokenTypeRefresh = "refresh_token"
+)
+
+// IntrospectionValidator validates access tokens, API keys and refresh tokens
+// with auth-service's RFC 7662 introspection endpoint. It is an alternative
+// to ValidateJWT for services that cannot verify signatures themselves. Each
+// answer is cached for the TTL, or until the token expires if that is sooner.
+type IntrospectionValidator struct {
+	url          string
+	clientID     string
+	clientSecret string
+	ttl          time.Duration
+	client       *http.Client
+
+	mu    sync.Mutex
+	cache map[string]cachedIntrospection // token hash -> response
+}
+
+type cachedIntrospection struct {
+	resp     *IntrospectionResponse
+	cachedAt time.Time
+}
+
+// NewIntrospectionValidator returns a validator that posts tokens to url,
+// authenticating as the confidential OpenID Connect client clientID
+func NewIntrospectionValidator(url, clientID, clientSecret string, ttl time.Duration) *IntrospectionValidator {
+	return &IntrospectionValidator{
+		url:          url,
+		clientID:     clientID,
+		clientSecret: clientSecret,
+		ttl:          ttl,
+		client:       &http.Client{Timeout: 5 * time.Second},
+		cache:        make(map[string]cachedIntrospection),
+	}
+}
+
+// Introspect returns auth-service's view of token, which may be inactive
+func (v *IntrospectionValidator) Introspect(ctx context.Context, token string) (*IntrospectionResponse, error) {
+	hash := HashAPIKey(token)
+	now := time.Now()
+
+	v.mu.Lock()
+	cached, ok := v.cache[hash]
+	v.mu.Unlock()
+	if ok && now.Sub(cached.cachedAt) < v.ttl && (cached.resp.Exp == 0 || now.Unix() < cached.resp.Exp) {
+		return cached.resp, nil
+	}
+
+	resp, err := v.introspect(ctx, token)
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	for h, entry := range v.cache {
+		if now.Sub(entry.cachedAt) >= v.ttl {
+			delete(v.cache, h)
+		}
+	}
+	if err != nil {
+		delete(v.cache, hash)
+		return nil, err
+	}
+	v.cache[hash] = cachedIntrospection{resp: resp, cachedAt: now}
+	return resp, nil
+}
+
+func (v *IntrospectionValidator) introspect(ctx context.Context, token string) (*IntrospectionResponse, error) {
+	form := url.Values{"token": {token}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, v.url, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(url.QueryEscape(v.clientID), url.QueryEscape(v.clientSecret))
+
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("introspect token: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("introspect token: unexpected status %d", resp.StatusCode)
+	}
+
+	var result IntrospectionResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("decode introspection: %w", err)
+	}
+	return &result, nil
+}
+
+// Validate returns claims for an active access token or API key, with its
+// scope as permissions, or ErrTokenInactive. Refresh tokens are rejected.
+func (v *IntrospectionValidator) Validate(ctx context.Context, token string) (*Claims, error) {
+	resp, err := v.Introspect(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+	if !resp.Active || resp.TokenType != TokenTypeBearer {
+		return nil, ErrTokenInactive
+	}
+
+	claims := &Claims{
+		Username:    resp.Username,
+		Roles:       resp.Roles,
+		Permissions: strings.Fields(resp.Scope),
+		Tenant:      resp.Tenant,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:       resp.Jti,
+			Issuer:   resp.Iss,
+			Subject:  resp.Sub,
+			Audience: resp.Aud,
+		},
+	}
+	if resp.Exp != 0 {
+		claims.ExpiresAt = jwt.NewNumericDate(time.Unix(resp.Exp, 0))
+	}
+	if resp.Iat != 0 {
+		claims.IssuedAt = jwt.NewNumericDate(time.Unix(resp.Iat, 0))
+	}
+	return claims, nil
+}
+
+// IntrospectionMiddleware is AuthMiddleware for services that validate
+// tokens by introspection. It stores the same context values, so
+// RequirePermission can follow it.
+func IntrospectionMiddleware(v *IntrospectionValidator) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token := strings.TrimPrefix(strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer "), "ApiKey ")
+		if token == "" {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "No authorization header"})
+			return
+		}
+
+		claims, err := v.Validate(c.Request.Context(), token)
+		if errors.Is(err, ErrTokenInactive) {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
+			return
+		}
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"error": "Could not verify token"})
+			return
+		}
+
+		c.Set(ContextClaims, claims)
+		c.Set(ContextUsername, claims.Username)
+		c.Next()
+	}
+}
+
+// IntrospectionURL returns the configured introspection URL or the
+// introspection endpoint of auth-service
+func IntrospectionURL() string {
+	if endpoints.Introspection != "" {
+		return endpoints.Introspection
+	}
+	return AuthServiceURL() + "/introspect"
+}
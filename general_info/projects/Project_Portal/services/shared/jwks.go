@@ -0,0 +1,190 @@
+package shared
+
+import (
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ErrUnknownKeyID is returned when no verification key matches a token's kid
+var ErrUnknownKeyID = errors.New("unknown signing key id")
+
+// SigningKey is a private key used to sign access tokens
+type SigningKey struct {
+	ID        string // published as the kid header
+	Algorithm string // "RS256" or "EdDSA"
+	Key       crypto.Signer
+}
+
+// Signer supplies the current signing key to GenerateJWT
+type Signer interface {
+	SigningKey(ctx context.Context) (*SigningKey, error)
+}
+
+// KeySet resolves the public key and algorithm registered for a kid
+type KeySet interface {
+	PublicKey(ctx context.Context, kid string) (alg string, key crypto.PublicKey, err error)
+}
+
+// JSONWebKey is the public part of a signing key as published in a JWKS (RFC 7517)
+type JSONWebKey struct {
+	KeyType   string `json:"kty"`
+	Use       string `json:"use,omitempty"`
+	KeyID     string `json:"kid"`
+	Algorithm string `json:"alg"`
+	// RSA keys
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+	// Ed25519 keys
+	Curve string `json:"crv,omitempty"`
+	X     string `json:"x,omitempty"`
+}
+
+// JSONWebKeySet is the document served from /.well-known/jwks.json
+type JSONWebKeySet struct {
+	Keys []JSONWebKey `json:"keys"`
+}
+
+// NewJSONWebKey encodes an RSA or Ed25519 public key as a JWK
+func NewJSONWebKey(kid, alg string, pub crypto.PublicKey) (JSONWebKey, error) {
+	jwk := JSONWebKey{Use: "sig", KeyID: kid, Algorithm: alg}
+
+	switch key := pub.(type) {
+	case *rsa.PublicKey:
+		jwk.KeyType = "RSA"
+		jwk.N = base64.RawURLEncoding.EncodeToString(key.N.Bytes())
+		jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes())
+	case ed25519.PublicKey:
+		jwk.KeyType = "OKP"
+		jwk.Curve = "Ed25519"
+		jwk.X = base64.RawURLEncoding.EncodeToString(key)
+	default:
+		return JSONWebKey{}, fmt.Errorf("unsupported public key type %T", pub)
+	}
+	return jwk, nil
+}
+
+// PublicKey decodes the JWK into an *rsa.PublicKey or ed25519.PublicKey
+func (k JSONWebKey) PublicKey() (crypto.PublicKey, error) {
+	switch {
+	case k.KeyType == "RSA" && k.Algorithm == "RS256":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, fmt.Errorf("decode modulus: %w", err)
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, fmt.Errorf("decode exponent: %w", err)
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case k.KeyType == "OKP" && k.Curve == "Ed25519" && k.Algorithm == "EdDSA":
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid Ed25519 public key")
+		}
+		return ed25519.PublicKey(x), nil
+	default:
+		return nil, fmt.Errorf("unsupported key kty=%q alg=%q", k.KeyType, k.Algorithm)
+	}
+}
+
+type cachedKey struct {
+	alg string
+	key crypto.PublicKey
+}
+
+// RemoteKeySet fetches verification keys from a JWKS endpoint and caches them.
+// An unknown kid triggers an early refetch so freshly rotated keys are picked
+// up without waiting for the cache to expire.
+type RemoteKeySet struct {
+	url    string
+	ttl    time.Duration
+	client *http.Client
+
+	mu          sync.Mutex
+	keys        map[string]cachedKey
+	fetchedAt   time.Time
+	attemptedAt time.Time
+}
+
+// minRefetchInterval limits how often unknown kids or fetch failures hit the endpoint
+const minRefetchInterval = 10 * time.Second
+
+// NewRemoteKeySet returns a KeySet backed by the JWKS document at url
+func NewRemoteKeySet(url string, ttl time.Duration) *RemoteKeySet {
+	return &RemoteKeySet{
+		url:    url,
+		ttl:    ttl,
+		client: &http.Client{Timeout: 5 * time.Second},
+		keys:   make(map[string]cachedKey),
+	}
+}
+
+// PublicKey returns the algorithm and public key published for kid
+func (s *RemoteKeySet) PublicKey(ctx context.Context, kid string) (string, crypto.PublicKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key, known := s.keys[kid]
+	stale := !known || time.Since(s.fetchedAt) > s.ttl
+	if stale && time.Since(s.attemptedAt) > minRefetchInterval {
+		s.attemptedAt = time.Now()
+		if err := s.fetchLocked(ctx); err != nil {
+			if !known {
+				return "", nil, err
+			}
+		} else {
+			key, known = s.keys[kid]
+		}
+	}
+
+	if !known {
+		return "", nil, ErrUnknownKeyID
+	}
+	return key.alg, key.key, nil
+}
+
+// fetchLocked reloads the key set; callers must hold s.mu
+func (s *RemoteKeySet) fetchLocked(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.url, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("fetch JWKS: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("fetch JWKS: unexpected status %d", resp.StatusCode)
+	}
+
+	var set JSONWebKeySet
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return fmt.Errorf("decode JWKS: %w", err)
+	}
+
+	keys := make(map[string]cachedKey, len(set.Keys))
+	for _, jwk := range set.Keys {
+		pub, err := jwk.PublicKey()
+		if err != nil {
+			continue // skip keys we cannot use rather than failing the whole set
+		}
+		keys[jwk.KeyID] = cachedKey{alg: jwk.Algorithm, key: pub}
+	}
+
+	s.keys = keys
+	s.fetchedAt = time.Now()
+	return nil
+}
@@ -0,0 +1,125 @@
+package shared
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Context keys set by AuthMiddleware
+const (
+	ContextUsername = "username"
+	ContextClaims   = "claims"
+)
+
+// AuthMiddleware validates the bearer token and stores its claims in the
+// request context under ContextClaims and the username under ContextUsername
+func AuthMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !authenticateRequest(c) {
+			return
+		}
+		c.Next()
+	}
+}
+
+// RequirePermission rejects requests whose token lacks perm. It authenticates
+// the request first if AuthMiddleware has not already run.
+func RequirePermission(perm string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if _, ok := c.Get(ContextClaims); !ok && !authenticateRequest(c) {
+			return
+		}
+
+		claims := ClaimsFromContext(c)
+		if claims == nil || !claims.HasPermission(perm) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Missing permission " + perm})
+			return
+		}
+		c.Next()
+	}
+}
+
+// RequireSession rejects API keys, for actions that only someone signed in as
+// the account holder may take. It authenticates the request first if
+// AuthMiddleware has not already run.
+func RequireSession() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if _, ok := c.Get(ContextClaims); !ok && !authenticateRequest(c) {
+			return
+		}
+
+		if claims := ClaimsFromContext(c); claims == nil || claims.FromAPIKey() {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "API keys are not accepted here"})
+			return
+		}
+		c.Next()
+	}
+}
+
+// authenticateRequest validates the bearer token or API key and stores its
+// claims, aborting with 401 and returning false when it is missing or invalid
+func authenticateRequest(c *gin.Context) bool {
+	tokenString := c.GetHeader("Authorization")
+	if tokenString == "" {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "No authorization header"})
+		return false
+	}
+
+	// Remove "Bearer " or "ApiKey " prefix
+	tokenString = strings.TrimPrefix(strings.TrimPrefix(tokenString, "Bearer "), "ApiKey ")
+
+	if IsAPIKey(tokenString) {
+		return authenticateAPIKey(c, tokenString)
+	}
+
+	claims, err := ValidateJWT(tokenString)
+	if errors.Is(err, ErrRevocationCheck) {
+		c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"error": "Could not verify token"})
+		return false
+	}
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
+		return false
+	}
+	// Tokens issued to OpenID Connect clients are only good for /userinfo
+	if claims.Scope != "" {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Token not valid for this service"})
+		return false
+	}
+
+	c.Set(ContextClaims, claims)
+	c.Set(ContextUsername, claims.Username)
+	return true
+}
+
+// ClaimsFromContext returns the claims stored by AuthMiddleware, or nil
+func ClaimsFromContext(c *gin.Context) *Claims {
+	claims, _ := c.Get(ContextClaims)
+	typed, _ := claims.(*Claims)
+	return typed
+}
+
+// authenticateAPIKey validates key with the installed APIKeyValidator
+func authenticateAPIKey(c *gin.Context, key string) bool {
+	if apiKeyValidator == nil {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "API keys are not accepted here"})
+		return false
+	}
+
+	claims, err := apiKeyValidator.ValidateAPIKey(c.Request.Context(), key)
+	if errors.Is(err, ErrInvalidAPIKey) {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid API key"})
+		return false
+	}
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"error": "Could not verify API key"})
+		return false
+	}
+
+	c.Set(ContextClaims, claims)
+	c.Set(ContextUsername, claims.Username)
+	return true
+}
@@ -0,0 +1,79 @@
+package shared
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// useCheapArgon2 keeps the tests fast; the cost is part of the hash anyway
+func useCheapArgon2(t *testing.T) {
+	params := DefaultArgon2Params
+	params.Memory = 64
+	params.Iterations = 1
+	params.Parallelism = 1
+	SetArgon2Params(params)
+	t.Cleanup(func() { SetArgon2Params(DefaultArgon2Params) })
+}
+
+func TestVerifyPassword(t *testing.T) {
+	useCheapArgon2(t)
+	hash, err := HashPassword("Correct-Horse-9!")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(hash, "$argon2id$v=19$m=64,t=1,p=1$") {
+		t.Fatalf("HashPassword = %q, want an argon2id PHC string", hash)
+	}
+	other, _ := HashPassword("Correct-Horse-9!")
+	if other == hash {
+		t.Error("two hashes of one password are equal; the salt is not random")
+	}
+
+	// SHA-256 of "Correct-Horse-9!", as the first HashPassword stored it
+	const legacy = "caac6ca8be26ec69fda9065732ac4f05ac5355061e4aa201c40fcb4a4d61d64c"
+
+	tests := []struct {
+		name        string
+		hash        string
+		password    string
+		match       bool
+		needsRehash bool
+	}{
+		{"argon2id", hash, "Correct-Horse-9!", true, false},
+		{"argon2id wrong password", hash, "correct-horse-9!", false, false},
+		{"legacy SHA-256", legacy, "Correct-Horse-9!", true, true},
+		{"legacy SHA-256 wrong password", legacy, "Wrong-Horse-9!", false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			match, needsRehash, err := VerifyPassword(tt.hash, tt.password)
+			if err != nil || match != tt.match || needsRehash != tt.needsRehash {
+				t.Errorf("VerifyPassword = %v, %v, %v; want %v, %v, nil", match, needsRehash, err, tt.match, tt.needsRehash)
+			}
+		})
+	}
+}
+
+func TestVerifyPasswordOutdatedCost(t *testing.T) {
+	useCheapArgon2(t)
+	hash, err := HashPassword("Correct-Horse-9!")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	params := getArgon2Params()
+	params.Iterations = 2
+	SetArgon2Params(params)
+	if match, needsRehash, err := VerifyPassword(hash, "Correct-Horse-9!"); err != nil || !match || !needsRehash {
+		t.Errorf("VerifyPassword after a cost change = %v, %v, %v; want true, true, nil", match, needsRehash, err)
+	}
+}
+
+func TestVerifyPasswordInvalidHash(t *testing.T) {
+	for _, hash := range []string{"", "plaintext", "$argon2i$v=19$m=64,t=1,p=1$c2FsdA$a2V5", "$argon2id$v=18$m=64,t=1,p=1$c2FsdA$a2V5"} {
+		if _, _, err := VerifyPassword(hash, "x"); !errors.Is(err, ErrInvalidHash) {
+			t.Errorf("VerifyPassword(%q) error = %v, want ErrInvalidHash", hash, err)
+		}
+	}
+}
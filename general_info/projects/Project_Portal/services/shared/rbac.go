@@ -0,0 +1,125 @@
+package shared
+
+import "sort"
+
+// Roles known to the Portal services
+const (
+	RoleUser  = "user"
+	RoleAdmin = "admin"
+)
+
+// Permissions carried in access tokens and checked by RequirePermission
+const (
+	PermProfileRead   = "profile:read"
+	PermUploadWrite   = "upload:write"
+	PermUploadsRead   = "uploads:read"   // list every user's uploads
+	PermUploadsDelete = "uploads:delete" // remove any user's upload
+	PermUsersRead     = "users:read"
+	PermUsersWrite    = "users:write" // disable and enable accounts
+	PermRolesWrite    = "roles:write"
+	PermClientsWrite  = "clients:write" // register and remove OpenID Connect clients
+	PermAuditRead     = "audit:read"    // search and export the auth audit log
+	PermOrgsWrite     = "orgs:write"    // create organizations
+)
+
+// RolePermissions maps each role to the permissions it grants
+var RolePermissions = map[string][]string{
+	RoleUser: {
+		PermProfileRead,
+		PermUploadWrite,
+	},
+	RoleAdmin: {
+		PermProfileRead,
+		PermUploadWrite,
+		PermUploadsRead,
+		PermUploadsDelete,
+		PermUsersRead,
+		PermUsersWrite,
+		PermRolesWrite,
+		PermClientsWrite,
+		PermAuditRead,
+		PermOrgsWrite,
+	},
+}
+
+// Roles a member holds within an organization. They only apply to tokens
+// issued for that organization's tenant.
+const (
+	OrgRoleMember = "member"
+	OrgRoleOwner  = "owner" // manages members and moderates the tenant's uploads
+)
+
+// OrgRolePermissions maps each organization role to the permissions it grants
+// within the organization
+var OrgRolePermissions = map[string][]string{
+	OrgRoleMember: {
+		PermProfileRead,
+		PermUploadWrite,
+	},
+	OrgRoleOwner: {
+		PermProfileRead,
+		PermUploadWrite,
+		PermUploadsRead,
+		PermUploadsDelete,
+	},
+}
+
+// IsKnownOrgRole reports whether role is defined in OrgRolePermissions
+func IsKnownOrgRole(role string) bool {
+	_, ok := OrgRolePermissions[role]
+	return ok
+}
+
+// IsKnownRole reports whether role is defined in RolePermissions
+func IsKnownRole(role string) bool {
+	_, ok := RolePermissions[role]
+	return ok
+}
+
+// PermissionsForRoles returns the sorted union of the permissions granted by roles
+func PermissionsForRoles(roles []string) []string {
+	return PermissionsForMember(roles, nil)
+}
+
+// PermissionsForMember returns the sorted union of the permissions granted by
+// the account's roles and its roles in the current organization
+func PermissionsForMember(roles, orgRoles []string) []string {
+	set := make(map[string]struct{})
+	for _, role := range roles {
+		for _, perm := range RolePermissions[role] {
+			set[perm] = struct{}{}
+		}
+	}
+	for _, role := range orgRoles {
+		for _, perm := range OrgRolePermissions[role] {
+			set[perm] = struct{}{}
+		}
+	}
+
+	perms := make([]string, 0, len(set))
+	for perm := range set {
+		perms = append(perms, perm)
+	}
+	sort.Strings(perms)
+	return perms
+}
+
+// HasPermission reports whether the token grants perm
+func (c *Claims) HasPermission(perm string) bool {
+	for _, p := range c.Permissions {
+		if p == perm {
+			return true
+		}
+	}
+	return false
+}
+
+// HasRole reports whether the token carries role
+func (c *Claims) HasRole(role string) bool {
+	for _, r := range c.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,104 @@
+package shared
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// RemoteDenyList asks auth-service whether access tokens were revoked and
+// caches each answer for a short time, so services that do not share the
+// token store still honor logouts and revoked sessions within the TTL
+type RemoteDenyList struct {
+	url    string
+	ttl    time.Duration
+	client *http.Client
+
+	mu    sync.Mutex
+	cache map[string]cachedRevocation // jti -> status
+}
+
+type cachedRevocation struct {
+	revoked  bool
+	cachedAt time.Time
+}
+
+// NewRemoteDenyList returns a deny-list that posts token IDs to url
+// (auth-service's /tokens/status endpoint)
+func NewRemoteDenyList(url string, ttl time.Duration) *RemoteDenyList {
+	return &RemoteDenyList{
+		url:    url,
+		ttl:    ttl,
+		client: &http.Client{Timeout: 5 * time.Second},
+		cache:  make(map[string]cachedRevocation),
+	}
+}
+
+// IsRevoked implements DenyList
+func (d *RemoteDenyList) IsRevoked(ctx context.Context, jti string) (bool, error) {
+	now := time.Now()
+
+	d.mu.Lock()
+	cached, ok := d.cache[jti]
+	d.mu.Unlock()
+	if ok && now.Sub(cached.cachedAt) < d.ttl {
+		return cached.revoked, nil
+	}
+
+	revoked, err := d.check(ctx, jti)
+	if err != nil {
+		return false, err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for id, entry := range d.cache {
+		if now.Sub(entry.cachedAt) >= d.ttl {
+			delete(d.cache, id)
+		}
+	}
+	d.cache[jti] = cachedRevocation{revoked: revoked, cachedAt: now}
+	return revoked, nil
+}
+
+func (d *RemoteDenyList) check(ctx context.Context, jti string) (bool, error) {
+	body, err := json.Marshal(map[string]string{"jti": jti})
+	if err != nil {
+		return false, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	AddServiceToken(req)
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return false, fmt.Errorf("check token status: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("check token status: unexpected status %d", resp.StatusCode)
+	}
+
+	var result TokenStatusResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return false, fmt.Errorf("decode token status: %w", err)
+	}
+	return result.Revoked, nil
+}
+
+// TokenStatusURL returns the configured token status URL or the token status
+// endpoint of auth-service
+func TokenStatusURL() string {
+	if endpoints.TokenStatus != "" {
+		return endpoints.TokenStatus
+	}
+	return AuthServiceURL() + "/tokens/status"
+}
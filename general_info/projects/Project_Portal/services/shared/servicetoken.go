@@ -0,0 +1,49 @@
+package shared
+
+import (
+	"crypto/subtle"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ServiceTokenHeader carries the service token on calls between services
+const ServiceTokenHeader = "X-Service-Token"
+
+var serviceToken string
+
+// SetServiceToken installs the token sent to and required by auth-service's
+// internal routes. It should be called once during service startup.
+func SetServiceToken(token string) {
+	serviceToken = token
+}
+
+// HasServiceToken reports whether a service token is installed
+func HasServiceToken() bool {
+	return serviceToken != ""
+}
+
+// AddServiceToken authenticates an outgoing call to another service
+func AddServiceToken(req *http.Request) {
+	if serviceToken != "" {
+		req.Header.Set(ServiceTokenHeader, serviceToken)
+	}
+}
+
+// RequireServiceToken rejects requests without the service token, for routes
+// only other services may call. Without an installed token every request is
+// let through, which configuration only allows outside release mode.
+func RequireServiceToken() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if serviceToken == "" {
+			c.Next()
+			return
+		}
+		got := c.GetHeader(ServiceTokenHeader)
+		if subtle.ConstantTimeCompare([]byte(got), []byte(serviceToken)) != 1 {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid service token"})
+			return
+		}
+		c.Next()
+	}
+}
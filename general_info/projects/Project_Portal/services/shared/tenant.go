@@ -0,0 +1,26 @@
+package shared
+
+import "regexp"
+
+// DefaultTenant holds the accounts and files that belong to no organization
+const DefaultTenant = "default"
+
+// tenantPattern keeps organization IDs safe to use as directory names and
+// URL segments
+var tenantPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{1,38}[a-z0-9]$`)
+
+// ValidTenantID reports whether id can name an organization. DefaultTenant
+// is reserved.
+func ValidTenantID(id string) bool {
+	return id != DefaultTenant && tenantPattern.MatchString(id)
+}
+
+// TenantID returns the tenant the token acts for. Tokens issued before
+// organizations existed, and tokens of accounts outside any organization,
+// belong to DefaultTenant.
+func (c *Claims) TenantID() string {
+	if c.Tenant == "" {
+		return DefaultTenant
+	}
+	return c.Tenant
+}
@@ -1,25 +1,68 @@
 package shared
 
-import "github.com/golang-jwt/jwt/v5"
+import (
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
 
 // User represents the user data structure for authentication
 type User struct {
-	Username string `json:"username" binding:"required"`
-	Password string `json:"password" binding:"required"`
+	Username string `json:"username" form:"username" binding:"required"`
+	Password string `json:"password" form:"password" binding:"required"`
+	Email    string `json:"email,omitempty" form:"email"` // required on registration only
 }
 
 // Claims represents JWT claims
 type Claims struct {
-	Username string `json:"username"`
+	Username    string   `json:"username"`
+	Roles       []string `json:"roles,omitempty"`
+	Permissions []string `json:"permissions,omitempty"`
+	// Scope lists the OAuth scopes granted to tokens issued to OIDC clients
+	Scope string `json:"scope,omitempty"`
+	// Tenant is the organization the token acts for; empty means DefaultTenant
+	Tenant   string   `json:"tenant,omitempty"`
+	OrgRoles []string `json:"org_roles,omitempty"`
+
+	// OpenID Connect ID token claims
+	Nonce           string           `json:"nonce,omitempty"`
+	AuthTime        *jwt.NumericDate `json:"auth_time,omitempty"`
+	AuthorizedParty string           `json:"azp,omitempty"`
+	Email           string           `json:"email,omitempty"`
+	EmailVerified   *bool            `json:"email_verified,omitempty"`
+
 	jwt.RegisteredClaims
 }
 
 // AuthResponse represents the response from authentication operations
 type AuthResponse struct {
-	Token    string `json:"token,omitempty"`
-	Username string `json:"username,omitempty"`
-	Message  string `json:"message"`
-	Error    string `json:"error,omitempty"`
+	Token        string `json:"token,omitempty"`
+	RefreshToken string `json:"refreshToken,omitempty"`
+	ExpiresIn    int64  `json:"expiresIn,omitempty"` // access token lifetime in seconds
+	Username     string `json:"username,omitempty"`
+	Message      string `json:"message"`
+	Error        string `json:"error,omitempty"`
+	// FieldErrors maps form field names to validation messages
+	FieldErrors map[string]string `json:"fieldErrors,omitempty"`
+	// MFARequired is set instead of Token when the account uses a second
+	// factor; MFAToken must then be sent with a code to complete the login
+	MFARequired bool   `json:"mfaRequired,omitempty"`
+	MFAToken    string `json:"mfaToken,omitempty"`
+}
+
+// MFAEnrollResponse carries a new, not yet confirmed TOTP secret
+type MFAEnrollResponse struct {
+	Secret     string `json:"secret,omitempty"`
+	OTPAuthURI string `json:"otpauthUri,omitempty"`
+	QRCode     string `json:"qrCode,omitempty"` // data:image/png;base64 URI of OTPAuthURI
+	Error      string `json:"error,omitempty"`
+}
+
+// RecoveryCodesResponse returns one-time recovery codes; they are shown only once
+type RecoveryCodesResponse struct {
+	RecoveryCodes []string `json:"recoveryCodes,omitempty"`
+	Message       string   `json:"message,omitempty"`
+	Error         string   `json:"error,omitempty"`
 }
 
 // UploadResponse represents the response from upload operations
@@ -27,12 +70,273 @@ type UploadResponse struct {
 	Message  string `json:"message"`
 	ImageURL string `json:"imageUrl,omitempty"`
 	Filename string `json:"filename,omitempty"`
-	Error    string `json:"error,omitempty"`
+	// OriginalName is the client's file name, sanitized; files are stored
+	// under Filename, which the server generates
+	OriginalName string `json:"originalName,omitempty"`
+	ContentType  string `json:"contentType,omitempty"`
+	Size         int64  `json:"size,omitempty"`
+	// Variants are resized copies of an image, smallest first
+	Variants []UploadVariant `json:"variants,omitempty"`
+	Error    string          `json:"error,omitempty"`
+	// Code identifies why an upload was rejected, one of the UploadErr
+	// constants
+	Code string `json:"code,omitempty"`
+	// FieldErrors maps invalid fields of an update to a message
+	FieldErrors map[string]string `json:"fieldErrors,omitempty"`
 }
 
-// ProfileResponse represents the response from profile operations
+// Upload rejection codes returned in UploadResponse.Code
+const (
+	UploadErrNoFile          = "no_file"
+	UploadErrEmptyFile       = "empty_file"
+	UploadErrTooLarge        = "too_large"
+	UploadErrUnsupportedType = "unsupported_type"
+	UploadErrInvalidImage    = "invalid_image"
+	UploadErrStorage         = "storage_error"
+)
+
+// UploadVariant is a resized copy of an uploaded image. Size is the
+// configured size, Width and Height are the actual dimensions.
+type UploadVariant struct {
+	Size   int    `json:"size"`
+	URL    string `json:"url"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+}
+
+// ProfileResponse represents the response from profile operations. The
+// upload totals are only filled in by upload-service.
 type ProfileResponse struct {
-	Username string `json:"username"`
-	Message  string `json:"message"`
-	Error    string `json:"error,omitempty"`
-}
\ No newline at end of file
+	Username         string     `json:"username"`
+	DisplayName      string     `json:"displayName,omitempty"`
+	Email            string     `json:"email,omitempty"`
+	EmailVerified    bool       `json:"emailVerified"`
+	Roles            []string   `json:"roles,omitempty"`
+	TwoFactorEnabled bool       `json:"twoFactorEnabled"`
+	CreatedAt        *time.Time `json:"createdAt,omitempty"`
+	UploadCount      int        `json:"uploadCount,omitempty"`
+	UploadBytes      int64      `json:"uploadBytes,omitempty"`
+	Message          string     `json:"message"`
+	Error            string     `json:"error,omitempty"`
+}
+
+// UserSummary describes an account in admin listings
+type UserSummary struct {
+	Username  string    `json:"username"`
+	Roles     []string  `json:"roles"`
+	Disabled  bool      `json:"disabled"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// UserListResponse represents a page of accounts returned to admins
+type UserListResponse struct {
+	Users  []UserSummary `json:"users"`
+	Offset int           `json:"offset"`
+	Limit  int           `json:"limit"`
+	Error  string        `json:"error,omitempty"`
+}
+
+// SessionInfo describes a signed-in device. A session lasts as long as its
+// refresh token family.
+type SessionInfo struct {
+	ID           string    `json:"id"`
+	UserAgent    string    `json:"userAgent,omitempty"`
+	ClientIP     string    `json:"clientIp,omitempty"`
+	CreatedAt    time.Time `json:"createdAt"`
+	LastActiveAt time.Time `json:"lastActiveAt"`
+	Current      bool      `json:"current"`
+}
+
+// SessionListResponse lists the signed-in user's active sessions
+type SessionListResponse struct {
+	Sessions []SessionInfo `json:"sessions"`
+	Error    string        `json:"error,omitempty"`
+}
+
+// TokenStatusResponse tells other services whether an access token was revoked
+type TokenStatusResponse struct {
+	Revoked bool `json:"revoked"`
+}
+
+// IntrospectionResponse is an RFC 7662 token introspection response. Inactive
+// tokens only carry Active; Roles and Tenant are Portal extensions.
+type IntrospectionResponse struct {
+	Active    bool     `json:"active"`
+	Scope     string   `json:"scope,omitempty"`
+	ClientID  string   `json:"client_id,omitempty"`
+	Username  string   `json:"username,omitempty"`
+	TokenType string   `json:"token_type,omitempty"`
+	Exp       int64    `json:"exp,omitempty"`
+	Iat       int64    `json:"iat,omitempty"`
+	Sub       string   `json:"sub,omitempty"`
+	Aud       []string `json:"aud,omitempty"`
+	Iss       string   `json:"iss,omitempty"`
+	Jti       string   `json:"jti,omitempty"`
+	Roles     []string `json:"roles,omitempty"`
+	Tenant    string   `json:"tenant,omitempty"`
+}
+
+// AuditEvent is an entry in the auth-service audit log
+type AuditEvent struct {
+	ID        int64     `json:"id"`
+	Time      time.Time `json:"time"`
+	Type      string    `json:"type"`
+	Username  string    `json:"username,omitempty"`
+	ClientIP  string    `json:"clientIp,omitempty"`
+	UserAgent string    `json:"userAgent,omitempty"`
+	Outcome   string    `json:"outcome"`
+	Detail    string    `json:"detail,omitempty"`
+}
+
+// AuditListResponse represents a page of audit events returned to admins,
+// newest first
+type AuditListResponse struct {
+	Events []AuditEvent `json:"events"`
+	Offset int          `json:"offset"`
+	Limit  int          `json:"limit"`
+	Error  string       `json:"error,omitempty"`
+}
+
+// UploadInfo describes a stored upload in moderation listings
+type UploadInfo struct {
+	Filename   string    `json:"filename"`
+	URL        string    `json:"url"`
+	Size       int64     `json:"size"`
+	ModifiedAt time.Time `json:"modifiedAt"`
+}
+
+// UploadListResponse represents a list of uploads returned to moderators
+type UploadListResponse struct {
+	Uploads []UploadInfo `json:"uploads"`
+	Error   string       `json:"error,omitempty"`
+}
+
+// UploadRecord describes one of the caller's uploads in their library. ID is
+// the stored file name.
+type UploadRecord struct {
+	ID           string   `json:"id"`
+	URL          string   `json:"url"`
+	Owner        string   `json:"owner"`
+	OriginalName string   `json:"originalName"`
+	Title        string   `json:"title,omitempty"`
+	Tags         []string `json:"tags"`
+	ContentType  string   `json:"contentType"`
+	Size         int64    `json:"size"`
+	Width        int      `json:"width,omitempty"`
+	Height       int      `json:"height,omitempty"`
+	// Checksum is the hex SHA-256 of the file
+	Checksum  string          `json:"checksum,omitempty"`
+	Variants  []UploadVariant `json:"variants,omitempty"`
+	CreatedAt time.Time       `json:"createdAt"`
+	UpdatedAt time.Time       `json:"updatedAt"`
+}
+
+// UploadLibraryResponse represents a page of the caller's uploads. Total
+// counts every upload matching the filters.
+type UploadLibraryResponse struct {
+	Uploads []UploadRecord `json:"uploads"`
+	Total   int            `json:"total"`
+	Offset  int            `json:"offset"`
+	Limit   int            `json:"limit"`
+	Error   string         `json:"error,omitempty"`
+}
+
+// UploadShareLink is a signed URL that anyone holding it can read an upload
+// with until ExpiresAt. Size selects a variant; Disposition is "inline" or
+// "attachment" when the link sets Content-Disposition.
+type UploadShareLink struct {
+	URL         string    `json:"url"`
+	ExpiresAt   time.Time `json:"expiresAt"`
+	Size        int       `json:"size,omitempty"`
+	Disposition string    `json:"disposition,omitempty"`
+}
+
+// OAuthClientInfo describes a registered OpenID Connect client. ClientSecret
+// is only returned once, when a confidential client is registered.
+type OAuthClientInfo struct {
+	ClientID     string    `json:"clientId"`
+	ClientSecret string    `json:"clientSecret,omitempty"`
+	Name         string    `json:"name"`
+	RedirectURIs []string  `json:"redirectUris"`
+	Public       bool      `json:"public"`
+	CreatedAt    time.Time `json:"createdAt"`
+}
+
+// OAuthClientListResponse is returned by the admin client listing
+type OAuthClientListResponse struct {
+	Clients []OAuthClientInfo `json:"clients"`
+	Error   string            `json:"error,omitempty"`
+}
+
+// OrgInfo describes an organization and the caller's roles in it
+type OrgInfo struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	Roles     []string  `json:"roles,omitempty"`
+	Current   bool      `json:"current,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// OrgListResponse is returned by the organization listings
+type OrgListResponse struct {
+	Orgs  []OrgInfo `json:"orgs"`
+	Error string    `json:"error,omitempty"`
+}
+
+// OrgMemberInfo is a member of an organization
+type OrgMemberInfo struct {
+	Username string    `json:"username"`
+	Roles    []string  `json:"roles"`
+	JoinedAt time.Time `json:"joinedAt"`
+}
+
+// OrgMemberListResponse is returned by the member listing
+type OrgMemberListResponse struct {
+	Members []OrgMemberInfo `json:"members"`
+	Error   string          `json:"error,omitempty"`
+}
+
+// OAuthTokenResponse is the RFC 6749 token endpoint response
+type OAuthTokenResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int64  `json:"expires_in"`
+	IDToken     string `json:"id_token,omitempty"`
+	Scope       string `json:"scope,omitempty"`
+}
+
+// APIKeyInfo describes a user's API key. Key holds the full secret and is only
+// returned when the key is created.
+type APIKeyInfo struct {
+	ID         string     `json:"id"`
+	Name       string     `json:"name"`
+	Key        string     `json:"key,omitempty"`
+	Prefix     string     `json:"prefix"` // first characters of the key, for recognising it
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	ExpiresAt  *time.Time `json:"expiresAt,omitempty"`
+	LastUsedAt *time.Time `json:"lastUsedAt,omitempty"`
+}
+
+// APIKeyListResponse is returned when listing a user's API keys
+type APIKeyListResponse struct {
+	Keys  []APIKeyInfo `json:"keys"`
+	Error string       `json:"error,omitempty"`
+}
+
+// APIKeyVerifyResponse is auth-service's answer to a key verification
+type APIKeyVerifyResponse struct {
+	KeyID     string     `json:"keyId,omitempty"`
+	Username  string     `json:"username,omitempty"`
+	Scopes    []string   `json:"scopes,omitempty"`
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+	Tenant    string     `json:"tenant,omitempty"`
+	Error     string     `json:"error,omitempty"`
+}
+
+// HealthResponse is returned by /healthz and /readyz. Checks maps each
+// dependency to "ok" or the reason it failed.
+type HealthResponse struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks,omitempty"`
+}
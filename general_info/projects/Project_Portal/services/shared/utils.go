@@ -1,52 +1,335 @@
 package shared
 
 import (
-	"crypto/sha256"
+	"context"
+	"crypto/rand"
 	"encoding/hex"
+	"errors"
+	"fmt"
 	"os"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
 )
 
-// getJWTSecret reads JWT secret from environment variable or returns default
+var (
+	// ErrTokenRevoked is returned by ValidateJWT for tokens on the deny-list
+	ErrTokenRevoked = errors.New("token has been revoked")
+	// ErrMissingTokenID is returned by ValidateJWT for tokens without a jti claim
+	ErrMissingTokenID = errors.New("token has no jti claim")
+	// ErrNoSigner is returned by GenerateJWT when no asymmetric signer is installed
+	ErrNoSigner = errors.New("no JWT signer configured")
+	// ErrRevocationCheck is returned by ValidateJWT when the deny-list cannot be consulted
+	ErrRevocationCheck = errors.New("could not check token revocation")
+)
+
+// DenyList reports access tokens that were revoked before they expired,
+// e.g. on logout or when a refresh token family is compromised
+type DenyList interface {
+	IsRevoked(ctx context.Context, jti string) (bool, error)
+}
+
+var (
+	denyList DenyList
+	signer   Signer
+	keySet   KeySet
+
+	defaultKeySetOnce sync.Once
+)
+
+// SetDenyList installs the deny-list consulted by ValidateJWT. It should be
+// called once during service startup; nil disables revocation checks.
+func SetDenyList(d DenyList) {
+	denyList = d
+}
+
+// SetSigner installs the key source GenerateJWT signs with. Only the auth
+// service holds private keys, so only it should call this.
+func SetSigner(s Signer) {
+	signer = s
+}
+
+// SetKeySet installs the verification keys used by ValidateJWT. Without it,
+// ValidateJWT fetches the auth service's JWKS from JWKSURL.
+func SetKeySet(k KeySet) {
+	keySet = k
+}
+
+// JWTSettings are the access token settings of a service's configuration
+type JWTSettings struct {
+	Secret         string
+	SigningAlg     string
+	Issuer         string
+	Audience       string
+	AccessTokenTTL time.Duration
+}
+
+// Endpoints override the auth-service endpoints other services call. Empty
+// URLs default to their path under the auth-service URL.
+type Endpoints struct {
+	JWKS          string
+	TokenStatus   string
+	APIKeyVerify  string
+	Introspection string
+}
+
+var (
+	jwtSettings    *JWTSettings
+	authServiceURL string
+	endpoints      Endpoints
+)
+
+// SetJWTSettings installs the JWT settings. Without them JWT_SECRET,
+// JWT_SIGNING_ALG, JWT_ISSUER and JWT_AUDIENCE are read instead.
+func SetJWTSettings(s JWTSettings) {
+	jwtSettings = &s
+}
+
+// SetAuthServiceURL installs the base URL of auth-service. Without it
+// AUTH_SERVICE_URL is read instead.
+func SetAuthServiceURL(url string) {
+	authServiceURL = url
+}
+
+// SetEndpoints installs the endpoint overrides
+func SetEndpoints(e Endpoints) {
+	endpoints = e
+}
+
+// DevJWTSecret is the HS256 secret used when JWT_SECRET is unset. It is
+// public, so it must never sign tokens outside local development.
+const DevJWTSecret = "your-secret-key"
+
+// getJWTSecret returns the configured JWT secret or the development default
 func getJWTSecret() []byte {
-	if secret := os.Getenv("JWT_SECRET"); secret != "" {
+	secret := os.Getenv("JWT_SECRET")
+	if jwtSettings != nil {
+		secret = jwtSettings.Secret
+	}
+	if secret != "" {
 		return []byte(secret)
 	}
-	return []byte("your-secret-key") // fallback for local development
+	return []byte(DevJWTSecret) // fallback for local development
+}
+
+// SigningAlgorithm returns the configured algorithm ("EdDSA", "RS256" or
+// "HS256"). HS256 uses the shared JWT_SECRET and is only meant for local
+// development, since every service holding the secret could mint tokens.
+func SigningAlgorithm() string {
+	alg := os.Getenv("JWT_SIGNING_ALG")
+	if jwtSettings != nil {
+		alg = jwtSettings.SigningAlg
+	}
+	switch alg {
+	case "RS256", "HS256":
+		return alg
+	default:
+		return "EdDSA"
+	}
 }
 
-// HashPassword creates a SHA256 hash of the password
-func HashPassword(password string) string {
-	hash := sha256.Sum256([]byte(password))
-	return hex.EncodeToString(hash[:])
+// AccessTokenTTL returns the configured access token lifetime or the default
+func AccessTokenTTL() time.Duration {
+	if jwtSettings != nil && jwtSettings.AccessTokenTTL > 0 {
+		return jwtSettings.AccessTokenTTL
+	}
+	return 15 * time.Minute
 }
 
-// GenerateJWT creates a JWT token for the given username
-func GenerateJWT(username string) (string, error) {
-	claims := &Claims{
-		Username: username,
+// getIssuer returns the configured iss claim value or the default
+func getIssuer() string {
+	iss := os.Getenv("JWT_ISSUER")
+	if jwtSettings != nil {
+		iss = jwtSettings.Issuer
+	}
+	if iss != "" {
+		return iss
+	}
+	return "portal-auth-service"
+}
+
+// getAudience returns the configured aud claim value or the default
+func getAudience() string {
+	aud := os.Getenv("JWT_AUDIENCE")
+	if jwtSettings != nil {
+		aud = jwtSettings.Audience
+	}
+	if aud != "" {
+		return aud
+	}
+	return "portal"
+}
+
+// JWKSURL returns the configured JWKS URL or the JWKS endpoint of auth-service
+func JWKSURL() string {
+	if endpoints.JWKS != "" {
+		return endpoints.JWKS
+	}
+	return AuthServiceURL() + "/.well-known/jwks.json"
+}
+
+// AuthServiceURL returns the configured base URL of auth-service without a
+// trailing slash
+func AuthServiceURL() string {
+	base := authServiceURL
+	if base == "" {
+		base = os.Getenv("AUTH_SERVICE_URL")
+	}
+	if base == "" {
+		base = "http://localhost:8082" // fallback for local development
+	}
+	return strings.TrimSuffix(base, "/")
+}
+
+func activeKeySet() KeySet {
+	if keySet != nil {
+		return keySet
+	}
+	defaultKeySetOnce.Do(func() {
+		keySet = NewRemoteKeySet(JWKSURL(), 5*time.Minute)
+	})
+	return keySet
+}
+
+// validMethods lists the alg header values ValidateJWT accepts
+func validMethods() []string {
+	if SigningAlgorithm() == "HS256" {
+		return []string{"HS256"}
+	}
+	return []string{"RS256", "EdDSA"}
+}
+
+// NewTokenID returns a random identifier suitable for jti claims and opaque tokens
+func NewTokenID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// GenerateJWT creates a short-lived access token for the given username with
+// the roles and the permissions they grant. It returns the token together with
+// its claims so callers can track the jti and expiry.
+func GenerateJWT(username string, roles []string) (string, *Claims, error) {
+	claims, err := NewAccessClaims(username, roles)
+	if err != nil {
+		return "", nil, err
+	}
+
+	signed, err := SignClaims(claims)
+	if err != nil {
+		return "", nil, err
+	}
+	return signed, claims, nil
+}
+
+// NewAccessClaims returns the claims GenerateJWT signs, so callers that need
+// extra claims such as Scope can add them before calling SignClaims
+func NewAccessClaims(username string, roles []string) (*Claims, error) {
+	jti, err := NewTokenID()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	return &Claims{
+		Username:    username,
+		Roles:       roles,
+		Permissions: PermissionsForRoles(roles),
 		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(time.Now().Add(24 * time.Hour)),
-			IssuedAt:  jwt.NewNumericDate(time.Now()),
+			ID:        jti,
+			Issuer:    getIssuer(),
+			Audience:  jwt.ClaimStrings{getAudience()},
+			ExpiresAt: jwt.NewNumericDate(now.Add(AccessTokenTTL())),
+			IssuedAt:  jwt.NewNumericDate(now),
 		},
+	}, nil
+}
+
+// SignClaims signs with the shared secret in HS256 mode and with the
+// installed Signer otherwise, adding the kid header
+func SignClaims(claims jwt.Claims) (string, error) {
+	if SigningAlgorithm() == "HS256" {
+		return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(getJWTSecret())
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString(getJWTSecret())
+	if signer == nil {
+		return "", ErrNoSigner
+	}
+	key, err := signer.SigningKey(context.Background())
+	if err != nil {
+		return "", err
+	}
+
+	method := jwt.GetSigningMethod(key.Algorithm)
+	if method == nil {
+		return "", fmt.Errorf("unsupported signing algorithm %q", key.Algorithm)
+	}
+
+	token := jwt.NewWithClaims(method, claims)
+	token.Header["kid"] = key.ID
+	return token.SignedString(key.Key)
 }
 
-// ValidateJWT validates a JWT token and returns the claims
-func ValidateJWT(tokenString string) (*Claims, error) {
-	token, err := jwt.ParseWithClaims(tokenString, &Claims{}, func(token *jwt.Token) (interface{}, error) {
+// keyFunc resolves the verification key for a token and makes sure the alg
+// header matches the algorithm the key was published for
+func keyFunc(token *jwt.Token) (interface{}, error) {
+	if SigningAlgorithm() == "HS256" {
 		return getJWTSecret(), nil
-	})
+	}
+
+	kid, _ := token.Header["kid"].(string)
+	if kid == "" {
+		return nil, ErrUnknownKeyID
+	}
+
+	alg, key, err := activeKeySet().PublicKey(context.Background(), kid)
+	if err != nil {
+		return nil, err
+	}
+	if alg != token.Method.Alg() {
+		return nil, fmt.Errorf("token alg %q does not match key alg %q", token.Method.Alg(), alg)
+	}
+	return key, nil
+}
+
+// ValidateJWT validates a JWT token and returns the claims. Only the expected
+// algorithms, issuer and audience are accepted, and tokens whose jti is on the
+// configured deny-list are rejected with ErrTokenRevoked.
+func ValidateJWT(tokenString string) (*Claims, error) {
+	token, err := jwt.ParseWithClaims(tokenString, &Claims{}, keyFunc,
+		jwt.WithValidMethods(validMethods()),
+		jwt.WithIssuer(getIssuer()),
+		jwt.WithAudience(getAudience()),
+	)
 
-	if err != nil || !token.Valid {
+	if err != nil {
 		return nil, err
 	}
+	if !token.Valid {
+		return nil, jwt.ErrTokenInvalidClaims
+	}
 
 	claims := token.Claims.(*Claims)
+	if claims.ID == "" {
+		return nil, ErrMissingTokenID
+	}
+	if claims.ExpiresAt == nil {
+		return nil, jwt.ErrTokenRequiredClaimMissing
+	}
+
+	if denyList != nil {
+		revoked, err := denyList.IsRevoked(context.Background(), claims.ID)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrRevocationCheck, err)
+		}
+		if revoked {
+			return nil, ErrTokenRevoked
+		}
+	}
+
 	return claims, nil
-}
\ No newline at end of file
+}
@@ -0,0 +1,174 @@
+package shared
+
+import (
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// testKeys signs with one Ed25519 key and publishes it under its kid
+type testKeys struct {
+	key *SigningKey
+}
+
+func (k testKeys) SigningKey(ctx context.Context) (*SigningKey, error) {
+	return k.key, nil
+}
+
+func (k testKeys) PublicKey(ctx context.Context, kid string) (string, crypto.PublicKey, error) {
+	if kid != k.key.ID {
+		return "", nil, ErrUnknownKeyID
+	}
+	return k.key.Algorithm, k.key.Key.Public(), nil
+}
+
+// useTestKeys installs EdDSA settings and a test key until the test ends
+func useTestKeys(t *testing.T) testKeys {
+	t.Helper()
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := testKeys{&SigningKey{ID: "test-key", Algorithm: "EdDSA", Key: private}}
+
+	SetJWTSettings(JWTSettings{SigningAlg: "EdDSA", Issuer: "portal-auth-service", Audience: "portal"})
+	SetSigner(keys)
+	SetKeySet(keys)
+	SetDenyList(nil)
+	t.Cleanup(func() {
+		jwtSettings, signer, keySet = nil, nil, nil
+	})
+	return keys
+}
+
+func TestValidateJWT(t *testing.T) {
+	keys := useTestKeys(t)
+	public := []byte(keys.key.Key.Public().(ed25519.PublicKey))
+
+	claims := func(edit func(*Claims)) *Claims {
+		c, err := NewAccessClaims("alice", []string{"user"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if edit != nil {
+			edit(c)
+		}
+		return c
+	}
+	sign := func(method jwt.SigningMethod, key any, kid string, c *Claims) string {
+		token := jwt.NewWithClaims(method, c)
+		if kid != "" {
+			token.Header["kid"] = kid
+		}
+		signed, err := token.SignedString(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return signed
+	}
+	valid, _, err := GenerateJWT("alice", []string{"user"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		want  error // nil means any error
+		ok    bool
+	}{
+		{name: "valid", token: valid, ok: true},
+		{
+			name:  "alg none",
+			token: sign(jwt.SigningMethodNone, jwt.UnsafeAllowNoneSignatureType, keys.key.ID, claims(nil)),
+			want:  jwt.ErrTokenSignatureInvalid,
+		},
+		{
+			name:  "HS256 signed with the public key",
+			token: sign(jwt.SigningMethodHS256, public, keys.key.ID, claims(nil)),
+			want:  jwt.ErrTokenSignatureInvalid,
+		},
+		{
+			name:  "HS256 signed with the development secret",
+			token: sign(jwt.SigningMethodHS256, []byte(DevJWTSecret), keys.key.ID, claims(nil)),
+			want:  jwt.ErrTokenSignatureInvalid,
+		},
+		{
+			name:  "wrong issuer",
+			token: sign(jwt.SigningMethodEdDSA, keys.key.Key, keys.key.ID, claims(func(c *Claims) { c.Issuer = "someone-else" })),
+			want:  jwt.ErrTokenInvalidIssuer,
+		},
+		{
+			name: "wrong audience",
+			token: sign(jwt.SigningMethodEdDSA, keys.key.Key, keys.key.ID,
+				claims(func(c *Claims) { c.Audience = jwt.ClaimStrings{"other-app"} })),
+			want: jwt.ErrTokenInvalidAudience,
+		},
+		{
+			name:  "unknown kid",
+			token: sign(jwt.SigningMethodEdDSA, keys.key.Key, "retired-key", claims(nil)),
+			want:  ErrUnknownKeyID,
+		},
+		{
+			name:  "no kid",
+			token: sign(jwt.SigningMethodEdDSA, keys.key.Key, "", claims(nil)),
+			want:  ErrUnknownKeyID,
+		},
+		{
+			name: "expired",
+			token: sign(jwt.SigningMethodEdDSA, keys.key.Key, keys.key.ID, claims(func(c *Claims) {
+				c.ExpiresAt = jwt.NewNumericDate(time.Now().Add(-time.Minute))
+			})),
+			want: jwt.ErrTokenExpired,
+		},
+		{
+			name:  "no jti",
+			token: sign(jwt.SigningMethodEdDSA, keys.key.Key, keys.key.ID, claims(func(c *Claims) { c.ID = "" })),
+			want:  ErrMissingTokenID,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ValidateJWT(tt.token)
+			if tt.ok {
+				if err != nil || got.Username != "alice" {
+					t.Fatalf("ValidateJWT = %+v, %v; want alice", got, err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("ValidateJWT accepted the token: %+v", got)
+			}
+			if tt.want != nil && !errors.Is(err, tt.want) {
+				t.Errorf("ValidateJWT error = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+// memoryDenyList revokes the listed token IDs
+type memoryDenyList map[string]bool
+
+func (d memoryDenyList) IsRevoked(ctx context.Context, jti string) (bool, error) {
+	return d[jti], nil
+}
+
+func TestValidateJWTRevoked(t *testing.T) {
+	useTestKeys(t)
+	token, claims, err := GenerateJWT("alice", []string{"user"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	SetDenyList(memoryDenyList{claims.ID: true})
+	t.Cleanup(func() { SetDenyList(nil) })
+
+	if _, err := ValidateJWT(token); !errors.Is(err, ErrTokenRevoked) {
+		t.Errorf("ValidateJWT of a revoked token: %v, want ErrTokenRevoked", err)
+	}
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"shared"
+	"upload-service/storage"
+)
+
+// Limits on what owners can set with PATCH /uploads/:id
+const (
+	maxTitleLength = 200
+	maxTags        = 20
+	maxTagLength   = 50
+)
+
+// librarySorts maps the sort query parameter to an ascending order
+var librarySorts = map[string]func(a, b *uploadMetadata) bool{
+	"createdAt": func(a, b *uploadMetadata) bool { return a.CreatedAt.Before(b.CreatedAt) },
+	"size":      func(a, b *uploadMetadata) bool { return a.Size < b.Size },
+	"name": func(a, b *uploadMetadata) bool {
+		return strings.ToLower(a.OriginalName) < strings.ToLower(b.OriginalName)
+	},
+	"title": func(a, b *uploadMetadata) bool { return strings.ToLower(a.Title) < strings.ToLower(b.Title) },
+}
+
+// toRecord describes an upload to its owner
+func toRecord(tenant string, meta *uploadMetadata) shared.UploadRecord {
+	record := shared.UploadRecord{
+		ID:           meta.Filename,
+		URL:          fileURL(tenant, meta.Filename, 0),
+		Owner:        meta.Owner,
+		OriginalName: meta.OriginalName,
+		Title:        meta.Title,
+		Tags:         meta.Tags,
+		ContentType:  meta.ContentType,
+		Size:         meta.Size,
+		Width:        meta.Width,
+		Height:       meta.Height,
+		Checksum:     meta.Checksum,
+		Variants:     signedVariants(tenant, meta.Filename, meta.Variants),
+		CreatedAt:    meta.CreatedAt,
+		UpdatedAt:    meta.UpdatedAt,
+	}
+	if record.Tags == nil {
+		record.Tags = []string{}
+	}
+	return record
+}
+
+// ownedMetadata loads the metadata of the caller's upload id. Uploads of
+// other users answer 404 like missing ones, so that their names cannot be
+// probed; the response has been written when ok is false.
+func ownedMetadata(c *gin.Context) (tenant string, meta *uploadMetadata, ok bool) {
+	tenant, id := tenantOf(c), c.Param("id")
+	username := c.GetString("username")
+	if !validFilename(id) || !ownedBy(id, username) {
+		c.JSON(http.StatusNotFound, shared.UploadResponse{Error: "Upload not found"})
+		return "", nil, false
+	}
+	meta, err := loadMetadata(c.Request.Context(), tenant, id)
+	if errors.Is(err, storage.ErrNotExist) || (err == nil && meta.Owner != username) {
+		c.JSON(http.StatusNotFound, shared.UploadResponse{Error: "Upload not found"})
+		return "", nil, false
+	}
+	if err != nil {
+		log.Printf("Failed to load upload %s/%s: %v", tenant, id, err)
+		c.JSON(http.StatusInternalServerError, shared.UploadResponse{Error: "Could not load upload"})
+		return "", nil, false
+	}
+	return tenant, meta, true
+}
+
+// listLibrary returns a page of the caller's uploads in the current tenant.
+// q matches the original name or title, tag and type must match exactly;
+// sort is createdAt (default), size, name or title and order asc or desc
+// (default). offset and limit page through the result.
+func listLibrary(c *gin.Context) {
+	less, ok := librarySorts[c.DefaultQuery("sort", "createdAt")]
+	if !ok {
+		c.JSON(http.StatusBadRequest, shared.UploadLibraryResponse{Error: "sort must be createdAt, size, name or title"})
+		return
+	}
+	order := c.DefaultQuery("order", "desc")
+	if order != "asc" && order != "desc" {
+		c.JSON(http.StatusBadRequest, shared.UploadLibraryResponse{Error: "order must be asc or desc"})
+		return
+	}
+	offset, limit := pagination(c)
+	query := strings.ToLower(c.Query("q"))
+	tag, contentType := c.Query("tag"), c.Query("type")
+
+	tenant := tenantOf(c)
+	uploads, err := ownedUploads(c.Request.Context(), tenant, c.GetString("username"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, shared.UploadLibraryResponse{Error: "Could not list uploads"})
+		return
+	}
+	var matches []*uploadMetadata
+	for _, upload := range uploads {
+		meta := upload.meta
+		if (query != "" && !strings.Contains(strings.ToLower(meta.OriginalName), query) &&
+			!strings.Contains(strings.ToLower(meta.Title), query)) ||
+			(tag != "" && !hasTag(meta.Tags, tag)) ||
+			(contentType != "" && meta.ContentType != contentType) {
+			continue
+		}
+		matches = append(matches, meta)
+	}
+
+	sort.SliceStable(matches, func(i, j int) bool {
+		if order == "desc" {
+			return less(matches[j], matches[i])
+		}
+		return less(matches[i], matches[j])
+	})
+	resp := shared.UploadLibraryResponse{Uploads: []shared.UploadRecord{}, Total: len(matches), Offset: offset, Limit: limit}
+	for i := offset; i < len(matches) && i < offset+limit; i++ {
+		resp.Uploads = append(resp.Uploads, toRecord(tenant, matches[i]))
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// pagination reads offset and limit query parameters, capping limit at 100
+func pagination(c *gin.Context) (offset, limit int) {
+	offset, _ = strconv.Atoi(c.DefaultQuery("offset", "0"))
+	limit, _ = strconv.Atoi(c.DefaultQuery("limit", "50"))
+	if offset < 0 {
+		offset = 0
+	}
+	if limit <= 0 || limit > 100 {
+		limit = 50
+	}
+	return offset, limit
+}
+
+func hasTag(tags []string, tag string) bool {
+	for _, t := range tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// getLibraryUpload returns one of the caller's uploads
+func getLibraryUpload(c *gin.Context) {
+	tenant, meta, ok := ownedMetadata(c)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, toRecord(tenant, meta))
+}
+
+type updateUploadRequest struct {
+	Title *string   `json:"title"`
+	Tags  *[]string `json:"tags"`
+}
+
+// updateLibraryUpload changes the title and tags of one of the caller's
+// uploads. Tags are trimmed, lowercased and deduplicated.
+func updateLibraryUpload(c *gin.Context) {
+	var req updateUploadRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, shared.UploadResponse{Error: "Invalid request"})
+		return
+	}
+	tenant, meta, ok := ownedMetadata(c)
+	if !ok {
+		return
+	}
+
+	fieldErrors := map[string]string{}
+	if req.Title != nil {
+		title := strings.TrimSpace(*req.Title)
+		if msg := validateTitle(title); msg != "" {
+			fieldErrors["title"] = msg
+		}
+		meta.Title = title
+	}
+	if req.Tags != nil {
+		tags, msg := normalizeTags(*req.Tags)
+		if msg != "" {
+			fieldErrors["tags"] = msg
+		}
+		meta.Tags = tags
+	}
+	if len(fieldErrors) > 0 {
+		c.JSON(http.StatusBadRequest, shared.UploadResponse{Error: "Validation failed", FieldErrors: fieldErrors})
+		return
+	}
+
+	meta.UpdatedAt = time.Now().UTC()
+	if err := saveMetadata(c.Request.Context(), tenant, meta); err != nil {
+		log.Printf("Failed to update upload %s/%s: %v", tenant, meta.Filename, err)
+		c.JSON(http.StatusInternalServerError, shared.UploadResponse{Error: "Could not update upload"})
+		return
+	}
+	c.JSON(http.StatusOK, toRecord(tenant, meta))
+}
+
+func validateTitle(title string) string {
+	if utf8.RuneCountInString(title) > maxTitleLength {
+		return fmt.Sprintf("Title must be at most %d characters", maxTitleLength)
+	}
+	for _, r := range title {
+		if unicode.IsControl(r) {
+			return "Title contains invalid characters"
+		}
+	}
+	return ""
+}
+
+func normalizeTags(raw []string) ([]string, string) {
+	tags := []string{}
+	seen := make(map[string]bool)
+	for _, tag := range raw {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if tag == "" || seen[tag] {
+			continue
+		}
+		if utf8.RuneCountInString(tag) > maxTagLength {
+			return nil, fmt.Sprintf("Tags must be at most %d characters", maxTagLength)
+		}
+		for _, r := range tag {
+			if unicode.IsControl(r) || r == ',' {
+				return nil, "Tags contain invalid characters"
+			}
+		}
+		seen[tag] = true
+		tags = append(tags, tag)
+	}
+	if len(tags) > maxTags {
+		return nil, fmt.Sprintf("At most %d tags are allowed", maxTags)
+	}
+	return tags, ""
+}
+
+type shareUploadRequest struct {
+	ExpiresAt   *time.Time `json:"expiresAt"`
+	Size        int        `json:"size"`
+	Disposition string     `json:"disposition"`
+}
+
+// shareLibraryUpload signs a URL of one of the caller's uploads, or with size
+// of one of its variants, that anyone can read it with. It expires at
+// expiresAt, at most upload.maxShareTTL away, or after upload.urlTTL;
+// disposition "inline" or "attachment" sets Content-Disposition. The body may
+// be empty.
+func shareLibraryUpload(c *gin.Context) {
+	var req shareUploadRequest
+	if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+		c.JSON(http.StatusBadRequest, shared.UploadResponse{Error: "Invalid request"})
+		return
+	}
+	tenant, meta, ok := ownedMetadata(c)
+	if !ok {
+		return
+	}
+
+	now := time.Now()
+	link := fileLink{tenant: tenant, filename: meta.Filename, size: req.Size,
+		disposition: req.Disposition, expires: now.Add(signer.ttl)}
+	fieldErrors := map[string]string{}
+	if req.ExpiresAt != nil {
+		latest := now.Add(signer.maxTTL)
+		if !req.ExpiresAt.After(now) {
+			fieldErrors["expiresAt"] = "Expiry must be in the future"
+		} else if req.ExpiresAt.After(latest) {
+			fieldErrors["expiresAt"] = "Expiry must not be after " + latest.UTC().Format(time.RFC3339)
+		}
+		link.expires = *req.ExpiresAt
+	}
+	if req.Size != 0 && !hasVariant(meta.Variants, req.Size) {
+		fieldErrors["size"] = "The upload has no variant of this size"
+	}
+	if req.Disposition != "" && req.Disposition != "inline" && req.Disposition != "attachment" {
+		fieldErrors["disposition"] = "Disposition must be inline or attachment"
+	}
+	if len(fieldErrors) > 0 {
+		c.JSON(http.StatusBadRequest, shared.UploadResponse{Error: "Validation failed", FieldErrors: fieldErrors})
+		return
+	}
+
+	c.JSON(http.StatusCreated, shared.UploadShareLink{
+		URL:         signer.signURL(link),
+		ExpiresAt:   time.Unix(link.expires.Unix(), 0).UTC(),
+		Size:        link.size,
+		Disposition: link.disposition,
+	})
+}
+
+func hasVariant(variants []shared.UploadVariant, size int) bool {
+	for _, variant := range variants {
+		if variant.Size == size {
+			return true
+		}
+	}
+	return false
+}
+
+// deleteLibraryUpload removes one of the caller's uploads with its variants
+// and metadata
+func deleteLibraryUpload(c *gin.Context) {
+	tenant, meta, ok := ownedMetadata(c)
+	if !ok {
+		return
+	}
+	err := removeUpload(c.Request.Context(), tenant, meta.Filename)
+	if err != nil && !errors.Is(err, storage.ErrNotExist) {
+		log.Printf("Failed to delete upload %s/%s: %v", tenant, meta.Filename, err)
+		c.JSON(http.StatusInternalServerError, shared.UploadResponse{Error: "Could not delete file"})
+		return
+	}
+	c.JSON(http.StatusOK, shared.UploadResponse{Message: "File deleted", Filename: meta.Filename})
+}
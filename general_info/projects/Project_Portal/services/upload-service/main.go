@@ -1,113 +1,520 @@
 package main
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"log"
+	"mime"
+	"mime/multipart"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
+	"regexp"
 	"strings"
 	"time"
 
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
 	"shared"
+	"shared/config"
+	"upload-service/storage"
 )
 
-var uploadDir = "./uploads"
+// profileClient fetches account records from auth-service
+var profileClient = &http.Client{Timeout: 5 * time.Second}
+
+// policy holds the size limit and allowed types from the configuration
+var policy *uploadPolicy
 
 func main() {
-	// Create upload directory if it doesn't exist
-	if err := os.MkdirAll(uploadDir, 0755); err != nil {
-		panic(err)
+	cfg := config.Default(":8083")
+	config.MustLoad("upload-service", cfg, &cfg.Upload)
+	var err error
+	if policy, err = newUploadPolicy(cfg.Upload); err != nil {
+		log.Fatal("Invalid upload configuration:", err)
+	}
+	variants = newVariantPool(cfg.Upload.Variants, cfg.Upload.VariantWorkers)
+	if signer, err = newURLSigner(cfg.Upload, cfg.Mode); err != nil {
+		log.Fatal("Invalid upload configuration:", err)
+	}
+
+	if cfg.Upload.Storage == "local" {
+		if err := migrateLegacyUploads(cfg.Upload.Dir); err != nil {
+			log.Fatal("Failed to move existing uploads into the default tenant:", err)
+		}
 	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	store, err = openStorage(ctx, cfg.Upload)
+	cancel()
+	if err != nil {
+		log.Fatal("Failed to open upload storage:", err)
+	}
+	if err := indexUploadOwners(context.Background()); err != nil {
+		log.Fatal("Failed to index the owners of existing uploads:", err)
+	}
+
+	// Accept API keys next to JWTs; revoked keys stop working once the
+	// cached verification expires
+	shared.SetAPIKeyValidator(shared.NewRemoteAPIKeyValidator(shared.APIKeyVerifyURL(), cfg.Upload.APIKeyCacheTTL))
+
+	// Honor logouts and revoked sessions within services.revocationCacheTTL
+	shared.SetDenyList(shared.NewRemoteDenyList(shared.TokenStatusURL(), cfg.Services.RevocationCacheTTL))
 
 	r := gin.Default()
+	if err := r.SetTrustedProxies(cfg.HTTP.TrustedProxies); err != nil {
+		log.Fatal("Invalid TRUSTED_PROXIES:", err)
+	}
 
 	// Configure CORS
-	config := cors.DefaultConfig()
-	config.AllowOrigins = []string{"*"}
-	config.AllowHeaders = []string{"Origin", "Content-Length", "Content-Type", "Authorization"}
-	config.AllowCredentials = true
-	r.Use(cors.New(config))
+	corsConfig := cors.DefaultConfig()
+	corsConfig.AllowOrigins = cfg.CORS.AllowOrigins
+	corsConfig.AllowHeaders = []string{"Origin", "Content-Length", "Content-Type", "Authorization",
+		"Tus-Resumable", "Upload-Length", "Upload-Offset", "Upload-Metadata", "X-HTTP-Method-Override"}
+	corsConfig.ExposeHeaders = []string{"Location", "Tus-Resumable", "Tus-Version", "Tus-Extension",
+		"Tus-Max-Size", "Upload-Length", "Upload-Offset", "Upload-Expires"}
+	corsConfig.AllowCredentials = cfg.CORS.AllowCredentials
+	r.Use(cors.New(corsConfig))
+
+	// Probes; the service is ready when the upload storage is writable
+	health := shared.NewHealth(2 * time.Second)
+	health.AddCheck("uploads", checkStorage)
+	r.GET("/healthz", health.Live)
+	r.GET("/readyz", health.Ready)
 
-	// Serve static files (uploaded images)
-	r.Static("/uploads", uploadDir)
+	// Serve uploaded files for signed URLs, which are the only credential.
+	// The gateway publishes them as /uploads/<tenant>/<filename>.
+	r.GET("/files/:tenant/:filename", serveUpload)
+
+	// The caller's own uploads; the id is the stored file name. Reading them
+	// hands out signed URLs, so it needs the same permission as uploading.
+	library := r.Group("/uploads", shared.RequirePermission(shared.PermUploadWrite))
+	{
+		library.GET("", listLibrary)
+		library.GET("/:id", getLibraryUpload)
+		library.PATCH("/:id", updateLibraryUpload)
+		library.DELETE("/:id", deleteLibraryUpload)
+		library.POST("/:id/share", shareLibraryUpload)
+	}
 
 	// Upload routes
-	r.POST("/upload", authMiddleware(), upload)
-	r.GET("/profile", authMiddleware(), getProfile)
+	r.POST("/upload", shared.RequirePermission(shared.PermUploadWrite), upload)
+	r.GET("/profile", shared.RequirePermission(shared.PermProfileRead), getProfile)
 
-	r.Run(":8083") // Upload service on port 8083
+	// Resumable uploads (tus 1.0). OPTIONS needs no token; GET returns the
+	// UploadResponse once the upload is complete.
+	r.OPTIONS("/tus", tusOptions)
+	r.OPTIONS("/tus/:id", tusOptions)
+	tus := r.Group("/tus", tusHeaders, shared.RequirePermission(shared.PermUploadWrite))
+	{
+		tus.POST("", createTusUpload)
+		tus.HEAD("/:id", headTusUpload)
+		tus.PATCH("/:id", patchTusUpload)
+		tus.GET("/:id", getTusUpload)
+	}
+	go expireTusUploads(time.Hour)
+
+	// Called by auth-service with the user's token when the account is
+	// deleted; API keys cannot wipe an account's files
+	r.DELETE("/account/uploads", shared.RequireSession(), deleteAccountUploads)
+
+	// Moderation routes
+	admin := r.Group("/admin", shared.AuthMiddleware())
+	{
+		admin.GET("/uploads", shared.RequirePermission(shared.PermUploadsRead), listUploads)
+		admin.DELETE("/uploads/:filename", shared.RequirePermission(shared.PermUploadsDelete), deleteUpload)
+	}
+
+	// Upload service on port 8083 by default. In-flight uploads may finish
+	// during the drain timeout after SIGTERM.
+	if err := shared.Serve(cfg.HTTP.Addr, tusMethodOverride(r), health, cfg.HTTP.ShutdownDelay, cfg.HTTP.DrainTimeout); err != nil {
+		log.Fatal("Server failed:", err)
+	}
+}
+
+// tenantOf returns the tenant of the request's token
+func tenantOf(c *gin.Context) string {
+	if claims := shared.ClaimsFromContext(c); claims != nil {
+		return claims.TenantID()
+	}
+	return shared.DefaultTenant
 }
 
+// validFilename accepts the names of uploads, rather than of metadata or of
+// files in other directories
+func validFilename(name string) bool {
+	return name == filepath.Base(name) && name != "" && !strings.HasPrefix(name, ".")
+}
+
+// migrateLegacyUploads moves files stored in dir before uploads were
+// partitioned by tenant into the default tenant's directory
+func migrateLegacyUploads(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defaultDir := filepath.Join(dir, shared.DefaultTenant)
+	if err := os.MkdirAll(defaultDir, 0755); err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		// Dot files were left behind by readiness checks, not users
+		if !entry.Type().IsRegular() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		if err := os.Rename(filepath.Join(dir, entry.Name()), filepath.Join(defaultDir, entry.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// serveUpload returns a file, or one of its variants, to whoever holds a URL
+// signed by upload-service. Missing and invalid signatures answer 403 whether
+// the file exists or not.
+func serveUpload(c *gin.Context) {
+	tenant, filename := c.Param("tenant"), c.Param("filename")
+	link, err := signer.verify(tenant, filename, c.Request.URL.Query())
+	if errors.Is(err, errLinkExpired) {
+		c.JSON(http.StatusForbidden, shared.UploadResponse{Error: "Link expired"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusForbidden, shared.UploadResponse{Error: "Invalid signature"})
+		return
+	}
+	if !validFilename(filename) {
+		c.JSON(http.StatusNotFound, shared.UploadResponse{Error: "File not found"})
+		return
+	}
+	key := uploadKey(tenant, filename)
+	if link.size > 0 {
+		key = variantKey(tenant, filename, link.size)
+	}
+
+	ctx := c.Request.Context()
+	body, info, err := store.Get(ctx, key)
+	if errors.Is(err, storage.ErrNotExist) {
+		c.JSON(http.StatusNotFound, shared.UploadResponse{Error: "File not found"})
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to read %s/%s: %v", tenant, filename, err)
+		c.JSON(http.StatusInternalServerError, shared.UploadResponse{Error: "Could not read file"})
+		return
+	}
+	defer body.Close()
+
+	if link.disposition != "" {
+		// Downloads are named after the client's file
+		name := filename
+		if meta, err := loadMetadata(ctx, tenant, filename); err == nil && meta.OriginalName != "" {
+			name = meta.OriginalName
+		}
+		c.Header("Content-Disposition", mime.FormatMediaType(link.disposition, map[string]string{"filename": name}))
+	}
+	// The URL stops working at its expiry, and so should cached copies
+	c.Header("Cache-Control", fmt.Sprintf("private, max-age=%d", int(time.Until(link.expires).Seconds())))
+	c.Header("X-Content-Type-Options", "nosniff")
+	if info.ContentType != "" {
+		c.Header("Content-Type", info.ContentType)
+	}
+	// Seekable backends also answer range and conditional requests
+	if rs, ok := body.(io.ReadSeeker); ok {
+		http.ServeContent(c.Writer, c.Request, filename, info.ModTime, rs)
+		return
+	}
+	c.Header("Last-Modified", info.ModTime.UTC().Format(http.TimeFormat))
+	c.DataFromReader(http.StatusOK, info.Size, info.ContentType, body, nil)
+}
+
+// upload stores the "image" part of a multipart request under a generated
+// name. The body is read as a stream, so the size limit holds without
+// buffering the file, and the file is only kept once it passed validation.
 func upload(c *gin.Context) {
 	username := c.GetString("username")
+	tenant := tenantOf(c)
 
-	file, header, err := c.Request.FormFile("image")
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, policy.maxBytes+multipartOverhead)
+	part, err := imagePart(c.Request)
 	if err != nil {
-		c.JSON(http.StatusBadRequest, shared.UploadResponse{Error: "No file uploaded"})
+		rejectUpload(c, readError(err))
 		return
 	}
-	defer file.Close()
+	defer part.Close()
 
-	// Create unique filename
-	timestamp := time.Now().Unix()
-	filename := fmt.Sprintf("%s_%d_%s", username, timestamp, header.Filename)
-	filepath := filepath.Join(uploadDir, filename)
+	file, err := policy.receive(part)
+	if err != nil {
+		rejectUpload(c, err)
+		return
+	}
+	defer os.Remove(file.tmpPath)
 
-	// Save file
-	out, err := os.Create(filepath)
+	resp, err := storeUpload(c.Request.Context(), tenant, username, sanitizeFilename(part.FileName()), file)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, shared.UploadResponse{Error: "Could not save file"})
+		rejectUpload(c, err)
 		return
 	}
-	defer out.Close()
+	c.JSON(http.StatusOK, resp)
+}
 
-	_, err = io.Copy(out, file)
+// storeUpload stores a received file with its metadata and variants under a
+// generated name. Both upload and completed tus uploads end here.
+func storeUpload(ctx context.Context, tenant, username, originalName string, file *receivedFile) (*shared.UploadResponse, error) {
+	// Generated names cannot be guessed and keep the username prefix that
+	// ownership is recognised by
+	suffix, err := randomHex(8)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, shared.UploadResponse{Error: "Could not save file"})
+		return nil, err
+	}
+	now := time.Now().UTC()
+	filename := fmt.Sprintf("%s_%d_%s%s", username, now.Unix(), suffix, uploadTypes[file.contentType])
+	meta := &uploadMetadata{
+		Filename:     filename,
+		OriginalName: originalName,
+		Owner:        username,
+		ContentType:  file.contentType,
+		Size:         file.size,
+		Width:        file.width,
+		Height:       file.height,
+		Checksum:     file.checksum,
+		CreatedAt:    now,
+		UpdatedAt:    now,
+	}
+	// Images are decoded while the variants are made, which rejects those
+	// that do not decode before anything else is stored
+	if meta.Variants, err = variants.generate(ctx, tenant, filename, file); err != nil {
+		return nil, err
+	}
+	// Metadata goes before the file, so that no stored file lacks it
+	cleanupCtx, cancel := detached(ctx)
+	defer cancel()
+	if err := recordOwnerTenant(ctx, username, tenant); err != nil {
+		removeVariants(cleanupCtx, tenant, filename)
+		return nil, err
+	}
+	if err := saveMetadata(ctx, tenant, meta); err != nil {
+		removeVariants(cleanupCtx, tenant, filename)
+		return nil, err
+	}
+	if err := storeFile(ctx, uploadKey(tenant, filename), file); err != nil {
+		removeVariants(cleanupCtx, tenant, filename)
+		store.Delete(cleanupCtx, metadataKey(tenant, filename))
+		return nil, err
+	}
+
+	return &shared.UploadResponse{
+		Message:      "File uploaded successfully",
+		ImageURL:     fileURL(tenant, filename, 0),
+		Filename:     filename,
+		OriginalName: meta.OriginalName,
+		ContentType:  meta.ContentType,
+		Size:         meta.Size,
+		Variants:     signedVariants(tenant, filename, meta.Variants),
+	}, nil
+}
+
+// storeFile copies a received file into the storage
+func storeFile(ctx context.Context, key string, file *receivedFile) error {
+	f, err := os.Open(file.tmpPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return store.Put(ctx, key, f, file.size, file.contentType)
+}
+
+// imagePart returns the "image" file part of a multipart request, skipping
+// any other fields
+func imagePart(r *http.Request) (*multipart.Part, error) {
+	reader, err := r.MultipartReader()
+	if err != nil {
+		return nil, &uploadError{http.StatusBadRequest, shared.UploadErrNoFile, "No file uploaded"}
+	}
+	for {
+		part, err := reader.NextPart()
+		if errors.Is(err, io.EOF) {
+			return nil, &uploadError{http.StatusBadRequest, shared.UploadErrNoFile, "No file uploaded"}
+		}
+		if err != nil {
+			return nil, err
+		}
+		if part.FormName() == "image" && part.FileName() != "" {
+			return part, nil
+		}
+		part.Close()
+	}
+}
+
+// rejectUpload answers with the code of an *uploadError, or as a storage
+// failure for anything else
+func rejectUpload(c *gin.Context, err error) {
+	var rejection *uploadError
+	if errors.As(err, &rejection) {
+		c.JSON(rejection.status, shared.UploadResponse{Error: rejection.message, Code: rejection.code})
 		return
 	}
+	log.Printf("Upload failed: %v", err)
+	c.JSON(http.StatusInternalServerError, shared.UploadResponse{Error: "Could not save file", Code: shared.UploadErrStorage})
+}
 
-	imageURL := fmt.Sprintf("/uploads/%s", filename)
-	c.JSON(http.StatusOK, shared.UploadResponse{
-		Message:  "File uploaded successfully",
-		ImageURL: imageURL,
-		Filename: filename,
-	})
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
 }
 
+// getProfile returns the account record from auth-service together with the
+// caller's upload totals in the current tenant
 func getProfile(c *gin.Context) {
 	username := c.GetString("username")
-	c.JSON(http.StatusOK, shared.ProfileResponse{
-		Username: username,
-		Message:  fmt.Sprintf("Welcome %s!", username),
-	})
-}
-
-func authMiddleware() gin.HandlerFunc {
-	return func(c *gin.Context) {
-		tokenString := c.GetHeader("Authorization")
-		if tokenString == "" {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "No authorization header"})
-			c.Abort()
-			return
-		}
 
-		// Remove "Bearer " prefix
-		if len(tokenString) > 7 && strings.HasPrefix(tokenString, "Bearer ") {
-			tokenString = tokenString[7:]
-		}
+	profile, err := fetchProfile(c, username)
+	if err != nil {
+		log.Printf("Failed to fetch profile for %q: %v", username, err)
+		c.JSON(http.StatusBadGateway, shared.ProfileResponse{Username: username, Error: "Could not load profile"})
+		return
+	}
+
+	uploads, err := ownedUploads(c.Request.Context(), tenantOf(c), username)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, shared.ProfileResponse{Username: username, Error: "Could not list uploads"})
+		return
+	}
+	for _, upload := range uploads {
+		profile.UploadCount++
+		profile.UploadBytes += upload.meta.Size
+	}
+
+	name := profile.DisplayName
+	if name == "" {
+		name = profile.Username
+	}
+	profile.Message = fmt.Sprintf("Welcome %s!", name)
+	c.JSON(http.StatusOK, profile)
+}
+
+// fetchProfile loads username's account record from auth-service
+func fetchProfile(c *gin.Context, username string) (*shared.ProfileResponse, error) {
+	req, err := http.NewRequestWithContext(c.Request.Context(), http.MethodGet,
+		shared.AuthServiceURL()+"/profiles/"+url.PathEscape(username), nil)
+	if err != nil {
+		return nil, err
+	}
+	shared.AddServiceToken(req)
+	resp, err := profileClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("auth-service returned %s", resp.Status)
+	}
+
+	var profile shared.ProfileResponse
+	if err := json.NewDecoder(resp.Body).Decode(&profile); err != nil {
+		return nil, fmt.Errorf("decode profile: %w", err)
+	}
+	return &profile, nil
+}
+
+// uploadSuffix matches what upload appends to the username, so that files of
+// "bob" are not mistaken for those of "bob_smith"
+var uploadSuffix = regexp.MustCompile(`^[0-9]+_`)
+
+// ownedBy reports whether filename could have been stored for username. It
+// only rules files out: "bob_1_..." passes for both "bob" and "bob_1", so the
+// owner recorded in the metadata decides.
+func ownedBy(filename, username string) bool {
+	prefix := username + "_"
+	return strings.HasPrefix(filename, prefix) && uploadSuffix.MatchString(filename[len(prefix):])
+}
+
+// deleteAccountUploads removes every file owned by the caller. Accounts are
+// global, so their files are removed from every tenant.
+func deleteAccountUploads(c *gin.Context) {
+	username := c.GetString("username")
+	ctx := c.Request.Context()
 
-		claims, err := shared.ValidateJWT(tokenString)
+	tenants, err := ownerTenants(ctx, username)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, shared.UploadResponse{Error: "Could not list uploads"})
+		return
+	}
+	deleted := 0
+	for _, tenant := range tenants {
+		uploads, err := ownedUploads(ctx, tenant, username)
 		if err != nil {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
-			c.Abort()
+			c.JSON(http.StatusInternalServerError, shared.UploadResponse{Error: "Could not list uploads"})
 			return
 		}
+		for _, upload := range uploads {
+			if err := removeUpload(ctx, upload.tenant, upload.meta.Filename); err != nil && !errors.Is(err, storage.ErrNotExist) {
+				c.JSON(http.StatusInternalServerError, shared.UploadResponse{Error: "Could not delete file"})
+				return
+			}
+			deleted++
+		}
+		if err := store.Delete(ctx, ownerTenantKey(username, tenant)); err != nil && !errors.Is(err, storage.ErrNotExist) {
+			log.Printf("Failed to remove the owner index of %s in %s: %v", username, tenant, err)
+		}
+	}
+	if err := removeTusUploadsOf(ctx, username); err != nil {
+		log.Printf("Failed to remove tus uploads of %s: %v", username, err)
+	}
+
+	c.JSON(http.StatusOK, shared.UploadResponse{Message: fmt.Sprintf("Deleted %d files", deleted)})
+}
+
+// listUploads returns every upload of the moderator's tenant
+func listUploads(c *gin.Context) {
+	tenant := tenantOf(c)
+	files, err := tenantFiles(c.Request.Context(), tenant)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, shared.UploadListResponse{Error: "Could not list uploads"})
+		return
+	}
 
-		c.Set("username", claims.Username)
-		c.Next()
+	resp := shared.UploadListResponse{Uploads: []shared.UploadInfo{}}
+	for _, info := range files {
+		_, filename, _ := splitKey(info.Key)
+		resp.Uploads = append(resp.Uploads, shared.UploadInfo{
+			Filename:   filename,
+			URL:        fileURL(tenant, filename, 0),
+			Size:       info.Size,
+			ModifiedAt: info.ModTime,
+		})
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// deleteUpload removes any upload of the moderator's tenant
+func deleteUpload(c *gin.Context) {
+	filename := c.Param("filename")
+	if !validFilename(filename) {
+		c.JSON(http.StatusBadRequest, shared.UploadResponse{Error: "Invalid filename"})
+		return
 	}
-}
\ No newline at end of file
+
+	err := removeUpload(c.Request.Context(), tenantOf(c), filename)
+	if errors.Is(err, storage.ErrNotExist) {
+		c.JSON(http.StatusNotFound, shared.UploadResponse{Error: "File not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, shared.UploadResponse{Error: "Could not delete file"})
+		return
+	}
+
+	c.JSON(http.StatusOK, shared.UploadResponse{Message: "File deleted", Filename: filename})
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"shared"
+	"upload-service/storage"
+)
+
+// uploadMetadata describes a stored upload. The client's file name is only
+// kept here, sanitized; the file itself is stored under a generated name.
+type uploadMetadata struct {
+	Filename     string `json:"filename"`
+	OriginalName string `json:"originalName"`
+	Owner        string `json:"owner"`
+	ContentType  string `json:"contentType"`
+	Size         int64  `json:"size"`
+	Width        int    `json:"width,omitempty"`
+	Height       int    `json:"height,omitempty"`
+	// Checksum is the hex SHA-256 of the file
+	Checksum  string    `json:"checksum"`
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+	// Variants are the resized copies that were stored
+	Variants []shared.UploadVariant `json:"variants,omitempty"`
+	// Title and Tags are set by the owner
+	Title string   `json:"title,omitempty"`
+	Tags  []string `json:"tags,omitempty"`
+}
+
+// metadataKey returns where the metadata of a tenant's file is kept. The
+// ".meta" segment starts with a dot, so it is never listed or served as an
+// upload.
+func metadataKey(tenant, filename string) string {
+	return tenant + "/.meta/" + filename + ".json"
+}
+
+func saveMetadata(ctx context.Context, tenant string, meta *uploadMetadata) error {
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	return store.Put(ctx, metadataKey(tenant, meta.Filename), bytes.NewReader(data), int64(len(data)), "application/json")
+}
+
+// loadMetadata reads the metadata of a tenant's file
+func loadMetadata(ctx context.Context, tenant, filename string) (*uploadMetadata, error) {
+	body, _, err := store.Get(ctx, metadataKey(tenant, filename))
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	var meta uploadMetadata
+	if err := json.NewDecoder(body).Decode(&meta); err != nil {
+		return nil, fmt.Errorf("decode metadata of %s/%s: %w", tenant, filename, err)
+	}
+	return &meta, nil
+}
+
+// ownedUpload is the metadata of an upload together with its tenant
+type ownedUpload struct {
+	tenant string
+	meta   *uploadMetadata
+}
+
+// ownerPrefix records, outside every tenant, which tenants each user has
+// stored files in, as empty objects under ".owners/<username>/<tenant>".
+// Account deletion then lists only those tenants instead of the whole store.
+const ownerPrefix = ".owners/"
+
+// ownerIndexedKey marks that files stored before the index was kept have
+// been added to it
+const ownerIndexedKey = ownerPrefix + ".indexed"
+
+func ownerTenantKey(username, tenant string) string {
+	return ownerPrefix + username + "/" + tenant
+}
+
+// recordOwnerTenant notes that username stores files in tenant
+func recordOwnerTenant(ctx context.Context, username, tenant string) error {
+	return store.Put(ctx, ownerTenantKey(username, tenant), strings.NewReader(""), 0, "application/octet-stream")
+}
+
+// ownerTenants returns the tenants username has stored files in. A tenant
+// may no longer hold any.
+func ownerTenants(ctx context.Context, username string) ([]string, error) {
+	objects, err := store.List(ctx, ownerPrefix+username+"/")
+	if err != nil {
+		return nil, err
+	}
+	var tenants []string
+	for _, object := range objects {
+		tenant := strings.TrimPrefix(object.Key, ownerPrefix+username+"/")
+		if tenant != "" && !strings.Contains(tenant, "/") {
+			tenants = append(tenants, tenant)
+		}
+	}
+	return tenants, nil
+}
+
+// indexUploadOwners adds the files stored before the owner index was kept to
+// it. The whole store is only listed once.
+func indexUploadOwners(ctx context.Context) error {
+	if _, err := store.Stat(ctx, ownerIndexedKey); err == nil || !errors.Is(err, storage.ErrNotExist) {
+		return err
+	}
+	objects, err := store.List(ctx, "")
+	if err != nil {
+		return err
+	}
+	indexed := make(map[string]bool)
+	for _, object := range objects {
+		tenant, filename, ok := metadataFile(object.Key)
+		if !ok {
+			continue
+		}
+		meta, err := loadMetadata(ctx, tenant, filename)
+		if errors.Is(err, storage.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		key := ownerTenantKey(meta.Owner, tenant)
+		if meta.Owner == "" || indexed[key] {
+			continue
+		}
+		if err := recordOwnerTenant(ctx, meta.Owner, tenant); err != nil {
+			return err
+		}
+		indexed[key] = true
+	}
+	return store.Put(ctx, ownerIndexedKey, strings.NewReader(""), 0, "application/octet-stream")
+}
+
+// metadataFile returns the tenant and file name whose metadata is kept under
+// key. Other objects report ok false.
+func metadataFile(key string) (tenant, filename string, ok bool) {
+	tenant, rest, _ := strings.Cut(key, "/")
+	filename, ok = strings.CutPrefix(rest, ".meta/")
+	if !ok || !strings.HasSuffix(filename, ".json") {
+		return "", "", false
+	}
+	filename = strings.TrimSuffix(filename, ".json")
+	return tenant, filename, validFilename(filename)
+}
+
+// ownedUploads returns the uploads of tenant whose metadata names username as
+// the owner. The stored name only narrows the search, since "bob_1_..." may
+// belong to "bob" or to "bob_1". Files without metadata have no recorded
+// owner and are left to moderators.
+func ownedUploads(ctx context.Context, tenant, username string) ([]ownedUpload, error) {
+	objects, err := store.List(ctx, tenant+"/.meta/"+username+"_")
+	if err != nil {
+		return nil, err
+	}
+	var uploads []ownedUpload
+	for _, object := range objects {
+		tenant, filename, ok := metadataFile(object.Key)
+		if !ok || !ownedBy(filename, username) {
+			continue
+		}
+		meta, err := loadMetadata(ctx, tenant, filename)
+		if errors.Is(err, storage.ErrNotExist) {
+			// Deleted since the listing
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if meta.Owner == username {
+			uploads = append(uploads, ownedUpload{tenant: tenant, meta: meta})
+		}
+	}
+	return uploads, nil
+}
+
+// removeUpload deletes a tenant's file together with its variants and
+// metadata. Files stored before metadata was recorded have none. A missing
+// file is reported as storage.ErrNotExist once the rest is gone.
+func removeUpload(ctx context.Context, tenant, filename string) error {
+	missing := store.Delete(ctx, uploadKey(tenant, filename))
+	if missing != nil && !errors.Is(missing, storage.ErrNotExist) {
+		return missing
+	}
+	if err := removeVariants(ctx, tenant, filename); err != nil {
+		return err
+	}
+	if err := store.Delete(ctx, metadataKey(tenant, filename)); err != nil && !errors.Is(err, storage.ErrNotExist) {
+		return err
+	}
+	return missing
+}
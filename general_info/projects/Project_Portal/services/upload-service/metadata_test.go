@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"upload-service/storage"
+)
+
+// useLocalStore points the package-level store at a temporary directory
+func useLocalStore(t *testing.T) {
+	t.Helper()
+	local, err := storage.NewLocal(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := store
+	store = local
+	t.Cleanup(func() { store = previous })
+}
+
+// putUpload stores a file and, unless owner is empty, its metadata. The owner
+// index is left to the caller.
+func putUpload(t *testing.T, tenant, filename, owner string) {
+	t.Helper()
+	ctx := context.Background()
+	if err := store.Put(ctx, uploadKey(tenant, filename), strings.NewReader("data"), 4, "image/png"); err != nil {
+		t.Fatal(err)
+	}
+	if owner == "" {
+		return
+	}
+	if err := saveMetadata(ctx, tenant, &uploadMetadata{Filename: filename, Owner: owner, Size: 4}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOwnedUploadsOverlappingUsernames(t *testing.T) {
+	useLocalStore(t)
+	// "bob_1_1700000000_b.png" passes the name check for both "bob" and "bob_1"
+	putUpload(t, "default", "bob_1700000000_a.png", "bob")
+	putUpload(t, "default", "bob_1_1700000000_b.png", "bob_1")
+	putUpload(t, "acme", "bob_1700000001_c.png", "bob")
+	putUpload(t, "default", "bob_1700000002_d.png", "")
+
+	tests := []struct {
+		tenant, username string
+		want             []string
+	}{
+		{"default", "bob", []string{"default/bob_1700000000_a.png"}},
+		{"default", "bob_1", []string{"default/bob_1_1700000000_b.png"}},
+		{"acme", "bob", []string{"acme/bob_1700000001_c.png"}},
+		{"default", "bo", nil},
+	}
+	for _, tt := range tests {
+		uploads, err := ownedUploads(context.Background(), tt.tenant, tt.username)
+		if err != nil {
+			t.Fatalf("ownedUploads(%q, %q): %v", tt.tenant, tt.username, err)
+		}
+		var got []string
+		for _, upload := range uploads {
+			got = append(got, upload.tenant+"/"+upload.meta.Filename)
+		}
+		if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("ownedUploads(%q, %q) = %v, want %v", tt.tenant, tt.username, got, tt.want)
+		}
+	}
+}
+
+func TestDeleteAccountUploadsKeepsOtherOwners(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	useLocalStore(t)
+	putUpload(t, "default", "bob_1700000000_a.png", "bob")
+	putUpload(t, "default", "bob_1_1700000000_b.png", "bob_1")
+	putUpload(t, "default", "bob_1700000002_d.png", "")
+	putUpload(t, "acme", "bob_1700000001_c.png", "bob")
+	// Files stored before the owner index was kept are found through it
+	if err := indexUploadOwners(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	putUpload(t, "other", "bob_1700000003_e.png", "bob")
+	if err := recordOwnerTenant(context.Background(), "bob", "other"); err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodDelete, "/account/uploads", nil)
+	c.Set("username", "bob")
+	deleteAccountUploads(c)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %s", w.Code, w.Body)
+	}
+	ctx := context.Background()
+	for _, key := range []string{"default/bob_1700000000_a.png", "acme/bob_1700000001_c.png", "other/bob_1700000003_e.png"} {
+		if _, err := store.Stat(ctx, key); !errors.Is(err, storage.ErrNotExist) {
+			t.Errorf("bob's upload %s still exists: %v", key, err)
+		}
+	}
+	if tenants, err := ownerTenants(ctx, "bob"); err != nil || len(tenants) != 0 {
+		t.Errorf("owner index of bob after deletion = %v, %v; want empty", tenants, err)
+	}
+	for _, filename := range []string{"bob_1_1700000000_b.png", "bob_1700000002_d.png"} {
+		if _, err := store.Stat(ctx, uploadKey("default", filename)); err != nil {
+			t.Errorf("%s was removed: %v", filename, err)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"shared"
+	"shared/config"
+)
+
+// Files are private: they are only served for URLs signed by upload-service.
+// A URL carries its expiry, an optional variant size and Content-Disposition,
+// and an HMAC-SHA256 of these with the file's tenant and name. Whoever holds
+// a URL can read the file until it expires, so responses carry short-lived
+// URLs and owners mint longer-lived share links explicitly.
+
+// minSigningKeyLength is the shortest UPLOAD_SIGNING_KEY accepted
+const minSigningKeyLength = 32
+
+var (
+	errBadSignature = errors.New("invalid signature")
+	errLinkExpired  = errors.New("link expired")
+)
+
+// urlSigner signs and verifies file URLs
+type urlSigner struct {
+	key []byte
+	// ttl is the lifetime of URLs in responses, maxTTL that of share links
+	ttl    time.Duration
+	maxTTL time.Duration
+}
+
+// signer holds the key and lifetimes from the configuration
+var signer *urlSigner
+
+// newURLSigner uses the configured key. Without one, debug and test mode sign
+// with a random key, so URLs break on restart and differ between replicas;
+// release mode refuses to start.
+func newURLSigner(cfg config.UploadConfig, mode string) (*urlSigner, error) {
+	s := &urlSigner{key: []byte(cfg.SigningKey), ttl: cfg.URLTTL, maxTTL: cfg.MaxShareTTL}
+	switch {
+	case len(s.key) >= minSigningKeyLength:
+	case len(s.key) > 0:
+		return nil, fmt.Errorf("UPLOAD_SIGNING_KEY must be at least %d bytes", minSigningKeyLength)
+	case mode == gin.ReleaseMode:
+		return nil, errors.New("UPLOAD_SIGNING_KEY must be set in release mode")
+	default:
+		log.Println("UPLOAD_SIGNING_KEY is not set; file URLs are signed with a random key and break on restart")
+		s.key = make([]byte, minSigningKeyLength)
+		if _, err := rand.Read(s.key); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// fileLink is what a signed URL grants: reading a file, or with size one of
+// its variants, until expires
+type fileLink struct {
+	tenant   string
+	filename string
+	size     int
+	// disposition is "", "inline" or "attachment"
+	disposition string
+	expires     time.Time
+}
+
+func (s *urlSigner) signature(link fileLink) string {
+	mac := hmac.New(sha256.New, s.key)
+	// Escaped names contain no newlines, so fields cannot run into each other
+	fmt.Fprintf(mac, "%s/%s\n%d\n%d\n%s", url.PathEscape(link.tenant), url.PathEscape(link.filename),
+		link.size, link.expires.Unix(), link.disposition)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// signURL returns the URL of link as the gateway publishes it
+func (s *urlSigner) signURL(link fileLink) string {
+	query := url.Values{}
+	if link.size > 0 {
+		query.Set("size", strconv.Itoa(link.size))
+	}
+	if link.disposition != "" {
+		query.Set("disposition", link.disposition)
+	}
+	query.Set("expires", strconv.FormatInt(link.expires.Unix(), 10))
+	query.Set("sig", s.signature(link))
+	return fmt.Sprintf("/uploads/%s/%s?%s", url.PathEscape(link.tenant), url.PathEscape(link.filename), query.Encode())
+}
+
+// verify returns the link that query grants for tenant/filename
+func (s *urlSigner) verify(tenant, filename string, query url.Values) (fileLink, error) {
+	link := fileLink{tenant: tenant, filename: filename, disposition: query.Get("disposition")}
+	expires, err := strconv.ParseInt(query.Get("expires"), 10, 64)
+	if err != nil {
+		return link, errBadSignature
+	}
+	link.expires = time.Unix(expires, 0)
+	if raw := query.Get("size"); raw != "" {
+		if link.size, err = strconv.Atoi(raw); err != nil || link.size <= 0 {
+			return link, errBadSignature
+		}
+	}
+	if !hmac.Equal([]byte(query.Get("sig")), []byte(s.signature(link))) {
+		return link, errBadSignature
+	}
+	if !time.Now().Before(link.expires) {
+		return link, errLinkExpired
+	}
+	return link, nil
+}
+
+// fileURL returns a URL of a file, or with size > 0 of its variant, that is
+// valid for upload.urlTTL
+func fileURL(tenant, filename string, size int) string {
+	return signer.signURL(fileLink{tenant: tenant, filename: filename, size: size, expires: time.Now().Add(signer.ttl)})
+}
+
+// signedVariants returns copies of a file's variants with URLs from fileURL
+func signedVariants(tenant, filename string, variants []shared.UploadVariant) []shared.UploadVariant {
+	if len(variants) == 0 {
+		return nil
+	}
+	signed := make([]shared.UploadVariant, len(variants))
+	for i, variant := range variants {
+		signed[i] = variant
+		signed[i].URL = fileURL(tenant, filename, variant.Size)
+	}
+	return signed
+}
@@ -0,0 +1,267 @@
+package storage
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// localTmpDir holds objects while Local writes them, and the lock files of
+// PutIf; it is never listed
+const localTmpDir = ".tmp"
+
+// localLockStale is how old a lock file must be before it is taken to be left
+// behind by a process that crashed while holding it
+const localLockStale = 30 * time.Second
+
+// Local stores objects as files below a root directory. It suits a single
+// replica, or several sharing a ReadWriteMany volume.
+type Local struct {
+	root string
+}
+
+// NewLocal returns a Local storing objects below root, creating it if needed
+func NewLocal(root string) (*Local, error) {
+	if err := os.MkdirAll(filepath.Join(root, localTmpDir), 0755); err != nil {
+		return nil, err
+	}
+	return &Local{root: root}, nil
+}
+
+func (l *Local) path(key string) (string, error) {
+	if err := checkKey(key); err != nil {
+		return "", err
+	}
+	return filepath.Join(l.root, filepath.FromSlash(key)), nil
+}
+
+// Put writes to a temporary file first and renames it into place. The
+// modification time is set to the nanosecond, since it makes up the ETag.
+func (l *Local) Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error {
+	p, err := l.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Join(l.root, localTmpDir), "put-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	n, err := io.Copy(tmp, r)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if n != size {
+		return io.ErrUnexpectedEOF
+	}
+	now := time.Now()
+	if err := os.Chtimes(tmp.Name(), now, now); err != nil {
+		return err
+	}
+	err = os.Rename(tmp.Name(), p)
+	if errors.Is(err, fs.ErrNotExist) {
+		// A Delete pruned the directory in the meantime
+		if err = os.MkdirAll(filepath.Dir(p), 0755); err == nil {
+			err = os.Rename(tmp.Name(), p)
+		}
+	}
+	return err
+}
+
+// PutIf holds a lock file for key while it compares the ETag and writes, so
+// that of several writers that read the same ETag only the first succeeds
+func (l *Local) PutIf(ctx context.Context, key string, r io.Reader, size int64, contentType, etag string) (string, error) {
+	if _, err := l.path(key); err != nil {
+		return "", err
+	}
+	if etag == "" {
+		return "", errNoETag
+	}
+	unlock, err := l.lock(ctx, key)
+	if err != nil {
+		return "", err
+	}
+	defer unlock()
+
+	info, err := l.Stat(ctx, key)
+	if errors.Is(err, ErrNotExist) {
+		return "", ErrPrecondition
+	}
+	if err != nil {
+		return "", err
+	}
+	if info.ETag != etag {
+		return "", ErrPrecondition
+	}
+	if err := l.Put(ctx, key, r, size, contentType); err != nil {
+		return "", err
+	}
+	if info, err = l.Stat(ctx, key); err != nil {
+		return "", err
+	}
+	return info.ETag, nil
+}
+
+// lock creates the lock file of key, waiting as long as ctx allows while
+// another writer holds it. Lock files are created exclusively, so they also
+// work between processes sharing a volume.
+func (l *Local) lock(ctx context.Context, key string) (unlock func(), err error) {
+	sum := sha256.Sum256([]byte(key))
+	name := filepath.Join(l.root, localTmpDir, "lock-"+hex.EncodeToString(sum[:]))
+	for {
+		f, err := os.OpenFile(name, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if err == nil {
+			f.Close()
+			return func() { os.Remove(name) }, nil
+		}
+		if !errors.Is(err, fs.ErrExist) {
+			return nil, err
+		}
+		if fi, err := os.Stat(name); err == nil && time.Since(fi.ModTime()) > localLockStale {
+			os.Remove(name)
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+// Get returns the open file, which can seek
+func (l *Local) Get(ctx context.Context, key string) (io.ReadCloser, *ObjectInfo, error) {
+	p, err := l.path(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, nil, notExist(err)
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	if !fi.Mode().IsRegular() {
+		f.Close()
+		return nil, nil, ErrNotExist
+	}
+	return f, localInfo(key, fi), nil
+}
+
+func (l *Local) Stat(ctx context.Context, key string) (*ObjectInfo, error) {
+	p, err := l.path(key)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := os.Stat(p)
+	if err != nil {
+		return nil, notExist(err)
+	}
+	if !fi.Mode().IsRegular() {
+		return nil, ErrNotExist
+	}
+	return localInfo(key, fi), nil
+}
+
+// Delete also removes the directories the object leaves empty
+func (l *Local) Delete(ctx context.Context, key string) error {
+	p, err := l.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(p); err != nil {
+		return notExist(err)
+	}
+	for dir := path.Dir(key); dir != "."; dir = path.Dir(dir) {
+		if os.Remove(filepath.Join(l.root, filepath.FromSlash(dir))) != nil {
+			break
+		}
+	}
+	return nil
+}
+
+// List walks only the directory the prefix points into
+func (l *Local) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	start := l.root
+	if dir := path.Dir(prefix + "x"); dir != "." {
+		if checkKey(dir) != nil {
+			return nil, ErrInvalidKey
+		}
+		start = filepath.Join(l.root, filepath.FromSlash(dir))
+	}
+
+	var objects []ObjectInfo
+	err := filepath.WalkDir(start, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		rel, err := filepath.Rel(l.root, p)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if d.IsDir() {
+			if key == localTmpDir {
+				return filepath.SkipDir
+			}
+			return ctx.Err()
+		}
+		if !d.Type().IsRegular() || !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+		fi, err := d.Info()
+		if err != nil {
+			// Removed since the directory was read
+			return nil
+		}
+		objects = append(objects, *localInfo(key, fi))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Key < objects[j].Key })
+	return objects, nil
+}
+
+func localInfo(key string, fi fs.FileInfo) *ObjectInfo {
+	return &ObjectInfo{
+		Key:         key,
+		Size:        fi.Size(),
+		ContentType: mime.TypeByExtension(path.Ext(key)),
+		ModTime:     fi.ModTime(),
+		ETag:        fmt.Sprintf(`"%x-%x"`, fi.ModTime().UnixNano(), fi.Size()),
+	}
+}
+
+// notExist translates missing files into ErrNotExist
+func notExist(err error) error {
+	if errors.Is(err, fs.ErrNotExist) {
+		return ErrNotExist
+	}
+	return err
+}
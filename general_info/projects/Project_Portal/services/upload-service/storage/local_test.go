@@ -0,0 +1,11 @@
+package storage
+
+import "testing"
+
+func TestLocal(t *testing.T) {
+	local, err := NewLocal(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	testStorage(t, local)
+}
@@ -0,0 +1,429 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// S3Options locate a bucket and hold the credentials to use it
+type S3Options struct {
+	// Endpoint is the base URL of the API, e.g. http://minio:9000
+	Endpoint string
+	Region   string
+	Bucket   string
+	// PathStyle addresses the bucket as Endpoint/Bucket rather than as
+	// Bucket.Endpoint
+	PathStyle       bool
+	AccessKeyID     string
+	SecretAccessKey string
+	// Client defaults to an http.Client without an overall timeout, since
+	// objects may be large, that gives up on responses whose headers take
+	// longer than s3ResponseTimeout
+	Client *http.Client
+}
+
+// s3ResponseTimeout is how long the default client waits for response
+// headers once a request was sent, so that a stalled backend fails calls
+// whose context has no deadline
+const s3ResponseTimeout = 30 * time.Second
+
+// S3 stores objects in a bucket of Amazon S3 or a compatible store such as
+// MinIO. Requests are signed with AWS Signature Version 4.
+type S3 struct {
+	opts S3Options
+	base *url.URL
+}
+
+// NewS3 returns an S3 for the bucket described by opts. It makes no request.
+func NewS3(opts S3Options) (*S3, error) {
+	base, err := url.Parse(strings.TrimSuffix(opts.Endpoint, "/"))
+	if err != nil || (base.Scheme != "http" && base.Scheme != "https") || base.Host == "" {
+		return nil, fmt.Errorf("storage: invalid S3 endpoint %q", opts.Endpoint)
+	}
+	if opts.Bucket == "" || opts.Region == "" {
+		return nil, errors.New("storage: S3 bucket and region are required")
+	}
+	if opts.Client == nil {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.ResponseHeaderTimeout = s3ResponseTimeout
+		opts.Client = &http.Client{Transport: transport}
+	}
+	if opts.PathStyle {
+		base.Path += "/" + opts.Bucket
+	} else {
+		base.Host = opts.Bucket + "." + base.Host
+	}
+	return &S3{opts: opts, base: base}, nil
+}
+
+// EnsureBucket creates the bucket unless it exists already, then checks that
+// the store enforces If-Match on writes, which PutIf depends on. Stores that
+// ignore it, such as older MinIO releases, fail here rather than silently
+// losing concurrent updates.
+func (s *S3) EnsureBucket(ctx context.Context) error {
+	if err := s.ensureBucket(ctx); err != nil {
+		return err
+	}
+	return s.checkConditionalWrites(ctx)
+}
+
+func (s *S3) ensureBucket(ctx context.Context) error {
+	resp, err := s.do(ctx, http.MethodHead, "", nil, nil, 0, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusNotFound:
+	default:
+		return fmt.Errorf("storage: check bucket %s: %s", s.opts.Bucket, resp.Status)
+	}
+
+	// us-east-1 is the default location and must not be named
+	var body []byte
+	if s.opts.Region != "us-east-1" {
+		body = []byte(`<CreateBucketConfiguration xmlns="http://s3.amazonaws.com/doc/2006-03-01/"><LocationConstraint>` +
+			s.opts.Region + `</LocationConstraint></CreateBucketConfiguration>`)
+	}
+	resp, err = s.do(ctx, http.MethodPut, "", nil, bytes.NewReader(body), int64(len(body)), nil)
+	if err != nil {
+		return err
+	}
+	return s.check(resp, http.MethodPut, s.opts.Bucket)
+}
+
+// checkConditionalWrites writes a probe object and overwrites it once with a
+// stale and once with the current ETag
+func (s *S3) checkConditionalWrites(ctx context.Context) error {
+	const key = ".conditional-write-probe"
+	put := func(data string, header http.Header) (string, error) {
+		return s.put(ctx, key, strings.NewReader(data), int64(len(data)), "text/plain", header)
+	}
+	first, err := put("1", http.Header{})
+	if err != nil {
+		return err
+	}
+	defer s.Delete(ctx, key)
+	if _, err := put("2", http.Header{"If-Match": {`"0"`}}); !errors.Is(err, ErrPrecondition) {
+		if err == nil {
+			err = errors.New("a write with a stale If-Match succeeded")
+		}
+		return fmt.Errorf("storage: bucket %s does not enforce conditional writes: %w", s.opts.Bucket, err)
+	}
+	if _, err := put("3", http.Header{"If-Match": {first}}); err != nil {
+		return fmt.Errorf("storage: bucket %s does not enforce conditional writes: %w", s.opts.Bucket, err)
+	}
+	return nil
+}
+
+func (s *S3) Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error {
+	_, err := s.put(ctx, key, r, size, contentType, http.Header{})
+	return err
+}
+
+// PutIf sends a write with If-Match, which S3 answers with 412 when the ETag
+// no longer matches, 409 when a concurrent write is still in progress and 404
+// when the object is gone. EnsureBucket checks that the store enforces it.
+func (s *S3) PutIf(ctx context.Context, key string, r io.Reader, size int64, contentType, etag string) (string, error) {
+	if etag == "" {
+		return "", errNoETag
+	}
+	return s.put(ctx, key, r, size, contentType, http.Header{"If-Match": {etag}})
+}
+
+// put stores an object and returns its ETag
+func (s *S3) put(ctx context.Context, key string, r io.Reader, size int64, contentType string, header http.Header) (string, error) {
+	if err := checkKey(key); err != nil {
+		return "", err
+	}
+	if contentType != "" {
+		header.Set("Content-Type", contentType)
+	}
+	resp, err := s.do(ctx, http.MethodPut, key, nil, r, size, header)
+	if err != nil {
+		return "", err
+	}
+	if header.Get("If-Match") != "" {
+		switch resp.StatusCode {
+		case http.StatusPreconditionFailed, http.StatusConflict, http.StatusNotFound:
+			resp.Body.Close()
+			return "", ErrPrecondition
+		}
+	}
+	etag := resp.Header.Get("ETag")
+	return etag, s.check(resp, http.MethodPut, key)
+}
+
+// Get returns the response body, which cannot seek
+func (s *S3) Get(ctx context.Context, key string) (io.ReadCloser, *ObjectInfo, error) {
+	if err := checkKey(key); err != nil {
+		return nil, nil, err
+	}
+	resp, err := s.do(ctx, http.MethodGet, key, nil, nil, 0, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, s.check(resp, http.MethodGet, key)
+	}
+	return resp.Body, headerInfo(key, resp), nil
+}
+
+func (s *S3) Stat(ctx context.Context, key string) (*ObjectInfo, error) {
+	if err := checkKey(key); err != nil {
+		return nil, err
+	}
+	resp, err := s.do(ctx, http.MethodHead, key, nil, nil, 0, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.check(resp, http.MethodHead, key); err != nil {
+		return nil, err
+	}
+	return headerInfo(key, resp), nil
+}
+
+// Delete checks that the object exists first, since S3 also answers
+// deletes of missing keys with success
+func (s *S3) Delete(ctx context.Context, key string) error {
+	if _, err := s.Stat(ctx, key); err != nil {
+		return err
+	}
+	resp, err := s.do(ctx, http.MethodDelete, key, nil, nil, 0, nil)
+	if err != nil {
+		return err
+	}
+	return s.check(resp, http.MethodDelete, key)
+}
+
+// listResult is the part of a ListObjectsV2 response that List reads
+type listResult struct {
+	Contents []struct {
+		Key          string    `xml:"Key"`
+		Size         int64     `xml:"Size"`
+		LastModified time.Time `xml:"LastModified"`
+		ETag         string    `xml:"ETag"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+// List follows continuation tokens until the listing is complete
+func (s *S3) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	var objects []ObjectInfo
+	query := url.Values{"list-type": {"2"}}
+	if prefix != "" {
+		query.Set("prefix", prefix)
+	}
+	for {
+		resp, err := s.do(ctx, http.MethodGet, "", query, nil, 0, nil)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			return nil, s.check(resp, http.MethodGet, s.opts.Bucket)
+		}
+		var result listResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("storage: decode listing: %w", err)
+		}
+		for _, c := range result.Contents {
+			objects = append(objects, ObjectInfo{Key: c.Key, Size: c.Size, ModTime: c.LastModified, ETag: c.ETag})
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			break
+		}
+		query.Set("continuation-token", result.NextContinuationToken)
+	}
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Key < objects[j].Key })
+	return objects, nil
+}
+
+// s3Error is the body S3 sends with failed requests
+type s3Error struct {
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+// check closes resp and turns a failure status into an error, 404 into
+// ErrNotExist
+func (s *S3) check(resp *http.Response, method, key string) error {
+	defer resp.Body.Close()
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		io.Copy(io.Discard, resp.Body)
+		return nil
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return ErrNotExist
+	}
+	var body s3Error
+	if xml.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&body) == nil && body.Code != "" {
+		return fmt.Errorf("storage: %s %s: %s: %s", method, key, body.Code, body.Message)
+	}
+	return fmt.Errorf("storage: %s %s: %s", method, key, resp.Status)
+}
+
+func headerInfo(key string, resp *http.Response) *ObjectInfo {
+	info := &ObjectInfo{Key: key, ContentType: resp.Header.Get("Content-Type"), ETag: resp.Header.Get("ETag")}
+	info.Size, _ = strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64)
+	info.ModTime, _ = http.ParseTime(resp.Header.Get("Last-Modified"))
+	return info
+}
+
+// unsignedPayload tells S3 not to check a hash of the body, so that uploads
+// can stream without being read twice
+const unsignedPayload = "UNSIGNED-PAYLOAD"
+
+// do sends a signed request for key, or for the bucket itself when key is
+// empty
+func (s *S3) do(ctx context.Context, method, key string, query url.Values, body io.Reader, size int64, header http.Header) (*http.Response, error) {
+	u := *s.base
+	if key != "" {
+		u.Path += "/" + key
+	}
+	if u.Path == "" {
+		u.Path = "/"
+	}
+	u.RawPath = escapePath(u.Path)
+	u.RawQuery = escapeQuery(query)
+
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	if body != nil {
+		req.ContentLength = size
+		if size == 0 {
+			req.Body = http.NoBody
+		}
+	}
+	s.sign(req, time.Now().UTC())
+	return s.opts.Client.Do(req)
+}
+
+// sign adds an AWS Signature Version 4 Authorization header to req. The
+// payload is left unsigned unless req already carries its hash.
+func (s *S3) sign(req *http.Request, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	payloadHash := req.Header.Get("X-Amz-Content-Sha256")
+	if payloadHash == "" {
+		payloadHash = unsignedPayload
+		req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	}
+
+	// Host and the x-amz-* headers are always signed, Content-Type and
+	// Range when set
+	signed := map[string]string{
+		"host":                 req.URL.Host,
+		"x-amz-date":           amzDate,
+		"x-amz-content-sha256": payloadHash,
+	}
+	for _, name := range []string{"Content-Type", "Range"} {
+		if value := req.Header.Get(name); value != "" {
+			signed[strings.ToLower(name)] = value
+		}
+	}
+	names := make([]string, 0, len(signed))
+	for name := range signed {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + strings.TrimSpace(signed[name]) + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := date + "/" + s.opts.Region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hexSHA256(canonicalRequest)
+
+	key := hmacSHA256([]byte("AWS4"+s.opts.SecretAccessKey), date)
+	key = hmacSHA256(key, s.opts.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+s.opts.AccessKeyID+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func hexSHA256(data string) string {
+	sum := sha256.Sum256([]byte(data))
+	return hex.EncodeToString(sum[:])
+}
+
+// escapePath encodes every byte of p except unreserved characters and
+// slashes, as Signature Version 4 requires
+func escapePath(p string) string {
+	segments := strings.Split(p, "/")
+	for i, segment := range segments {
+		segments[i] = escapeSigV4(segment)
+	}
+	return strings.Join(segments, "/")
+}
+
+// escapeQuery encodes query sorted by name, with spaces as %20
+func escapeQuery(query url.Values) string {
+	names := make([]string, 0, len(query))
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var parts []string
+	for _, name := range names {
+		for _, value := range query[name] {
+			parts = append(parts, escapeSigV4(name)+"="+escapeSigV4(value))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+func escapeSigV4(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == '~' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
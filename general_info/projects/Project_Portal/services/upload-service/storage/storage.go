@@ -0,0 +1,74 @@
+// Package storage keeps upload-service's files behind one interface, so that
+// they can live on a local disk or in an S3-compatible bucket shared by every
+// replica.
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"time"
+)
+
+// ErrNotExist is returned for keys that name no object
+var ErrNotExist = errors.New("storage: object does not exist")
+
+// ErrPrecondition is returned by PutIf when the object changed since its
+// ETag was read
+var ErrPrecondition = errors.New("storage: object changed")
+
+// errNoETag is returned by PutIf without an ETag to compare
+var errNoETag = errors.New("storage: PutIf needs the ETag of the current object")
+
+// ErrInvalidKey is returned for keys that are empty, absolute or contain
+// empty, "." or ".." segments
+var ErrInvalidKey = errors.New("storage: invalid key")
+
+// ObjectInfo describes a stored object
+type ObjectInfo struct {
+	// Key is the slash-separated name of the object, e.g. "default/a.png"
+	Key  string
+	Size int64
+	// ContentType is empty in List results, which do not carry it
+	ContentType string
+	ModTime     time.Time
+	// ETag changes whenever the object is written
+	ETag string
+}
+
+// Storage stores objects under slash-separated keys. Implementations are safe
+// for concurrent use.
+type Storage interface {
+	// Put stores size bytes from r under key, replacing any object there.
+	// Readers never see a partly written object.
+	Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error
+	// PutIf stores like Put, but only if the object at key still has the
+	// given ETag, which must not be empty. It returns the ETag of the new
+	// object, or ErrPrecondition if another write came first.
+	PutIf(ctx context.Context, key string, r io.Reader, size int64, contentType, etag string) (string, error)
+	// Get opens the object at key. The reader also implements io.Seeker
+	// when the backend can seek, which lets range requests be served.
+	Get(ctx context.Context, key string) (io.ReadCloser, *ObjectInfo, error)
+	// Stat describes the object at key
+	Stat(ctx context.Context, key string) (*ObjectInfo, error)
+	// Delete removes the object at key, or returns ErrNotExist
+	Delete(ctx context.Context, key string) error
+	// List returns every object whose key starts with prefix, at any depth,
+	// sorted by key
+	List(ctx context.Context, prefix string) ([]ObjectInfo, error)
+}
+
+// checkKey rejects keys that could escape the storage root or that backends
+// would store under a different name
+func checkKey(key string) error {
+	if key == "" || strings.HasPrefix(key, "/") || strings.ContainsAny(key, "\\\x00") {
+		return ErrInvalidKey
+	}
+	for _, segment := range strings.Split(key, "/") {
+		if segment == "" || segment == "." || segment == ".." {
+			return ErrInvalidKey
+		}
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+)
+
+// testStorage checks the behaviour every Storage implementation promises
+func testStorage(t *testing.T, s Storage) {
+	t.Helper()
+	ctx := context.Background()
+
+	put := func(key, data string) {
+		t.Helper()
+		if err := s.Put(ctx, key, strings.NewReader(data), int64(len(data)), "text/plain"); err != nil {
+			t.Fatalf("Put(%q): %v", key, err)
+		}
+	}
+
+	put("default/a.txt", "hello")
+	body, info, err := s.Get(ctx, "default/a.txt")
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	data, err := io.ReadAll(body)
+	body.Close()
+	if err != nil || string(data) != "hello" {
+		t.Fatalf("Get read %q, %v; want hello", data, err)
+	}
+	if info.Size != 5 || info.ETag == "" {
+		t.Errorf("Get info = %+v, want size 5 and an ETag", info)
+	}
+	if stat, err := s.Stat(ctx, "default/a.txt"); err != nil || stat.Size != 5 || stat.ETag != info.ETag {
+		t.Errorf("Stat = %+v, %v; want size 5 and ETag %s", stat, err, info.ETag)
+	}
+
+	// Enough keys for the S3 fake to page the listing
+	var want []string
+	for i := 0; i < 5; i++ {
+		key := fmt.Sprintf("acme/%d.txt", i)
+		put(key, "x")
+		want = append(want, key)
+	}
+	put("acme2/other.txt", "x")
+	objects, err := s.List(ctx, "acme/")
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	var got []string
+	for _, object := range objects {
+		got = append(got, object.Key)
+	}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("List = %v, want %v", got, want)
+	}
+
+	if err := s.Delete(ctx, "default/a.txt"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, err := s.Stat(ctx, "default/a.txt"); !errors.Is(err, ErrNotExist) {
+		t.Errorf("Stat after Delete: %v, want ErrNotExist", err)
+	}
+	if _, _, err := s.Get(ctx, "default/a.txt"); !errors.Is(err, ErrNotExist) {
+		t.Errorf("Get after Delete: %v, want ErrNotExist", err)
+	}
+	if err := s.Delete(ctx, "default/a.txt"); !errors.Is(err, ErrNotExist) {
+		t.Errorf("Delete of a missing key: %v, want ErrNotExist", err)
+	}
+
+	putIf := func(data, etag string) (string, error) {
+		return s.PutIf(ctx, "tus/info.json", strings.NewReader(data), int64(len(data)), "application/json", etag)
+	}
+	if _, err := putIf("1", `"missing"`); !errors.Is(err, ErrPrecondition) {
+		t.Errorf("PutIf on a missing object: %v, want ErrPrecondition", err)
+	}
+	if err := s.Put(ctx, "tus/info.json", strings.NewReader("1"), 1, "application/json"); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	stat, err := s.Stat(ctx, "tus/info.json")
+	if err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+	first := stat.ETag
+	if _, err := putIf("2", ""); err == nil {
+		t.Error("PutIf without an ETag succeeded")
+	}
+	second, err := putIf("2", first)
+	if err != nil {
+		t.Fatalf("PutIf with the current ETag: %v", err)
+	}
+	if _, err := putIf("3", first); !errors.Is(err, ErrPrecondition) {
+		t.Errorf("PutIf with a stale ETag: %v, want ErrPrecondition", err)
+	}
+	if stat, err := s.Stat(ctx, "tus/info.json"); err != nil || stat.ETag != second {
+		t.Errorf("Stat after PutIf = %+v, %v; want ETag %s", stat, err, second)
+	}
+
+	for _, key := range []string{"", "/abs", "a/../b", "a//b", "./a"} {
+		if err := s.Put(ctx, key, strings.NewReader("x"), 1, ""); !errors.Is(err, ErrInvalidKey) {
+			t.Errorf("Put(%q): %v, want ErrInvalidKey", key, err)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"shared/config"
+	"upload-service/storage"
+)
+
+// store holds every tenant's files under "<tenant>/<filename>". It is chosen
+// by UPLOAD_STORAGE.
+var store storage.Storage
+
+// detachedTimeout bounds storage calls that must finish after the request
+// that made them was cancelled
+const detachedTimeout = time.Minute
+
+// detached returns a context that survives the cancellation of ctx, such as a
+// client going away, but not detachedTimeout, so that a stalled backend
+// cannot hold the handler forever
+func detached(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.WithoutCancel(ctx), detachedTimeout)
+}
+
+// openStorage returns the backend the configuration selects. A missing S3
+// bucket is created, which is convenient with a fresh MinIO.
+func openStorage(ctx context.Context, cfg config.UploadConfig) (storage.Storage, error) {
+	switch cfg.Storage {
+	case "s3":
+		s3, err := storage.NewS3(storage.S3Options{
+			Endpoint:        cfg.S3.Endpoint,
+			Region:          cfg.S3.Region,
+			Bucket:          cfg.S3.Bucket,
+			PathStyle:       cfg.S3.PathStyle,
+			AccessKeyID:     cfg.S3.AccessKeyID,
+			SecretAccessKey: cfg.S3.SecretAccessKey,
+		})
+		if err != nil {
+			return nil, err
+		}
+		if err := s3.EnsureBucket(ctx); err != nil {
+			return nil, err
+		}
+		return s3, nil
+	case "local":
+		return storage.NewLocal(cfg.Dir)
+	}
+	return nil, fmt.Errorf("unknown storage %q", cfg.Storage)
+}
+
+// uploadKey returns the key of a tenant's file
+func uploadKey(tenant, filename string) string {
+	return tenant + "/" + filename
+}
+
+// splitKey returns the tenant and file name of an upload's key. Other
+// objects, such as metadata, report ok false.
+func splitKey(key string) (tenant, filename string, ok bool) {
+	tenant, filename, ok = strings.Cut(key, "/")
+	return tenant, filename, ok && validFilename(filename)
+}
+
+// tenantFiles returns the uploads of tenant
+func tenantFiles(ctx context.Context, tenant string) ([]storage.ObjectInfo, error) {
+	objects, err := store.List(ctx, tenant+"/")
+	if err != nil {
+		return nil, err
+	}
+	files := objects[:0]
+	for _, object := range objects {
+		if _, _, ok := splitKey(object.Key); ok {
+			files = append(files, object)
+		}
+	}
+	return files, nil
+}
+
+// checkStorage writes and removes a probe object, since storage that turned
+// read-only or full still lists fine
+func checkStorage(ctx context.Context) error {
+	suffix, err := randomHex(8)
+	if err != nil {
+		return err
+	}
+	key := ".readyz-" + suffix
+	if err := store.Put(ctx, key, strings.NewReader("ok"), 2, "text/plain"); err != nil {
+		return err
+	}
+	return store.Delete(ctx, key)
+}
@@ -0,0 +1,579 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"shared"
+	"upload-service/storage"
+)
+
+// Resumable uploads implement the tus 1.0 core protocol with the creation
+// and expiration extensions (https://tus.io/protocols/resumable-upload).
+// Every PATCH is stored as a chunk object, so an interrupted transfer can
+// resume from its last offset on any replica. The state of an upload lists
+// its chunks and is only written if it did not change since it was read, so
+// that of two PATCHes at the same offset, such as a stale one and its resume
+// on another replica, only one is kept. Once the last byte arrives the chunks
+// are validated and stored exactly like a file sent to upload.
+const (
+	tusVersion    = "1.0.0"
+	tusExtensions = "creation,expiration"
+	// tusExpiry is how long an upload may take to complete
+	tusExpiry = 24 * time.Hour
+	// tusPrefix holds the state of resumable uploads, outside every tenant
+	tusPrefix = ".tus/"
+)
+
+// tusUpload is the state of a resumable upload
+type tusUpload struct {
+	ID     string `json:"id"`
+	Owner  string `json:"owner"`
+	Tenant string `json:"tenant"`
+	Length int64  `json:"length"`
+	Offset int64  `json:"offset"`
+	// Metadata is the decoded Upload-Metadata; "filename" becomes the
+	// original name
+	Metadata  map[string]string `json:"metadata,omitempty"`
+	CreatedAt time.Time         `json:"createdAt"`
+	ExpiresAt time.Time         `json:"expiresAt"`
+	// Chunks are the stored parts of the file, in order
+	Chunks []tusChunk `json:"chunks,omitempty"`
+	// Result is set once the upload was completed and stored
+	Result *shared.UploadResponse `json:"result,omitempty"`
+
+	// etag is the ETag of the state as it was loaded or last saved
+	etag string
+}
+
+// tusChunk is the body of one PATCH, stored at Key
+type tusChunk struct {
+	Key    string `json:"key"`
+	Offset int64  `json:"offset"`
+	Size   int64  `json:"size"`
+}
+
+func tusInfoKey(id string) string {
+	return tusPrefix + id + "/info.json"
+}
+
+// tusChunkKey names chunks by their zero-padded offset and a random suffix,
+// so that two requests writing at the same offset never share a chunk
+func tusChunkKey(id string, offset int64, suffix string) string {
+	return fmt.Sprintf("%s%s/chunks/%020d-%s", tusPrefix, id, offset, suffix)
+}
+
+func loadTusUpload(ctx context.Context, id string) (*tusUpload, error) {
+	body, info, err := store.Get(ctx, tusInfoKey(id))
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	var upload tusUpload
+	if err := json.NewDecoder(body).Decode(&upload); err != nil {
+		return nil, fmt.Errorf("decode tus upload %s: %w", id, err)
+	}
+	upload.etag = info.ETag
+	return &upload, nil
+}
+
+// saveTusUpload writes the state unless another request changed it since it
+// was loaded, which is reported as storage.ErrPrecondition
+func saveTusUpload(ctx context.Context, upload *tusUpload) error {
+	data, err := json.Marshal(upload)
+	if err != nil {
+		return err
+	}
+	etag, err := store.PutIf(ctx, tusInfoKey(upload.ID), bytes.NewReader(data), int64(len(data)), "application/json", upload.etag)
+	if err != nil {
+		return err
+	}
+	upload.etag = etag
+	return nil
+}
+
+// storeNewTusUpload writes the first state of an upload. Its random id is
+// known to no other request yet, so the write needs no condition.
+func storeNewTusUpload(ctx context.Context, upload *tusUpload) error {
+	data, err := json.Marshal(upload)
+	if err != nil {
+		return err
+	}
+	key := tusInfoKey(upload.ID)
+	if err := store.Put(ctx, key, bytes.NewReader(data), int64(len(data)), "application/json"); err != nil {
+		return err
+	}
+	info, err := store.Stat(ctx, key)
+	if err != nil {
+		return err
+	}
+	upload.etag = info.ETag
+	return nil
+}
+
+// removeTusUpload deletes the state and chunks of an upload
+func removeTusUpload(ctx context.Context, id string) error {
+	objects, err := store.List(ctx, tusPrefix+id+"/")
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, object := range objects {
+		if err := store.Delete(ctx, object.Key); err != nil && !errors.Is(err, storage.ErrNotExist) {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// tusHeaders checks the protocol version of every request except OPTIONS and
+// marks every response with it
+func tusHeaders(c *gin.Context) {
+	c.Header("Tus-Resumable", tusVersion)
+	if c.GetHeader("Tus-Resumable") != tusVersion {
+		c.Header("Tus-Version", tusVersion)
+		c.AbortWithStatusJSON(http.StatusPreconditionFailed, shared.UploadResponse{Error: "Unsupported tus version"})
+		return
+	}
+	c.Next()
+}
+
+// tusOptions describes the server's tus support
+func tusOptions(c *gin.Context) {
+	c.Header("Tus-Resumable", tusVersion)
+	c.Header("Tus-Version", tusVersion)
+	c.Header("Tus-Extension", tusExtensions)
+	c.Header("Tus-Max-Size", strconv.FormatInt(policy.maxBytes, 10))
+	c.Status(http.StatusNoContent)
+}
+
+// tusMethodOverride lets clients behind proxies that only pass GET and POST
+// send the other tus methods in X-HTTP-Method-Override, as tus requires
+func tusMethodOverride(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		method := r.Header.Get("X-HTTP-Method-Override")
+		if method != "" && r.Method == http.MethodPost && strings.HasPrefix(r.URL.Path, "/tus/") {
+			r.Method = strings.ToUpper(method)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// createTusUpload handles POST /tus. Upload-Length is required and
+// Upload-Metadata may name the file.
+func createTusUpload(c *gin.Context) {
+	length, err := strconv.ParseInt(c.GetHeader("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		c.JSON(http.StatusBadRequest, shared.UploadResponse{Error: "Upload-Length must be a non-negative integer"})
+		return
+	}
+	if length == 0 {
+		c.JSON(http.StatusBadRequest, shared.UploadResponse{Error: "File is empty", Code: shared.UploadErrEmptyFile})
+		return
+	}
+	if length > policy.maxBytes {
+		rejectUpload(c, tooLarge(policy.maxBytes))
+		return
+	}
+	metadata, err := parseUploadMetadata(c.GetHeader("Upload-Metadata"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, shared.UploadResponse{Error: "Invalid Upload-Metadata"})
+		return
+	}
+
+	id, err := randomHex(16)
+	if err != nil {
+		rejectUpload(c, err)
+		return
+	}
+	now := time.Now().UTC()
+	upload := &tusUpload{
+		ID:        id,
+		Owner:     c.GetString("username"),
+		Tenant:    tenantOf(c),
+		Length:    length,
+		Metadata:  metadata,
+		CreatedAt: now,
+		ExpiresAt: now.Add(tusExpiry),
+	}
+	if err := storeNewTusUpload(c.Request.Context(), upload); err != nil {
+		rejectUpload(c, err)
+		return
+	}
+
+	c.Header("Location", "/tus/"+id)
+	c.Header("Upload-Expires", upload.ExpiresAt.Format(http.TimeFormat))
+	c.Status(http.StatusCreated)
+}
+
+// parseUploadMetadata decodes "key base64value" pairs separated by commas;
+// the value may be missing
+func parseUploadMetadata(header string) (map[string]string, error) {
+	metadata := make(map[string]string)
+	if strings.TrimSpace(header) == "" {
+		return metadata, nil
+	}
+	for _, pair := range strings.Split(header, ",") {
+		key, encoded, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		if key == "" {
+			return nil, errors.New("empty key")
+		}
+		value, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, err
+		}
+		metadata[key] = string(value)
+	}
+	return metadata, nil
+}
+
+// ownedTusUpload loads the caller's upload :id. Uploads of other users answer
+// 404 like missing ones; the response has been written when ok is false.
+func ownedTusUpload(c *gin.Context) (*tusUpload, bool) {
+	id := c.Param("id")
+	if len(id) != 32 || strings.Trim(id, "0123456789abcdef") != "" {
+		c.JSON(http.StatusNotFound, shared.UploadResponse{Error: "Upload not found"})
+		return nil, false
+	}
+	upload, err := loadTusUpload(c.Request.Context(), id)
+	if errors.Is(err, storage.ErrNotExist) ||
+		(err == nil && (upload.Owner != c.GetString("username") || upload.Tenant != tenantOf(c))) {
+		c.JSON(http.StatusNotFound, shared.UploadResponse{Error: "Upload not found"})
+		return nil, false
+	}
+	if err != nil {
+		log.Printf("Failed to load tus upload %s: %v", id, err)
+		c.JSON(http.StatusInternalServerError, shared.UploadResponse{Error: "Could not load upload"})
+		return nil, false
+	}
+	if time.Now().After(upload.ExpiresAt) {
+		c.JSON(http.StatusGone, shared.UploadResponse{Error: "Upload expired"})
+		return nil, false
+	}
+	return upload, true
+}
+
+// headTusUpload handles HEAD /tus/:id, which tells a client where to resume
+func headTusUpload(c *gin.Context) {
+	upload, ok := ownedTusUpload(c)
+	if !ok {
+		return
+	}
+	c.Header("Cache-Control", "no-store")
+	c.Header("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	c.Header("Upload-Length", strconv.FormatInt(upload.Length, 10))
+	c.Header("Upload-Expires", upload.ExpiresAt.Format(http.TimeFormat))
+	c.Status(http.StatusOK)
+}
+
+// getTusUpload returns the UploadResponse of a completed upload, which tus
+// has no place for in the final PATCH response
+func getTusUpload(c *gin.Context) {
+	upload, ok := ownedTusUpload(c)
+	if !ok {
+		return
+	}
+	if upload.Result == nil {
+		c.JSON(http.StatusConflict, shared.UploadResponse{Error: fmt.Sprintf("Upload is incomplete at %d of %d bytes", upload.Offset, upload.Length)})
+		return
+	}
+	// The stored URLs may have expired
+	result := *upload.Result
+	result.ImageURL = fileURL(upload.Tenant, result.Filename, 0)
+	result.Variants = signedVariants(upload.Tenant, result.Filename, result.Variants)
+	c.JSON(http.StatusOK, result)
+}
+
+// patchTusUpload handles PATCH /tus/:id. The body is appended at
+// Upload-Offset, which must be the current offset. Bytes that arrived before
+// the connection broke are kept. A request that lost the race for an offset
+// to another one answers 409 and its chunk is dropped. The request that
+// completes the upload also validates and stores it; a rejected file answers
+// like upload and is discarded.
+func patchTusUpload(c *gin.Context) {
+	if c.ContentType() != "application/offset+octet-stream" {
+		c.JSON(http.StatusUnsupportedMediaType, shared.UploadResponse{Error: "Content-Type must be application/offset+octet-stream"})
+		return
+	}
+	upload, ok := ownedTusUpload(c)
+	if !ok {
+		return
+	}
+	offset, err := strconv.ParseInt(c.GetHeader("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		c.JSON(http.StatusBadRequest, shared.UploadResponse{Error: "Upload-Offset must be a non-negative integer"})
+		return
+	}
+	if offset != upload.Offset {
+		c.JSON(http.StatusConflict, shared.UploadResponse{Error: fmt.Sprintf("Upload-Offset must be %d", upload.Offset)})
+		return
+	}
+
+	ctx := c.Request.Context()
+	// The state must be saved even if the client went away meanwhile
+	saveCtx, cancel := detached(ctx)
+	defer cancel()
+	if upload.Offset < upload.Length {
+		chunk, err := appendTusChunk(ctx, upload, c.Request.Body)
+		if errors.Is(err, errChunkTooLong) {
+			c.JSON(http.StatusBadRequest, shared.UploadResponse{Error: "Body goes past Upload-Length"})
+			return
+		}
+		if chunk != nil {
+			upload.Chunks = append(upload.Chunks, *chunk)
+			upload.Offset += chunk.Size
+			if err := saveTusUpload(saveCtx, upload); err != nil {
+				if err := store.Delete(saveCtx, chunk.Key); err != nil {
+					log.Printf("Failed to remove chunk %s: %v", chunk.Key, err)
+				}
+				rejectTusWrite(c, err)
+				return
+			}
+		}
+		if err != nil {
+			log.Printf("Tus upload %s interrupted at %d: %v", upload.ID, upload.Offset, err)
+			rejectUpload(c, err)
+			return
+		}
+	}
+
+	if upload.Offset == upload.Length && upload.Result == nil {
+		if err := completeTusUpload(ctx, upload); err != nil {
+			rejectTusWrite(c, err)
+			return
+		}
+	}
+	c.Header("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	c.Header("Upload-Expires", upload.ExpiresAt.Format(http.TimeFormat))
+	c.Status(http.StatusNoContent)
+}
+
+// rejectTusWrite answers a PATCH that lost to a concurrent one with 409, so
+// that the client asks for the offset again, and anything else like upload
+func rejectTusWrite(c *gin.Context, err error) {
+	if errors.Is(err, storage.ErrPrecondition) {
+		c.JSON(http.StatusConflict, shared.UploadResponse{Error: "Upload was changed by another request; check its offset"})
+		return
+	}
+	rejectUpload(c, err)
+}
+
+var errChunkTooLong = errors.New("chunk goes past the upload length")
+
+// appendTusChunk spools body to a temporary file, since storage needs the
+// size up front, and stores what arrived as a chunk at the upload's offset.
+// The chunk is nil if nothing arrived.
+func appendTusChunk(ctx context.Context, upload *tusUpload, body io.Reader) (*tusChunk, error) {
+	tmp, err := os.CreateTemp(policy.tempDir, "tus-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	remaining := upload.Length - upload.Offset
+	n, readErr := io.Copy(tmp, io.LimitReader(body, remaining+1))
+	if n > remaining {
+		return nil, errChunkTooLong
+	}
+	if n == 0 {
+		return nil, readErr
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	suffix, err := randomHex(8)
+	if err != nil {
+		return nil, err
+	}
+	chunk := &tusChunk{Key: tusChunkKey(upload.ID, upload.Offset, suffix), Offset: upload.Offset, Size: n}
+	// The client may be gone, but what it sent is kept for the resume
+	putCtx, cancel := detached(ctx)
+	defer cancel()
+	if err := store.Put(putCtx, chunk.Key, tmp, n, "application/octet-stream"); err != nil {
+		return nil, err
+	}
+	return chunk, readErr
+}
+
+// completeTusUpload validates the assembled chunks and stores them like a
+// file sent to upload. Rejected files are discarded with their chunks. If
+// another request completed the upload first, the stored file is removed
+// again and storage.ErrPrecondition returned.
+func completeTusUpload(ctx context.Context, upload *tusUpload) error {
+	// The chunks must follow each other without gaps up to the length
+	var offset int64
+	for _, chunk := range upload.Chunks {
+		if chunk.Offset != offset {
+			return fmt.Errorf("tus upload %s: chunk %s starts at %d, expected %d", upload.ID, chunk.Key, chunk.Offset, offset)
+		}
+		offset += chunk.Size
+	}
+	if offset != upload.Length {
+		return fmt.Errorf("tus upload %s: chunks end at %d of %d bytes", upload.ID, offset, upload.Length)
+	}
+	// The result and the cleanup must be saved even if the client went away
+	saveCtx, cancel := detached(ctx)
+	defer cancel()
+	chunks := &chunkReader{ctx: ctx, chunks: upload.Chunks}
+	defer chunks.Close()
+
+	var result *shared.UploadResponse
+	file, err := policy.receive(chunks)
+	if err == nil {
+		defer os.Remove(file.tmpPath)
+		result, err = storeUpload(ctx, upload.Tenant, upload.Owner, sanitizeFilename(upload.Metadata["filename"]), file)
+	}
+	var rejection *uploadError
+	if errors.As(err, &rejection) {
+		if err := removeTusUpload(saveCtx, upload.ID); err != nil {
+			log.Printf("Failed to remove rejected tus upload %s: %v", upload.ID, err)
+		}
+		return err
+	}
+	if err != nil {
+		return err
+	}
+
+	// The state is kept until it expires, so that the result can be fetched
+	upload.Result = result
+	if err := saveTusUpload(saveCtx, upload); err != nil {
+		if errors.Is(err, storage.ErrPrecondition) {
+			if err := removeUpload(saveCtx, upload.Tenant, result.Filename); err != nil {
+				log.Printf("Failed to remove duplicate of tus upload %s: %v", upload.ID, err)
+			}
+		}
+		return err
+	}
+	for _, chunk := range upload.Chunks {
+		if err := store.Delete(saveCtx, chunk.Key); err != nil && !errors.Is(err, storage.ErrNotExist) {
+			log.Printf("Failed to remove chunk %s: %v", chunk.Key, err)
+		}
+	}
+	return nil
+}
+
+// chunkReader reads stored chunks one after the other, opening each only
+// when the previous one is exhausted. A chunk whose size differs from the
+// recorded one fails the read.
+type chunkReader struct {
+	ctx     context.Context
+	chunks  []tusChunk
+	current io.ReadCloser
+	// remaining is what is left of the current chunk
+	remaining int64
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	for {
+		if r.current == nil {
+			if len(r.chunks) == 0 {
+				return 0, io.EOF
+			}
+			chunk := r.chunks[0]
+			body, info, err := store.Get(r.ctx, chunk.Key)
+			if err != nil {
+				return 0, err
+			}
+			if info.Size != chunk.Size {
+				body.Close()
+				return 0, fmt.Errorf("chunk %s has %d bytes, expected %d", chunk.Key, info.Size, chunk.Size)
+			}
+			r.current, r.remaining, r.chunks = body, chunk.Size, r.chunks[1:]
+		}
+		n, err := r.current.Read(p[:min(int64(len(p)), r.remaining+1)])
+		r.remaining -= int64(n)
+		if r.remaining < 0 {
+			return 0, errors.New("chunk is longer than recorded")
+		}
+		if errors.Is(err, io.EOF) {
+			if r.remaining > 0 {
+				return 0, io.ErrUnexpectedEOF
+			}
+			r.current.Close()
+			r.current = nil
+			err = nil
+		}
+		if n > 0 || err != nil {
+			return n, err
+		}
+	}
+}
+
+func (r *chunkReader) Close() error {
+	if r.current == nil {
+		return nil
+	}
+	return r.current.Close()
+}
+
+// tusUploads returns the state of every resumable upload
+func tusUploads(ctx context.Context) ([]*tusUpload, error) {
+	objects, err := store.List(ctx, tusPrefix)
+	if err != nil {
+		return nil, err
+	}
+	var uploads []*tusUpload
+	for _, object := range objects {
+		id, name, _ := strings.Cut(strings.TrimPrefix(object.Key, tusPrefix), "/")
+		if name != "info.json" {
+			continue
+		}
+		upload, err := loadTusUpload(ctx, id)
+		if errors.Is(err, storage.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		uploads = append(uploads, upload)
+	}
+	return uploads, nil
+}
+
+// removeTusUploadsOf removes the resumable uploads of a deleted account
+func removeTusUploadsOf(ctx context.Context, username string) error {
+	uploads, err := tusUploads(ctx)
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, upload := range uploads {
+		if upload.Owner == username {
+			errs = append(errs, removeTusUpload(ctx, upload.ID))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// expireTusUploads removes expired resumable uploads every interval
+func expireTusUploads(interval time.Duration) {
+	for range time.Tick(interval) {
+		ctx, cancel := context.WithTimeout(context.Background(), interval)
+		uploads, err := tusUploads(ctx)
+		if err != nil {
+			log.Printf("Failed to list tus uploads: %v", err)
+		}
+		for _, upload := range uploads {
+			if time.Now().Before(upload.ExpiresAt) {
+				continue
+			}
+			if err := removeTusUpload(ctx, upload.ID); err != nil {
+				log.Printf("Failed to remove expired tus upload %s: %v", upload.ID, err)
+			}
+		}
+		cancel()
+	}
+}
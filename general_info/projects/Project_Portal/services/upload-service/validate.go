@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif" // registered for decode checks
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"unicode"
+
+	"shared"
+	"shared/config"
+)
+
+// uploadTypes maps the content types upload-service can sniff to the
+// extension stored files get. UPLOAD_ALLOWED_TYPES picks from these.
+var uploadTypes = map[string]string{
+	"image/jpeg":      ".jpg",
+	"image/png":       ".png",
+	"image/gif":       ".gif",
+	"application/pdf": ".pdf",
+}
+
+// maxImagePixels bounds the dimensions an image may declare, since a small
+// file can decode to gigabytes of pixels. A decoded image of this size takes
+// up to 64 MB.
+const maxImagePixels = 16_000_000
+
+// maxGIFPixels bounds the pixels of all frames of an animated GIF together,
+// so that a small image cannot repeat itself thousands of times
+const maxGIFPixels = 64_000_000
+
+// errInvalidImage rejects a file that does not decode as the image its first
+// bytes announce
+var errInvalidImage = &uploadError{http.StatusUnprocessableEntity, shared.UploadErrInvalidImage, "File is not a valid image"}
+
+// multipartOverhead is allowed on top of the file size for the multipart
+// headers and any other form fields
+const multipartOverhead = 64 << 10
+
+// uploadPolicy decides which files upload accepts
+type uploadPolicy struct {
+	maxBytes     int64
+	allowedTypes map[string]bool
+	// tempDir holds files until they are stored
+	tempDir string
+}
+
+// newUploadPolicy checks that every allowed type is one upload-service knows
+func newUploadPolicy(cfg config.UploadConfig) (*uploadPolicy, error) {
+	policy := &uploadPolicy{maxBytes: cfg.MaxBytes, allowedTypes: make(map[string]bool), tempDir: cfg.TempDir}
+	for _, contentType := range cfg.AllowedTypes {
+		if _, ok := uploadTypes[contentType]; !ok {
+			return nil, fmt.Errorf("unsupported upload type %q", contentType)
+		}
+		policy.allowedTypes[contentType] = true
+	}
+	return policy, nil
+}
+
+// uploadError is a rejected upload. Its code is returned in
+// UploadResponse.Code so that clients need not parse the message.
+type uploadError struct {
+	status  int
+	code    string
+	message string
+}
+
+func (e *uploadError) Error() string {
+	return e.message
+}
+
+// receivedFile is an upload that passed validation and waits in a temporary
+// file to be stored
+type receivedFile struct {
+	tmpPath     string
+	contentType string
+	size        int64
+	width       int
+	height      int
+	// checksum is the hex SHA-256 of the file
+	checksum string
+}
+
+// receive streams r into a local temporary file. The content type is
+// sniffed from the first bytes before anything is written, the size limit is
+// enforced while copying and the dimensions images declare are checked; the
+// full decode is left to the variant workers. Rejections are returned as
+// *uploadError; the temporary file is removed unless receive succeeds.
+func (p *uploadPolicy) receive(r io.Reader) (*receivedFile, error) {
+	head := make([]byte, 512)
+	n, err := io.ReadFull(r, head)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return nil, readError(err)
+	}
+	head = head[:n]
+	if n == 0 {
+		return nil, &uploadError{http.StatusBadRequest, shared.UploadErrEmptyFile, "File is empty"}
+	}
+
+	contentType, _, _ := mime.ParseMediaType(http.DetectContentType(head))
+	if !p.allowedTypes[contentType] {
+		return nil, &uploadError{http.StatusUnsupportedMediaType, shared.UploadErrUnsupportedType,
+			fmt.Sprintf("Files of type %s are not allowed", contentType)}
+	}
+
+	// The file is only handed to the storage once it passed validation
+	tmp, err := os.CreateTemp(p.tempDir, "upload-*")
+	if err != nil {
+		return nil, err
+	}
+	file := &receivedFile{tmpPath: tmp.Name(), contentType: contentType}
+	err = p.copyLimited(tmp, head, r, file)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && strings.HasPrefix(contentType, "image/") {
+		err = verifyImage(file)
+	}
+	if err != nil {
+		os.Remove(file.tmpPath)
+		return nil, err
+	}
+	return file, nil
+}
+
+// copyLimited writes head and the rest of r to w, failing as soon as more
+// than maxBytes arrived, and checksums what it wrote
+func (p *uploadPolicy) copyLimited(w io.Writer, head []byte, r io.Reader, file *receivedFile) error {
+	hash := sha256.New()
+	w = io.MultiWriter(w, hash)
+	if _, err := w.Write(head); err != nil {
+		return err
+	}
+	n, err := io.Copy(w, io.LimitReader(r, p.maxBytes-int64(len(head))+1))
+	if err != nil {
+		return readError(err)
+	}
+	file.size = int64(len(head)) + n
+	if file.size > p.maxBytes {
+		return tooLarge(p.maxBytes)
+	}
+	file.checksum = hex.EncodeToString(hash.Sum(nil))
+	return nil
+}
+
+// verifyImage checks the dimensions an image declares, and for a GIF its
+// frames, without decoding the pixels, and records them
+func verifyImage(file *receivedFile) error {
+	f, err := os.Open(file.tmpPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	cfg, _, err := image.DecodeConfig(f)
+	if err != nil {
+		return errInvalidImage
+	}
+	oversized := &uploadError{http.StatusUnprocessableEntity, shared.UploadErrInvalidImage, "Image dimensions are too large"}
+	if cfg.Width*cfg.Height > maxImagePixels {
+		return oversized
+	}
+	if file.contentType == "image/gif" {
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		frames, err := countGIFFrames(f)
+		if err != nil {
+			return errInvalidImage
+		}
+		if frames*cfg.Width*cfg.Height > maxGIFPixels {
+			return oversized
+		}
+	}
+	file.width, file.height = cfg.Width, cfg.Height
+	return nil
+}
+
+// countGIFFrames counts the images in a GIF by walking its blocks, without
+// decompressing any pixels
+func countGIFFrames(r io.Reader) (int, error) {
+	br := bufio.NewReader(r)
+	// Header and logical screen descriptor
+	header := make([]byte, 13)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return 0, err
+	}
+	if err := skipColorTable(br, header[10]); err != nil {
+		return 0, err
+	}
+	frames := 0
+	for {
+		introducer, err := br.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		switch introducer {
+		case 0x21: // extension: label, then data sub-blocks
+			if _, err := br.ReadByte(); err != nil {
+				return 0, err
+			}
+		case 0x2c: // image descriptor, then LZW code size and data sub-blocks
+			frames++
+			descriptor := make([]byte, 9)
+			if _, err := io.ReadFull(br, descriptor); err != nil {
+				return 0, err
+			}
+			if err := skipColorTable(br, descriptor[8]); err != nil {
+				return 0, err
+			}
+			if _, err := br.ReadByte(); err != nil {
+				return 0, err
+			}
+		case 0x3b: // trailer
+			return frames, nil
+		default:
+			return 0, fmt.Errorf("unknown GIF block 0x%02x", introducer)
+		}
+		if err := skipSubBlocks(br); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// skipColorTable skips the color table that the packed field of a screen or
+// image descriptor announces
+func skipColorTable(br *bufio.Reader, packed byte) error {
+	if packed&0x80 == 0 {
+		return nil
+	}
+	_, err := br.Discard(3 << (packed&0x07 + 1))
+	return err
+}
+
+// skipSubBlocks skips data sub-blocks up to and including the empty one that
+// ends them
+func skipSubBlocks(br *bufio.Reader) error {
+	for {
+		size, err := br.ReadByte()
+		if err != nil || size == 0 {
+			return err
+		}
+		if _, err := br.Discard(int(size)); err != nil {
+			return err
+		}
+	}
+}
+
+// readError reports a request body that went over the limit of
+// http.MaxBytesReader as too large; other read errors mean the client went
+// away and are returned as they are
+func readError(err error) error {
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		return tooLarge(maxBytesErr.Limit - multipartOverhead)
+	}
+	return err
+}
+
+func tooLarge(limit int64) error {
+	return &uploadError{http.StatusRequestEntityTooLarge, shared.UploadErrTooLarge,
+		fmt.Sprintf("File is larger than %d bytes", limit)}
+}
+
+// sanitizeFilename reduces a client-supplied file name to something safe to
+// store and display: no directories, control characters or leading dots, and
+// at most 100 characters
+func sanitizeFilename(name string) string {
+	name = path.Base(strings.ReplaceAll(name, `\`, "/"))
+	name = strings.Map(func(r rune) rune {
+		if !unicode.IsPrint(r) || r == '/' {
+			return -1
+		}
+		return r
+	}, name)
+	name = strings.TrimSpace(strings.TrimLeft(name, ". "))
+	if runes := []rune(name); len(runes) > 100 {
+		name = string(runes[:100])
+	}
+	if name == "" {
+		name = "upload"
+	}
+	return name
+}
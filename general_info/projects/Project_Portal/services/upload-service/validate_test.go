@@ -0,0 +1,32 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/gif"
+	"testing"
+)
+
+func TestCountGIFFrames(t *testing.T) {
+	palette := color.Palette{color.Black, color.White}
+	anim := &gif.GIF{}
+	for i := 0; i < 3; i++ {
+		frame := image.NewPaletted(image.Rect(0, 0, 16, 16), palette)
+		frame.SetColorIndex(i, i, 1)
+		anim.Image = append(anim.Image, frame)
+		anim.Delay = append(anim.Delay, 10)
+	}
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, anim); err != nil {
+		t.Fatal(err)
+	}
+
+	frames, err := countGIFFrames(bytes.NewReader(buf.Bytes()))
+	if err != nil || frames != 3 {
+		t.Fatalf("countGIFFrames = %d, %v; want 3", frames, err)
+	}
+	if _, err := countGIFFrames(bytes.NewReader(buf.Bytes()[:buf.Len()-10])); err == nil {
+		t.Error("countGIFFrames accepted a truncated GIF")
+	}
+}
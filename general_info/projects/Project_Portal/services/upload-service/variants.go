@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"golang.org/x/image/draw"
+	"shared"
+)
+
+// variantPool decodes and resizes images on a fixed number of workers, so
+// that a burst of large uploads queues up instead of taking every CPU from
+// request handling. The workers also bound how many decoded images are held
+// in memory at once.
+type variantPool struct {
+	sizes []int
+	jobs  chan func()
+}
+
+// variants is set from UPLOAD_VARIANTS and UPLOAD_VARIANT_WORKERS
+var variants *variantPool
+
+// newVariantPool starts workers that make the given sizes, largest first
+func newVariantPool(sizes []int, workers int) *variantPool {
+	unique := make(map[int]bool)
+	p := &variantPool{jobs: make(chan func())}
+	for _, size := range sizes {
+		if !unique[size] {
+			unique[size] = true
+			p.sizes = append(p.sizes, size)
+		}
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(p.sizes)))
+	for i := 0; i < workers; i++ {
+		go func() {
+			for job := range p.jobs {
+				job()
+			}
+		}()
+	}
+	return p
+}
+
+// variantKey returns where a variant of a tenant's file is kept, next to the
+// original in the tenant's namespace
+func variantKey(tenant, filename string, size int) string {
+	return fmt.Sprintf("%s/.variants/%s/%d%s", tenant, filename, size, path.Ext(filename))
+}
+
+// variantResult is what a worker made of a received image
+type variantResult struct {
+	made []shared.UploadVariant
+	err  error
+}
+
+// generate decodes a received image on a worker, stores its variants and
+// returns them smallest first. This is the only full decode of an upload, so
+// an image that does not decode is rejected here, as *uploadError, before any
+// variant is stored. Sizes at least as large as the image are skipped;
+// variants that fail are logged and left out. It waits for a free worker only
+// as long as ctx allows.
+func (p *variantPool) generate(ctx context.Context, tenant, filename string, file *receivedFile) ([]shared.UploadVariant, error) {
+	if !strings.HasPrefix(file.contentType, "image/") {
+		return nil, nil
+	}
+
+	done := make(chan variantResult, 1)
+	job := func() {
+		src, err := decodeImage(file)
+		if err != nil {
+			done <- variantResult{err: err}
+			return
+		}
+		made, err := makeVariants(ctx, p.sizes, tenant, filename, file, src)
+		if err != nil {
+			log.Printf("Failed to make variants of %s/%s: %v", tenant, filename, err)
+		}
+		done <- variantResult{made: made}
+	}
+	select {
+	case p.jobs <- job:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	result := <-done
+	sort.Slice(result.made, func(i, j int) bool { return result.made[i].Size < result.made[j].Size })
+	return result.made, result.err
+}
+
+// decodeImage decodes the whole of a received image, so that files which
+// only start like an image are rejected
+func decodeImage(file *receivedFile) (image.Image, error) {
+	f, err := os.Open(file.tmpPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	src, _, err := image.Decode(f)
+	if err != nil {
+		return nil, errInvalidImage
+	}
+	return src, nil
+}
+
+// makeVariants scales each variant from the previous, larger one, which is
+// faster than starting from the original every time and looks the same
+func makeVariants(ctx context.Context, sizes []int, tenant, filename string, file *receivedFile, src image.Image) ([]shared.UploadVariant, error) {
+	var made []shared.UploadVariant
+	for _, size := range sizes {
+		bounds := src.Bounds()
+		if size >= bounds.Dx() && size >= bounds.Dy() {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return made, err
+		}
+
+		dst := image.NewRGBA(fitRect(bounds, size))
+		draw.CatmullRom.Scale(dst, dst.Bounds(), src, bounds, draw.Src, nil)
+		var buf bytes.Buffer
+		if err := encodeVariant(&buf, dst, file.contentType); err != nil {
+			return made, err
+		}
+		key := variantKey(tenant, filename, size)
+		if err := store.Put(ctx, key, &buf, int64(buf.Len()), file.contentType); err != nil {
+			return made, err
+		}
+		// URLs are signed when the variant is handed out
+		made = append(made, shared.UploadVariant{
+			Size:   size,
+			Width:  dst.Bounds().Dx(),
+			Height: dst.Bounds().Dy(),
+		})
+		src = dst
+	}
+	return made, nil
+}
+
+// fitRect returns the rectangle of an image scaled to fit size by size,
+// keeping its aspect ratio
+func fitRect(bounds image.Rectangle, size int) image.Rectangle {
+	w, h := bounds.Dx(), bounds.Dy()
+	if w >= h {
+		return image.Rect(0, 0, size, max(1, h*size/w))
+	}
+	return image.Rect(0, 0, max(1, w*size/h), size)
+}
+
+// encodeVariant writes img in the format of the original. Animated GIFs
+// become a still of their first frame.
+func encodeVariant(buf *bytes.Buffer, img image.Image, contentType string) error {
+	switch contentType {
+	case "image/jpeg":
+		return jpeg.Encode(buf, img, &jpeg.Options{Quality: 85})
+	case "image/png":
+		return png.Encode(buf, img)
+	case "image/gif":
+		return gif.Encode(buf, img, &gif.Options{NumColors: 256})
+	}
+	return fmt.Errorf("no variants for %s", contentType)
+}
+
+// removeVariants deletes every stored variant of a tenant's file, including
+// sizes that are no longer configured
+func removeVariants(ctx context.Context, tenant, filename string) error {
+	objects, err := store.List(ctx, tenant+"/.variants/"+filename+"/")
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, object := range objects {
+		errs = append(errs, store.Delete(ctx, object.Key))
+	}
+	return errors.Join(errs...)
+}